@@ -48,9 +48,9 @@ for %%T in (%TARGETS%) do (
         set GOARCH=%%b
 
         if "%%a"=="windows" (
-            go build -o build/postgresql_%%a_%%b.exe main.go
+            go build -o build/postgresql_%%a_%%b.exe .
         ) else (
-            go build -o build/postgresql_%%a_%%b main.go
+            go build -o build/postgresql_%%a_%%b .
         )
     )
 )
@@ -0,0 +1,47 @@
+package pgcomp
+
+import "time"
+
+// analyzeOptions are the analyze_after and analyze_if_rows_over inputs.
+type analyzeOptions struct {
+	After      bool
+	IfRowsOver int64
+}
+
+// loadedRows is how many rows a load result reports as written, and
+// whether res is a load result at all.
+func loadedRows(res interface{}) (int64, bool) {
+	m, ok := res.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	for _, k := range []string{"inserted", "loaded", "copied"} {
+		if n, ok := m[k].(int64); ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// analyzeTable runs ANALYZE on table after a committed load of rows rows,
+// unless the load is at or below opts.IfRowsOver, and describes what it
+// did for the meta of the response.
+func analyzeTable(db querier, table string, rows int64, opts analyzeOptions) (map[string]interface{}, error) {
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]interface{}{"table": rel.Name, "rows": rows, "analyzed": false}
+	if rows <= opts.IfRowsOver {
+		return info, nil
+	}
+	stmt := "ANALYZE " + rel.Name
+	logSQL(stmt, nil)
+	start := time.Now()
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+	info["analyzed"] = true
+	info["duration_ms"] = time.Since(start).Milliseconds()
+	return info, nil
+}
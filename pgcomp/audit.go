@@ -0,0 +1,94 @@
+package pgcomp
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// auditSpec is the "audit" input. The named table must provide these
+// columns:
+//
+//	executed_at timestamptz, actor text, context jsonb, data_type text,
+//	object_name text, sql_fingerprint text, params_hash text,
+//	rows_affected bigint, duration_ms bigint, outcome text, error text
+type auditSpec struct {
+	Table   string          `json:"table"`
+	Actor   string          `json:"actor"`
+	Context json.RawMessage `json:"context"`
+}
+
+// auditRecord describes the statement being audited.
+type auditRecord struct {
+	DataType   string
+	ObjectName string
+	SQL        string
+	Parameters string
+	Rows       int64
+	Duration   time.Duration
+	Err        error
+}
+
+func parseAuditSpec(val string) (*auditSpec, error) {
+	var spec auditSpec
+	if err := json.Unmarshal([]byte(val), &spec); err != nil {
+		return nil, fmt.Errorf("invalid audit: %v", err)
+	}
+	if spec.Table == "" || spec.Actor == "" {
+		return nil, fmt.Errorf("audit requires table and actor")
+	}
+	return &spec, nil
+}
+
+// writeAudit inserts the audit row in its own short transaction on a pool
+// connection of its own, so the row is written whatever happened to the
+// audited statement.
+func writeAudit(db *sql.DB, spec *auditSpec, rec auditRecord) error {
+	rel, err := resolveRelation(db, spec.Table)
+	if err != nil {
+		return err
+	}
+
+	var context interface{}
+	if len(spec.Context) > 0 {
+		context = string(spec.Context)
+	}
+	outcome, errText := "success", interface{}(nil)
+	if rec.Err != nil {
+		outcome, errText = "failure", rec.Err.Error()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO `+rel.Name+` (executed_at, actor, context, data_type, object_name,
+			sql_fingerprint, params_hash, rows_affected, duration_ms, outcome, error)
+		VALUES (now(), $1, $2::jsonb, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		spec.Actor, context, rec.DataType, nullIfEmpty(rec.ObjectName),
+		hashText(rec.SQL), hashText(rec.Parameters), rec.Rows, rec.Duration.Milliseconds(), outcome, errText)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// hashText returns the hex SHA-256 of s, or nil for an empty string.
+func hashText(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
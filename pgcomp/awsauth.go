@@ -0,0 +1,42 @@
+package pgcomp
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+)
+
+// rdsAuthToken generates a short-lived RDS IAM authentication token for the
+// given endpoint, signed with the default AWS credential chain.
+func rdsAuthToken(host string, port int, region, user string) (string, error) {
+	ctx := context.Background()
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return "", newError("iam_token_failed", "failed to load AWS configuration: %v", err)
+	}
+	if cfg.Region == "" {
+		return "", newError("iam_token_failed", "aws_region is required for auth_method aws_iam")
+	}
+
+	token, err := auth.BuildAuthToken(ctx, net.JoinHostPort(host, strconv.Itoa(port)), cfg.Region, user, cfg.Credentials)
+	if err != nil {
+		return "", newError("iam_token_failed", "failed to generate RDS IAM auth token: %v", err)
+	}
+	return token, nil
+}
+
+// atLeastRequire upgrades sslmode so IAM tokens are never sent in clear text.
+func atLeastRequire(sslmode string) string {
+	switch sslmode {
+	case "", "disable", "allow", "prefer":
+		return "require"
+	}
+	return sslmode
+}
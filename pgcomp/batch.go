@@ -0,0 +1,202 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// batchStatement is one entry of the statements input of the transaction
+// data_type.
+type batchStatement struct {
+	Query      string        `json:"query"`
+	Parameters []interface{} `json:"parameters"`
+	OnError    string        `json:"on_error"` // fail (default) or continue
+	Lock       *lockSpec     `json:"lock"`
+}
+
+var batchOnError = []string{"fail", "continue"}
+
+func parseBatchStatements(val string) ([]batchStatement, error) {
+	var stmts []batchStatement
+	dec := json.NewDecoder(strings.NewReader(val))
+	err := decodeArray(dec, limits.Statements, "statements", "MAX_STATEMENTS", func(dec *json.Decoder) error {
+		var st batchStatement
+		if err := dec.Decode(&st); err != nil {
+			return err
+		}
+		if limits.Parameters > 0 && len(st.Parameters) > limits.Parameters {
+			return limitExceeded("parameters", int64(limits.Parameters), "MAX_PARAMETERS", "statements[%d] has more than %d parameters", len(stmts), limits.Parameters)
+		}
+		stmts = append(stmts, st)
+		return nil
+	})
+	var ce *componentError
+	if errors.As(err, &ce) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("statements must be a JSON array of {query, parameters, on_error, lock}: %v", err)
+	}
+	for i := range stmts {
+		if err := checkSQLLength(stmts[i].Query); err != nil {
+			return nil, fmt.Errorf("statements[%d]: %w", i, err)
+		}
+		if strings.TrimSpace(stmts[i].Query) == "" {
+			return nil, fmt.Errorf("statements[%d]: query is required", i)
+		}
+		stmts[i].OnError = strings.ToLower(stmts[i].OnError)
+		if stmts[i].OnError == "" {
+			stmts[i].OnError = "fail"
+		}
+		if !containsString(batchOnError, stmts[i].OnError) {
+			return nil, fmt.Errorf("statements[%d]: invalid on_error %q, allowed: %s", i, stmts[i].OnError, strings.Join(batchOnError, ", "))
+		}
+		if l := stmts[i].Lock; l != nil {
+			if !classifyStatement(stmts[i].Query).ReturnsRows {
+				return nil, fmt.Errorf("statements[%d]: lock needs a query that returns rows", i)
+			}
+			if err := l.normalize(); err != nil {
+				return nil, fmt.Errorf("statements[%d]: %v", i, err)
+			}
+			stmts[i].Query = lockQuery(stmts[i].Query, l)
+		}
+		for j := range stmts[i].Parameters {
+			stmts[i].Parameters[j] = hstoreArg(stmts[i].Parameters[j])
+		}
+	}
+	return stmts, nil
+}
+
+// runBatch runs stmts in order inside tx. A statement with on_error
+// continue runs under a savepoint, so when it fails only its own work is
+// rolled back and the transaction stays usable for the rest. Any other
+// failure stops the batch: the remaining statements are skipped and the
+// returned error carries the per-statement results, so the caller rolls
+// the whole transaction back.
+func runBatch(tx querier, stmts []batchStatement) (interface{}, error) {
+	if len(stmts) == 0 {
+		return nil, fmt.Errorf("statements is required for transaction")
+	}
+
+	results := make([]map[string]interface{}, len(stmts))
+	counts := map[string]int{"succeeded": 0, "rolled_back": 0, "skipped": 0}
+	summary := func() map[string]interface{} {
+		return map[string]interface{}{
+			"statements":  results,
+			"succeeded":   counts["succeeded"],
+			"rolled_back": counts["rolled_back"],
+			"skipped":     counts["skipped"],
+		}
+	}
+
+	for i, st := range stmts {
+		res := map[string]interface{}{"index": i, "status": "ok"}
+		results[i] = res
+
+		savepoint := fmt.Sprintf("batch_stmt_%d", i)
+		if st.OnError == "continue" {
+			if _, err := tx.Exec("SAVEPOINT " + savepoint); err != nil {
+				return nil, err
+			}
+		}
+
+		logSQL(st.Query, st.Parameters)
+		err := runBatchStatement(tx, st, res)
+		if err == nil {
+			if st.OnError == "continue" {
+				if _, err := tx.Exec("RELEASE SAVEPOINT " + savepoint); err != nil {
+					return nil, err
+				}
+			}
+			counts["succeeded"]++
+			continue
+		}
+
+		res["error"] = err.Error()
+		if code := sqlState(err); code != "" {
+			res["sqlstate"] = code
+		}
+		if st.OnError == "continue" {
+			if _, rerr := tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint); rerr != nil {
+				return nil, rerr
+			}
+			if _, v := explainViolation(tx, err); v != nil {
+				res["violation"] = v
+			}
+			res["status"] = "rolled_back"
+			counts["rolled_back"]++
+			continue
+		}
+
+		res["status"] = "failed"
+		for j := i + 1; j < len(stmts); j++ {
+			results[j] = map[string]interface{}{"index": j, "status": "skipped"}
+			counts["skipped"]++
+		}
+		ce := newError("statement_failed", "statement %d failed, transaction rolled back: %v", i, err)
+		ce.Details = summary()
+		ce.cause = err
+		return nil, ce
+	}
+	return summary(), nil
+}
+
+// runBatchStatement runs one statement and records its rows or the
+// number of rows it affected in res.
+func runBatchStatement(tx querier, st batchStatement, res map[string]interface{}) error {
+	if !classifyStatement(st.Query).ReturnsRows {
+		r, err := tx.Exec(st.Query, st.Parameters...)
+		if err != nil {
+			return err
+		}
+		affected, _ := r.RowsAffected()
+		res["rows_affected"] = affected
+		return nil
+	}
+
+	rows, err := tx.Query(st.Query, st.Parameters...)
+	if err != nil {
+		return err
+	}
+	out, err := collectRows(rows)
+	if err != nil {
+		return err
+	}
+	res["rows"] = out
+	return nil
+}
+
+// collectRows reads and closes rows as result rows in column order.
+func collectRows(rows *sql.Rows) ([]orderedRow, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	keys, _ := dedupeColumns(columns)
+	types := columnTypeNames(rows)
+	out := make([]orderedRow, 0)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, len(values))
+		for i, v := range values {
+			var dbType string
+			if i < len(types) {
+				dbType = types[i]
+			}
+			m[keys[i]] = normalizeValue(v, dbType)
+		}
+		out = append(out, orderedRow{keys: keys, values: m})
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,167 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// benchmarkOptions carries the inputs of the benchmark data_type.
+type benchmarkOptions struct {
+	Iterations  int
+	Warmup      int
+	Concurrency int
+	AllowWrite  bool
+	StmtCache   int // prepared statements kept for reuse; 0 disables
+}
+
+// runBenchmark executes query Iterations times (after Warmup untimed runs),
+// spread over Concurrency pooled connections, and reports latency
+// percentiles. Result rows are read and discarded.
+func runBenchmark(db *sql.DB, query, parameters string, opts benchmarkOptions) (interface{}, error) {
+	if !opts.AllowWrite && !classifyStatement(query).ReadOnly {
+		return nil, fmt.Errorf("benchmark only runs read-only statements unless allow_write_benchmark is set")
+	}
+	args, err := parseArgs(parameters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters: %v", err)
+	}
+	if opts.Iterations <= 0 {
+		opts.Iterations = 10
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Concurrency > opts.Iterations {
+		opts.Concurrency = opts.Iterations
+	}
+	db.SetMaxOpenConns(opts.Concurrency)
+	db.SetMaxIdleConns(opts.Concurrency)
+
+	var cache *stmtCache
+	if opts.StmtCache > 0 {
+		cache = newStmtCache(db, opts.StmtCache)
+		defer cache.Close()
+	}
+
+	for i := 0; i < opts.Warmup; i++ {
+		if _, err := runOnce(db, cache, query, args); err != nil {
+			return nil, fmt.Errorf("warmup run %d: %v", i+1, err)
+		}
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, opts.Iterations)
+		rowCounts = make([]int64, 0, opts.Iterations)
+		firstErr  error
+		next      = make(chan int)
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range next {
+				t := time.Now()
+				n, err := runOnce(db, cache, query, args)
+				d := time.Since(t)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				latencies = append(latencies, d)
+				rowCounts = append(rowCounts, n)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < opts.Iterations; i++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	total := time.Since(start)
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var rowSum int64
+	for _, n := range rowCounts {
+		rowSum += n
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+	res := map[string]interface{}{
+		"iterations":        len(latencies),
+		"warmup":            opts.Warmup,
+		"concurrency":       opts.Concurrency,
+		"min_ms":            ms(latencies[0]),
+		"p50_ms":            ms(percentile(latencies, 50)),
+		"p95_ms":            ms(percentile(latencies, 95)),
+		"p99_ms":            ms(percentile(latencies, 99)),
+		"max_ms":            ms(latencies[len(latencies)-1]),
+		"rows_per_exec":     float64(rowSum) / float64(len(rowCounts)),
+		"total_duration_ms": ms(total),
+	}
+	if cache != nil {
+		res["statement_cache"] = cache.stats()
+	}
+	return res, nil
+}
+
+// runOnce executes the statement and drains its rows, returning how many
+// rows it produced (or affected, for statements without a result set).
+// With a cache the statement is prepared once and reused.
+func runOnce(db *sql.DB, cache *stmtCache, query string, args []interface{}) (int64, error) {
+	if cache == nil {
+		return execDrain(db, query, args)
+	}
+	var n int64
+	err := cache.run(query, func(stmt *sql.Stmt) error {
+		var err error
+		n, err = execDrain(preparedQuerier{stmt}, query, args)
+		return err
+	})
+	return n, err
+}
+
+func execDrain(db querier, query string, args []interface{}) (int64, error) {
+	if !classifyStatement(query).ReturnsRows {
+		res, err := db.Exec(query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var n int64
+	for rows.Next() {
+		n++
+	}
+	return n, rows.Err()
+}
+
+// percentile uses the nearest-rank method on sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
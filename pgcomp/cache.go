@@ -0,0 +1,119 @@
+package pgcomp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheNeutralInputs do not influence the result and are left out of the
+// cache key.
+var cacheNeutralInputs = map[string]bool{
+	"cache_dir": true, "cache_ttl_seconds": true, "cache_bypass": true,
+	"request_id": true, "log_level": true,
+	"slow_ms": true, "explain_on_slow": true,
+}
+
+// resultCache stores successful read results as files named after a hash of
+// the request, so identical invocations within the TTL skip the statement.
+type resultCache struct {
+	dir  string
+	ttl  time.Duration
+	key  string
+	path string
+}
+
+type cacheEntry struct {
+	CreatedAt time.Time `json:"created_at"`
+	Response  Response  `json:"output"`
+}
+
+// cachedResult re-reads an entry's result as raw JSON, so it is served
+// byte for byte (rows keep their column order).
+type cachedResult struct {
+	Response struct {
+		Result json.RawMessage `json:"result"`
+	} `json:"output"`
+}
+
+// newResultCache keys the cache on every input that can change the result:
+// the connection settings (password included, so callers with different
+// credentials never share entries), the statement and its parameters. The
+// deployment policy is part of the key too, so a result cached under one
+// policy is never served under another.
+func newResultCache(dir string, ttl time.Duration, input Request, pol *policy) *resultCache {
+	lines := make([]string, 0, len(input.Params)+1)
+	for _, p := range input.Params {
+		name := strings.ToLower(p.InputName)
+		if cacheNeutralInputs[name] {
+			continue
+		}
+		lines = append(lines, name+"="+strings.TrimSpace(p.CompValue))
+	}
+	if pol != nil {
+		// input names have no spaces, so this line is no input's
+		rules, _ := json.Marshal(pol)
+		lines = append(lines, "deployment policy="+string(rules))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	key := hex.EncodeToString(sum[:])
+	return &resultCache{dir: dir, ttl: ttl, key: key, path: filepath.Join(dir, key+".json")}
+}
+
+// load returns the cached output and its age when a fresh entry exists.
+func (c *resultCache) load() (Response, time.Duration, bool) {
+	raw, err := os.ReadFile(c.path)
+	if err != nil {
+		return Response{}, 0, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return Response{}, 0, false
+	}
+	age := time.Since(entry.CreatedAt)
+	if age < 0 || age > c.ttl {
+		return Response{}, 0, false
+	}
+	var result cachedResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return Response{}, 0, false
+	}
+	entry.Response.Result = result.Response.Result
+	return entry.Response, age, true
+}
+
+// store writes the entry to a temporary file and renames it into place, so
+// concurrent invocations only ever see complete entries.
+func (c *resultCache) store(out Response) error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(cacheEntry{CreatedAt: time.Now(), Response: out})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, c.key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package pgcomp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultCacheKey(t *testing.T) {
+	in := Request{Params: []Param{
+		{InputName: "query", CompValue: "SELECT sum(amount) FROM sales.orders"},
+		{InputName: "cache_dir", CompValue: "/tmp/a"},
+	}}
+	moved := Request{Params: []Param{
+		{InputName: "cache_dir", CompValue: "/tmp/b"},
+		{InputName: "query", CompValue: "SELECT sum(amount) FROM sales.orders"},
+	}}
+	key := func(in Request, pol *policy) string { return newResultCache("/tmp", time.Minute, in, pol).key }
+
+	if key(in, nil) != key(moved, nil) {
+		t.Error("the key depends on input order or cache_dir")
+	}
+	loose := &policy{Tables: []string{"sales.*"}}
+	strict := &policy{Tables: []string{"sales.orders"}, MaxRows: 10}
+	if key(in, nil) == key(in, loose) || key(in, loose) == key(in, strict) {
+		t.Error("results cached under different policies share a key")
+	}
+	if key(in, loose) != key(moved, &policy{Tables: []string{"sales.*"}}) {
+		t.Error("the same policy gives different keys")
+	}
+}
@@ -0,0 +1,84 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"strconv"
+)
+
+// probedExtensions are the extensions optional features depend on.
+var probedExtensions = []string{"pgcrypto", "pg_trgm", "postgis", "pg_stat_statements", "hstore"}
+
+// capabilities answers the capabilities data_type: what the server and
+// the connecting role allow, so a caller can decide which optional
+// features to offer up front instead of finding out from a failure.
+// Nothing is created or changed to find out.
+func capabilities(db querier) (interface{}, error) {
+	var version string
+	var versionNum, maxPrepared string
+	var inRecovery, superuser, replication, createTemp, createSchema bool
+	var walLevel, role string
+	err := db.QueryRow(`SELECT current_setting('server_version'), current_setting('server_version_num'),
+			current_setting('max_prepared_transactions'), current_setting('wal_level'),
+			pg_is_in_recovery(), r.rolsuper, r.rolreplication, r.rolname::text,
+			has_database_privilege(current_database(), 'TEMPORARY'),
+			has_database_privilege(current_database(), 'CREATE')
+		FROM pg_roles r WHERE r.rolname = current_user`).Scan(
+		&version, &versionNum,
+		&maxPrepared, &walLevel,
+		&inRecovery, &superuser, &replication, &role,
+		&createTemp,
+		&createSchema)
+	if err != nil {
+		return nil, err
+	}
+	num, _ := strconv.Atoi(versionNum)
+	prepared, _ := strconv.Atoi(maxPrepared)
+
+	extensions := make(map[string]interface{}, len(probedExtensions)+1)
+	for _, name := range probedExtensions {
+		var installed, available sql.NullString
+		err := db.QueryRow("SELECT installed_version, default_version FROM pg_available_extensions WHERE name = $1", name).Scan(&installed, &available)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		extensions[name] = map[string]interface{}{
+			"installed": installed.Valid,
+			"version":   nullString(installed),
+			// installable with create_extension, given the privilege
+			"available": err == nil,
+		}
+	}
+	// wal2json is a logical decoding output plugin, not an extension; the
+	// catalog only shows it through the slots that use it
+	var slots int64
+	if err := db.QueryRow("SELECT count(*) FROM pg_replication_slots WHERE plugin = 'wal2json'").Scan(&slots); err != nil {
+		return nil, err
+	}
+	extensions["wal2json"] = map[string]interface{}{
+		"kind":   "output_plugin",
+		"slots":  slots,
+		"in_use": slots > 0,
+	}
+
+	server := "primary"
+	if inRecovery {
+		server = "standby"
+	}
+	return map[string]interface{}{
+		"server_version":     version,
+		"server_version_num": num,
+		"server_role":        server,
+		"role": map[string]interface{}{
+			"name":          role,
+			"superuser":     superuser,
+			"replication":   replication,
+			"create_temp":   createTemp,
+			"create_schema": createSchema,
+		},
+		"max_prepared_transactions": prepared,
+		"two_phase_commit":          prepared > 0,
+		"wal_level":                 walLevel,
+		"logical_decoding":          walLevel == "logical" && (superuser || replication) && (!inRecovery || num >= 160000),
+		"extensions":                extensions,
+	}, nil
+}
@@ -0,0 +1,311 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultCDCLimit caps a peek when no limit is given, so an idle consumer
+// does not pull an unbounded backlog into one response.
+const defaultCDCLimit = 1000
+
+// cdcOptions are the inputs of cdc_peek and cdc_advance.
+type cdcOptions struct {
+	Slot    string
+	Limit   int64  // upto_nchanges; counted in whole transactions by the server
+	UptoLSN string // stop at this LSN
+}
+
+// cdcSlot checks that the slot exists, is logical and uses an output plugin
+// whose format we can parse, returning the plugin name.
+func cdcSlot(db querier, slot string) (string, error) {
+	if slot == "" {
+		return "", fmt.Errorf("slot_name is required")
+	}
+	var slotType string
+	var plugin sql.NullString
+	err := db.QueryRow("SELECT slot_type, plugin FROM pg_replication_slots WHERE slot_name = $1", slot).Scan(&slotType, &plugin)
+	if err == sql.ErrNoRows {
+		return "", newError("slot_not_found", "replication slot %q does not exist", slot)
+	}
+	if err != nil {
+		return "", err
+	}
+	if slotType != "logical" {
+		return "", newError("unsupported_plugin", "replication slot %q is a %s slot; cdc needs a logical slot", slot, slotType)
+	}
+	switch plugin.String {
+	case "wal2json", "test_decoding":
+		return plugin.String, nil
+	}
+	return "", newError("unsupported_plugin", "replication slot %q uses output plugin %s; cdc supports wal2json and test_decoding", slot, plugin.String)
+}
+
+// cdcPeek reads pending changes without consuming them.
+func cdcPeek(db querier, opts cdcOptions) (interface{}, error) {
+	plugin, err := cdcSlot(db, opts.Slot)
+	if err != nil {
+		return nil, err
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultCDCLimit
+	}
+
+	q := "SELECT lsn::text, xid::text, data FROM pg_logical_slot_peek_changes($1, $2::pg_lsn, $3::int"
+	if plugin == "wal2json" {
+		// format-version 2 emits one JSON document per change
+		q += ", 'format-version', '2', 'include-lsn', '1'"
+	}
+	q += ")"
+	args := []interface{}{opts.Slot, nullIfEmpty(opts.UptoLSN), limit}
+	logSQL(q, args)
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []map[string]interface{}{}
+	var lastLSN string
+	for rows.Next() {
+		var lsn, xid, data string
+		if err := rows.Scan(&lsn, &xid, &data); err != nil {
+			return nil, err
+		}
+		var change map[string]interface{}
+		if plugin == "wal2json" {
+			change, err = parseWal2JSON(data)
+		} else {
+			change, err = parseTestDecoding(data)
+		}
+		if err != nil {
+			change = map[string]interface{}{"action": "unparsed", "raw": data, "error": err.Error()}
+		}
+		change["lsn"] = lsn
+		change["xid"] = xid
+		changes = append(changes, change)
+		lastLSN = lsn
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{"slot_name": opts.Slot, "plugin": plugin, "changes": changes, "last_lsn": nil}
+	if lastLSN != "" {
+		// pass last_lsn as upto_lsn to cdc_advance to confirm these changes
+		res["last_lsn"] = lastLSN
+	}
+	return res, nil
+}
+
+// cdcAdvance confirms consumption: up to upto_lsn with
+// pg_replication_slot_advance, or else by reading and discarding up to
+// limit changes with pg_logical_slot_get_changes.
+func cdcAdvance(db querier, opts cdcOptions) (interface{}, error) {
+	if _, err := cdcSlot(db, opts.Slot); err != nil {
+		return nil, err
+	}
+	if opts.UptoLSN != "" {
+		var endLSN sql.NullString
+		err := db.QueryRow("SELECT end_lsn::text FROM pg_replication_slot_advance($1, $2::pg_lsn)", opts.Slot, opts.UptoLSN).Scan(&endLSN)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"slot_name": opts.Slot, "confirmed_lsn": nullString(endLSN)}, nil
+	}
+	if opts.Limit <= 0 {
+		return nil, fmt.Errorf("cdc_advance needs upto_lsn or limit")
+	}
+	var consumed int64
+	var last sql.NullString
+	err := db.QueryRow("SELECT count(*), max(lsn)::text FROM pg_logical_slot_get_changes($1, NULL, $2::int)", opts.Slot, opts.Limit).Scan(&consumed, &last)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"slot_name": opts.Slot, "consumed": consumed, "confirmed_lsn": nullString(last)}, nil
+}
+
+var wal2jsonActions = map[string]string{
+	"B": "begin", "C": "commit", "I": "insert", "U": "update", "D": "delete", "T": "truncate", "M": "message",
+}
+
+// parseWal2JSON turns a wal2json format-version 2 document into a change
+// with column values keyed by name.
+func parseWal2JSON(data string) (map[string]interface{}, error) {
+	var doc struct {
+		Action  string `json:"action"`
+		Schema  string `json:"schema"`
+		Table   string `json:"table"`
+		Columns []struct {
+			Name  string      `json:"name"`
+			Value interface{} `json:"value"`
+		} `json:"columns"`
+		Identity []struct {
+			Name  string      `json:"name"`
+			Value interface{} `json:"value"`
+		} `json:"identity"`
+		Prefix  string `json:"prefix"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return nil, err
+	}
+	change := map[string]interface{}{"action": wal2jsonActions[doc.Action]}
+	if change["action"] == "" {
+		change["action"] = doc.Action
+	}
+	if doc.Table != "" {
+		change["schema"] = doc.Schema
+		change["table"] = doc.Table
+	}
+	if len(doc.Columns) > 0 {
+		cols := map[string]interface{}{}
+		for _, c := range doc.Columns {
+			cols[c.Name] = c.Value
+		}
+		change["columns"] = cols
+	}
+	if len(doc.Identity) > 0 {
+		key := map[string]interface{}{}
+		for _, c := range doc.Identity {
+			key[c.Name] = c.Value
+		}
+		change["identity"] = key
+	}
+	if doc.Action == "M" {
+		change["prefix"] = doc.Prefix
+		change["content"] = doc.Content
+	}
+	return change, nil
+}
+
+// parseTestDecoding parses test_decoding's text lines:
+//
+//	BEGIN 529
+//	table public.orders: INSERT: id[integer]:1 note[text]:'it''s'
+//	table public.orders: UPDATE: old-key: id[integer]:1 new-tuple: id[integer]:2
+//	COMMIT 529
+func parseTestDecoding(data string) (map[string]interface{}, error) {
+	switch {
+	case strings.HasPrefix(data, "BEGIN"):
+		return map[string]interface{}{"action": "begin"}, nil
+	case strings.HasPrefix(data, "COMMIT"):
+		return map[string]interface{}{"action": "commit"}, nil
+	case strings.HasPrefix(data, "message:"):
+		return map[string]interface{}{"action": "message", "raw": data}, nil
+	case !strings.HasPrefix(data, "table "):
+		return nil, fmt.Errorf("unrecognised test_decoding line")
+	}
+
+	rest := data[len("table "):]
+	i := strings.Index(rest, ": ")
+	if i < 0 {
+		return nil, fmt.Errorf("missing table name")
+	}
+	qualified := rest[:i]
+	rest = rest[i+2:]
+	j := strings.Index(rest, ":")
+	if j < 0 {
+		return nil, fmt.Errorf("missing action")
+	}
+	action := strings.ToLower(rest[:j])
+	rest = strings.TrimSpace(rest[j+1:])
+
+	change := map[string]interface{}{"action": action}
+	if dot := strings.LastIndex(qualified, "."); dot >= 0 {
+		change["schema"], change["table"] = qualified[:dot], qualified[dot+1:]
+	} else {
+		change["table"] = qualified
+	}
+	if action == "truncate" || rest == "(no-tuple-data)" {
+		return change, nil
+	}
+
+	if strings.HasPrefix(rest, "old-key: ") {
+		parts := strings.SplitN(rest[len("old-key: "):], " new-tuple: ", 2)
+		key, err := parseTestDecodingTuple(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		change["identity"] = key
+		rest = ""
+		if len(parts) == 2 {
+			rest = parts[1]
+		}
+	}
+	if rest != "" {
+		cols, err := parseTestDecodingTuple(rest)
+		if err != nil {
+			return nil, err
+		}
+		if action == "delete" {
+			change["identity"] = cols
+		} else {
+			change["columns"] = cols
+		}
+	}
+	return change, nil
+}
+
+// parseTestDecodingTuple parses name[type]:value pairs. Quoted values use
+// ” for an embedded quote; an unquoted null is SQL NULL.
+func parseTestDecodingTuple(s string) (map[string]interface{}, error) {
+	cols := map[string]interface{}{}
+	for i := 0; i < len(s); {
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		open := strings.IndexByte(s[i:], '[')
+		if open < 0 {
+			return nil, fmt.Errorf("missing column type")
+		}
+		name := s[i : i+open]
+		i += open
+		closeIdx := strings.Index(s[i:], "]:")
+		if closeIdx < 0 {
+			return nil, fmt.Errorf("missing column value")
+		}
+		i += closeIdx + 2
+
+		if i < len(s) && s[i] == '\'' {
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated quoted value for %s", name)
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			cols[name] = b.String()
+			continue
+		}
+		end := strings.IndexByte(s[i:], ' ')
+		if end < 0 {
+			end = len(s) - i
+		}
+		raw := s[i : i+end]
+		i += end
+		switch raw {
+		case "null":
+			cols[name] = nil
+		case "unchanged-toast-datum":
+			// The value did not change and was not logged
+		default:
+			cols[name] = raw
+		}
+	}
+	return cols, nil
+}
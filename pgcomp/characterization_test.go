@@ -0,0 +1,69 @@
+package pgcomp
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata/characterization from the current output")
+
+// conn are connection inputs that pass validation; nothing connects
+// before the failures below.
+const conn = `{"inputname":"host","compvalue":"localhost"},{"inputname":"username","compvalue":"erp"},{"inputname":"dbname","compvalue":"erp"}`
+
+// TestCharacterization pins the exact bytes Run writes for requests that
+// need no database, one golden file per case, so moving code around
+// cannot change what the ERP integration reads. go test -run
+// TestCharacterization -update rewrites the files after an intended
+// change.
+func TestCharacterization(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+	}{
+		{"not_json", `{"params":`},
+		{"not_an_object", `[]`},
+		{"no_params", `{"params":[]}`},
+		{"missing_dbname", `{"params":[{"inputname":"host","compvalue":"localhost"},{"inputname":"username","compvalue":"erp"}]}`},
+		{"strict_unknown", `{"params":[{"inputname":"strict","compvalue":"true"},{"inputname":"data_tpye","compvalue":"table"}]}`},
+		{"bad_limit", `{"params":[{"inputname":"limit","compvalue":"ten"}]}`},
+		{"bad_port", `{"params":[` + conn + `,{"inputname":"port","compvalue":"99999"}]}`},
+		{"bad_column_order", `{"params":[{"inputname":"column_order","compvalue":"random"}]}`},
+		{"bad_representation", `{"params":[{"inputname":"output_representation","compvalue":"rows"}]}`},
+		{"bad_date_formats", `{"params":[{"inputname":"date_formats","compvalue":"{\"d\": {\"format\": \"DD/MM/YY\"}}"}]}`},
+		{"bad_session_attrs", `{"params":[` + conn + `,{"inputname":"target_session_attrs","compvalue":"standby"}]}`},
+		{"bad_auth_method", `{"params":[` + conn + `,{"inputname":"auth_method","compvalue":"kerberos"}]}`},
+		{"bad_driver", `{"params":[` + conn + `,{"inputname":"driver","compvalue":"odbc"}]}`},
+		{"client_encoding_needs_pgx", `{"params":[` + conn + `,{"inputname":"client_encoding","compvalue":"LATIN1"}]}`},
+		{"bad_route", `{"params":[` + conn + `,{"inputname":"route","compvalue":"sideways"}]}`},
+		{"fingerprint", `{"params":[` + conn + `,{"inputname":"data_type","compvalue":"fingerprint"},{"inputname":"query","compvalue":"SELECT * FROM orders WHERE id = 42 AND code = 'A-1'"}]}`},
+		{"fingerprint_no_query", `{"params":[` + conn + `,{"inputname":"data_type","compvalue":"fingerprint"}]}`},
+		{"v2_fingerprint", `{"params":[{"inputname":"envelope_version","compvalue":"2"},{"inputname":"request_id","compvalue":"req-7"},` + conn + `,{"inputname":"data_type","compvalue":"fingerprint"},{"inputname":"query","compvalue":"select 1"}]}`},
+		{"v2_error_warnings", `{"params":[{"inputname":"envelope_version","compvalue":"2"},{"inputname":"request_id","compvalue":"req-8"},{"inputname":"data_type","compvalue":"table"},{"inputname":"data_type","compvalue":"table"},{"inputname":"colour","compvalue":"red"}]}`},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		Run(strings.NewReader(c.input), &out, nil)
+		golden := filepath.Join("testdata", "characterization", c.name+".json")
+		if *updateGolden {
+			if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%s: %v (run with -update to create it)", c.name, err)
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, out.Bytes(), want)
+		}
+	}
+}
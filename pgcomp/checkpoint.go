@@ -0,0 +1,234 @@
+package pgcomp
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// checkpointOptions are the commit_every, state_file and resume inputs.
+type checkpointOptions struct {
+	Every     int64 // input rows per committed batch
+	StateFile string
+	Resume    bool
+}
+
+// checkpointState is the state_file of a checkpointed load. Position is
+// the number of input rows consumed by the committed batches, so a resumed
+// run skips exactly those.
+type checkpointState struct {
+	InputHash string    `json:"input_hash"`
+	Batches   int64     `json:"batches_committed"`
+	Position  int64     `json:"input_rows_committed"`
+	Rows      int64     `json:"rows_written"`
+	Complete  bool      `json:"complete"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// checkpointer splits a load into transactions of opts.Every input rows.
+// It is the querier the load writes through: statements go to the current
+// batch transaction, or to the pool before the first one is begun. The
+// methods do nothing on a nil *checkpointer, so the loads call them
+// unconditionally.
+type checkpointer struct {
+	db    *sql.DB
+	opts  checkpointOptions
+	tx    *sql.Tx
+	state checkpointState
+
+	position int64 // input rows consumed so far
+	written  int64 // rows written since the last commit
+	batches  int64 // batches committed by this run
+	skipped  int64
+	resumed  bool
+}
+
+func newCheckpointer(db *sql.DB, opts checkpointOptions) *checkpointer {
+	return &checkpointer{db: db, opts: opts}
+}
+
+func (c *checkpointer) current() querier {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.db
+}
+
+func (c *checkpointer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.current().Exec(query, args...)
+}
+
+func (c *checkpointer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.current().Query(query, args...)
+}
+
+func (c *checkpointer) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.current().QueryRow(query, args...)
+}
+
+// begin loads the state of a resumed run and opens the first batch.
+// inputHash identifies the input; a resume against a different input is
+// refused, since skipping rows by position is only sound when the input
+// is the same rows in the same order.
+func (c *checkpointer) begin(inputHash string) error {
+	if c == nil {
+		return nil
+	}
+	c.state = checkpointState{InputHash: inputHash}
+	if c.opts.Resume {
+		if c.opts.StateFile == "" {
+			return fmt.Errorf("resume needs a state_file")
+		}
+		raw, err := os.ReadFile(c.opts.StateFile)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return fmt.Errorf("failed to read state_file: %v", err)
+		default:
+			var prev checkpointState
+			if err := json.Unmarshal(raw, &prev); err != nil {
+				return fmt.Errorf("failed to parse state_file: %v", err)
+			}
+			if prev.InputHash != inputHash {
+				return newError("state_mismatch", "state_file %s belongs to a different input; it must be the same rows in the same order to resume", c.opts.StateFile)
+			}
+			c.state, c.resumed = prev, true
+		}
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	c.tx = tx
+	return nil
+}
+
+// skip reports whether input row position (1-based) was committed by an
+// earlier run.
+func (c *checkpointer) skip(position int64) bool {
+	if c == nil || position > c.state.Position {
+		return false
+	}
+	c.skipped++
+	return true
+}
+
+// batchRows caps a load's rows per statement at the batch size, so
+// batches end where a statement does.
+func (c *checkpointer) batchRows(n int) int {
+	if c == nil || c.opts.Every >= int64(n) {
+		return n
+	}
+	return int(c.opts.Every)
+}
+
+// flushed records that the input up to position has been written, n rows
+// of it, and commits a batch once opts.Every input rows are pending.
+func (c *checkpointer) flushed(position, n int64) error {
+	if c == nil {
+		return nil
+	}
+	c.position = position
+	c.written += n
+	if c.position-c.state.Position < c.opts.Every {
+		return nil
+	}
+	if err := c.commit(false); err != nil {
+		return err
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	c.tx = tx
+	return nil
+}
+
+// commit commits the current batch and records it in the state file.
+func (c *checkpointer) commit(complete bool) error {
+	if err := c.tx.Commit(); err != nil {
+		return err
+	}
+	c.tx = nil
+	if c.position > c.state.Position {
+		c.state.Position = c.position
+		c.state.Rows += c.written
+		c.state.Batches++
+		c.batches++
+	}
+	c.written = 0
+	c.state.Complete = complete
+	logger.Info("checkpoint committed", "batch", c.state.Batches, "input_rows", c.state.Position, "rows_written", c.state.Rows)
+	if c.opts.StateFile == "" {
+		return nil
+	}
+	c.state.UpdatedAt = time.Now().UTC()
+	raw, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.opts.StateFile, raw); err != nil {
+		return fmt.Errorf("batch %d was committed but state_file could not be written: %v", c.state.Batches, err)
+	}
+	return nil
+}
+
+// finish commits the last batch and adds the checkpoint totals to res.
+func (c *checkpointer) finish(res map[string]interface{}) error {
+	if c == nil {
+		return nil
+	}
+	if err := c.commit(true); err != nil {
+		return err
+	}
+	res["checkpoint"] = map[string]interface{}{
+		"batches_committed": c.batches,
+		"total_batches":     c.state.Batches,
+		"rows_written":      c.state.Rows,
+		"resumed":           c.resumed,
+		"skipped_rows":      c.skipped,
+	}
+	return nil
+}
+
+// close rolls back the batch in progress after a failure; the committed
+// ones stay.
+func (c *checkpointer) close() {
+	if c != nil && c.tx != nil {
+		c.tx.Rollback()
+	}
+}
+
+// failed rewords a load error once batches are committed: they stay, and
+// the failure is in the batch after them.
+func (c *checkpointer) failed(err error) error {
+	if c == nil || c.state.Batches == 0 {
+		return err
+	}
+	ce := newError("partially_committed", "%v; %d batch(es) with the first %d input rows stay committed, rerun with resume to continue", err, c.state.Batches, c.state.Position)
+	ce.Details = map[string]interface{}{"batches_committed": c.state.Batches, "input_rows_committed": c.state.Position}
+	var orig *componentError
+	if errors.As(err, &orig) {
+		for k, v := range orig.Details {
+			ce.Details[k] = v
+		}
+	}
+	ce.cause = err
+	return ce
+}
+
+// hashInput is the input_hash of a state file.
+func hashInput(parts ...interface{}) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, p := range parts {
+		enc.Encode(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
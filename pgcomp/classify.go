@@ -0,0 +1,335 @@
+package pgcomp
+
+import (
+	"strings"
+	"unicode"
+)
+
+// statementInfo is what the component needs to know about a SQL text before
+// running it.
+type statementInfo struct {
+	Keyword     string // leading keyword of the first statement, upper-cased
+	ReturnsRows bool   // run with Query rather than Exec
+	ReadOnly    bool   // safe to send to a standby
+}
+
+var rowKeywords = map[string]bool{"SELECT": true, "WITH": true, "SHOW": true, "EXPLAIN": true, "CALL": true, "VALUES": true, "TABLE": true}
+var readKeywords = map[string]bool{"SELECT": true, "WITH": true, "SHOW": true, "EXPLAIN": true, "VALUES": true, "TABLE": true}
+var writeWords = map[string]bool{"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true, "TRUNCATE": true, "INTO": true}
+
+// classifyStatement looks past comments, string literals and quoted
+// identifiers to decide how a statement has to be executed. A statement is
+// read-only when every statement in the text starts with a read keyword and
+// none of them modifies data: data-modifying CTEs, SELECT ... INTO and row
+// locking clauses (FOR UPDATE/SHARE) all count as writes. Functions called
+// from a SELECT can still write; that cannot be seen from the text.
+func classifyStatement(sql string) statementInfo {
+	var info statementInfo
+	readOnly := true
+	for i, words := range splitStatements(sqlWords(sql)) {
+		if i == 0 {
+			info.Keyword = words[0]
+			info.ReturnsRows = rowKeywords[words[0]]
+		}
+		if !readKeywords[words[0]] {
+			readOnly = false
+			continue
+		}
+		for j, w := range words {
+			if writeWords[w] {
+				readOnly = false
+			}
+			if w == "FOR" && j+1 < len(words) && (words[j+1] == "SHARE" || words[j+1] == "KEY" || words[j+1] == "NO") {
+				readOnly = false
+			}
+		}
+	}
+	info.ReadOnly = readOnly && info.Keyword != ""
+	return info
+}
+
+// ddlKeywords lead statements that change the schema or privileges.
+var ddlKeywords = map[string]bool{"CREATE": true, "ALTER": true, "DROP": true, "TRUNCATE": true, "COMMENT": true,
+	"GRANT": true, "REVOKE": true, "REINDEX": true, "CLUSTER": true, "VACUUM": true, "REFRESH": true, "SECURITY": true,
+	"IMPORT": true, "REASSIGN": true}
+
+// statementKinds reports whether sql, read the way classifyStatement
+// reads it, has statements that change the schema (ddl) or the data
+// (dml). SELECT ... INTO creates a table and counts as DDL. Anything that
+// is neither a read nor DDL, DO and CALL included, counts as DML.
+func statementKinds(sql string) (ddl, dml bool) {
+	for _, words := range splitStatements(sqlWords(sql)) {
+		switch {
+		case ddlKeywords[words[0]]:
+			ddl = true
+		case readKeywords[words[0]]:
+			for _, w := range words {
+				switch {
+				case w == "INTO" && words[0] == "SELECT":
+					ddl = true
+				case writeWords[w]:
+					dml = true
+				}
+			}
+		case words[0] == "SET" || words[0] == "RESET" || words[0] == "BEGIN" || words[0] == "COMMIT" || words[0] == "ROLLBACK":
+		default:
+			dml = true
+		}
+	}
+	return ddl, dml
+}
+
+// hasOrderBy reports whether sql has an ORDER BY anywhere outside
+// comments and literals. It cannot tell the outer query's from one in a
+// subquery.
+func hasOrderBy(sql string) bool {
+	words := sqlWords(sql)
+	for i := 0; i+1 < len(words); i++ {
+		if words[i] == "ORDER" && words[i+1] == "BY" {
+			return true
+		}
+	}
+	return false
+}
+
+func splitStatements(words []string) [][]string {
+	var stmts [][]string
+	var cur []string
+	for _, w := range words {
+		if w == ";" {
+			if len(cur) > 0 {
+				stmts = append(stmts, cur)
+			}
+			cur = nil
+			continue
+		}
+		cur = append(cur, w)
+	}
+	if len(cur) > 0 {
+		stmts = append(stmts, cur)
+	}
+	return stmts
+}
+
+// sqlWords returns the upper-cased bare words of sql plus ";" separators,
+// skipping comments, string and dollar-quoted literals and quoted identifiers.
+func sqlWords(sql string) []string {
+	var words []string
+	scanSQL([]rune(sql), func(w string) { words = append(words, w) }, nil)
+	return words
+}
+
+// scanSQL walks r the way the server's lexer splits it. word receives each
+// upper-cased bare word and ";" separator; quoted, when not nil, receives
+// the kind and rune span [from, to) of each comment, string literal,
+// quoted identifier and dollar-quoted body.
+func scanSQL(r []rune, word func(string), quoted func(kind string, from, to int)) {
+	span := func(kind string, from, to int) {
+		if quoted != nil {
+			quoted(kind, from, to)
+		}
+	}
+	for i := 0; i < len(r); {
+		c := r[i]
+		from := i
+		switch {
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+			span("comment", from, i)
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			depth := 0
+			for i < len(r) {
+				if r[i] == '/' && i+1 < len(r) && r[i+1] == '*' {
+					depth++
+					i += 2
+				} else if r[i] == '*' && i+1 < len(r) && r[i+1] == '/' {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			span("comment", from, i)
+		case c == '\'':
+			i = skipQuoted(r, i, c)
+			span("string literal", from, i)
+		case c == '"':
+			i = skipQuoted(r, i, c)
+			span("quoted identifier", from, i)
+		case c == '$':
+			if tag, ok := dollarTag(r, i); ok {
+				i = skipDollarQuoted(r, i, tag)
+				span("dollar-quoted body", from, i)
+			} else {
+				i++
+			}
+		case c == ';':
+			word(";")
+			i++
+		case (c == 'E' || c == 'e') && i+1 < len(r) && r[i+1] == '\'':
+			i = skipEscapeString(r, i+1)
+			span("string literal", from, i)
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_' || r[j] == '$') {
+				j++
+			}
+			word(strings.ToUpper(string(r[i:j])))
+			i = j
+		default:
+			i++
+		}
+	}
+}
+
+// skipQuoted returns the index just past the literal or identifier opened by
+// quote at r[i]; doubled quotes are escapes.
+func skipQuoted(r []rune, i int, quote rune) int {
+	for i++; i < len(r); i++ {
+		if r[i] == quote {
+			if i+1 < len(r) && r[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(r)
+}
+
+// skipEscapeString is skipQuoted for E'...' literals, where a backslash
+// also escapes the next character.
+func skipEscapeString(r []rune, i int) int {
+	for i++; i < len(r); i++ {
+		switch {
+		case r[i] == '\\':
+			i++
+		case r[i] == '\'' && i+1 < len(r) && r[i+1] == '\'':
+			i++
+		case r[i] == '\'':
+			return i + 1
+		}
+	}
+	return len(r)
+}
+
+// dollarTag recognises the opening delimiter of a dollar-quoted string ($$ or
+// $tag$) starting at r[i].
+func dollarTag(r []rune, i int) ([]rune, bool) {
+	for j := i + 1; j < len(r); j++ {
+		if r[j] == '$' {
+			return r[i : j+1], true
+		}
+		if !(unicode.IsLetter(r[j]) || r[j] == '_' || (j > i+1 && unicode.IsDigit(r[j]))) {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// skipDollarQuoted returns the index just past the closing tag of the
+// dollar-quoted string opened at r[i].
+func skipDollarQuoted(r []rune, i int, tag []rune) int {
+	for j := i + len(tag); j+len(tag) <= len(r); j++ {
+		if string(r[j:j+len(tag)]) == string(tag) {
+			return j + len(tag)
+		}
+	}
+	return len(r)
+}
+
+// scriptStatement is one statement of a SQL script: its text without the
+// separating semicolon and the 1-based line it starts on.
+type scriptStatement struct {
+	Text string
+	Line int
+}
+
+// splitScript cuts a SQL script into statements at the semicolons that
+// are not inside comments, literals, quoted identifiers or dollar-quoted
+// bodies. Comments and blank lines before a statement are not part of it.
+// A psql meta-command (a line starting with a backslash) becomes a
+// statement of its own, so the caller can refuse it.
+func splitScript(script string) []scriptStatement {
+	var out []scriptStatement
+	r := []rune(script)
+	line, start, startLine := 1, -1, 0
+	end := func(i int) {
+		if start >= 0 {
+			out = append(out, scriptStatement{Text: strings.TrimSpace(string(r[start:i])), Line: startLine})
+		}
+		start = -1
+	}
+	// lines counts the newlines in r[from:to] into line
+	lines := func(from, to int) {
+		for _, c := range r[from:to] {
+			if c == '\n' {
+				line++
+			}
+		}
+	}
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+			continue
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			j := skipBlockComment(r, i)
+			lines(i, j)
+			i = j
+			continue
+		case c == ';':
+			end(i)
+			i++
+			continue
+		}
+		if start < 0 {
+			start, startLine = i, line
+			if c == '\\' {
+				for i < len(r) && r[i] != '\n' {
+					i++
+				}
+				end(i)
+				continue
+			}
+		}
+		j := i + 1
+		switch {
+		case c == '\'' || c == '"':
+			j = skipQuoted(r, i, c)
+		case (c == 'E' || c == 'e') && i+1 < len(r) && r[i+1] == '\'' && (i == 0 || !isWordRune(r[i-1])):
+			j = skipEscapeString(r, i+1)
+		case c == '$' && (i == 0 || !isWordRune(r[i-1])):
+			if tag, ok := dollarTag(r, i); ok {
+				j = skipDollarQuoted(r, i, tag)
+			}
+		case isWordRune(c):
+			for j < len(r) && (isWordRune(r[j]) || r[j] == '$') {
+				j++
+			}
+		}
+		lines(i, j)
+		i = j
+	}
+	end(len(r))
+	return out
+}
+
+func isWordRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+}
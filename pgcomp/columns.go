@@ -0,0 +1,121 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// resultColumn describes one result column: the name the server gave it,
+// its 1-based position, and the key its values are stored under in a row.
+type resultColumn struct {
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+	Key      string `json:"key"`
+}
+
+// dedupeColumns returns a distinct row key for every column: the first of
+// several equally named columns keeps the name and later ones get _2, _3,
+// ... skipping suffixes that are themselves column names. duplicates lists
+// each repeated name once, in order of first repetition.
+func dedupeColumns(columns []string) (keys []string, duplicates []string) {
+	taken := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		taken[c] = true
+	}
+
+	seen := make(map[string]int, len(columns))
+	keys = make([]string, len(columns))
+	for i, c := range columns {
+		seen[c]++
+		if seen[c] == 1 {
+			keys[i] = c
+			continue
+		}
+		if seen[c] == 2 {
+			duplicates = append(duplicates, c)
+		}
+		n := seen[c]
+		key := c + "_" + strconv.Itoa(n)
+		for taken[key] {
+			n++
+			key = c + "_" + strconv.Itoa(n)
+		}
+		seen[c] = n
+		taken[key] = true
+		keys[i] = key
+	}
+	return keys, duplicates
+}
+
+func describeColumns(columns, keys []string) []resultColumn {
+	out := make([]resultColumn, len(columns))
+	for i, c := range columns {
+		out[i] = resultColumn{Name: c, Position: i + 1, Key: keys[i]}
+	}
+	return out
+}
+
+// columnOrders are the "column_order" values: keys in result column order,
+// or sorted by name as encoding/json writes maps.
+var columnOrders = []string{"query", "name"}
+
+// orderedRow is a result row that marshals its keys in column order.
+type orderedRow struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r orderedRow) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(r.values[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// orderRows pairs every row with keys. Keys a row lacks are written as
+// null so all rows have the same shape.
+func orderRows(rows []map[string]interface{}, keys []string) []orderedRow {
+	out := make([]orderedRow, len(rows))
+	for i, r := range rows {
+		out[i] = orderedRow{keys: keys, values: r}
+	}
+	return out
+}
+
+// outputRepresentations are the "output_representation" values: one object
+// per row, or the column names once and each row as an array of values.
+var outputRepresentations = []string{"objects", "compact"}
+
+type compactResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+func compactRows(rows []map[string]interface{}, keys []string) compactResult {
+	out := compactResult{Columns: keys, Rows: make([][]interface{}, len(rows))}
+	for i, r := range rows {
+		vals := make([]interface{}, len(keys))
+		for j, k := range keys {
+			vals[j] = r[k]
+		}
+		out.Rows[i] = vals
+	}
+	return out
+}
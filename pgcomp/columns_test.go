@@ -0,0 +1,63 @@
+package pgcomp
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+// wideRows is a result of n rows of a 40-column table: ids, names,
+// amounts, timestamps, flags and nulls.
+func wideRows(n int) ([]map[string]interface{}, []string) {
+	keys := make([]string, 40)
+	for j := range keys {
+		keys[j] = fmt.Sprintf("column_%02d", j)
+	}
+	rows := make([]map[string]interface{}, n)
+	for i := range rows {
+		row := make(map[string]interface{}, len(keys))
+		for j, k := range keys {
+			switch j % 5 {
+			case 0:
+				row[k] = int64(i*40 + j)
+			case 1:
+				row[k] = fmt.Sprintf("customer %d", i)
+			case 2:
+				row[k] = "1234.56"
+			case 3:
+				row[k] = "2026-01-01T00:00:00Z"
+			default:
+				if i%3 == 0 {
+					row[k] = nil
+				} else {
+					row[k] = i%2 == 0
+				}
+			}
+		}
+		rows[i] = row
+	}
+	return rows, keys
+}
+
+// benchmarkEncode encodes the 10k-row wide result as result(rows, keys)
+// lays it out, reporting the size of the document as bytes/result.
+func benchmarkEncode(b *testing.B, result func([]map[string]interface{}, []string) interface{}) {
+	rows, keys := wideRows(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int64
+	for i := 0; i < b.N; i++ {
+		w := &countingWriter{w: io.Discard}
+		(&responder{w: w}).write(Response{Result: result(rows, keys)})
+		size = w.n
+	}
+	b.ReportMetric(float64(size), "bytes/result")
+}
+
+func BenchmarkEncodeObjects(b *testing.B) {
+	benchmarkEncode(b, func(rows []map[string]interface{}, _ []string) interface{} { return rows })
+}
+
+func BenchmarkEncodeCompact(b *testing.B) {
+	benchmarkEncode(b, func(rows []map[string]interface{}, keys []string) interface{} { return compactRows(rows, keys) })
+}
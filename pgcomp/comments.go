@@ -0,0 +1,138 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// commentOptions are the set inputs of the comments data_type. A nil
+// Table leaves the table comment alone; a nil entry of Columns removes
+// that column's comment.
+type commentOptions struct {
+	Table   *string
+	Columns map[string]*string
+}
+
+func parseColumnComments(val string) (map[string]*string, error) {
+	var m map[string]*string
+	if err := json.Unmarshal([]byte(val), &m); err != nil {
+		return nil, fmt.Errorf("column_comments must be a JSON object of column to comment (or null): %v", err)
+	}
+	return m, nil
+}
+
+// manageComments implements the comments data_type on a table-like
+// relation: get returns its comment and the comment of every column, set
+// writes COMMENT ON statements for the given ones. Set runs in the
+// request transaction, so a bulk update applies all comments or none.
+func manageComments(db querier, table, operation string, opts commentOptions) (interface{}, error) {
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	switch operation {
+	case "", "get":
+		return relationComments(db, rel)
+	case "set":
+	default:
+		return nil, fmt.Errorf("unknown comments operation %q (allowed: get, set)", operation)
+	}
+	if opts.Table == nil && len(opts.Columns) == 0 {
+		return nil, fmt.Errorf("comment or column_comments is required for comments set")
+	}
+
+	cols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(cols))
+	for i, c := range cols {
+		known[i] = c.Name
+	}
+	names := make([]string, 0, len(opts.Columns))
+	for c := range opts.Columns {
+		if !containsString(known, c) {
+			return nil, fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+		}
+		names = append(names, c)
+	}
+	sort.Strings(names)
+
+	// COMMENT ON takes no parameters, so the text is quoted as a literal
+	kind := "TABLE"
+	switch rel.Kind {
+	case "view":
+		kind = "VIEW"
+	case "materialized_view":
+		kind = "MATERIALIZED VIEW"
+	case "foreign_table":
+		kind = "FOREIGN TABLE"
+	}
+	var stmts []string
+	if opts.Table != nil {
+		stmts = append(stmts, fmt.Sprintf("COMMENT ON %s %s IS %s", kind, rel.Name, commentLiteral(opts.Table)))
+	}
+	for _, c := range names {
+		stmts = append(stmts, fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", rel.Name, pq.QuoteIdentifier(c), commentLiteral(opts.Columns[c])))
+	}
+	for _, stmt := range stmts {
+		logSQL(stmt, nil)
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	res, err := relationComments(db, rel)
+	if err != nil {
+		return nil, err
+	}
+	res["updated"] = len(stmts)
+	return res, nil
+}
+
+// commentLiteral is the IS clause value; NULL (or an empty comment)
+// removes the comment.
+func commentLiteral(s *string) string {
+	if s == nil || *s == "" {
+		return "NULL"
+	}
+	return pq.QuoteLiteral(*s)
+}
+
+// relationComments reads the comment of rel and of each of its columns,
+// nil where none is set.
+func relationComments(db querier, rel *relation) (map[string]interface{}, error) {
+	var tableComment sql.NullString
+	if err := db.QueryRow("SELECT obj_description($1::oid, 'pg_class')", rel.OID).Scan(&tableComment); err != nil {
+		return nil, err
+	}
+	columns, err := columnComments(db, rel)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"relation": rel.Name, "comment": nullString(tableComment), "columns": columns}, nil
+}
+
+// columnComments maps every column of rel to its comment or nil.
+func columnComments(db querier, rel *relation) (map[string]interface{}, error) {
+	rows, err := db.Query(`SELECT a.attname::text, col_description(a.attrelid, a.attnum)
+		FROM pg_attribute a WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, rel.OID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]interface{}{}
+	for rows.Next() {
+		var name string
+		var comment sql.NullString
+		if err := rows.Scan(&name, &comment); err != nil {
+			return nil, err
+		}
+		out[name] = nullString(comment)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,352 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// pgTypeInfo is the part of pg_type needed to decode composite values.
+type pgTypeInfo struct {
+	Name   string
+	Type   string // typtype: b base, c composite, d domain, e enum, ...
+	Elem   uint32 // element type of an array type
+	Fields []compositeField
+}
+
+type compositeField struct {
+	Name string
+	OID  uint32
+}
+
+// compositeDecoder expands composite values, and arrays of them, into JSON
+// objects using the attribute definitions read once per invocation.
+// Column type OIDs come from pgx, which reports unknown types by OID, or in
+// table mode from the catalog; lib/pq reports neither for other modes.
+type compositeDecoder struct {
+	columns []uint32 // composite (or composite array) type per result column, 0 otherwise
+	types   map[uint32]*pgTypeInfo
+}
+
+// newCompositeDecoder resolves the candidate column types. oids holds the
+// type OID of each result column where known. It uses the pool rather than
+// the request transaction because the result set is still open there.
+func newCompositeDecoder(db *sql.DB, oids []uint32) *compositeDecoder {
+	d := &compositeDecoder{columns: make([]uint32, len(oids)), types: map[uint32]*pgTypeInfo{}}
+	var pending []uint32
+	for _, oid := range oids {
+		if oid != 0 {
+			pending = append(pending, oid)
+		}
+	}
+	if len(pending) == 0 {
+		return d
+	}
+	if err := d.load(db, pending); err != nil {
+		logger.Warn("composite type lookup failed", "error", err.Error())
+		return d
+	}
+	for i, oid := range oids {
+		if d.isComposite(oid) || d.isComposite(d.elem(oid)) {
+			d.columns[i] = oid
+		}
+	}
+	return d
+}
+
+// load reads the types in oids and, transitively, their field and element
+// types.
+func (d *compositeDecoder) load(db *sql.DB, oids []uint32) error {
+	for depth := 0; len(oids) > 0 && depth < 16; depth++ {
+		ids := make([]int64, 0, len(oids))
+		for _, oid := range oids {
+			if _, done := d.types[oid]; !done {
+				ids = append(ids, int64(oid))
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		rows, err := db.Query(`SELECT t.oid, t.typname, t.typtype::text, t.typelem, a.attname, a.atttypid
+			FROM pg_type t
+			LEFT JOIN pg_attribute a ON t.typtype = 'c' AND a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+			WHERE t.oid = ANY($1)
+			ORDER BY t.oid, a.attnum`, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		var next []uint32
+		for rows.Next() {
+			var oid, elem uint32
+			var name, typ string
+			var field sql.NullString
+			var fieldType sql.NullInt64
+			if err := rows.Scan(&oid, &name, &typ, &elem, &field, &fieldType); err != nil {
+				rows.Close()
+				return err
+			}
+			info := d.types[oid]
+			if info == nil {
+				info = &pgTypeInfo{Name: name, Type: typ, Elem: elem}
+				d.types[oid] = info
+				if elem != 0 {
+					next = append(next, elem)
+				}
+			}
+			if field.Valid {
+				info.Fields = append(info.Fields, compositeField{Name: field.String, OID: uint32(fieldType.Int64)})
+				next = append(next, uint32(fieldType.Int64))
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		oids = next
+	}
+	return nil
+}
+
+func (d *compositeDecoder) isComposite(oid uint32) bool {
+	t := d.types[oid]
+	return t != nil && t.Type == "c"
+}
+
+func (d *compositeDecoder) elem(oid uint32) uint32 {
+	if t := d.types[oid]; t != nil {
+		return t.Elem
+	}
+	return 0
+}
+
+// apply decodes the value of result column i when it is composite-typed,
+// reporting false (and the value untouched) otherwise or when the text
+// does not parse.
+func (d *compositeDecoder) apply(i int, val interface{}) (interface{}, bool) {
+	if i >= len(d.columns) || d.columns[i] == 0 {
+		return val, false
+	}
+	var s string
+	switch v := val.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return val, false
+	}
+	out, err := d.decode(d.columns[i], s)
+	if err != nil {
+		logger.Warn("could not decode composite value", "type", d.types[d.columns[i]].Name, "error", err.Error())
+		return val, false
+	}
+	return out, true
+}
+
+// decode converts the text form of a value of type oid.
+func (d *compositeDecoder) decode(oid uint32, s string) (interface{}, error) {
+	t := d.types[oid]
+	switch {
+	case t == nil:
+		return s, nil
+	case t.Type == "c":
+		fields, err := splitComposite(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != len(t.Fields) {
+			return nil, fmt.Errorf("%s has %d fields, value has %d", t.Name, len(t.Fields), len(fields))
+		}
+		obj := make(map[string]interface{}, len(fields))
+		for i, f := range t.Fields {
+			if fields[i] == nil {
+				obj[f.Name] = nil
+				continue
+			}
+			if obj[f.Name], err = d.decode(f.OID, *fields[i]); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case t.Elem != 0 && strings.HasPrefix(t.Name, "_"):
+		return d.decodeArray(t.Elem, s)
+	}
+	return scalarValue(t.Name, s), nil
+}
+
+func (d *compositeDecoder) decodeArray(elem uint32, s string) (interface{}, error) {
+	// Arrays may carry explicit bounds: [0:1]={...}
+	if strings.HasPrefix(s, "[") {
+		if i := strings.Index(s, "="); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	p := &arrayParser{s: s}
+	v, err := p.parse(func(item string) (interface{}, error) { return d.decode(elem, item) })
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(s) {
+		return nil, fmt.Errorf("trailing text after array")
+	}
+	return v, nil
+}
+
+// scalarValue types a composite field or array element from its text form
+// the way the drivers would for a top-level column.
+func scalarValue(typ, s string) interface{} {
+	switch typ {
+	case "int2", "int4", "int8", "oid", "xid", "cid":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case "float4", "float8":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "bool":
+		return s == "t"
+	}
+	return s
+}
+
+// splitComposite splits the text form (a,"b c",,"d""e") into its fields;
+// a nil entry is a NULL field.
+func splitComposite(s string) ([]*string, error) {
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		return nil, fmt.Errorf("not a composite value")
+	}
+	body := s[1 : len(s)-1]
+	var fields []*string
+	var b strings.Builder
+	quoted, inQuotes, seen := false, false, false
+	flush := func() {
+		if !seen && !quoted {
+			fields = append(fields, nil)
+		} else {
+			v := b.String()
+			fields = append(fields, &v)
+		}
+		b.Reset()
+		quoted, seen = false, false
+	}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\\' && i+1 < len(body):
+			i++
+			b.WriteByte(body[i])
+			seen = true
+		case c == '"' && inQuotes && i+1 < len(body) && body[i+1] == '"':
+			i++
+			b.WriteByte('"')
+		case c == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case c == ',' && !inQuotes:
+			flush()
+		default:
+			b.WriteByte(c)
+			seen = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in composite value")
+	}
+	flush()
+	return fields, nil
+}
+
+// arrayParser parses the array text form {a,"b",NULL,{c}}.
+type arrayParser struct {
+	s   string
+	pos int
+}
+
+func (p *arrayParser) parse(item func(string) (interface{}, error)) (interface{}, error) {
+	if p.pos >= len(p.s) || p.s[p.pos] != '{' {
+		return nil, fmt.Errorf("not an array value")
+	}
+	p.pos++
+	out := []interface{}{}
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+		return out, nil
+	}
+	for {
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		switch p.s[p.pos] {
+		case '{':
+			sub, err := p.parse(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sub)
+		case '"':
+			var b strings.Builder
+			for p.pos++; p.pos < len(p.s) && p.s[p.pos] != '"'; p.pos++ {
+				if p.s[p.pos] == '\\' && p.pos+1 < len(p.s) {
+					p.pos++
+				}
+				b.WriteByte(p.s[p.pos])
+			}
+			if p.pos >= len(p.s) {
+				return nil, fmt.Errorf("unterminated quote in array")
+			}
+			p.pos++
+			v, err := item(b.String())
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		default:
+			start := p.pos
+			for p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != '}' {
+				p.pos++
+			}
+			raw := p.s[start:p.pos]
+			if raw == "NULL" {
+				out = append(out, nil)
+				break
+			}
+			v, err := item(raw)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if p.s[p.pos] == '}' {
+			p.pos++
+			return out, nil
+		}
+		if p.s[p.pos] != ',' {
+			return nil, fmt.Errorf("expected , in array")
+		}
+		p.pos++
+	}
+}
+
+// resultTypeOIDs returns the OID of each result column whose type the
+// driver could not name: the OID pgx reports instead of a name, or for
+// lib/pq the type found by the table mode catalog lookup.
+func resultTypeOIDs(columns, types []string, byName map[string]uint32) []uint32 {
+	oids := make([]uint32, len(columns))
+	for i, c := range columns {
+		if i < len(types) && types[i] != "" && types[i] != unknownType {
+			if n, err := strconv.ParseUint(types[i], 10, 32); err == nil {
+				oids[i] = uint32(n)
+			}
+			continue
+		}
+		oids[i] = byName[c]
+	}
+	return oids
+}
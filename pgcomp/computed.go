@@ -0,0 +1,476 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// computedColumn is one entry of the "computed_columns" input: a column
+// appended to every result row, holding the value of Expr over the row.
+//
+// Expressions are deliberately small, with no way to reach anything but
+// the row:
+//
+//	column, "Quoted Column"  the row's value; earlier computed columns too
+//	42, 12.50, 'text', null  literals; '' is a quote inside text
+//	-x, x * y, x / y         arithmetic, in the usual precedence
+//	x + y, x - y
+//	x || y                   text concatenation, below arithmetic
+//	coalesce(x, y, ...)      the first argument that is not null
+//	(x)
+//
+// As in SQL, an operator with a null operand gives null. Numeric columns
+// arrive as decimal strings, so text that is a plain decimal counts as a
+// number in arithmetic. Integers stay integers under + - *, decimals stay
+// exact with the scale SQL would give them, and / keeps at least six
+// decimals; a float operand makes the result a float.
+type computedColumn struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+
+	eval exprNode
+}
+
+// exprNode evaluates a parsed expression over one row.
+type exprNode func(row map[string]interface{}) (interface{}, error)
+
+// minDivisionScale is the fewest decimals a division result keeps.
+const minDivisionScale = 6
+
+func parseComputedColumns(val string) ([]computedColumn, error) {
+	var cols []computedColumn
+	if err := json.Unmarshal([]byte(val), &cols); err != nil {
+		return nil, fmt.Errorf("computed_columns must be a JSON array of {name, expr}: %v", err)
+	}
+	seen := map[string]bool{}
+	for i := range cols {
+		c := &cols[i]
+		if c.Name == "" || c.Expr == "" {
+			return nil, fmt.Errorf("computed column %d needs a name and an expr", i)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("computed column %q is given twice", c.Name)
+		}
+		seen[c.Name] = true
+		node, err := parseExpr(c.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("computed column %q: %v in expr %q", c.Name, err, c.Expr)
+		}
+		c.eval = node
+	}
+	return cols, nil
+}
+
+// applyComputed adds the computed columns to row, the i-th of the result.
+func applyComputed(cols []computedColumn, i int, row map[string]interface{}) error {
+	for _, c := range cols {
+		if _, ok := row[c.Name]; ok {
+			return computedError(c, i, fmt.Errorf("%q is already a result column", c.Name))
+		}
+		v, err := c.eval(row)
+		if err != nil {
+			return computedError(c, i, err)
+		}
+		row[c.Name] = v
+	}
+	return nil
+}
+
+func computedError(c computedColumn, i int, err error) error {
+	ce := newError("computed_column_error", "computed column %q, row %d: %v in expr %q", c.Name, i, err, c.Expr)
+	ce.Details = map[string]interface{}{"column": c.Name, "expr": c.Expr, "row": i}
+	return ce
+}
+
+// exprToken is a lexed token: kind is one of num, str, ident, qident (a
+// "quoted" identifier), op or end.
+type exprToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+func lexExpr(s string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isDigit(rune(c)) || (c == '.' && i+1 < len(s) && isDigit(rune(s[i+1]))):
+			j := i
+			for j < len(s) && (isDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			toks = append(toks, exprToken{"num", s[i:j], i})
+			i = j
+		case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+			j := i
+			for j < len(s) && (s[j] == '_' || isDigit(rune(s[j])) || (s[j]|0x20 >= 'a' && s[j]|0x20 <= 'z')) {
+				j++
+			}
+			toks = append(toks, exprToken{"ident", s[i:j], i})
+			i = j
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(s) {
+					return nil, fmt.Errorf("unterminated %c at %d", c, i)
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						b.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+				j++
+			}
+			kind := "str"
+			if c == '"' {
+				kind = "qident"
+			}
+			toks = append(toks, exprToken{kind, b.String(), i})
+			i = j + 1
+		case strings.HasPrefix(s[i:], "||"):
+			toks = append(toks, exprToken{"op", "||", i})
+			i += 2
+		case strings.IndexByte("+-*/(),", c) >= 0:
+			toks = append(toks, exprToken{"op", string(c), i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return append(toks, exprToken{"end", "", len(s)}), nil
+}
+
+// exprParser is a recursive descent parser over the tokens of one
+// expression, lowest precedence first.
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func parseExpr(s string) (exprNode, error) {
+	toks, err := lexExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	node, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "end" {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	p.pos++
+	return t
+}
+
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == "op" && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// binary parses operand (op operand)* for the operators ops of one
+// precedence level, left associative.
+func (p *exprParser) binary(operand func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != "op" || !containsString(ops, t.text) {
+			return left, nil
+		}
+		p.pos++
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode(t.text, left, right)
+	}
+}
+
+func (p *exprParser) concat() (exprNode, error) { return p.binary(p.additive, "||") }
+
+func (p *exprParser) additive() (exprNode, error) { return p.binary(p.term, "+", "-") }
+
+func (p *exprParser) term() (exprNode, error) { return p.binary(p.unary, "*", "/") }
+
+func (p *exprParser) unary() (exprNode, error) {
+	if p.accept("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryNode("-", func(map[string]interface{}) (interface{}, error) { return int64(0), nil }, operand), nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case "num":
+		v, ok := numberLiteral(t.text)
+		if !ok {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return func(map[string]interface{}) (interface{}, error) { return v, nil }, nil
+	case "str":
+		return func(map[string]interface{}) (interface{}, error) { return t.text, nil }, nil
+	case "ident", "qident":
+		if t.kind == "ident" && strings.EqualFold(t.text, "null") {
+			return func(map[string]interface{}) (interface{}, error) { return nil, nil }, nil
+		}
+		if t.kind == "ident" && p.accept("(") {
+			return p.call(t)
+		}
+		name := t.text
+		return func(row map[string]interface{}) (interface{}, error) {
+			v, ok := row[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown column %q", name)
+			}
+			return v, nil
+		}, nil
+	case "op":
+		if t.text == "(" {
+			node, err := p.concat()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, fmt.Errorf("missing ) at %d", p.peek().pos)
+			}
+			return node, nil
+		}
+	case "end":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// call parses the arguments of function fn; coalesce is the only one.
+func (p *exprParser) call(fn exprToken) (exprNode, error) {
+	if !strings.EqualFold(fn.text, "coalesce") {
+		return nil, fmt.Errorf("unknown function %s at %d, only coalesce is supported", fn.text, fn.pos)
+	}
+	var args []exprNode
+	for !p.accept(")") {
+		if len(args) > 0 && !p.accept(",") {
+			return nil, fmt.Errorf("expected , or ) at %d", p.peek().pos)
+		}
+		arg, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("coalesce needs at least one argument")
+	}
+	return func(row map[string]interface{}) (interface{}, error) {
+		for _, a := range args {
+			v, err := a(row)
+			if err != nil || v != nil {
+				return v, err
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+// numberLiteral is an integer literal as int64 and a decimal one as its
+// text, the way numeric columns arrive.
+func numberLiteral(s string) (interface{}, bool) {
+	if !isPlainDecimal(s) {
+		return nil, false
+	}
+	if !strings.Contains(s, ".") {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return s, true
+		}
+		return n, true
+	}
+	return s, true
+}
+
+// isPlainDecimal reports whether s is an optionally signed decimal like
+// those numeric columns are returned as, without exponent or fraction
+// forms big.Rat would also accept.
+func isPlainDecimal(s string) bool {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	digits, dots := 0, 0
+	for _, c := range s {
+		switch {
+		case isDigit(c):
+			digits++
+		case c == '.':
+			dots++
+		default:
+			return false
+		}
+	}
+	return digits > 0 && dots <= 1
+}
+
+func binaryNode(op string, left, right exprNode) exprNode {
+	return func(row map[string]interface{}) (interface{}, error) {
+		a, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+		b, err := right(row)
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || b == nil {
+			return nil, nil
+		}
+		if op == "||" {
+			return concatValues(a, b)
+		}
+		return arithmetic(op, a, b)
+	}
+}
+
+func concatValues(a, b interface{}) (interface{}, error) {
+	sa, ok := exprText(a)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply || to %s", exprTypeName(a))
+	}
+	sb, ok := exprText(b)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply || to %s", exprTypeName(b))
+	}
+	return sa + sb, nil
+}
+
+func exprText(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case time.Time:
+		// As the value is written in the output
+		return t.Format(time.RFC3339Nano), true
+	}
+	return "", false
+}
+
+// exprNumber reads v as a number for arithmetic; text must be a plain
+// decimal.
+func exprNumber(v interface{}) (*big.Rat, string, int, bool) {
+	if s, ok := v.(string); ok && !isPlainDecimal(s) {
+		return nil, "", 0, false
+	}
+	return toRat(v)
+}
+
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	ra, ka, sa, ok := exprNumber(a)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply %s to %s %s", op, exprTypeName(a), exprValue(a))
+	}
+	rb, kb, sb, ok := exprNumber(b)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply %s to %s %s", op, exprTypeName(b), exprValue(b))
+	}
+	if op == "/" && rb.Sign() == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	if ka == "float" || kb == "float" {
+		fa, _ := ra.Float64()
+		fb, _ := rb.Float64()
+		switch op {
+		case "+":
+			return fa + fb, nil
+		case "-":
+			return fa - fb, nil
+		case "*":
+			return fa * fb, nil
+		}
+		return fa / fb, nil
+	}
+
+	r := new(big.Rat)
+	scale := sa
+	if sb > scale {
+		scale = sb
+	}
+	switch op {
+	case "+":
+		r.Add(ra, rb)
+	case "-":
+		r.Sub(ra, rb)
+	case "*":
+		r.Mul(ra, rb)
+		scale = sa + sb
+	case "/":
+		r.Quo(ra, rb)
+		if scale < minDivisionScale {
+			scale = minDivisionScale
+		}
+	}
+	if ka == "int" && kb == "int" && op != "/" && r.Num().IsInt64() {
+		return r.Num().Int64(), nil
+	}
+	return r.FloatString(scale), nil
+}
+
+func exprTypeName(v interface{}) string {
+	switch v.(type) {
+	case int64, float64:
+		return "number"
+	case string:
+		return "text"
+	case bool:
+		return "boolean"
+	case time.Time:
+		return "timestamp"
+	case map[string]interface{}, map[string]*string:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// exprValue quotes a scalar operand for an error message.
+func exprValue(v interface{}) string {
+	if s, ok := exprText(v); ok {
+		if len(s) > 40 {
+			s = s[:40] + "..."
+		}
+		return strconv.Quote(s)
+	}
+	return ""
+}
@@ -0,0 +1,550 @@
+package pgcomp
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// querier is the part of *sql.DB and *sql.Tx the mode handlers use, so the
+// same handler can run standalone or inside a request transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// connConfig describes how to reach the server.
+type connConfig struct {
+	Hosts              []string // host or host:port entries, tried in order
+	Port               int      // default port for entries without one
+	Username           string
+	Password           string
+	DBName             string
+	SSLMode            string
+	TargetSessionAttrs string // any, read-write or read-only
+	AuthMethod         string // "" (password), aws_iam, vault or gssapi
+	AWSRegion          string
+	KrbSrvName         string // gssapi service name, default postgres
+	ClientEncoding     string // "" leaves the driver's UTF8
+	Vault              vaultConfig
+	Driver             string     // database/sql driver name: postgres (lib/pq) or pgx
+	Tunnel             *sshTunnel // dial through an SSH jump host when set
+	ConnectTimeout     time.Duration
+	ConnectRetries     int    // extra sweeps over the hosts after a network failure
+	IPFamily           string // any, ipv4 or ipv6
+	// KeepAlive overrides the TCP keepalive settings when set. The drivers
+	// do not take libpq's keepalives options, so they are applied by the
+	// dialer.
+	KeepAlive *net.KeepAliveConfig
+}
+
+// parseHosts accepts either a JSON array of hosts or a comma-separated list.
+func parseHosts(val string) ([]string, error) {
+	var list []string
+	if strings.HasPrefix(val, "[") {
+		if err := json.Unmarshal([]byte(val), &list); err != nil {
+			return nil, fmt.Errorf("hosts must be a JSON array of strings: %v", err)
+		}
+	} else {
+		list = strings.Split(val, ",")
+	}
+
+	out := make([]string, 0, len(list))
+	for _, h := range list {
+		if h = strings.TrimSpace(h); h != "" {
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}
+
+// connect opens a pool against the first host that accepts the connection
+// and satisfies TargetSessionAttrs; lib/pq only ever tries a single host, so
+// the failover loop lives here. A name resolving to several addresses is
+// tried address by address, since the drivers only try the first.
+func connect(cfg connConfig) (*sql.DB, connTarget, error) {
+	var failures []string
+	var lastErr error
+	for _, h := range cfg.Hosts {
+		host, port := splitHostPort(h, cfg.Port)
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+		ips, err := resolveHost(cfg, host)
+		if err != nil {
+			logger.Warn("host lookup failed", "host", host, "error", err.Error())
+			failures = append(failures, fmt.Sprintf("%s: %v", addr, err))
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			logger.Info("connecting", "host", addr, "ip", ip, "dbname", cfg.DBName, "user", cfg.Username, "driver", cfg.Driver)
+			start := time.Now()
+			db, err := connectHost(cfg, host, port, ip)
+			if err != nil {
+				logger.Warn("connection failed", "host", addr, "ip", ip, "duration_ms", time.Since(start).Milliseconds(), "error", err.Error())
+				label := addr
+				if ip != "" {
+					label += " (" + ip + ")"
+				}
+				failures = append(failures, fmt.Sprintf("%s: %v", label, err))
+				lastErr = err
+				continue
+			}
+			logger.Info("connected", "host", addr, "ip", ip, "duration_ms", time.Since(start).Milliseconds())
+			return db, connTarget{Addr: addr, IP: ip, Addresses: len(ips)}, nil
+		}
+	}
+	if len(failures) == 1 {
+		return nil, connTarget{}, lastErr
+	}
+	return nil, connTarget{}, fmt.Errorf("failed to connect to any host: %s", strings.Join(failures, "; "))
+}
+
+// connTarget is where a request's connection ended up.
+type connTarget struct {
+	Addr      string // host:port as configured
+	IP        string // resolved address dialled, "" when the driver resolved
+	Addresses int    // how many addresses the host name resolved to
+	Read      bool   // a read host from route auto
+	Attempts  int    // connection sweeps over the host list
+}
+
+// peerInputs are the connection inputs of a second database (host2,
+// port2, ... or connection_uri2) for the modes that compare or copy data
+// between two databases.
+type peerInputs struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	DBName   string
+	SSLMode  string
+	URI      string
+}
+
+func (p peerInputs) set() bool {
+	return p != peerInputs{}
+}
+
+// peerConfig derives the configuration of the second connection from the
+// first one: connection_uri2 is applied first, then the individual inputs,
+// and whatever neither sets is inherited, so dbname2 alone compares two
+// databases of the same server. The SSH tunnel belongs to the first server
+// and is not reused.
+func peerConfig(base connConfig, p peerInputs) (connConfig, error) {
+	cfg := base
+	cfg.Tunnel = nil
+	cfg.TargetSessionAttrs = "any"
+	if p.URI != "" {
+		u, err := url.Parse(p.URI)
+		if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+			return cfg, fmt.Errorf("connection_uri2 must be a postgres:// or postgresql:// URI")
+		}
+		if u.Host != "" {
+			if cfg.Hosts, err = parseHosts(u.Host); err != nil {
+				return cfg, err
+			}
+		}
+		if u.User != nil {
+			cfg.Username = u.User.Username()
+			if pw, ok := u.User.Password(); ok {
+				cfg.Password = pw
+			}
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			cfg.DBName = db
+		}
+		if mode := u.Query().Get("sslmode"); mode != "" {
+			cfg.SSLMode = mode
+		}
+	}
+	if p.Host != "" {
+		hosts, err := parseHosts(p.Host)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Hosts = hosts
+	}
+	if p.Port != 0 {
+		cfg.Port = p.Port
+	}
+	if p.Username != "" {
+		cfg.Username = p.Username
+	}
+	if p.Password != "" {
+		cfg.Password = p.Password
+	}
+	if p.DBName != "" {
+		cfg.DBName = p.DBName
+	}
+	if p.SSLMode != "" {
+		cfg.SSLMode = p.SSLMode
+	}
+	return cfg, nil
+}
+
+// openPeer connects to the second database of dataType.
+func openPeer(base connConfig, p peerInputs, dataType string) (*sql.DB, error) {
+	if !p.set() {
+		return nil, fmt.Errorf("host2, dbname2 or connection_uri2 is required for %s", dataType)
+	}
+	cfg, err := peerConfig(base, p)
+	if err != nil {
+		return nil, err
+	}
+	db, _, err := connect(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("second connection: %w", err)
+	}
+	return db, nil
+}
+
+// resolveHost returns the addresses to try for host, filtered by
+// IPFamily. It returns [""] (let the driver dial the name) for IP
+// literals, Unix socket directories and SSH tunnels, where the jump host
+// resolves.
+func resolveHost(cfg connConfig, host string) ([]string, error) {
+	if cfg.Tunnel != nil || strings.HasPrefix(host, "/") || net.ParseIP(host) != nil {
+		return []string{""}, nil
+	}
+	timeout := cfg.ConnectTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, a := range addrs {
+		v4 := a.IP.To4() != nil
+		if (cfg.IPFamily == "ipv4" && !v4) || (cfg.IPFamily == "ipv6" && v4) {
+			continue
+		}
+		ips = append(ips, a.IP.String())
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("host %s has no %s address", host, cfg.IPFamily)
+	}
+	return ips, nil
+}
+
+// connectHost connects to host:port, dialling ip instead of resolving the
+// name when ip is set; the name is still what TLS verifies.
+func connectHost(cfg connConfig, host string, port int, ip string) (*sql.DB, error) {
+	password, sslmode := cfg.Password, cfg.SSLMode
+	if cfg.AuthMethod == "aws_iam" {
+		token, err := rdsAuthToken(host, port, cfg.AWSRegion, cfg.Username)
+		if err != nil {
+			return nil, err
+		}
+		password, sslmode = token, atLeastRequire(sslmode)
+	}
+	if cfg.AuthMethod == "gssapi" {
+		registerGSS(cfg.Username)
+	}
+
+	driver := cfg.Driver
+	if driver == "" {
+		driver = "postgres"
+	}
+	connStr := buildConnStr(host, port, cfg.Username, password, cfg.DBName, sslmode)
+	if cfg.KrbSrvName != "" {
+		connStr += " krbsrvname=" + dsnValue(cfg.KrbSrvName)
+	}
+	if cfg.ClientEncoding != "" {
+		connStr += " client_encoding=" + dsnValue(cfg.ClientEncoding)
+	}
+	if cfg.ConnectTimeout > 0 {
+		connStr += fmt.Sprintf(" connect_timeout=%d", int(cfg.ConnectTimeout.Seconds()))
+	}
+	var dial dialFunc
+	switch {
+	case cfg.Tunnel != nil:
+		dial = cfg.Tunnel.DialContext
+	case ip != "" || cfg.KeepAlive != nil:
+		var d net.Dialer
+		if ka := cfg.KeepAlive; ka != nil {
+			d.KeepAliveConfig = *ka
+			if !ka.Enable {
+				d.KeepAlive = -1
+			}
+		}
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if ip != "" {
+				addr = net.JoinHostPort(ip, strconv.Itoa(port))
+			}
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+	db, err := openDB(driver, connStr, dial)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping db: %w", err)
+	}
+
+	if cfg.TargetSessionAttrs == "" || cfg.TargetSessionAttrs == "any" {
+		return db, nil
+	}
+	var inRecovery bool
+	if err := db.QueryRow("SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to check recovery state: %v", err)
+	}
+	if cfg.TargetSessionAttrs == "read-write" && inRecovery {
+		db.Close()
+		return nil, fmt.Errorf("server is a standby, target_session_attrs is read-write")
+	}
+	if cfg.TargetSessionAttrs == "read-only" && !inRecovery {
+		db.Close()
+		return nil, fmt.Errorf("server is a primary, target_session_attrs is read-only")
+	}
+	return db, nil
+}
+
+// connectRouted implements "route": "auto": read-only requests go to the
+// first reachable host in readHosts, everything else goes to cfg.Hosts, which
+// is also the fallback when no read host can be reached. Network failures
+// are retried ConnectRetries times with exponential backoff, each attempt a
+// full sweep over the hosts.
+func connectRouted(cfg connConfig, readHosts []string, readOnly bool) (*sql.DB, connTarget, error) {
+	// One set of Vault credentials serves every host tried
+	if cfg.AuthMethod == "vault" {
+		var err error
+		if cfg.Username, cfg.Password, err = vaultCredentials(cfg.Vault); err != nil {
+			return nil, connTarget{}, err
+		}
+	}
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		db, target, err := connectSweep(cfg, readHosts, readOnly)
+		target.Attempts = attempt
+		if err == nil || attempt > cfg.ConnectRetries || !retryableConnectError(err) {
+			return db, target, err
+		}
+		logger.Warn("connection sweep failed, retrying", "attempt", attempt, "backoff_ms", backoff.Milliseconds(), "error", err.Error())
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+func connectSweep(cfg connConfig, readHosts []string, readOnly bool) (*sql.DB, connTarget, error) {
+	if readOnly && len(readHosts) > 0 {
+		readCfg := cfg
+		readCfg.Hosts = readHosts
+		readCfg.TargetSessionAttrs = "any"
+		if db, target, err := connect(readCfg); err == nil {
+			target.Read = true
+			return db, target, nil
+		}
+	}
+	return connect(cfg)
+}
+
+// retryableConnectError reports whether a failed sweep may succeed when
+// repeated: the server answering with an error (bad password, missing
+// database) or a component error (SSH, Vault, Kerberos) will not.
+func retryableConnectError(err error) bool {
+	var ce *componentError
+	return sqlState(err) == "" && !errors.As(err, &ce)
+}
+
+// brokenConnection reports whether err means the connection died rather
+// than the statement failing, and whether running it again on a new
+// connection is safe: always when the driver says the statement was never
+// sent (driver.ErrBadConn), otherwise only for a read-only statement,
+// since a write cut off mid-flight may have committed.
+func brokenConnection(err error, readOnly bool) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	if !readOnly || sqlState(err) != "" {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// connectionRetries counts the statements this process ran again on a new
+// connection after the first one broke; see pool_stats.
+var connectionRetries int64
+
+// pinnedStatement runs a statement outside a transaction on a connection
+// of its own instead of whichever the pool hands out, so a broken one is
+// known and can be discarded by itself. database/sql's own retry on
+// driver.ErrBadConn does not apply to a pinned connection; run retries
+// once, and only when brokenConnection says it is safe.
+type pinnedStatement struct {
+	db   *sql.DB
+	conn *sql.Conn // the connection the statement ran on, held until close
+}
+
+func (p *pinnedStatement) run(stmt string, isSelect, readOnly bool) (rows *sql.Rows, res sql.Result, err error) {
+	ctx := context.Background()
+	for attempt := 0; ; attempt++ {
+		conn, err := p.db.Conn(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isSelect {
+			rows, err = conn.QueryContext(ctx, stmt)
+		} else {
+			res, err = conn.ExecContext(ctx, stmt)
+		}
+		if err == nil || attempt > 0 || !brokenConnection(err, readOnly) {
+			p.conn = conn
+			return rows, res, err
+		}
+		logger.Warn("connection broken, retrying on a new connection", "error", err.Error())
+		// ErrBadConn from Raw makes database/sql close this connection
+		// rather than return it to the pool
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		conn.Close()
+		connectionRetries++
+	}
+}
+
+// close returns the connection to the pool; rows read from it must be
+// closed first.
+func (p *pinnedStatement) close() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+// poolStats answers the pool_stats input: database/sql's counters for the
+// request's pool, the retries above and the statement cache counters.
+func poolStats(db *sql.DB) map[string]interface{} {
+	s := db.Stats()
+	return map[string]interface{}{
+		"max_open_connections": s.MaxOpenConnections,
+		"open_connections":     s.OpenConnections,
+		"in_use":               s.InUse,
+		"idle":                 s.Idle,
+		"wait_count":           s.WaitCount,
+		"wait_ms":              s.WaitDuration.Milliseconds(),
+		"max_idle_closed":      s.MaxIdleClosed,
+		"max_idle_time_closed": s.MaxIdleTimeClosed,
+		"max_lifetime_closed":  s.MaxLifetimeClosed,
+		"connection_retries":   connectionRetries,
+		"statement_cache": map[string]interface{}{
+			"hits":          stmtCacheTotals.hits,
+			"misses":        stmtCacheTotals.misses,
+			"invalidations": stmtCacheTotals.invalidations,
+		},
+	}
+}
+
+// dialFunc opens the network connection for a database connection.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// pqDialer adapts a dialFunc to lib/pq's Dialer.
+type pqDialer dialFunc
+
+func (d pqDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d pqDialer) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d(ctx, network, addr)
+}
+
+func (d pqDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// openDB is sql.Open, except that with dial set the driver connects
+// through it. The driver then does no name resolution of its own.
+func openDB(driver, connStr string, dial dialFunc) (*sql.DB, error) {
+	if dial == nil {
+		return sql.Open(driver, connStr)
+	}
+	if driver == "pgx" {
+		cc, err := pgx.ParseConfig(connStr)
+		if err != nil {
+			return nil, err
+		}
+		cc.DialFunc = pgconn.DialFunc(dial)
+		cc.LookupFunc = func(_ context.Context, host string) ([]string, error) { return []string{host}, nil }
+		return stdlib.OpenDB(*cc), nil
+	}
+	c, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+	c.Dialer(pqDialer(dial))
+	return sql.OpenDB(c), nil
+}
+
+// readOnlyRequest reports whether a request can be served by a standby.
+func readOnlyRequest(dataType, query string) bool {
+	switch dataType {
+	case "table", "estimate_count", "exists", "list_views", "list_enum", "list_constraints", "describe", "index_report",
+		"schema_diff", "verify_copy", "duplicates",
+		"orphans", "check_encoding":
+		return true
+	case "query":
+		return classifyStatement(query).ReadOnly
+	}
+	return false
+}
+
+// serverVersion returns server_version_num, e.g. 150004 for 15.4.
+func serverVersion(db querier) (int, error) {
+	var v int
+	err := db.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&v)
+	return v, err
+}
+
+// splitHostPort splits "host:port" (or "[v6]:port"), using def when the
+// entry carries no port of its own.
+func splitHostPort(entry string, def int) (string, int) {
+	host, p, err := net.SplitHostPort(entry)
+	if err != nil {
+		return strings.Trim(entry, "[]"), def
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return entry, def
+	}
+	return host, port
+}
+
+func buildConnStr(host string, port int, username, password, dbname, sslmode string) string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		dsnValue(host), port, dsnValue(username), dsnValue(password), dsnValue(dbname), dsnValue(sslmode))
+}
+
+// dsnValue quotes a keyword/value connection string value so passwords and
+// tokens containing spaces or quotes survive intact.
+func dsnValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " '\\") {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
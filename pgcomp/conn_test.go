@@ -0,0 +1,139 @@
+package pgcomp
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// flakyDriver hands out connections whose first statement fails with the
+// next of its errors; a connection that failed once keeps failing, as a
+// connection cut by the network does.
+type flakyDriver struct {
+	mu     sync.Mutex
+	errs   []error
+	opened int
+	closed int
+	ran    int // statements that reached a working connection
+}
+
+type flakyConn struct {
+	d   *flakyDriver
+	err error
+}
+
+func (d *flakyDriver) Open(string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := &flakyConn{d: d}
+	if len(d.errs) > 0 {
+		c.err, d.errs = d.errs[0], d.errs[1:]
+	}
+	d.opened++
+	return c, nil
+}
+
+func (c *flakyConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *flakyConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (c *flakyConn) Close() error {
+	c.d.mu.Lock()
+	c.d.closed++
+	c.d.mu.Unlock()
+	return nil
+}
+
+func (c *flakyConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.d.mu.Lock()
+	c.d.ran++
+	c.d.mu.Unlock()
+	return &emptyRows{}, nil
+}
+
+func (c *flakyConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.d.mu.Lock()
+	c.d.ran++
+	c.d.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string         { return []string{"n"} }
+func (emptyRows) Close() error              { return nil }
+func (emptyRows) Next([]driver.Value) error { return io.EOF }
+
+type flakyConnector struct{ d *flakyDriver }
+
+func (c flakyConnector) Connect(context.Context) (driver.Conn, error) { return c.d.Open("") }
+func (c flakyConnector) Driver() driver.Driver                        { return c.d }
+
+func TestPinnedStatementRetry(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		isSelect bool
+		readOnly bool
+		retried  bool
+	}{
+		{"never sent, write", driver.ErrBadConn, false, false, true},
+		{"reset, read", syscall.ECONNRESET, true, true, true},
+		{"eof, read", io.EOF, true, true, true},
+		{"eof, write", io.EOF, false, false, false},
+		{"eof, writing select", io.EOF, true, false, false},
+		{"server error, read", &pq.Error{Code: "57014", Message: "canceling statement"}, true, true, false},
+	}
+	for _, c := range cases {
+		d := &flakyDriver{errs: []error{c.err}}
+		db := sql.OpenDB(flakyConnector{d})
+		before := connectionRetries
+		p := &pinnedStatement{db: db}
+		rows, _, err := p.run("SELECT 1", c.isSelect, c.readOnly)
+		if rows != nil {
+			rows.Close()
+		}
+		p.close()
+
+		retries := connectionRetries - before
+		switch {
+		case c.retried && (err != nil || retries != 1 || d.ran != 1):
+			t.Errorf("%s: err %v, %d retries, %d run; want one retry that runs", c.name, err, retries, d.ran)
+		case !c.retried && (err == nil || retries != 0 || d.ran != 0):
+			t.Errorf("%s: err %v, %d retries, %d run; want the error without a retry", c.name, err, retries, d.ran)
+		}
+		if c.retried && d.closed != 1 {
+			t.Errorf("%s: %d connections closed, want the broken one", c.name, d.closed)
+		}
+		if got := poolStats(db)["connection_retries"]; got != connectionRetries {
+			t.Errorf("%s: pool_stats connection_retries %v, want %d", c.name, got, connectionRetries)
+		}
+		db.Close()
+	}
+}
+
+// A second broken connection is reported, not retried again.
+func TestPinnedStatementRetriesOnce(t *testing.T) {
+	d := &flakyDriver{errs: []error{driver.ErrBadConn, driver.ErrBadConn}}
+	db := sql.OpenDB(flakyConnector{d})
+	defer db.Close()
+	p := &pinnedStatement{db: db}
+	defer p.close()
+	if _, _, err := p.run("UPDATE t SET n = 1", false, false); !errors.Is(err, driver.ErrBadConn) {
+		t.Errorf("err %v, want driver.ErrBadConn", err)
+	}
+	if d.opened != 2 {
+		t.Errorf("%d connections opened, want 2", d.opened)
+	}
+}
@@ -0,0 +1,68 @@
+package pgcomp
+
+import "database/sql"
+
+// connectionInfo describes the session the component is actually using:
+// everything is read in one statement so it all comes from the same
+// backend. clientOpts are the connection options set by inputs, reported
+// under client_options when there are any.
+func connectionInfo(db querier, clientOpts map[string]interface{}) (interface{}, error) {
+	var pid int64
+	var ssl sql.NullBool
+	var sslVersion, sslCipher sql.NullString
+	var sslBits sql.NullInt64
+	var serverAddr sql.NullString
+	var version, encoding, clientEncoding, searchPath, effectivePath, currentUser, sessionUser, database string
+	var statementTimeout, lockTimeout, idleTimeout, timeZone, appName, collate, ctype string
+	err := db.QueryRow(`SELECT pg_backend_pid(), s.ssl, s.version, s.cipher, s.bits,
+			inet_server_addr()::text, current_setting('server_version'), current_setting('server_encoding'),
+			current_setting('client_encoding'), current_setting('search_path'), array_to_string(current_schemas(true), ','),
+			current_user::text, session_user::text, current_database()::text,
+			current_setting('statement_timeout'), current_setting('lock_timeout'),
+			current_setting('idle_in_transaction_session_timeout'), current_setting('TimeZone'),
+			current_setting('application_name'), d.datcollate::text, d.datctype::text
+		FROM (SELECT 1) AS one
+		JOIN pg_database d ON d.datname = current_database()
+		LEFT JOIN pg_stat_ssl s ON s.pid = pg_backend_pid()`).Scan(
+		&pid, &ssl, &sslVersion, &sslCipher, &sslBits,
+		&serverAddr, &version, &encoding,
+		&clientEncoding, &searchPath, &effectivePath,
+		&currentUser, &sessionUser, &database,
+		&statementTimeout, &lockTimeout,
+		&idleTimeout, &timeZone,
+		&appName, &collate, &ctype)
+	if err != nil {
+		return nil, err
+	}
+
+	sslInfo := map[string]interface{}{"in_use": ssl.Valid && ssl.Bool, "protocol": nullString(sslVersion), "cipher": nullString(sslCipher), "bits": nil}
+	if sslBits.Valid {
+		sslInfo["bits"] = sslBits.Int64
+	}
+	info := map[string]interface{}{
+		"backend_pid":           pid,
+		"ssl":                   sslInfo,
+		"server_address":        nullString(serverAddr),
+		"server_version":        version,
+		"server_encoding":       encoding,
+		"client_encoding":       clientEncoding,
+		"lc_collate":            collate,
+		"lc_ctype":              ctype,
+		"database":              database,
+		"current_role":          currentUser,
+		"session_user":          sessionUser,
+		"search_path":           searchPath,
+		"effective_search_path": effectivePath,
+		"settings": map[string]interface{}{
+			"statement_timeout":                   statementTimeout,
+			"lock_timeout":                        lockTimeout,
+			"idle_in_transaction_session_timeout": idleTimeout,
+			"TimeZone":                            timeZone,
+			"application_name":                    appName,
+		},
+	}
+	if len(clientOpts) > 0 {
+		info["client_options"] = clientOpts
+	}
+	return info, nil
+}
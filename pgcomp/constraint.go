@@ -0,0 +1,214 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// violationCodes are the constraint violations explained to the caller,
+// by SQLSTATE.
+var violationCodes = map[string]string{
+	"23505": "unique_violation",
+	"23503": "foreign_key_violation",
+	"23502": "not_null_violation",
+	"23514": "check_violation",
+	"23P01": "exclusion_violation",
+}
+
+// violationKey parses the DETAIL of unique, foreign key and exclusion
+// violations: Key (a, b)=(1, x) already exists.
+var violationKey = regexp.MustCompile(`^Key \((.+?)\)=\((.*)\) (already exists|is not present in table "(.+)"|is still referenced from table "(.+)"|conflicts with existing key .*)\.$`)
+
+// constraintMeta is what the catalog says about a constraint.
+type constraintMeta struct {
+	Table      string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+	Definition string
+}
+
+// constraintCache keeps the constraints looked up so far, by schema,
+// table and name, so repeated violations query the catalog once.
+var constraintCache = map[string]*constraintMeta{}
+
+// lookupConstraint finds the constraint name of schema.table (either may
+// be empty when the server did not report it) in pg_constraint, or the
+// unique index of that name a unique violation can also name. It returns
+// nil when there is neither.
+func lookupConstraint(db querier, schema, table, name string) (*constraintMeta, error) {
+	key := schema + "\x00" + table + "\x00" + name
+	if m, ok := constraintCache[key]; ok {
+		return m, nil
+	}
+	var m constraintMeta
+	var cols, refCols, def string
+	err := db.QueryRow(`SELECT c.conrelid::regclass::text,
+			array_to_json(ARRAY(SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum ORDER BY k.ord))::text,
+			CASE WHEN c.confrelid <> 0 THEN c.confrelid::regclass::text ELSE '' END,
+			array_to_json(ARRAY(SELECT a.attname FROM unnest(c.confkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum ORDER BY k.ord))::text,
+			pg_get_constraintdef(c.oid)
+		FROM pg_constraint c
+		JOIN pg_class r ON r.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = r.relnamespace
+		WHERE c.conname = $1 AND ($2 = '' OR n.nspname = $2) AND ($3 = '' OR r.relname = $3)
+		LIMIT 1`, name, schema, table).Scan(&m.Table, &cols, &m.RefTable, &refCols, &def)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`SELECT i.indrelid::regclass::text,
+				array_to_json(ARRAY(SELECT a.attname FROM unnest(i.indkey) WITH ORDINALITY AS k(attnum, ord)
+					JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum ORDER BY k.ord))::text,
+				'', '[]', pg_get_indexdef(i.indexrelid)
+			FROM pg_index i
+			JOIN pg_class x ON x.oid = i.indexrelid
+			JOIN pg_namespace n ON n.oid = x.relnamespace
+			WHERE x.relname = $1 AND i.indisunique AND ($2 = '' OR n.nspname = $2)
+			LIMIT 1`, name, schema).Scan(&m.Table, &cols, &m.RefTable, &refCols, &def)
+	}
+	if err == sql.ErrNoRows {
+		constraintCache[key] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(cols), &m.Columns)
+	json.Unmarshal([]byte(refCols), &m.RefColumns)
+	m.Definition = def
+	constraintCache[key] = &m
+	return &m, nil
+}
+
+// explainViolation describes a constraint violation for people: the
+// constraint, its table and columns, the offending values from the
+// server's DETAIL and a message that does not need SQL to be read. v is
+// nil when err is not a constraint violation. A failed catalog
+// lookup only leaves out what the driver did not report.
+func explainViolation(db querier, err error) (msg string, v map[string]interface{}) {
+	se := asServerError(err)
+	if se == nil || violationCodes[se.Code] == "" {
+		return "", nil
+	}
+	code := violationCodes[se.Code]
+	v = map[string]interface{}{
+		"code":           code,
+		"sqlstate":       se.Code,
+		"constraint":     nullIfEmpty(se.Constraint),
+		"server_message": se.Message,
+	}
+	table := se.Table
+	if se.Schema != "" && table != "" {
+		table = se.Schema + "." + table
+	}
+	var columns []string
+	if se.Column != "" {
+		columns = []string{se.Column}
+	}
+	if se.Constraint != "" {
+		m, lerr := lookupConstraint(db, se.Schema, se.Table, se.Constraint)
+		if lerr != nil {
+			logger.Warn("constraint lookup failed", "constraint", se.Constraint, "error", lerr.Error())
+		}
+		if m != nil {
+			table = m.Table
+			if columns == nil {
+				columns = m.Columns
+			}
+			if m.RefTable != "" {
+				v["referenced_table"] = m.RefTable
+				v["referenced_columns"] = m.RefColumns
+			}
+			if code == "check_violation" || code == "exclusion_violation" {
+				v["definition"] = m.Definition
+			}
+		}
+	}
+	v["table"] = nullIfEmpty(table)
+
+	// The offending values, when the server reports them (it leaves them
+	// out for a role that may not read the columns)
+	var pairs []string
+	if k := violationKey.FindStringSubmatch(se.Detail); k != nil {
+		keyCols := strings.Split(k[1], ", ")
+		keyVals := strings.Split(k[2], ", ")
+		if columns == nil {
+			columns = keyCols
+		}
+		if len(keyCols) == len(keyVals) {
+			values := orderedRow{keys: keyCols, values: map[string]interface{}{}}
+			for i, c := range keyCols {
+				values.values[c] = keyVals[i]
+				pairs = append(pairs, c+" = "+keyVals[i])
+			}
+			v["values"] = values
+		} else {
+			// a value holding ", " makes the split unreliable
+			v["values"] = k[2]
+			pairs = []string{k[1] + " = " + k[2]}
+		}
+		if _, ok := v["referenced_table"]; !ok && k[4] != "" {
+			v["referenced_table"] = k[4]
+		}
+		if k[5] != "" {
+			v["referencing_table"] = k[5]
+		}
+	} else if row := strings.TrimPrefix(se.Detail, "Failing row contains "); row != se.Detail {
+		v["failing_row"] = strings.TrimSuffix(row, ".")
+	}
+
+	v["columns"] = columns
+
+	what := strings.Join(pairs, ", ")
+	if what == "" {
+		what = "the same " + strings.Join(columns, ", ")
+	}
+	switch code {
+	case "unique_violation":
+		msg = fmt.Sprintf("a row with %s already exists in %s", what, table)
+	case "foreign_key_violation":
+		if ref, ok := v["referencing_table"]; ok {
+			msg = fmt.Sprintf("the row of %s with %s is still referenced from %s", table, what, ref)
+		} else {
+			ref := v["referenced_table"]
+			if ref == nil {
+				ref = "the referenced table"
+			}
+			msg = fmt.Sprintf("%s refers to a row of %s that does not exist", what, ref)
+		}
+	case "not_null_violation":
+		msg = fmt.Sprintf("%s of %s must have a value", strings.Join(columns, ", "), table)
+	case "check_violation":
+		msg = fmt.Sprintf("the row does not satisfy the check %s on %s", se.Constraint, table)
+	case "exclusion_violation":
+		msg = fmt.Sprintf("the row with %s conflicts with an existing row of %s", what, table)
+	}
+	v["message"] = msg
+	return msg, v
+}
+
+// explainConstraint turns a constraint violation in err into a
+// componentError coded after the violation, with its explanation as the
+// details; the server error stays reachable as the cause. An error that
+// already carries a code keeps it and gets the explanation under
+// "violation". db should not be an aborted transaction.
+func explainConstraint(db querier, err error) error {
+	msg, v := explainViolation(db, err)
+	if v == nil {
+		return err
+	}
+	var ce *componentError
+	if errors.As(err, &ce) {
+		out := &componentError{Code: ce.Code, Message: err.Error(), Details: map[string]interface{}{}, cause: err}
+		for k, val := range ce.Details {
+			out.Details[k] = val
+		}
+		out.Details["violation"] = v
+		return out
+	}
+	return &componentError{Code: v["code"].(string), Message: msg, Details: v, cause: err}
+}
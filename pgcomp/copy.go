@@ -0,0 +1,250 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// copyOptions are the inputs of the copy_between data_type.
+type copyOptions struct {
+	Truncate bool
+	// Mapping renames source columns to target columns; when set, only
+	// the mapped columns are copied.
+	Mapping          map[string]string
+	OverrideIdentity bool
+	Progress         *progress
+	// Checkpoint, on the second connection, commits the copy in batches
+	// instead of one transaction (commit_every).
+	Checkpoint *checkpointer
+}
+
+func parseColumnMapping(val string) (map[string]string, error) {
+	var m map[string]string
+	if err := json.Unmarshal([]byte(val), &m); err != nil {
+		return nil, fmt.Errorf("column_mapping must be a JSON object of source column to target column: %v", err)
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("column_mapping is empty")
+	}
+	return m, nil
+}
+
+// copyBetween answers the copy_between data_type: it streams the rows of
+// query on src into table on dst in multi-row INSERTs, all in one
+// transaction on dst that is only committed when the number of rows read
+// matches the rows inserted (and, after a truncate, the rows in table).
+// With a checkpoint the rows are committed in batches instead and the
+// last batch is only committed once the counts match.
+func copyBetween(src querier, dst *sql.DB, query string, args []interface{}, table string, opts copyOptions) (interface{}, error) {
+	if !classifyStatement(query).ReadOnly {
+		return nil, fmt.Errorf("the copy_between query must be read-only")
+	}
+	var tx querier
+	var commit func() error
+	cp := opts.Checkpoint
+	if cp != nil {
+		// Resuming skips rows by position, which needs a stable order
+		if !hasOrderBy(query) {
+			return nil, fmt.Errorf("commit_every needs a copy_between query with an ORDER BY that fixes the row order")
+		}
+		if err := cp.begin(hashInput(table, query, args, opts.Mapping)); err != nil {
+			return nil, err
+		}
+		tx = cp
+	} else {
+		t, err := dst.Begin()
+		if err != nil {
+			return nil, fmt.Errorf("second connection: %w", err)
+		}
+		defer t.Rollback()
+		tx, commit = t, t.Commit
+	}
+
+	rel, err := resolveRelation(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rel.columns(tx)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(cols))
+	for i, c := range cols {
+		known[i] = c.Name
+	}
+
+	logSQL(query, args)
+	rows, err := src.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	srcCols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	types := columnTypeNames(rows)
+
+	// Pair every copied source column with its target column
+	var srcIndex []int
+	var targets []string
+	for i, c := range srcCols {
+		target := c
+		if opts.Mapping != nil {
+			var ok bool
+			if target, ok = opts.Mapping[c]; !ok {
+				continue
+			}
+		}
+		if !containsString(known, target) {
+			return nil, fmt.Errorf("column %q does not exist in %s", target, rel.Name)
+		}
+		srcIndex = append(srcIndex, i)
+		targets = append(targets, target)
+	}
+	for c := range opts.Mapping {
+		if !containsString(srcCols, c) {
+			return nil, fmt.Errorf("column_mapping: %q is not a column of the query", c)
+		}
+	}
+	keep, stripped, overriding := splitReadOnly(targets, cols, opts.OverrideIdentity)
+	if len(keep) == 0 {
+		return nil, fmt.Errorf("no column of the query can be written to %s", rel.Name)
+	}
+	var copied []int
+	quoted := make([]string, 0, len(keep))
+	for i, t := range targets {
+		if containsString(keep, t) {
+			copied = append(copied, srcIndex[i])
+			quoted = append(quoted, pq.QuoteIdentifier(t))
+		}
+	}
+
+	// A resumed copy keeps the batches it already committed
+	if opts.Truncate && (cp == nil || !cp.resumed) {
+		stmt := "TRUNCATE " + rel.Name
+		logSQL(stmt, nil)
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) ", rel.Name, strings.Join(quoted, ", "))
+	if overriding {
+		prefix += "OVERRIDING SYSTEM VALUE "
+	}
+	prefix += "VALUES "
+	perBatch := importBatchRows
+	if maxRows := maxBindParams / len(copied); perBatch > maxRows {
+		perBatch = maxRows
+	}
+	perBatch = cp.batchRows(perBatch)
+
+	var read, inserted int64
+	var batchArgs []interface{}
+	var values []string
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		logSQL(prefix+"...", nil)
+		res, err := tx.Exec(prefix+strings.Join(values, ", "), batchArgs...)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		inserted += n
+		batchArgs, values = batchArgs[:0], values[:0]
+		return cp.flushed(read, n)
+	}
+
+	raw := make([]interface{}, len(srcCols))
+	dest := make([]interface{}, len(srcCols))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		read++
+		if cp.skip(read) {
+			continue
+		}
+		ph := make([]string, len(copied))
+		var size int64
+		for j, i := range copied {
+			v := copyValue(raw[i], types[i])
+			switch t := v.(type) {
+			case string:
+				size += int64(len(t))
+			case []byte:
+				size += int64(len(t))
+			}
+			batchArgs = append(batchArgs, v)
+			ph[j] = "$" + strconv.Itoa(len(batchArgs))
+		}
+		values = append(values, "("+strings.Join(ph, ", ")+")")
+		if len(values) >= perBatch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		opts.Progress.add(1, size)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{"table": rel.Name, "source_rows": read, "copied": inserted, "truncated": opts.Truncate}
+	var skipped int64
+	if cp != nil {
+		skipped = cp.skipped
+	}
+	verified := read-skipped == inserted
+	if opts.Truncate {
+		var n int64
+		if err := tx.QueryRow("SELECT count(*) FROM " + rel.Name).Scan(&n); err != nil {
+			return nil, err
+		}
+		res["target_rows"] = n
+		verified = verified && n == read
+	}
+	if !verified {
+		lost := "nothing was committed"
+		if cp != nil {
+			lost = "the last batch was not committed"
+		}
+		ce := newError("verification_failed", "copied %d of %d source rows into %s; %s", inserted, read-skipped, rel.Name, lost)
+		ce.Details = res
+		return nil, ce
+	}
+	if cp != nil {
+		if err := cp.finish(res); err != nil {
+			return nil, fmt.Errorf("second connection: %w", err)
+		}
+	} else if err := commit(); err != nil {
+		return nil, fmt.Errorf("second connection: commit failed: %w", err)
+	}
+	res["verified"] = true
+	opts.Progress.finish(res)
+	return writeResult(res, stripped), nil
+}
+
+// copyValue turns a scanned source value into an argument for the target.
+// lib/pq returns most types as their text form in a []byte, which it
+// would send back as bytea, so only bytea values stay binary.
+func copyValue(v interface{}, dbType string) interface{} {
+	if b, ok := v.([]byte); ok && dbType != "BYTEA" {
+		return string(b)
+	}
+	return v
+}
@@ -0,0 +1,137 @@
+package pgcomp
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cryptoKeyEnv holds the key for crypto_key_source env.
+const cryptoKeyEnv = "PGCRYPTO_KEY"
+
+// secretArg is a bind argument that is sent to the server as is but
+// prints masked, so a key never reaches the debug log of its statement.
+type secretArg string
+
+func (s secretArg) Value() (driver.Value, error) { return string(s), nil }
+
+func (s secretArg) String() string { return "********" }
+
+func (s secretArg) MarshalJSON() ([]byte, error) { return []byte(`"********"`), nil }
+
+// columnCrypto is the encrypt_columns / decrypt_columns configuration:
+// the bytea columns stored with pgp_sym_encrypt and the key. The key only
+// ever travels as a bind argument, never in SQL text, so echo_sql, audit
+// fingerprints and errors cannot show it. The methods are nil-safe.
+type columnCrypto struct {
+	Columns []string
+	key     secretArg
+}
+
+// cryptoKey reads the key from the crypto_key input (source "" or input),
+// the PGCRYPTO_KEY environment variable (env) or crypto_key_file (file).
+func cryptoKey(source, input, file string) (secretArg, error) {
+	var key string
+	switch source {
+	case "", "input":
+		key = input
+		if key == "" {
+			return "", newError("crypto_config", "crypto_key is required with encrypt_columns or decrypt_columns")
+		}
+	case "env":
+		key = os.Getenv(cryptoKeyEnv)
+		if key == "" {
+			return "", newError("crypto_config", "%s is not set", cryptoKeyEnv)
+		}
+	case "file":
+		if file == "" {
+			return "", newError("crypto_config", "crypto_key_file is required with crypto_key_source file")
+		}
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return "", newError("crypto_config", "failed to read crypto_key_file: %v", err)
+		}
+		if key = strings.TrimSpace(string(raw)); key == "" {
+			return "", newError("crypto_config", "crypto_key_file is empty")
+		}
+	default:
+		return "", newError("crypto_config", "crypto_key_source must be one of: input, env, file")
+	}
+	return secretArg(key), nil
+}
+
+func (c *columnCrypto) covers(col string) bool {
+	return c != nil && containsString(c.Columns, col)
+}
+
+// check makes sure pgcrypto is usable and every column is a bytea column
+// of relCols, the only type pgp_sym_encrypt returns.
+func (c *columnCrypto) check(db querier, input string, relName string, relCols []columnInfo) error {
+	if c == nil {
+		return nil
+	}
+	if err := checkPgcrypto(db); err != nil {
+		return err
+	}
+	for _, name := range c.Columns {
+		found := false
+		for _, rc := range relCols {
+			if rc.Name != name {
+				continue
+			}
+			found = true
+			if rc.TypName != "bytea" {
+				return fmt.Errorf("%s column %q is %s; pgp_sym_encrypt values are stored as bytea", input, name, rc.TypeSQL)
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s column %q does not exist in %s", input, name, relName)
+		}
+	}
+	return nil
+}
+
+// encrypt is the SQL writing the text bound at placeholder encrypted with
+// the key bound at keyPlaceholder.
+func (c *columnCrypto) encrypt(placeholder, keyPlaceholder string) string {
+	return "pgp_sym_encrypt(" + placeholder + "::text, " + keyPlaceholder + ")"
+}
+
+// decrypt is the select-list entry reading the quoted column back as
+// text under its own name.
+func (c *columnCrypto) decrypt(quoted, keyPlaceholder string) string {
+	return "pgp_sym_decrypt(" + quoted + ", " + keyPlaceholder + ") AS " + quoted
+}
+
+// checkPgcrypto reports a clear error up front instead of the "function
+// pgp_sym_encrypt does not exist" the server would raise. It looks the
+// function up the way the statement will, through the search_path.
+func checkPgcrypto(db querier) error {
+	var found bool
+	if err := db.QueryRow("SELECT to_regprocedure('pgp_sym_encrypt(text, text)') IS NOT NULL").Scan(&found); err != nil {
+		return err
+	}
+	if !found {
+		return newError("extension_missing", "encrypt_columns and decrypt_columns require the pgcrypto extension on the search_path; install it with CREATE EXTENSION pgcrypto (data_type extensions, operation create)")
+	}
+	return nil
+}
+
+// bindValue appends v to args and returns its placeholder for column col:
+// cast to typ, or encrypted when c covers col. The key is appended to args
+// the first time a statement needs it and its position kept in keyPos,
+// which starts at 0 for every statement.
+func (c *columnCrypto) bindValue(args *[]interface{}, keyPos *int, col, typ string, v interface{}) string {
+	*args = append(*args, mergeValue(v))
+	ph := "$" + strconv.Itoa(len(*args))
+	if !c.covers(col) {
+		return ph + "::" + typ
+	}
+	if *keyPos == 0 {
+		*args = append(*args, c.key)
+		*keyPos = len(*args)
+	}
+	return c.encrypt(ph, "$"+strconv.Itoa(*keyPos))
+}
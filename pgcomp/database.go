@@ -0,0 +1,86 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// databaseOptions carries the inputs of the database data_type.
+type databaseOptions struct {
+	Name      string
+	Owner     string
+	Encoding  string
+	Template  string
+	LcCollate string
+	Force     bool
+}
+
+// manageDatabase creates or drops a database. db must be connected to a
+// maintenance database, since neither statement can target the current one
+// and neither can run inside a transaction block.
+func manageDatabase(db *sql.DB, operation string, opts databaseOptions) (interface{}, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("name is required for database %s", operation)
+	}
+
+	switch operation {
+	case "create":
+		stmt := "CREATE DATABASE " + pq.QuoteIdentifier(opts.Name)
+		if opts.Owner != "" {
+			stmt += " OWNER " + pq.QuoteIdentifier(opts.Owner)
+		}
+		if opts.Template != "" {
+			stmt += " TEMPLATE " + pq.QuoteIdentifier(opts.Template)
+		}
+		if opts.Encoding != "" {
+			stmt += " ENCODING " + pq.QuoteLiteral(opts.Encoding)
+		}
+		if opts.LcCollate != "" {
+			stmt += " LC_COLLATE " + pq.QuoteLiteral(opts.LcCollate)
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, databaseError(err, opts.Name)
+		}
+		return map[string]interface{}{"database": opts.Name, "created": true}, nil
+
+	case "drop":
+		var terminated int64
+		if opts.Force {
+			err := db.QueryRow(`SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity
+				WHERE datname = $1 AND pid <> pg_backend_pid()`, opts.Name).Scan(&terminated)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, err := db.Exec("DROP DATABASE " + pq.QuoteIdentifier(opts.Name)); err != nil {
+			return nil, databaseError(err, opts.Name)
+		}
+		return map[string]interface{}{"database": opts.Name, "dropped": true, "terminated_backends": terminated}, nil
+	}
+
+	return nil, fmt.Errorf("unknown database operation %q (allowed: create, drop)", operation)
+}
+
+// databaseError maps the server errors provisioning runs into most often to
+// coded errors the pipeline can branch on.
+func databaseError(err error, name string) error {
+	se := asServerError(err)
+	if se == nil {
+		return err
+	}
+	switch se.Code {
+	case "42P04":
+		return newError("database_exists", "database %q already exists", name)
+	case "3D000":
+		return newError("database_not_found", "database %q does not exist", name)
+	case "55006":
+		ce := newError("database_in_use", "database %q is being accessed by other users; retry with force to terminate them", name)
+		if se.Detail != "" {
+			ce.Details = map[string]interface{}{"detail": se.Detail}
+		}
+		return ce
+	}
+	return err
+}
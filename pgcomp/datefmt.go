@@ -0,0 +1,210 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateTypes are the column types a date format applies to.
+var dateTypes = []string{"date", "timestamp", "timestamptz"}
+
+// dateFormat is how the values of one date or timestamp column are
+// written in the data being loaded.
+type dateFormat struct {
+	// Format is a DD/MM/YYYY HH24:MI:SS TZH:TZM style pattern, or epoch
+	// or epoch_ms for Unix time; empty accepts ISO 8601
+	Format string `json:"format"`
+	// AssumeTimezone is the zone (e.g. Europe/Amsterdam) of values that
+	// carry no offset; it decides the instant a timestamptz column stores
+	AssumeTimezone string `json:"assume_timezone"`
+	// YearPivot admits two-digit years: YY below the pivot is 20YY, the
+	// rest 19YY. Without one a YY format is refused as ambiguous.
+	YearPivot *int `json:"year_pivot"`
+
+	layouts   []string
+	twoDigits bool // the layout has a YY year
+	loc       *time.Location
+}
+
+func parseDateFormats(val string) (map[string]*dateFormat, error) {
+	var formats map[string]*dateFormat
+	if err := json.Unmarshal([]byte(val), &formats); err != nil {
+		return nil, fmt.Errorf("date_formats must be a JSON object of column: {format, assume_timezone, year_pivot}: %v", err)
+	}
+	for c, f := range formats {
+		if f == nil {
+			return nil, fmt.Errorf("date_formats: %q is null", c)
+		}
+		if err := f.prepare(); err != nil {
+			return nil, fmt.Errorf("date_formats: %q: %v", c, err)
+		}
+	}
+	return formats, nil
+}
+
+func (f *dateFormat) prepare() error {
+	if f.AssumeTimezone != "" {
+		loc, err := time.LoadLocation(f.AssumeTimezone)
+		if err != nil {
+			return fmt.Errorf("unknown assume_timezone %q", f.AssumeTimezone)
+		}
+		f.loc = loc
+	}
+	if p := f.YearPivot; p != nil && (*p < 0 || *p > 99) {
+		return fmt.Errorf("year_pivot must be between 0 and 99")
+	}
+	switch strings.ToLower(f.Format) {
+	case "":
+		f.layouts = dateLayouts
+		return nil
+	case "epoch", "epoch_ms":
+		f.Format = strings.ToLower(f.Format)
+		return nil
+	}
+	upper := strings.ToUpper(f.Format)
+	if strings.Contains(upper, "YY") && !strings.Contains(upper, "YYYY") && f.YearPivot == nil {
+		return fmt.Errorf("format %s has a two-digit year, which needs year_pivot", f.Format)
+	}
+	f.twoDigits = strings.Contains(upper, "YY") && !strings.Contains(upper, "YYYY")
+	f.layouts = []string{dateLayout(f.Format)}
+	return nil
+}
+
+// dateLayout converts a DD/MM/YYYY HH24:MI:SS TZH:TZM style format into a
+// Go time layout.
+func dateLayout(format string) string {
+	return strings.NewReplacer(
+		"TZH:TZM", "Z07:00", "TZH", "Z07",
+		"YYYY", "2006", "YY", "06", "MON", "Jan", "MM", "01", "DD", "02",
+		"HH24", "15", "HH", "15", "MI", "04", "SS", "05",
+	).Replace(format)
+}
+
+// parse turns s into the text the server reads for a column of type typ
+// (date, timestamp or timestamptz). A value without an offset is wall
+// clock time in assume_timezone (UTC without one); a wall clock time the
+// zone skips at a DST change is refused, one it repeats is read as the
+// later, post-transition one, as PostgreSQL reads it.
+func (f *dateFormat) parse(s, typ string) (string, error) {
+	switch strings.ToLower(s) {
+	case "infinity", "-infinity":
+		return strings.ToLower(s), nil
+	}
+	loc := f.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	var t time.Time
+	switch f.Format {
+	case "epoch", "epoch_ms":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("not a Unix time in %s", strings.TrimPrefix(f.Format, "epoch_"))
+		}
+		if f.Format == "epoch" {
+			t = time.Unix(n, 0)
+		} else {
+			t = time.UnixMilli(n)
+		}
+		t = t.In(loc)
+	default:
+		var err error
+		zoned := false
+		for _, layout := range f.layouts {
+			if t, err = time.Parse(layout, s); err == nil {
+				zoned = strings.Contains(layout, "Z07")
+				break
+			}
+		}
+		if err != nil {
+			// A value of the right shape with a field out of range (month
+			// 13, 31 February) says which field
+			if pe, ok := err.(*time.ParseError); ok && pe.Message != "" && len(f.layouts) == 1 {
+				return "", fmt.Errorf("%s", strings.TrimPrefix(pe.Message, ": "))
+			}
+			return "", fmt.Errorf("does not match format %s", firstNonEmpty(f.Format, "YYYY-MM-DD[ HH:MM:SS]"))
+		}
+		if f.twoDigits {
+			// time.Parse applies a pivot of its own; only the digits count
+			year := 1900 + t.Year()%100
+			if t.Year()%100 < *f.YearPivot {
+				year += 100
+			}
+			d := time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+			if d.Day() != t.Day() {
+				return "", fmt.Errorf("%d has no %s %d", year, t.Month(), t.Day())
+			}
+			t = d
+		}
+		if t.Year() < 1 {
+			return "", fmt.Errorf("year 0 does not exist")
+		}
+		switch {
+		case zoned:
+			// the instant stays; a timestamp column gets the zone's reading
+			if f.loc != nil {
+				t = t.In(f.loc)
+			}
+		case typ != "date":
+			if t, err = wallClock(t, loc); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	switch typ {
+	case "date":
+		return t.Format("2006-01-02"), nil
+	case "timestamp":
+		return t.Format("2006-01-02 15:04:05.999999"), nil
+	}
+	return t.Format("2006-01-02 15:04:05.999999-07:00"), nil
+}
+
+// wallClock is the instant the wall clock reading of t (its zone is
+// ignored) names in loc.
+func wallClock(t time.Time, loc *time.Location) (time.Time, error) {
+	const wall = "2006-01-02 15:04:05.999999999"
+	naive := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	// The offsets on either side of any transition near it; a repeated
+	// reading is valid with both
+	_, before := naive.Add(-12 * time.Hour).In(loc).Zone()
+	_, after := naive.Add(12 * time.Hour).In(loc).Zone()
+	for _, off := range []int{after, before} {
+		at := naive.Add(-time.Duration(off) * time.Second).In(loc)
+		if at.Format(wall) == naive.Format(wall) {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s does not exist in %s (skipped by a DST change)", naive.Format("2006-01-02 15:04:05"), loc)
+}
+
+// applyDateFormats rewrites, in place, the string values rows hold for
+// the date columns formats names; see numberLocale.applyRows.
+func applyDateFormats(formats map[string]*dateFormat, cols []columnInfo, rows []map[string]interface{}) []importError {
+	var bad []importError
+	for _, c := range cols {
+		f, ok := formats[c.Name]
+		if !ok || !containsString(dateTypes, c.TypName) {
+			continue
+		}
+		for r, row := range rows {
+			s, ok := row[c.Name].(string)
+			if !ok {
+				continue
+			}
+			v, err := f.parse(strings.TrimSpace(s), c.TypName)
+			if err != nil {
+				if len(bad) < maxReportedImportErrors {
+					bad = append(bad, importError{Row: r, Column: c.Name, Value: s, Reason: err.Error()})
+				}
+				continue
+			}
+			row[c.Name] = v
+		}
+	}
+	return bad
+}
@@ -0,0 +1,89 @@
+package pgcomp
+
+import (
+	"strings"
+	"testing"
+
+	_ "time/tzdata" // Europe/Amsterdam wherever the tests run
+)
+
+func TestDateFormatParse(t *testing.T) {
+	pivot := func(n int) *int { return &n }
+	cases := []struct {
+		name   string
+		format dateFormat
+		in     string
+		typ    string
+		want   string // the value, or a part of the error when err
+		err    bool
+	}{
+		// Europe/Amsterdam skips 02:00-03:00 on 2026-03-29 and repeats
+		// 02:00-03:00 on 2026-10-25
+		{"before spring gap", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "29/03/2026 01:59", "timestamptz", "2026-03-29 01:59:00+01:00", false},
+		{"in spring gap", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "29/03/2026 02:30", "timestamptz", "2026-03-29 02:30:00 does not exist in Europe/Amsterdam", true},
+		{"gap as timestamp", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "29/03/2026 02:30", "timestamp", "does not exist", true},
+		{"after spring gap", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "29/03/2026 03:00", "timestamptz", "2026-03-29 03:00:00+02:00", false},
+		{"before repeated hour", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "25/10/2026 01:30", "timestamptz", "2026-10-25 01:30:00+02:00", false},
+		{"repeated hour", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "25/10/2026 02:30", "timestamptz", "2026-10-25 02:30:00+01:00", false},
+		{"repeated hour as timestamp", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "25/10/2026 02:30", "timestamp", "2026-10-25 02:30:00", false},
+		{"after repeated hour", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "25/10/2026 03:00", "timestamptz", "2026-10-25 03:00:00+01:00", false},
+		{"offset kept", dateFormat{AssumeTimezone: "Europe/Amsterdam"}, "2026-10-25T02:30:00+02:00", "timestamptz", "2026-10-25 02:30:00+02:00", false},
+		{"offset to zone", dateFormat{AssumeTimezone: "Europe/Amsterdam"}, "2026-10-25 01:30:00Z", "timestamp", "2026-10-25 02:30:00", false},
+		{"utc without zone", dateFormat{Format: "DD/MM/YYYY HH24:MI"}, "29/03/2026 02:30", "timestamptz", "2026-03-29 02:30:00+00:00", false},
+		{"date ignores gap", dateFormat{Format: "DD/MM/YYYY HH24:MI", AssumeTimezone: "Europe/Amsterdam"}, "29/03/2026 02:30", "date", "2026-03-29", false},
+
+		// two-digit years
+		{"below pivot", dateFormat{Format: "DD.MM.YY", YearPivot: pivot(50)}, "01.02.49", "date", "2049-02-01", false},
+		{"at pivot", dateFormat{Format: "DD.MM.YY", YearPivot: pivot(50)}, "01.02.50", "date", "1950-02-01", false},
+		{"pivot 0", dateFormat{Format: "DD.MM.YY", YearPivot: pivot(0)}, "01.02.00", "date", "1900-02-01", false},
+		{"pivot 99", dateFormat{Format: "DD.MM.YY", YearPivot: pivot(99)}, "01.02.98", "date", "2098-02-01", false},
+		{"leap day in 2000", dateFormat{Format: "DD.MM.YY", YearPivot: pivot(50)}, "29.02.00", "date", "2000-02-29", false},
+		{"no leap day in 1900", dateFormat{Format: "DD.MM.YY", YearPivot: pivot(0)}, "29.02.00", "date", "1900 has no February 29", true},
+
+		// fields out of range
+		{"month 13", dateFormat{Format: "DD/MM/YYYY"}, "01/13/2026", "date", "month out of range", true},
+		{"31 February", dateFormat{Format: "DD/MM/YYYY"}, "31/02/2026", "date", "day out of range", true},
+		{"day 32", dateFormat{Format: "DD/MM/YYYY"}, "32/01/2026", "date", "day out of range", true},
+		{"hour 24", dateFormat{Format: "DD/MM/YYYY HH24:MI"}, "01/01/2026 24:00", "timestamp", "hour out of range", true},
+		{"minute 60", dateFormat{Format: "DD/MM/YYYY HH24:MI"}, "01/01/2026 10:60", "timestamp", "minute out of range", true},
+		{"wrong shape", dateFormat{Format: "DD/MM/YYYY"}, "2026-01-01", "date", "does not match format DD/MM/YYYY", true},
+		{"iso wrong shape", dateFormat{}, "01/01/2026", "date", "does not match format YYYY-MM-DD[ HH:MM:SS]", true},
+
+		// Unix time and infinities
+		{"epoch", dateFormat{Format: "epoch"}, "0", "timestamptz", "1970-01-01 00:00:00+00:00", false},
+		{"epoch_ms in zone", dateFormat{Format: "epoch_ms", AssumeTimezone: "Europe/Amsterdam"}, "1792892400123", "timestamptz", "2026-10-25 02:40:00.123+01:00", false},
+		{"epoch not a number", dateFormat{Format: "epoch"}, "1.5", "timestamptz", "not a Unix time in epoch", true},
+		{"infinity", dateFormat{Format: "DD/MM/YYYY"}, "Infinity", "timestamptz", "infinity", false},
+	}
+	for _, c := range cases {
+		f := c.format
+		if err := f.prepare(); err != nil {
+			t.Fatalf("%s: prepare: %v", c.name, err)
+		}
+		got, err := f.parse(c.in, c.typ)
+		switch {
+		case c.err && (err == nil || !strings.Contains(err.Error(), c.want)):
+			t.Errorf("%s: parse(%q) = %q, %v; want an error with %q", c.name, c.in, got, err, c.want)
+		case !c.err && (err != nil || got != c.want):
+			t.Errorf("%s: parse(%q) = %q, %v; want %q", c.name, c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestDateFormatPrepare(t *testing.T) {
+	for _, c := range []struct{ val, err string }{
+		{`{"d": {"format": "DD/MM/YY"}}`, "needs year_pivot"},
+		{`{"d": {"format": "DD/MM/YY", "year_pivot": 100}}`, "year_pivot must be between 0 and 99"},
+		{`{"d": {"format": "DD/MM/YY", "year_pivot": -1}}`, "year_pivot must be between 0 and 99"},
+		{`{"d": {"assume_timezone": "Europe/Atlantis"}}`, `unknown assume_timezone "Europe/Atlantis"`},
+		{`{"d": null}`, `"d" is null`},
+		{`["d"]`, "must be a JSON object"},
+	} {
+		if _, err := parseDateFormats(c.val); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("parseDateFormats(%s): %v, want an error with %q", c.val, err, c.err)
+		}
+	}
+	if _, err := parseDateFormats(`{"d": {"format": "DD/MM/YYYY", "year_pivot": 50}}`); err != nil {
+		t.Errorf("a pivot on a four-digit year: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxDependencyDepth bounds how far cascading foreign keys are followed.
+const maxDependencyDepth = 8
+
+// deleteOptions are the delete data_type inputs besides the rows (key
+// objects) and key_columns shared with the write modes.
+type deleteOptions struct {
+	ExplainDependencies bool // on a foreign key violation, report what references the rows
+	CheckOnly           bool // report the dependencies without deleting
+	CascadePreview      bool // also list what ON DELETE CASCADE would remove; implies check_only
+}
+
+var fkActions = map[string]string{"a": "no_action", "r": "restrict", "c": "cascade", "n": "set_null", "d": "set_default"}
+
+// dependency is one foreign key referencing a set of rows, with the rows
+// it matches. Children are only followed through cascading keys, since
+// only those rows would be deleted in turn.
+type dependency struct {
+	Table      string        `json:"table"`
+	Constraint string        `json:"constraint"`
+	Columns    []string      `json:"columns"`
+	References []string      `json:"references"`
+	OnDelete   string        `json:"on_delete"`
+	Rows       int64         `json:"rows"`
+	Blocking   bool          `json:"blocking"`
+	Children   []*dependency `json:"children,omitempty"`
+
+	oid uint32
+}
+
+// rowSet is SQL selecting a set of rows of a table, with its arguments;
+// dependency queries nest it to reach the rows that reference it.
+type rowSet struct {
+	OID  uint32
+	SQL  string
+	Args []interface{}
+}
+
+// deleteRows deletes the rows of table matching the key objects in
+// opts.Rows. It runs under a savepoint so that, on a foreign key
+// violation, the transaction is still usable to explain what blocked it.
+func deleteRows(db querier, table string, w writeOptions, opts deleteOptions) (interface{}, error) {
+	if len(w.KeyColumns) == 0 {
+		return nil, fmt.Errorf("key_columns is required for delete")
+	}
+	rel, _, types, err := writeTarget(db, table, writeOptions{Rows: w.Rows})
+	if err != nil {
+		return nil, err
+	}
+
+	var args []interface{}
+	tuples := make([]string, len(w.Rows))
+	for r, row := range w.Rows {
+		ph := make([]string, len(w.KeyColumns))
+		for i, k := range w.KeyColumns {
+			v, ok := row[k]
+			if !ok || v == nil {
+				return nil, fmt.Errorf("row %d: key column %q must be present and not null", r, k)
+			}
+			args = append(args, mergeValue(v))
+			ph[i] = "$" + strconv.Itoa(len(args)) + "::" + types[k]
+		}
+		tuples[r] = "(" + strings.Join(ph, ", ") + ")"
+	}
+	if len(args) > maxBindParams {
+		return nil, fmt.Errorf("delete of %d rows exceeds the %d parameter limit; split the rows", len(w.Rows), maxBindParams)
+	}
+	quoted := make([]string, len(w.KeyColumns))
+	for i, k := range w.KeyColumns {
+		quoted[i] = pq.QuoteIdentifier(k)
+	}
+	where := fmt.Sprintf("(%s) IN (VALUES %s)", strings.Join(quoted, ", "), strings.Join(tuples, ", "))
+	target := rowSet{OID: rel.OID, SQL: "SELECT * FROM " + rel.Name + " WHERE " + where, Args: args}
+
+	if opts.CheckOnly || opts.CascadePreview {
+		var matched int64
+		if err := db.QueryRow("SELECT count(*) FROM ("+target.SQL+") AS t", args...).Scan(&matched); err != nil {
+			return nil, err
+		}
+		deps, err := dependencies(db, target, 0, map[uint32]bool{})
+		if err != nil {
+			return nil, err
+		}
+		res := map[string]interface{}{"deleted": 0, "matched": matched, "blocked": blocked(deps), "dependencies": deps}
+		if opts.CascadePreview {
+			res["cascade"] = cascadeSummary(rel.Name, matched, deps)
+		}
+		return res, nil
+	}
+
+	stmt := "DELETE FROM " + rel.Name + " WHERE " + where
+	if err := checkSQLLength(stmt); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("SAVEPOINT delete_rows"); err != nil {
+		return nil, err
+	}
+	logSQL(stmt, args)
+	res, err := db.Exec(stmt, args...)
+	if err != nil {
+		if _, rerr := db.Exec("ROLLBACK TO SAVEPOINT delete_rows"); rerr != nil {
+			return nil, err
+		}
+		se := asServerError(err)
+		if se == nil || se.Code != "23503" || !opts.ExplainDependencies {
+			return nil, err
+		}
+		deps, derr := dependencies(db, target, 0, map[uint32]bool{})
+		if derr != nil {
+			return nil, err
+		}
+		ce := newError("foreign_key_violation", "rows of %s are still referenced (%s); nothing was deleted", rel.Name, se.Constraint)
+		ce.Details = map[string]interface{}{"constraint": se.Constraint, "dependencies": deps}
+		return nil, ce
+	}
+	if _, err := db.Exec("RELEASE SAVEPOINT delete_rows"); err != nil {
+		return nil, err
+	}
+	n, _ := res.RowsAffected()
+	return map[string]interface{}{"deleted": n}, nil
+}
+
+// dependencies walks the foreign keys referencing set's table and counts
+// the rows of set each one matches. Cascading keys are followed to the
+// rows they would delete; seen guards against cycles.
+func dependencies(db querier, set rowSet, depth int, seen map[uint32]bool) ([]*dependency, error) {
+	rows, err := db.Query(`SELECT c.oid, c.conname::text, c.conrelid::regclass::text, c.conrelid, c.confdeltype::text,
+			array_to_json(ARRAY(SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum ORDER BY k.ord))::text,
+			array_to_json(ARRAY(SELECT a.attname FROM unnest(c.confkey) WITH ORDINALITY AS k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum ORDER BY k.ord))::text
+		FROM pg_constraint c
+		WHERE c.contype = 'f' AND c.confrelid = $1
+		ORDER BY 3, 2`, set.OID)
+	if err != nil {
+		return nil, err
+	}
+	var deps []*dependency
+	var childOIDs []uint32
+	for rows.Next() {
+		var d dependency
+		var childOID uint32
+		var action, cols, refs string
+		if err := rows.Scan(&d.oid, &d.Constraint, &d.Table, &childOID, &action, &cols, &refs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(cols), &d.Columns); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(refs), &d.References); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.OnDelete = fkActions[action]
+		deps = append(deps, &d)
+		childOIDs = append(childOIDs, childOID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]*dependency, 0, len(deps))
+	for i, d := range deps {
+		if seen[d.oid] {
+			continue
+		}
+		child := referencingSet(d, childOIDs[i], set)
+		if err := db.QueryRow("SELECT count(*) FROM ("+child.SQL+") AS t", child.Args...).Scan(&d.Rows); err != nil {
+			return nil, err
+		}
+		if d.Rows == 0 {
+			continue
+		}
+		d.Blocking = d.OnDelete == "no_action" || d.OnDelete == "restrict"
+		if d.OnDelete == "cascade" && depth+1 < maxDependencyDepth {
+			seen[d.oid] = true
+			if d.Children, err = dependencies(db, child, depth+1, seen); err != nil {
+				return nil, err
+			}
+			delete(seen, d.oid)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// referencingSet is the rows of d's table whose foreign key points into
+// parent.
+func referencingSet(d *dependency, oid uint32, parent rowSet) rowSet {
+	cols := make([]string, len(d.Columns))
+	for i, c := range d.Columns {
+		cols[i] = "c." + pq.QuoteIdentifier(c)
+	}
+	refs := make([]string, len(d.References))
+	for i, c := range d.References {
+		refs[i] = "p." + pq.QuoteIdentifier(c)
+	}
+	return rowSet{
+		OID: oid,
+		SQL: fmt.Sprintf("SELECT c.* FROM %s AS c WHERE (%s) IN (SELECT %s FROM (%s) AS p)",
+			d.Table, strings.Join(cols, ", "), strings.Join(refs, ", "), parent.SQL),
+		Args: parent.Args,
+	}
+}
+
+// blocked reports whether any no_action or restrict key, at any depth,
+// still matches rows.
+func blocked(deps []*dependency) bool {
+	for _, d := range deps {
+		if d.Blocking || blocked(d.Children) {
+			return true
+		}
+	}
+	return false
+}
+
+// cascadeSummary flattens the cascading part of deps into the rows each
+// table would lose, starting with the target itself.
+func cascadeSummary(table string, matched int64, deps []*dependency) []map[string]interface{} {
+	out := []map[string]interface{}{{"table": table, "rows": matched, "depth": 0}}
+	var walk func(deps []*dependency, depth int)
+	walk = func(deps []*dependency, depth int) {
+		for _, d := range deps {
+			if d.OnDelete != "cascade" {
+				continue
+			}
+			out = append(out, map[string]interface{}{"table": d.Table, "rows": d.Rows, "depth": depth, "constraint": d.Constraint})
+			walk(d.Children, depth+1)
+		}
+	}
+	walk(deps, 1)
+	return out
+}
@@ -0,0 +1,96 @@
+package pgcomp
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// drivers are the values of the driver input and how each reports a
+// server error, so the tests below run once per driver.
+var drivers = []struct {
+	name     string
+	serverEr func(code, msg, detail, schema, table, column, constraint string) error
+}{
+	{"postgres", func(code, msg, detail, schema, table, column, constraint string) error {
+		return &pq.Error{Code: pq.ErrorCode(code), Message: msg, Detail: detail, Schema: schema, Table: table, Column: column, Constraint: constraint}
+	}},
+	{"pgx", func(code, msg, detail, schema, table, column, constraint string) error {
+		return &pgconn.PgError{Code: code, Message: msg, Detail: detail, SchemaName: schema, TableName: table, ColumnName: column, ConstraintName: constraint}
+	}},
+}
+
+func TestServerErrorPerDriver(t *testing.T) {
+	for _, d := range drivers {
+		err := fmt.Errorf("execution error: %w", d.serverEr("23505", `duplicate key value violates unique constraint "orders_code_key"`,
+			"Key (code)=(A-1) already exists.", "sales", "orders", "", ""))
+		want := &serverError{
+			Code:    "23505",
+			Message: `duplicate key value violates unique constraint "orders_code_key"`,
+			Detail:  "Key (code)=(A-1) already exists.",
+			Schema:  "sales",
+			Table:   "orders",
+		}
+		if got := asServerError(err); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: asServerError = %+v, want %+v", d.name, got, want)
+		}
+		if got := sqlState(err); got != "23505" {
+			t.Errorf("%s: sqlState = %q", d.name, got)
+		}
+		// No constraint name, so nothing is looked up in the catalog
+		msg, v := explainViolation(nil, err)
+		if msg != "a row with code = A-1 already exists in sales.orders" || v["code"] != "unique_violation" {
+			t.Errorf("%s: explainViolation = %q, %v", d.name, msg, v)
+		}
+		if brokenConnection(err, true) {
+			t.Errorf("%s: a server error is not a broken connection", d.name)
+		}
+	}
+	if asServerError(fmt.Errorf("dial tcp: connection refused")) != nil {
+		t.Error("a network error is not a server error")
+	}
+}
+
+// The same server value, as each driver hands it to Scan, normalizes to
+// the same result value.
+func TestNormalizeValuePerDriver(t *testing.T) {
+	ts := time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		dbType string
+		pq     interface{} // what lib/pq scans into an interface{}
+		pgx    interface{} // what pgx's stdlib scans
+		want   interface{}
+	}{
+		{"numeric", "NUMERIC", []byte("1234.50"), "123450e-2", "1234.50"},
+		{"numeric(38)", "NUMERIC", []byte("12345678901234567890123456789012345678"), "12345678901234567890123456789012345678", "12345678901234567890123456789012345678"},
+		{"tiny numeric", "NUMERIC", []byte("0.000000000000000000000000000001"), "1e-30", "0.000000000000000000000000000001"},
+		{"numeric NaN", "NUMERIC", []byte("NaN"), "NaN", "NaN"},
+		{"float8", "FLOAT8", 3.14159, 3.14159, 3.14159},
+		{"float8 NaN", "FLOAT8", math.NaN(), math.NaN(), "NaN"},
+		{"float8 -Infinity", "FLOAT8", math.Inf(-1), math.Inf(-1), "-Infinity"},
+		{"float4 Infinity", "FLOAT4", float32(math.Inf(1)), float32(math.Inf(1)), "Infinity"},
+		{"oid", "OID", []byte("16384"), int64(16384), int64(16384)},
+		{"bigint", "INT8", int64(9007199254740993), int64(9007199254740993), int64(9007199254740993)},
+		{"text", "TEXT", "café", "café", "café"},
+		{"bool", "BOOL", true, true, true},
+		{"timestamptz", "TIMESTAMPTZ", ts, ts, ts},
+		{"null", "TEXT", nil, nil, nil},
+		{"hstore", hstoreType, []byte(`"a"=>"1", "b"=>NULL`), `"a"=>"1", "b"=>NULL`, map[string]interface{}{"a": "1", "b": nil}},
+	}
+	for _, c := range cases {
+		for _, d := range []struct {
+			driver string
+			val    interface{}
+		}{{"postgres", c.pq}, {"pgx", c.pgx}} {
+			if got := normalizeValue(d.val, c.dbType); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s under %s: normalizeValue(%#v) = %#v, want %#v", c.name, d.driver, d.val, got, c.want)
+			}
+		}
+	}
+}
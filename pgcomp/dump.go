@@ -0,0 +1,450 @@
+package pgcomp
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dumpInsertRows is how many rows one INSERT of the dump carries.
+const dumpInsertRows = 100
+
+// dumpTable is what export_schema writes for one table.
+type dumpTable struct {
+	rel     *relation
+	cols    []columnInfo
+	exprs   map[string]string // column defaults and generation expressions
+	inline  []string          // CONSTRAINT ... clauses other than foreign keys
+	fks     []dumpFK
+	indexes []string // CREATE INDEX statements of indexes without a constraint
+	// serial and identity sequences, set to their current value at the end
+	sequences []dumpSequence
+	comments  map[string]interface{}
+}
+
+type dumpFK struct {
+	name   string
+	def    string
+	parent uint32
+}
+
+type dumpSequence struct {
+	name   string
+	column string
+	create string // CREATE SEQUENCE for a serial column, "" for identity
+	last   int64
+	called bool
+}
+
+// exportSchema answers the export_schema data_type: a restorable SQL dump
+// of names, tables with their columns, constraints, indexes, sequences,
+// comments and rows, written to file inside BEGIN/COMMIT. Tables come in
+// foreign key order, parents first. A foreign key that closes a cycle, or
+// references its own table, is added after all the data instead, where
+// it is validated once. Everything is read in one snapshot with an empty
+// search_path, so every name in the dump is schema qualified.
+func exportSchema(db *sql.DB, names []string, file string) (interface{}, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("object_name (the tables to dump) is required for export_schema")
+	}
+	if file == "" {
+		return nil, fmt.Errorf("output_file is required for export_schema")
+	}
+	tx, snap, err := beginSnapshot(db, &snapshotSpec{Isolation: "repeatable_read"})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var rels []*relation
+	seen := map[uint32]bool{}
+	for _, n := range names {
+		rel, err := resolveRelation(tx, n)
+		if err != nil {
+			return nil, err
+		}
+		if rel.Kind != "table" {
+			return nil, fmt.Errorf("export_schema dumps ordinary tables; %s is a %s", rel.Name, strings.ReplaceAll(rel.Kind, "_", " "))
+		}
+		if !seen[rel.OID] {
+			seen[rel.OID] = true
+			rels = append(rels, rel)
+		}
+	}
+	if _, err := tx.Exec("SELECT set_config('search_path', '', true)"); err != nil {
+		return nil, err
+	}
+	tables := make([]*dumpTable, len(rels))
+	for i, rel := range rels {
+		if err := tx.QueryRow("SELECT $1::oid::regclass::text", rel.OID).Scan(&rel.Name); err != nil {
+			return nil, err
+		}
+		if tables[i], err = readDumpTable(tx, rel); err != nil {
+			return nil, err
+		}
+	}
+	ordered, deferred := dumpOrder(tables)
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output_file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	out := &countingWriter{w: tmp}
+	w := bufio.NewWriter(out)
+
+	fmt.Fprintf(w, "-- export_schema dump of %d table(s), snapshot taken at %s\n", len(ordered), snap["started_at"])
+	w.WriteString("BEGIN;\nSET LOCAL client_encoding = 'UTF8';\nSELECT pg_catalog.set_config('search_path', '', true);\n\n")
+	for _, t := range ordered {
+		for _, s := range t.sequences {
+			if s.create != "" {
+				w.WriteString(s.create + ";\n")
+			}
+		}
+		w.WriteString(t.createSQL(deferred) + ";\n\n")
+	}
+	var external []string
+	rowCounts := make([]map[string]interface{}, 0, len(ordered))
+	for _, t := range ordered {
+		n, err := t.writeData(tx, w)
+		if err != nil {
+			tmp.Close()
+			return nil, err
+		}
+		rowCounts = append(rowCounts, map[string]interface{}{"table": t.rel.Name, "rows": n})
+		for _, fk := range t.fks {
+			if !seen[fk.parent] {
+				external = append(external, t.rel.Name+"."+fk.name)
+			}
+		}
+	}
+	var deferredNames []string
+	for _, t := range ordered {
+		for _, s := range t.sequences {
+			if s.create != "" {
+				fmt.Fprintf(w, "ALTER SEQUENCE %s OWNED BY %s.%s;\n", s.name, t.rel.Name, pq.QuoteIdentifier(s.column))
+			}
+			// looked up by column, as an identity sequence gets a new name
+			fmt.Fprintf(w, "SELECT pg_catalog.setval(pg_catalog.pg_get_serial_sequence(%s, %s), %d, %t);\n",
+				pq.QuoteLiteral(t.rel.Name), pq.QuoteLiteral(s.column), s.last, s.called)
+		}
+		for _, fk := range t.fks {
+			if deferred[t.rel.Name+"."+fk.name] {
+				fmt.Fprintf(w, "ALTER TABLE %s ADD CONSTRAINT %s %s;\n", t.rel.Name, pq.QuoteIdentifier(fk.name), fk.def)
+				deferredNames = append(deferredNames, t.rel.Name+"."+fk.name)
+			}
+		}
+		for _, idx := range t.indexes {
+			w.WriteString(idx + ";\n")
+		}
+		if c, ok := t.comments["comment"].(string); ok {
+			fmt.Fprintf(w, "COMMENT ON TABLE %s IS %s;\n", t.rel.Name, commentLiteral(&c))
+		}
+		for _, col := range t.cols {
+			if c, ok := t.comments["columns"].(map[string]interface{})[col.Name].(string); ok {
+				fmt.Fprintf(w, "COMMENT ON COLUMN %s.%s IS %s;\n", t.rel.Name, pq.QuoteIdentifier(col.Name), commentLiteral(&c))
+			}
+		}
+	}
+	w.WriteString("\nCOMMIT;\n")
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write output_file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write output_file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return nil, fmt.Errorf("failed to write output_file: %v", err)
+	}
+
+	order := make([]string, len(ordered))
+	for i, t := range ordered {
+		order[i] = t.rel.Name
+	}
+	if deferredNames == nil {
+		deferredNames = []string{}
+	}
+	if external == nil {
+		external = []string{}
+	}
+	return map[string]interface{}{
+		"output_file":          file,
+		"bytes":                out.n,
+		"snapshot_at":          snap["started_at"],
+		"order":                order,
+		"tables":               rowCounts,
+		"deferred_constraints": deferredNames,
+		// foreign keys to tables outside the dump, which must exist where
+		// it is restored
+		"external_references": external,
+		"dumped_at":           time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// readDumpTable reads the definition of rel from the catalogs.
+func readDumpTable(db querier, rel *relation) (*dumpTable, error) {
+	t := &dumpTable{rel: rel, exprs: map[string]string{}}
+	var err error
+	if t.cols, err = rel.columns(db); err != nil {
+		return nil, err
+	}
+	err = scanRows(db, `SELECT a.attname::text, pg_get_expr(d.adbin, d.adrelid)
+		FROM pg_attrdef d JOIN pg_attribute a ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+		WHERE d.adrelid = $1`, []interface{}{rel.OID}, func(scan func(...interface{}) error) error {
+		var col, expr string
+		if err := scan(&col, &expr); err != nil {
+			return err
+		}
+		t.exprs[col] = expr
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// NOT NULL constraints (contype n) are covered by the columns
+	err = scanRows(db, `SELECT conname::text, contype::text, pg_get_constraintdef(oid), confrelid
+		FROM pg_constraint WHERE conrelid = $1 AND conislocal AND contype IN ('p', 'u', 'c', 'x', 'f')
+		ORDER BY contype = 'p' DESC, conname`, []interface{}{rel.OID}, func(scan func(...interface{}) error) error {
+		var name, typ, def string
+		var parent uint32
+		if err := scan(&name, &typ, &def, &parent); err != nil {
+			return err
+		}
+		if typ == "f" {
+			t.fks = append(t.fks, dumpFK{name: name, def: def, parent: parent})
+		} else {
+			t.inline = append(t.inline, "CONSTRAINT "+pq.QuoteIdentifier(name)+" "+def)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanRows(db, `SELECT pg_get_indexdef(i.indexrelid) FROM pg_index i
+		WHERE i.indrelid = $1 AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.indexrelid AND c.conrelid = i.indrelid)
+		ORDER BY i.indexrelid::regclass::text`, []interface{}{rel.OID}, func(scan func(...interface{}) error) error {
+		var def string
+		if err := scan(&def); err != nil {
+			return err
+		}
+		t.indexes = append(t.indexes, def)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// deptype a: a serial column's sequence; i: an identity sequence
+	err = scanRows(db, `SELECT s.oid::regclass::text, a.attname::text, d.deptype = 'a'
+		FROM pg_depend d
+		JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+		JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass
+			AND d.refobjid = $1 AND d.deptype IN ('a', 'i')
+		ORDER BY a.attnum`, []interface{}{rel.OID}, func(scan func(...interface{}) error) error {
+		var s dumpSequence
+		var serial bool
+		if err := scan(&s.name, &s.column, &serial); err != nil {
+			return err
+		}
+		if serial {
+			s.create = "CREATE SEQUENCE " + s.name
+		}
+		t.sequences = append(t.sequences, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range t.sequences {
+		s := &t.sequences[i]
+		if err := db.QueryRow("SELECT last_value, is_called FROM "+s.name).Scan(&s.last, &s.called); err != nil {
+			return nil, err
+		}
+		if s.create == "" {
+			continue
+		}
+		// pg_sequence exists from PostgreSQL 10; before that the defaults
+		// are kept
+		var opts sql.NullString
+		err := db.QueryRow(`SELECT CASE WHEN to_regclass('pg_catalog.pg_sequence') IS NOT NULL THEN
+			(SELECT format(' AS %s INCREMENT BY %s MINVALUE %s MAXVALUE %s START WITH %s CACHE %s%s',
+				format_type(seqtypid, NULL), seqincrement, seqmin, seqmax, seqstart, seqcache, CASE WHEN seqcycle THEN ' CYCLE' ELSE '' END)
+			FROM pg_sequence WHERE seqrelid = $1::regclass) END`, s.name).Scan(&opts)
+		if err != nil {
+			return nil, err
+		}
+		s.create += opts.String
+	}
+	if t.comments, err = relationComments(db, rel); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// createSQL is the CREATE TABLE of t with every constraint but the
+// deferred foreign keys.
+func (t *dumpTable) createSQL(deferred map[string]bool) string {
+	var lines []string
+	for _, c := range t.cols {
+		l := "    " + pq.QuoteIdentifier(c.Name) + " " + c.TypeSQL
+		switch {
+		case c.Generated != "":
+			l += " GENERATED ALWAYS AS (" + t.exprs[c.Name] + ")"
+			if c.Generated == "s" {
+				l += " STORED"
+			} else {
+				l += " VIRTUAL"
+			}
+		case c.Identity == "a":
+			l += " GENERATED ALWAYS AS IDENTITY"
+		case c.Identity == "d":
+			l += " GENERATED BY DEFAULT AS IDENTITY"
+		case t.exprs[c.Name] != "":
+			l += " DEFAULT " + t.exprs[c.Name]
+		}
+		if c.NotNull && c.Identity == "" {
+			l += " NOT NULL"
+		}
+		lines = append(lines, l)
+	}
+	for _, c := range t.inline {
+		lines = append(lines, "    "+c)
+	}
+	for _, fk := range t.fks {
+		if !deferred[t.rel.Name+"."+fk.name] {
+			lines = append(lines, "    CONSTRAINT "+pq.QuoteIdentifier(fk.name)+" "+fk.def)
+		}
+	}
+	return "CREATE TABLE " + t.rel.Name + " (\n" + strings.Join(lines, ",\n") + "\n)"
+}
+
+// writeData writes the rows of t as multi-row INSERTs in primary key
+// order. Values travel as their text form, a literal the server casts
+// back to the column type; generated columns are left to the server.
+func (t *dumpTable) writeData(db querier, w *bufio.Writer) (int64, error) {
+	var names, selects []string
+	override := ""
+	for _, c := range t.cols {
+		if c.Generated != "" {
+			continue
+		}
+		if c.Identity == "a" {
+			override = " OVERRIDING SYSTEM VALUE"
+		}
+		q := pq.QuoteIdentifier(c.Name)
+		names = append(names, q)
+		selects = append(selects, q+"::text")
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+	q := "SELECT " + strings.Join(selects, ", ") + " FROM ONLY " + t.rel.Name
+	pk, err := primaryKey(db, t.rel)
+	if err != nil {
+		return 0, err
+	}
+	if len(pk) > 0 {
+		for i, c := range pk {
+			pk[i] = pq.QuoteIdentifier(c)
+		}
+		q += " ORDER BY " + strings.Join(pk, ", ")
+	}
+	logSQL(q, nil)
+	rows, err := db.Query(q)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	head := "INSERT INTO " + t.rel.Name + " (" + strings.Join(names, ", ") + ")" + override + " VALUES\n"
+	vals := make([]sql.NullString, len(names))
+	ptrs := make([]interface{}, len(names))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	lits := make([]string, len(names))
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		for i, v := range vals {
+			lits[i] = "NULL"
+			if v.Valid {
+				lits[i] = pq.QuoteLiteral(v.String)
+			}
+		}
+		if n%dumpInsertRows == 0 {
+			if n > 0 {
+				w.WriteString(";\n")
+			}
+			w.WriteString(head)
+		} else {
+			w.WriteString(",\n")
+		}
+		w.WriteString("(" + strings.Join(lits, ", ") + ")")
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if n > 0 {
+		w.WriteString(";\n\n")
+	}
+	return n, nil
+}
+
+// dumpOrder sorts tables so that every table comes after the tables its
+// foreign keys reference, keeping the given order where it is free. When
+// only tables in a cycle remain, the first of them is taken and its
+// foreign keys to the tables still pending are deferred, as are all self
+// references. Deferred keys are reported as table.constraint.
+func dumpOrder(tables []*dumpTable) ([]*dumpTable, map[string]bool) {
+	inDump := map[uint32]bool{}
+	for _, t := range tables {
+		inDump[t.rel.OID] = true
+	}
+	done := map[uint32]bool{}
+	deferred := map[string]bool{}
+	var out []*dumpTable
+	ready := func(t *dumpTable) bool {
+		for _, fk := range t.fks {
+			if fk.parent != t.rel.OID && inDump[fk.parent] && !done[fk.parent] {
+				return false
+			}
+		}
+		return true
+	}
+	for len(out) < len(tables) {
+		var next *dumpTable
+		for _, t := range tables {
+			if !done[t.rel.OID] && ready(t) {
+				next = t
+				break
+			}
+		}
+		if next == nil {
+			for _, t := range tables {
+				if !done[t.rel.OID] {
+					next = t
+					break
+				}
+			}
+		}
+		for _, fk := range next.fks {
+			if fk.parent == next.rel.OID || inDump[fk.parent] && !done[fk.parent] {
+				deferred[next.rel.Name+"."+fk.name] = true
+			}
+		}
+		done[next.rel.OID] = true
+		out = append(out, next)
+	}
+	return out, deferred
+}
@@ -0,0 +1,206 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultDuplicateKeys = 100
+	// maxDuplicateRows caps the conflicting rows include_rows returns, over
+	// all keys together.
+	maxDuplicateRows = 1000
+)
+
+// duplicateOptions are the inputs of the duplicates data_type.
+type duplicateOptions struct {
+	Columns     []string // the key that should be unique
+	Filter      []filterSpec
+	Limit       int64 // duplicate keys to return, default 100
+	IncludeRows bool
+	// IgnoreNulls leaves out keys with a NULL column, which a unique
+	// constraint does not consider equal (unless NULLS NOT DISTINCT)
+	IgnoreNulls bool
+}
+
+// findDuplicates answers the duplicates data_type: the values of columns
+// that more than one row of table shares, most repeated first, with how
+// many rows share each. The totals cover every duplicate key, so
+// duplicate_keys = 0 tells whether a unique constraint on columns can be
+// added; with include_rows the conflicting rows are returned under their
+// key.
+func findDuplicates(db querier, table string, opts duplicateOptions) (interface{}, error) {
+	if len(opts.Columns) == 0 {
+		return nil, fmt.Errorf("columns is required for duplicates")
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultDuplicateKeys
+	}
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	relCols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(relCols))
+	for i, c := range relCols {
+		known[i] = c.Name
+	}
+	keys := make([]string, len(opts.Columns))
+	for i, c := range opts.Columns {
+		if !containsString(known, c) {
+			return nil, fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+		}
+		keys[i] = pq.QuoteIdentifier(c)
+	}
+	keyList := strings.Join(keys, ", ")
+
+	// where renders the filter and null conditions with the columns
+	// qualified by prefix, binding into args.
+	where := func(prefix string, args *[]interface{}) (string, error) {
+		bind := func(v interface{}) string {
+			*args = append(*args, v)
+			return "$" + strconv.Itoa(len(*args))
+		}
+		column := func(c string) (string, error) {
+			if !containsString(known, c) {
+				return "", fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+			}
+			return prefix + pq.QuoteIdentifier(c), nil
+		}
+		var conds []string
+		for _, f := range opts.Filter {
+			cond, err := f.render(column, bind)
+			if err != nil {
+				return "", err
+			}
+			conds = append(conds, cond)
+		}
+		if opts.IgnoreNulls {
+			for _, k := range keys {
+				conds = append(conds, prefix+k+" IS NOT NULL")
+			}
+		}
+		if len(conds) == 0 {
+			return "", nil
+		}
+		return " WHERE " + strings.Join(conds, " AND "), nil
+	}
+	grouped := func(args *[]interface{}) (string, error) {
+		w, err := where("", args)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("SELECT %s, count(*) AS _dup_count FROM %s%s GROUP BY %s HAVING count(*) > 1", keyList, rel.Name, w, keyList), nil
+	}
+
+	var args []interface{}
+	g, err := grouped(&args)
+	if err != nil {
+		return nil, err
+	}
+	q := fmt.Sprintf("SELECT count(*), COALESCE(sum(_dup_count), 0) FROM (%s) AS d", g)
+	logSQL(q, args)
+	var dupKeys, dupRows int64
+	if err := db.QueryRow(q, args...).Scan(&dupKeys, &dupRows); err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{
+		"table":          rel.Name,
+		"columns":        opts.Columns,
+		"duplicate_keys": dupKeys,
+		"duplicate_rows": dupRows,
+		// rows beyond the first of every key, what a cleanup has to remove
+		"extra_rows":    dupRows - dupKeys,
+		"nulls_ignored": opts.IgnoreNulls,
+		"keys":          []map[string]interface{}{},
+		"truncated":     dupKeys > opts.Limit,
+	}
+	if dupKeys == 0 {
+		return res, nil
+	}
+
+	args = nil
+	if g, err = grouped(&args); err != nil {
+		return nil, err
+	}
+	keysQ := fmt.Sprintf("%s ORDER BY count(*) DESC, %s LIMIT %d", g, keyList, opts.Limit)
+	logSQL(keysQ, args)
+	rows, err := db.Query(keysQ, args...)
+	if err != nil {
+		return nil, err
+	}
+	found, err := collectRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]map[string]interface{}, len(found))
+	byKey := map[string]map[string]interface{}{}
+	for i, r := range found {
+		key := orderedRow{keys: opts.Columns, values: map[string]interface{}{}}
+		for _, c := range opts.Columns {
+			key.values[c] = r.values[c]
+		}
+		entries[i] = map[string]interface{}{"key": key, "count": r.values["_dup_count"]}
+		byKey[duplicateKey(key)] = entries[i]
+	}
+	res["keys"] = entries
+	if !opts.IncludeRows {
+		return res, nil
+	}
+
+	// keysQ again as the CTE, so its arguments come first
+	outer, err := where("src.", &args)
+	if err != nil {
+		return nil, err
+	}
+	on := make([]string, len(keys))
+	for i, k := range keys {
+		on[i] = fmt.Sprintf("src.%s IS NOT DISTINCT FROM dup.%s", k, k)
+	}
+	order := make([]string, len(keys))
+	for i, k := range keys {
+		order[i] = "dup." + k
+	}
+	rowsQ := fmt.Sprintf("WITH dup AS (%s) SELECT src.* FROM %s AS src JOIN dup ON %s%s ORDER BY dup._dup_count DESC, %s LIMIT %d",
+		keysQ, rel.Name, strings.Join(on, " AND "), outer, strings.Join(order, ", "), maxDuplicateRows+1)
+	logSQL(rowsQ, args)
+	rows, err = db.Query(rowsQ, args...)
+	if err != nil {
+		return nil, err
+	}
+	conflicting, err := collectRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	res["rows_truncated"] = len(conflicting) > maxDuplicateRows
+	if len(conflicting) > maxDuplicateRows {
+		conflicting = conflicting[:maxDuplicateRows]
+	}
+	for _, e := range entries {
+		e["rows"] = []orderedRow{}
+	}
+	for _, r := range conflicting {
+		key := orderedRow{keys: opts.Columns, values: map[string]interface{}{}}
+		for _, c := range opts.Columns {
+			key.values[c] = r.values[c]
+		}
+		if e, ok := byKey[duplicateKey(key)]; ok {
+			e["rows"] = append(e["rows"].([]orderedRow), r)
+		}
+	}
+	return res, nil
+}
+
+// duplicateKey identifies a key's values as read back from the server,
+// keeping NULL apart from any text.
+func duplicateKey(key orderedRow) string {
+	raw, _ := json.Marshal(key)
+	return string(raw)
+}
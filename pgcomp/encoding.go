@@ -0,0 +1,181 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const defaultEncodingOffenders = 100
+
+// serverEncoding returns the database's server_encoding.
+func serverEncoding(db querier) (string, error) {
+	var enc string
+	err := db.QueryRow("SELECT current_setting('server_encoding')").Scan(&enc)
+	return enc, err
+}
+
+// readsRows reports whether a request returns rows read from the tables,
+// the strings a SQL_ASCII database may hold in any encoding. Only those
+// requests spend a round trip on serverEncoding.
+func readsRows(dataType, query string) bool {
+	switch dataType {
+	case "table", "stored_function", "stored_procedure":
+		return true
+	case "query", "template":
+		return classifyStatement(query).ReturnsRows
+	}
+	return false
+}
+
+// utf8Encoding reports whether name is one of the server's spellings of
+// UTF8 (utf-8, Unicode, ...).
+func utf8Encoding(name string) bool {
+	n := strings.ToUpper(strings.NewReplacer("-", "", "_", "").Replace(name))
+	return n == "UTF8" || n == "UNICODE"
+}
+
+// encodingCheckOptions are the inputs of the check_encoding data_type.
+type encodingCheckOptions struct {
+	Columns    []string // the text columns to check
+	KeyColumns []string // how offending rows are named, default the primary key
+	Limit      int64    // offending rows reported, default 100
+}
+
+// checkEncoding answers the check_encoding data_type: it reads columns of
+// every row of table and reports the rows holding bytes that are not valid
+// UTF-8, which only a SQL_ASCII database lets in. Offending rows are named
+// by their key (ctid without a primary key) with the first invalid byte
+// of each bad value; the counts cover the whole table, the rows listed stop
+// at limit.
+func checkEncoding(db querier, table string, opts encodingCheckOptions) (interface{}, error) {
+	if len(opts.Columns) == 0 {
+		return nil, fmt.Errorf("columns is required for check_encoding")
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultEncodingOffenders
+	}
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	relCols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(relCols))
+	for i, c := range relCols {
+		known[i] = c.Name
+	}
+	keyCols := opts.KeyColumns
+	if len(keyCols) == 0 {
+		if keyCols, err = primaryKey(db, rel); err != nil {
+			return nil, err
+		}
+	}
+	var selects []string
+	for _, c := range keyCols {
+		if !containsString(known, c) {
+			return nil, fmt.Errorf("key column %q does not exist in %s", c, rel.Name)
+		}
+		selects = append(selects, pq.QuoteIdentifier(c))
+	}
+	if len(keyCols) == 0 {
+		keyCols = []string{"ctid"}
+		selects = []string{"ctid::text"}
+	}
+	for _, c := range opts.Columns {
+		if !containsString(known, c) {
+			return nil, fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+		}
+		// The text form, so a domain or varchar column reads as its bytes
+		selects = append(selects, pq.QuoteIdentifier(c)+"::text")
+	}
+	enc, err := serverEncoding(db)
+	if err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf("SELECT %s FROM %s", strings.Join(selects, ", "), rel.Name)
+	logSQL(q, nil)
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]interface{}, len(keyCols))
+	values := make([]sql.RawBytes, len(opts.Columns))
+	dest := make([]interface{}, 0, len(keys)+len(values))
+	for i := range keys {
+		dest = append(dest, &keys[i])
+	}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	var scanned, invalid int64
+	perColumn := make(map[string]int64, len(opts.Columns))
+	for _, c := range opts.Columns {
+		perColumn[c] = 0
+	}
+	offenders := []map[string]interface{}{}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		scanned++
+		var bad []map[string]interface{}
+		for i, v := range values {
+			if utf8.Valid(v) {
+				continue
+			}
+			perColumn[opts.Columns[i]]++
+			bad = append(bad, map[string]interface{}{
+				"column": opts.Columns[i],
+				"offset": invalidOffset(v),
+				"bytes":  len(v),
+			})
+		}
+		if bad == nil {
+			continue
+		}
+		invalid++
+		if int64(len(offenders)) < opts.Limit {
+			key := orderedRow{keys: keyCols, values: make(map[string]interface{}, len(keyCols))}
+			for i, c := range keyCols {
+				key.values[c] = normalizeValue(keys[i], "")
+			}
+			offenders = append(offenders, map[string]interface{}{"key": key, "columns": bad})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"table":           rel.Name,
+		"columns":         opts.Columns,
+		"key_columns":     keyCols,
+		"server_encoding": enc,
+		"rows_scanned":    scanned,
+		"invalid_rows":    invalid,
+		"invalid_values":  perColumn,
+		"rows":            offenders,
+		"truncated":       invalid > int64(len(offenders)),
+	}, nil
+}
+
+// invalidOffset is the byte offset of the first byte of b that does not
+// start a valid UTF-8 sequence.
+func invalidOffset(b []byte) int {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
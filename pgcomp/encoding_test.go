@@ -0,0 +1,36 @@
+package pgcomp
+
+import "testing"
+
+func TestReadsRows(t *testing.T) {
+	for _, c := range []struct {
+		dataType, query string
+		want            bool
+	}{
+		{"table", "", true},
+		{"stored_function", "", true},
+		{"stored_procedure", "", true},
+		{"query", "SELECT name FROM customers", true},
+		{"query", "WITH c AS (SELECT 1) SELECT * FROM c", true},
+		{"query", "UPDATE customers SET name = 'x' RETURNING id", false}, // run with Exec, as the query path runs it
+		{"query", "UPDATE customers SET name = 'x'", false},
+		{"query", "CREATE INDEX ON customers (name)", false},
+		{"template", "SELECT name FROM {{.table}}", true},
+		{"insert", "", false},
+		{"describe", "", false},
+		{"list_enum", "", false},
+		{"connection_info", "", false},
+	} {
+		if got := readsRows(c.dataType, c.query); got != c.want {
+			t.Errorf("readsRows(%s, %q) = %v, want %v", c.dataType, c.query, got, c.want)
+		}
+	}
+}
+
+func TestUTF8Encoding(t *testing.T) {
+	for name, want := range map[string]bool{"UTF8": true, "utf-8": true, "Unicode": true, "utf_8": true, "SQL_ASCII": false, "LATIN1": false, "": false} {
+		if got := utf8Encoding(name); got != want {
+			t.Errorf("utf8Encoding(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
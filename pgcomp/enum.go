@@ -0,0 +1,47 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// listEnum returns the labels of the enum type name in pg_enum sort order.
+// name is resolved like a type name in SQL, so it may be schema-qualified.
+func listEnum(db querier, name string) (interface{}, error) {
+	var oid uint32
+	var typeName, typtype string
+	err := db.QueryRow(`SELECT t.oid, t.oid::regtype::text, t.typtype::text
+		FROM pg_type t WHERE t.oid = to_regtype($1)`, name).Scan(&oid, &typeName, &typtype)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("type %q does not exist", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if typtype != "e" {
+		return nil, fmt.Errorf("type %s is not an enum", typeName)
+	}
+
+	labels, err := enumLabels(db, oid)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"type": typeName, "labels": labels}, nil
+}
+
+func enumLabels(db querier, typeOID uint32) ([]string, error) {
+	rows, err := db.Query("SELECT enumlabel FROM pg_enum WHERE enumtypid = $1 ORDER BY enumsortorder", typeOID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	labels := []string{}
+	for rows.Next() {
+		var l string
+		if err := rows.Scan(&l); err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+	}
+	return labels, rows.Err()
+}
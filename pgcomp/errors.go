@@ -0,0 +1,103 @@
+package pgcomp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// componentError is an error with a stable, machine-readable code that is
+// reported in the output next to the human readable message.
+type componentError struct {
+	Code    string
+	Message string
+	Details map[string]interface{}
+
+	// cause is the underlying error, when there is one, so the server
+	// error stays reachable through errors.As
+	cause error
+}
+
+func (e *componentError) Error() string {
+	return e.Message
+}
+
+func (e *componentError) Unwrap() error {
+	return e.cause
+}
+
+func newError(code, format string, args ...interface{}) *componentError {
+	return &componentError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorOutput builds the Response for a failed request, carrying over the code
+// and details of a componentError anywhere in err's chain. An empty prefix
+// reports the error message as-is.
+func errorOutput(prefix string, err error) Response {
+	out := Response{Error: err.Error()}
+	if prefix != "" {
+		out.Error = fmt.Sprintf("%s: %v", prefix, err)
+	}
+	var ce *componentError
+	if errors.As(err, &ce) {
+		out.Code = ce.Code
+		if len(ce.Details) > 0 {
+			out.Details = ce.Details
+		}
+	}
+	return out
+}
+
+// serverError is the driver-neutral view of an error reported by the server.
+type serverError struct {
+	Code       string
+	Message    string
+	Detail     string
+	Hint       string
+	Schema     string
+	Table      string
+	Column     string
+	Constraint string
+}
+
+// asServerError extracts the server error fields from a lib/pq or pgx error,
+// returning nil for errors that did not come from the server.
+func asServerError(err error) *serverError {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return &serverError{
+			Code:       string(pqErr.Code),
+			Message:    pqErr.Message,
+			Detail:     pqErr.Detail,
+			Hint:       pqErr.Hint,
+			Schema:     pqErr.Schema,
+			Table:      pqErr.Table,
+			Column:     pqErr.Column,
+			Constraint: pqErr.Constraint,
+		}
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return &serverError{
+			Code:       pgErr.Code,
+			Message:    pgErr.Message,
+			Detail:     pgErr.Detail,
+			Hint:       pgErr.Hint,
+			Schema:     pgErr.SchemaName,
+			Table:      pgErr.TableName,
+			Column:     pgErr.ColumnName,
+			Constraint: pgErr.ConstraintName,
+		}
+	}
+	return nil
+}
+
+// sqlState returns the SQLSTATE of a server error, or "" for other errors.
+func sqlState(err error) string {
+	if se := asServerError(err); se != nil {
+		return se.Code
+	}
+	return ""
+}
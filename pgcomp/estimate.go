@@ -0,0 +1,100 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// estimateCount returns the planner's row estimate for a relation (from
+// pg_class.reltuples) or for a query (from EXPLAIN's top plan node). When
+// exactIfUnder is positive and the estimate is below it, a real count(*)
+// is run instead so small results are reported exactly.
+func estimateCount(db querier, objectName, query, parameters string, exactIfUnder int64) (interface{}, error) {
+	args, err := parseArgs(parameters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters: %v", err)
+	}
+
+	res := map[string]interface{}{"approximate": true}
+	var estimate int64
+	var countSQL string
+	var countArgs []interface{}
+
+	if objectName != "" {
+		rel, err := resolveRelation(db, objectName)
+		if err != nil {
+			return nil, err
+		}
+
+		var relTuples float64
+		if err := db.QueryRow("SELECT reltuples FROM pg_class WHERE oid = $1", rel.OID).Scan(&relTuples); err != nil {
+			return nil, err
+		}
+
+		if relTuples < 0 {
+			// Never vacuumed or analyzed (or a partitioned parent): let the
+			// planner extrapolate from the relation size instead.
+			if estimate, err = explainRows(db, "SELECT 1 FROM "+rel.Name); err != nil {
+				return nil, err
+			}
+		} else {
+			estimate = int64(relTuples)
+		}
+
+		var lastAnalyze sql.NullTime
+		err = db.QueryRow("SELECT GREATEST(last_analyze, last_autoanalyze) FROM pg_stat_user_tables WHERE relid = $1", rel.OID).Scan(&lastAnalyze)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if lastAnalyze.Valid {
+			res["last_analyze"] = lastAnalyze.Time.Format(time.RFC3339)
+		} else {
+			res["last_analyze"] = nil
+		}
+		countSQL = "SELECT count(*) FROM " + rel.Name
+	} else {
+		if estimate, err = explainRows(db, query, args...); err != nil {
+			return nil, err
+		}
+		countSQL = "SELECT count(*) FROM (" + query + ") AS q"
+		countArgs = args
+	}
+
+	res["estimate"] = estimate
+	res["count"] = estimate
+
+	if exactIfUnder > 0 && estimate < exactIfUnder {
+		var exact int64
+		if err := db.QueryRow(countSQL, countArgs...).Scan(&exact); err != nil {
+			return nil, err
+		}
+		res["count"] = exact
+		res["approximate"] = false
+	}
+
+	return res, nil
+}
+
+// explainRows plans the statement without running it and returns the
+// "Plan Rows" figure of the top plan node.
+func explainRows(db querier, query string, args ...interface{}) (int64, error) {
+	var raw []byte
+	if err := db.QueryRow("EXPLAIN (FORMAT JSON) "+query, args...).Scan(&raw); err != nil {
+		return 0, err
+	}
+
+	var plans []struct {
+		Plan struct {
+			PlanRows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(raw, &plans); err != nil {
+		return 0, fmt.Errorf("failed to parse plan: %v", err)
+	}
+	if len(plans) == 0 {
+		return 0, fmt.Errorf("empty plan")
+	}
+	return int64(plans[0].Plan.PlanRows), nil
+}
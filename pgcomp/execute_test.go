@@ -0,0 +1,77 @@
+package pgcomp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	req := Request{Params: []Param{
+		{InputName: "host", CompValue: "localhost"},
+		{InputName: "username", CompValue: "erp"},
+		{InputName: "dbname", CompValue: "erp"},
+		{InputName: "data_type", CompValue: "fingerprint"},
+		{InputName: "query", CompValue: "SELECT * FROM orders WHERE id = 9007199254740993"},
+	}}
+	resp, err := Execute(context.Background(), req)
+	if err != nil || resp.Error != "" {
+		t.Fatalf("Execute: %v, %q", err, resp.Error)
+	}
+	res, _ := resp.Result.(map[string]interface{})
+	if res["fingerprint"] != "SELECT * FROM orders WHERE id = $1" {
+		t.Errorf("result %v", resp.Result)
+	}
+
+	// A failed request is an answer, not an error
+	resp, err = Execute(context.Background(), Request{Params: []Param{{InputName: "limit", CompValue: "ten"}}})
+	if err != nil || resp.Error != `limit must be a non-negative integer, got "ten"` {
+		t.Errorf("bad input: %v, %q", err, resp.Error)
+	}
+
+	if resp.EnvelopeVersion != 1 || resp.Warnings != nil {
+		t.Errorf("version 1 response: version %d, warnings %q", resp.EnvelopeVersion, resp.Warnings)
+	}
+
+	// Version 2 brings request_id and the warnings back with the result
+	v2 := Request{Params: append([]Param{
+		{InputName: "envelope_version", CompValue: "2"},
+		{InputName: "request_id", CompValue: "req-9"},
+		{InputName: "strict", CompValue: "false"},
+		{InputName: "colour", CompValue: "red"},
+	}, req.Params...)}
+	resp, err = Execute(context.Background(), v2)
+	if err != nil || resp.Error != "" {
+		t.Fatalf("Execute v2: %v, %q", err, resp.Error)
+	}
+	if resp.EnvelopeVersion != 2 || resp.RequestID != "req-9" || len(resp.Warnings) != 1 || resp.Warnings[0] != `unknown input "colour" ignored` {
+		t.Errorf("version 2 envelope: %+v", resp)
+	}
+
+	// A deployment policy comes as the command's --policy, or POLICY_FILE
+	file := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(file, []byte(`{"data_types": ["table"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	denied := func(name string, resp Envelope, err error) {
+		t.Helper()
+		if err != nil || resp.Code != "policy_denied" {
+			t.Errorf("%s: %v, %s %q", name, err, resp.Code, resp.Error)
+		}
+	}
+	resp, err = Execute(context.Background(), req, "--policy", file)
+	denied("--policy", resp, err)
+	resp, err = Execute(context.Background(), req, "--policy="+file)
+	denied("--policy=", resp, err)
+	t.Setenv(policyEnv, file)
+	resp, err = Execute(context.Background(), req)
+	denied(policyEnv, resp, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Execute(ctx, req); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled context: %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package pgcomp
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultExportChunk = 10000
+
+// exportOptions are the inputs of the export data_type.
+type exportOptions struct {
+	File      string // rows go to part files File.00001, File.00002, ...
+	StateFile string
+	ChunkRows int
+	Progress  *progress
+}
+
+// keysetPage restricts a table query to the rows after After in the order
+// of Columns. Types are the columns' SQL types, used to cast the bound
+// key text.
+type keysetPage struct {
+	Columns []string
+	Types   []string
+	After   []string
+}
+
+// keysetAlias names the i-th key column appended to the select list.
+func keysetAlias(i int) string {
+	return fmt.Sprintf("__export_key_%d", i+1)
+}
+
+// exportState is the state_file contents. It is replaced only after a part
+// file is complete and renamed into place, so it never covers rows that
+// were not written; a part written before a crash is simply rewritten.
+type exportState struct {
+	QueryHash   string    `json:"query_hash"`
+	ResumeToken string    `json:"resume_token"`
+	RowsWritten int64     `json:"rows_written"`
+	Parts       []string  `json:"parts"`
+	Complete    bool      `json:"complete"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// exportTable writes the rows of a table as NDJSON part files, paging by
+// primary key. With a state_file an interrupted export continues after the
+// last completed part when re-run with the same inputs.
+func exportTable(db *sql.DB, name string, tq tableQuery, opts exportOptions) (interface{}, error) {
+	if opts.File == "" {
+		return nil, fmt.Errorf("output_file is required for export")
+	}
+	if opts.ChunkRows <= 0 {
+		opts.ChunkRows = defaultExportChunk
+	}
+	rel, err := resolveRelation(db, name)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := primaryKey(db, rel)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk) == 0 {
+		return nil, newError("no_primary_key", "export needs a primary key to page through %s", rel.Name)
+	}
+	cols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	typeSQL := map[string]string{}
+	for _, c := range cols {
+		typeSQL[c.Name] = c.TypeSQL
+	}
+	page := &keysetPage{Columns: pk}
+	for _, k := range pk {
+		page.Types = append(page.Types, typeSQL[k])
+	}
+
+	hash, err := exportHash(rel.Name, tq, pk)
+	if err != nil {
+		return nil, err
+	}
+	state := &exportState{QueryHash: hash}
+	resumed := false
+	if opts.StateFile != "" {
+		prev, err := loadExportState(opts.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			if prev.QueryHash != hash {
+				return nil, newError("state_mismatch", "state_file %s belongs to a different export (query hash differs)", opts.StateFile)
+			}
+			state, resumed = prev, true
+			if page.After, err = decodeResumeToken(state.ResumeToken, len(pk)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Without a filter the planner's row estimate gives an ETA
+	if len(tq.Filter) == 0 {
+		var estimate float64
+		if err := db.QueryRow("SELECT reltuples::float8 FROM pg_class WHERE oid = $1", rel.OID).Scan(&estimate); err == nil && estimate > 0 {
+			opts.Progress.expect(int64(estimate)-state.RowsWritten, 0)
+		}
+	}
+
+	var written int64
+	for !state.Complete {
+		tq.keyset = page
+		tq.Limit = int64(opts.ChunkRows)
+		part := fmt.Sprintf("%s.%05d", opts.File, len(state.Parts)+1)
+		n, last, err := writeExportPart(db, db, name, &tq, part, len(pk), "ndjson", opts.Progress)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			page.After = last
+			state.Parts = append(state.Parts, part)
+			state.RowsWritten += n
+			written += n
+			if state.ResumeToken, err = encodeResumeToken(last); err != nil {
+				return nil, err
+			}
+		}
+		state.Complete = n < int64(opts.ChunkRows)
+		if opts.StateFile != "" {
+			state.UpdatedAt = time.Now().UTC()
+			if err := saveExportState(opts.StateFile, state); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	res := map[string]interface{}{
+		"rows_written":  state.RowsWritten,
+		"rows_this_run": written,
+		"parts":         state.Parts,
+		"resumed":       resumed,
+		"resume_token":  state.ResumeToken,
+		"complete":      state.Complete,
+	}
+	opts.Progress.finish(res)
+	return res, nil
+}
+
+// writeExportPart runs one keyset page or key range, read through src,
+// into part via a temporary file and returns the row count and the text of
+// the last row's key. format is ndjson or csv, with a header row.
+func writeExportPart(db *sql.DB, src querier, name string, tq *tableQuery, part string, keyCols int, format string, prog *progress) (int64, []string, error) {
+	rows, _, _, err := queryTable(src, name, tq)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, nil, err
+	}
+	dataCols := len(columns) - keyCols
+	keys, _ := dedupeColumns(columns[:dataCols])
+	types := markExtensionTypes(db, columnTypeNames(rows))
+	geo := newGeometryOutput(tq.GeometryFormat, tq.geometry)
+
+	tmp, err := os.CreateTemp(filepath.Dir(part), filepath.Base(part)+".*.tmp")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create export part: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	out := &countingWriter{w: tmp}
+	enc := json.NewEncoder(out)
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(out)
+		cw.Write(keys)
+	}
+
+	var n, written int64
+	last := make([]string, keyCols)
+	for rows.Next() {
+		vals := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			tmp.Close()
+			return 0, nil, err
+		}
+		m := make(map[string]interface{}, dataCols)
+		for i := 0; i < dataCols; i++ {
+			var dbType string
+			if i < len(types) {
+				dbType = types[i]
+			}
+			m[keys[i]] = geo.apply(columns[i], dbType, normalizeValue(vals[i], dbType))
+		}
+		for i := range last {
+			last[i] = fmt.Sprint(normalizeValue(vals[dataCols+i], ""))
+		}
+		if cw != nil {
+			err = writeCSVRow(cw, keys, m)
+		} else {
+			err = enc.Encode(orderedRow{keys: keys, values: m})
+		}
+		if err != nil {
+			tmp.Close()
+			return 0, nil, fmt.Errorf("failed to write export part: %v", err)
+		}
+		n++
+		prog.add(1, out.n-written)
+		written = out.n
+	}
+	if err := rows.Err(); err != nil {
+		tmp.Close()
+		return 0, nil, err
+	}
+	if cw != nil {
+		if cw.Flush(); cw.Error() != nil {
+			tmp.Close()
+			return 0, nil, fmt.Errorf("failed to write export part: %v", cw.Error())
+		}
+		prog.add(0, out.n-written)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, nil, fmt.Errorf("failed to write export part: %v", err)
+	}
+	if n == 0 {
+		return 0, nil, nil
+	}
+	if err := os.Rename(tmp.Name(), part); err != nil {
+		return 0, nil, fmt.Errorf("failed to write export part: %v", err)
+	}
+	return n, last, nil
+}
+
+// exportHash identifies an export by everything that decides which rows
+// it produces and in what order.
+func exportHash(relName string, tq tableQuery, pk []string) (string, error) {
+	raw, err := json.Marshal(map[string]interface{}{
+		"relation": relName,
+		"columns":  tq.Columns,
+		"filter":   tq.Filter,
+		"key":      pk,
+		"geometry": tq.GeometryFormat,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func encodeResumeToken(key []string) (string, error) {
+	raw, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeResumeToken(token string, keyCols int) ([]string, error) {
+	if token == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	var key []string
+	if err == nil {
+		err = json.Unmarshal(raw, &key)
+	}
+	if err != nil || len(key) != keyCols {
+		return nil, fmt.Errorf("state_file has an invalid resume_token")
+	}
+	return key, nil
+}
+
+// loadExportState returns nil when the state file does not exist yet.
+func loadExportState(path string) (*exportState, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state_file: %v", err)
+	}
+	var st exportState
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return nil, fmt.Errorf("failed to parse state_file: %v", err)
+	}
+	return &st, nil
+}
+
+func saveExportState(path string, st *exportState) error {
+	raw, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state_file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state_file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state_file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write state_file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// manageExtensions implements the extensions data_type. Only extensions
+// listed in pg_available_extensions can be created or dropped, so the mode
+// never runs DDL built from arbitrary input.
+func manageExtensions(db querier, operation, name, schema string) (interface{}, error) {
+	switch operation {
+	case "", "list":
+		return listExtensions(db)
+	case "create", "drop":
+	default:
+		return nil, fmt.Errorf("unknown extensions operation %q (allowed: list, create, drop)", operation)
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("name is required for extensions %s", operation)
+	}
+
+	var installed sql.NullString
+	err := db.QueryRow("SELECT installed_version FROM pg_available_extensions WHERE name = $1", name).Scan(&installed)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("extension %q is not available on this server", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{"extension": name}
+	if operation == "create" {
+		stmt := "CREATE EXTENSION IF NOT EXISTS " + pq.QuoteIdentifier(name)
+		if schema != "" {
+			stmt += " SCHEMA " + pq.QuoteIdentifier(schema)
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+		var version string
+		if err := db.QueryRow("SELECT extversion FROM pg_extension WHERE extname = $1", name).Scan(&version); err != nil {
+			return nil, err
+		}
+		res["created"] = !installed.Valid
+		res["version"] = version
+		return res, nil
+	}
+
+	if _, err := db.Exec("DROP EXTENSION IF EXISTS " + pq.QuoteIdentifier(name)); err != nil {
+		return nil, err
+	}
+	res["dropped"] = installed.Valid
+	return res, nil
+}
+
+func listExtensions(db querier) (interface{}, error) {
+	installed := make([]map[string]interface{}, 0)
+	rows, err := db.Query(`SELECT e.extname, e.extversion, n.nspname
+		FROM pg_extension e JOIN pg_namespace n ON n.oid = e.extnamespace
+		ORDER BY e.extname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, version, schema string
+		if err := rows.Scan(&name, &version, &schema); err != nil {
+			return nil, err
+		}
+		installed = append(installed, map[string]interface{}{"name": name, "version": version, "schema": schema})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	available := make([]map[string]interface{}, 0)
+	rows, err = db.Query(`SELECT name, default_version, installed_version, comment
+		FROM pg_available_extensions ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var defVersion, instVersion, comment sql.NullString
+		if err := rows.Scan(&name, &defVersion, &instVersion, &comment); err != nil {
+			return nil, err
+		}
+		available = append(available, map[string]interface{}{
+			"name":              name,
+			"default_version":   nullString(defVersion),
+			"installed_version": nullString(instVersion),
+			"comment":           nullString(comment),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"installed": installed, "available": available}, nil
+}
+
+func nullString(s sql.NullString) interface{} {
+	if s.Valid {
+		return s.String
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package pgcomp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFanoutConcurrency = 4
+	maxFanoutConcurrency     = 64
+)
+
+// fanoutTarget is one entry of the "targets" input: overrides of the
+// request's connection, applied like the second connection's inputs, so
+// {"dbname": "tenant_a"} alone reaches another database of the same
+// server. Label names the target in the result; it defaults to dbname.
+type fanoutTarget struct {
+	Label    string `json:"label"`
+	DSN      string `json:"dsn"` // postgres:// URI
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	DBName   string `json:"dbname"`
+	SSLMode  string `json:"sslmode"`
+	Timeout  int    `json:"timeout"` // seconds, overrides target_timeout
+}
+
+// fanoutOptions are the inputs of the fanout data_type.
+type fanoutOptions struct {
+	Targets     []fanoutTarget
+	Concurrency int
+	Timeout     int // seconds per target, connecting included; 0 is none
+	FailFast    bool
+}
+
+func parseFanoutTargets(val string) ([]fanoutTarget, error) {
+	var targets []fanoutTarget
+	if err := json.Unmarshal([]byte(val), &targets); err != nil {
+		return nil, fmt.Errorf("invalid targets: %v", err)
+	}
+	seen := map[string]bool{}
+	for i := range targets {
+		t := &targets[i]
+		if t.Label == "" {
+			t.Label = t.DBName
+		}
+		if t.Label == "" {
+			return nil, fmt.Errorf("targets[%d] needs a label or dbname", i)
+		}
+		if seen[t.Label] {
+			return nil, fmt.Errorf("targets label %q is repeated", t.Label)
+		}
+		seen[t.Label] = true
+		if t.Timeout < 0 {
+			return nil, fmt.Errorf("targets[%d] timeout must not be negative", i)
+		}
+	}
+	return targets, nil
+}
+
+// config is base with t's overrides. A target that keeps the server
+// (no host and no host in dsn) keeps the SSH tunnel too.
+func (t fanoutTarget) config(base connConfig) (connConfig, error) {
+	cfg, err := peerConfig(base, peerInputs{
+		Host:     t.Host,
+		Port:     t.Port,
+		Username: t.Username,
+		Password: t.Password,
+		DBName:   t.DBName,
+		SSLMode:  t.SSLMode,
+		URI:      t.DSN,
+	})
+	if err != nil {
+		return cfg, err
+	}
+	if equalStrings(cfg.Hosts, base.Hosts) && cfg.Port == base.Port {
+		cfg.Tunnel = base.Tunnel
+	}
+	return cfg, nil
+}
+
+// runFanout answers the fanout data_type: query runs once on every
+// target, at most opts.Concurrency at a time. Every target gets a
+// connection of its own that is closed when it is done, so no two
+// targets ever share a pool, whatever their credentials. A failing target
+// is reported in its entry and does not stop the others, unless
+// fail_fast is set: then no target is started after the first failure
+// and the ones not started are reported as skipped.
+func runFanout(base connConfig, query string, args []interface{}, opts fanoutOptions) (interface{}, error) {
+	if query == "" {
+		return nil, fmt.Errorf("query is required for fanout")
+	}
+	if len(opts.Targets) == 0 {
+		return nil, fmt.Errorf("targets is required for fanout")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultFanoutConcurrency
+	}
+	if opts.Concurrency > maxFanoutConcurrency {
+		return nil, fmt.Errorf("concurrency must be at most %d for fanout", maxFanoutConcurrency)
+	}
+	start := time.Now()
+
+	results := make([]map[string]interface{}, len(opts.Targets))
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped bool
+	)
+	sem := make(chan struct{}, opts.Concurrency)
+	for i, t := range opts.Targets {
+		sem <- struct{}{}
+		mu.Lock()
+		skip := stopped
+		mu.Unlock()
+		if skip {
+			<-sem
+			results[i] = map[string]interface{}{"label": t.Label, "status": "skipped"}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t fanoutTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := runFanoutTarget(base, t, query, args, opts.Timeout)
+			results[i] = res
+			if res["status"] == "failed" && opts.FailFast {
+				mu.Lock()
+				stopped = true
+				mu.Unlock()
+			}
+		}(i, t)
+	}
+	wg.Wait()
+
+	counts := map[string]int{"ok": 0, "failed": 0, "skipped": 0}
+	for _, r := range results {
+		counts[r["status"].(string)]++
+	}
+	return map[string]interface{}{
+		"targets":     results,
+		"succeeded":   counts["ok"],
+		"failed":      counts["failed"],
+		"skipped":     counts["skipped"],
+		"duration_ms": time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// runFanoutTarget connects to t and runs query there; the outcome, rows
+// or rows affected or the error, is its result entry.
+func runFanoutTarget(base connConfig, t fanoutTarget, query string, args []interface{}, timeout int) map[string]interface{} {
+	res := map[string]interface{}{"label": t.Label, "status": "ok"}
+	began := time.Now()
+	if t.Timeout > 0 {
+		timeout = t.Timeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	fail := func(err error) map[string]interface{} {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %ds: %w", timeout, err)
+		}
+		res["status"] = "failed"
+		res["error"] = err.Error()
+		if code := sqlState(err); code != "" {
+			res["sqlstate"] = code
+		}
+		res["duration_ms"] = time.Since(began).Milliseconds()
+		return res
+	}
+
+	cfg, err := t.config(base)
+	if err != nil {
+		return fail(err)
+	}
+	res["dbname"] = cfg.DBName
+	if d := time.Duration(timeout) * time.Second; d > 0 && (cfg.ConnectTimeout <= 0 || cfg.ConnectTimeout > d) {
+		cfg.ConnectTimeout = d
+	}
+	db, target, err := connect(cfg)
+	if err != nil {
+		return fail(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	res["host"] = target.Addr
+
+	logSQL(query, args)
+	if classifyStatement(query).ReturnsRows {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fail(err)
+		}
+		out, err := collectRows(rows)
+		if err != nil {
+			return fail(err)
+		}
+		res["rows"] = out
+		res["row_count"] = len(out)
+	} else {
+		r, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return fail(err)
+		}
+		n, _ := r.RowsAffected()
+		res["rows_affected"] = n
+	}
+	res["duration_ms"] = time.Since(began).Milliseconds()
+	return res
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,339 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// fdwSpec is the "fdw" input: the postgres_fdw server, the user mapping
+// and the foreign schema to import. Only the parts given are set up.
+type fdwSpec struct {
+	Host    string            `json:"host"`
+	Port    json.Number       `json:"port"`
+	DBName  string            `json:"dbname"`
+	Options map[string]string `json:"options"` // further server options, e.g. fetch_size
+
+	User       string `json:"user"` // local role of the user mapping, default CURRENT_USER
+	RemoteUser string `json:"remote_user"`
+
+	RemoteSchema string   `json:"remote_schema"`
+	LocalSchema  string   `json:"local_schema"` // default public
+	Tables       []string `json:"tables"`       // LIMIT TO; empty imports the whole schema
+}
+
+// fdwOptions are the inputs of the fdw data_type. Password is the
+// remote_password input, kept apart from the spec so it is masked in the
+// designer and never part of an echoed input.
+type fdwOptions struct {
+	Spec     fdwSpec
+	Password string
+}
+
+func parseFDWSpec(val string) (fdwSpec, error) {
+	var s fdwSpec
+	if err := json.Unmarshal([]byte(val), &s); err != nil {
+		return s, fmt.Errorf("fdw must be a JSON object of {host, port, dbname, options, user, remote_user, remote_schema, local_schema, tables}: %v", err)
+	}
+	return s, nil
+}
+
+// manageFDW implements the fdw data_type: list shows the foreign servers,
+// user mappings and foreign tables; setup creates or updates the server
+// name, its user mapping and imports the foreign schema. Setup can be run
+// again with the same inputs: existing server options are updated, the
+// user mapping is replaced and tables that were already imported are
+// left out of the import. It runs in the request transaction, so a
+// failed step leaves nothing behind.
+func manageFDW(db querier, operation, name string, opts fdwOptions) (interface{}, error) {
+	switch operation {
+	case "", "list":
+		return listFDW(db)
+	case "setup":
+	default:
+		return nil, fmt.Errorf("unknown fdw operation %q (allowed: list, setup)", operation)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("name (the foreign server) is required for fdw setup")
+	}
+	spec := opts.Spec
+	server := pq.QuoteIdentifier(name)
+	res := map[string]interface{}{"server": name}
+
+	if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS postgres_fdw"); err != nil {
+		return nil, err
+	}
+
+	serverOpts := map[string]string{}
+	for k, v := range spec.Options {
+		serverOpts[k] = v
+	}
+	if spec.Host != "" {
+		serverOpts["host"] = spec.Host
+	}
+	if spec.Port != "" {
+		serverOpts["port"] = spec.Port.String()
+	}
+	if spec.DBName != "" {
+		serverOpts["dbname"] = spec.DBName
+	}
+	var current sql.NullString
+	err := db.QueryRow("SELECT array_to_json(srvoptions)::text FROM pg_foreign_server WHERE srvname = $1", name).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		stmt := fmt.Sprintf("CREATE SERVER %s FOREIGN DATA WRAPPER postgres_fdw", server)
+		if len(serverOpts) > 0 {
+			stmt += " OPTIONS (" + fdwOptionList(serverOpts, nil, false) + ")"
+		}
+		logSQL(stmt, nil)
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+		res["server_created"] = true
+	case err != nil:
+		return nil, err
+	default:
+		res["server_created"] = false
+		if len(serverOpts) > 0 {
+			have, err := parseOptionArray(current)
+			if err != nil {
+				return nil, err
+			}
+			stmt := fmt.Sprintf("ALTER SERVER %s OPTIONS (%s)", server, fdwOptionList(serverOpts, have, false))
+			logSQL(stmt, nil)
+			if _, err := db.Exec(stmt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if spec.RemoteUser != "" {
+		user := "CURRENT_USER"
+		if spec.User != "" {
+			user = pq.QuoteIdentifier(spec.User)
+			if strings.EqualFold(spec.User, "public") {
+				user = "PUBLIC"
+			}
+		}
+		mapping := map[string]string{"user": spec.RemoteUser}
+		if opts.Password != "" {
+			mapping["password"] = opts.Password
+		}
+		// Replacing the mapping avoids reading its options, which only
+		// the server owner and superusers may see
+		drop := fmt.Sprintf("DROP USER MAPPING IF EXISTS FOR %s SERVER %s", user, server)
+		logSQL(drop, nil)
+		if _, err := db.Exec(drop); err != nil {
+			return nil, err
+		}
+		create := fmt.Sprintf("CREATE USER MAPPING FOR %s SERVER %s OPTIONS (", user, server)
+		logSQL(create+fdwOptionList(mapping, nil, true)+")", nil)
+		if _, err := db.Exec(create + fdwOptionList(mapping, nil, false) + ")"); err != nil {
+			return nil, err
+		}
+		res["user_mapping"] = map[string]interface{}{"user": strings.Trim(user, `"`), "remote_user": spec.RemoteUser, "password_set": opts.Password != ""}
+	}
+
+	if spec.RemoteSchema != "" {
+		imported, err := importForeignSchema(db, name, spec)
+		if err != nil {
+			return nil, err
+		}
+		res["imported_tables"] = imported
+	}
+	return res, nil
+}
+
+// importForeignSchema imports spec.RemoteSchema from server, skipping the
+// tables already imported into the local schema, and returns the foreign
+// tables it created.
+func importForeignSchema(db querier, server string, spec fdwSpec) ([]string, error) {
+	local := spec.LocalSchema
+	if local == "" {
+		local = "public"
+	}
+	existing, err := foreignTables(db, server, local)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := fmt.Sprintf("IMPORT FOREIGN SCHEMA %s", pq.QuoteIdentifier(spec.RemoteSchema))
+	if len(spec.Tables) > 0 {
+		var todo []string
+		for _, t := range spec.Tables {
+			if !containsString(existing, t) {
+				todo = append(todo, pq.QuoteIdentifier(t))
+			}
+		}
+		if len(todo) == 0 {
+			return []string{}, nil
+		}
+		stmt += " LIMIT TO (" + strings.Join(todo, ", ") + ")"
+	} else if len(existing) > 0 {
+		quoted := make([]string, len(existing))
+		for i, t := range existing {
+			quoted[i] = pq.QuoteIdentifier(t)
+		}
+		stmt += " EXCEPT (" + strings.Join(quoted, ", ") + ")"
+	}
+	stmt += fmt.Sprintf(" FROM SERVER %s INTO %s", pq.QuoteIdentifier(server), pq.QuoteIdentifier(local))
+	logSQL(stmt, nil)
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+
+	after, err := foreignTables(db, server, local)
+	if err != nil {
+		return nil, err
+	}
+	imported := make([]string, 0)
+	for _, t := range after {
+		if !containsString(existing, t) {
+			imported = append(imported, t)
+		}
+	}
+	return imported, nil
+}
+
+// foreignTables names the foreign tables of server in schema.
+func foreignTables(db querier, server, schema string) ([]string, error) {
+	rows, err := db.Query(`SELECT c.relname::text FROM pg_foreign_table ft
+		JOIN pg_class c ON c.oid = ft.ftrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_foreign_server s ON s.oid = ft.ftserver
+		WHERE s.srvname = $1 AND n.nspname = $2 ORDER BY 1`, server, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+// fdwOptionList renders opts as an OPTIONS list in key order. Keys in
+// have are SET, others ADDed; a nil have renders a plain CREATE list.
+// With redact, password values are replaced for logging.
+func fdwOptionList(opts, have map[string]string, redact bool) string {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		v := pq.QuoteLiteral(opts[k])
+		if redact && k == "password" {
+			v = "'********'"
+		}
+		parts[i] = pq.QuoteIdentifier(k) + " " + v
+		if have != nil {
+			if _, ok := have[k]; ok {
+				parts[i] = "SET " + parts[i]
+			} else {
+				parts[i] = "ADD " + parts[i]
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseOptionArray reads a catalog options array (key=value entries)
+// passed through array_to_json.
+func parseOptionArray(s sql.NullString) (map[string]string, error) {
+	out := map[string]string{}
+	if !s.Valid {
+		return out, nil
+	}
+	var entries []string
+	if err := json.Unmarshal([]byte(s.String), &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		k, v, _ := strings.Cut(e, "=")
+		out[k] = v
+	}
+	return out, nil
+}
+
+func listFDW(db querier) (interface{}, error) {
+	servers := make([]map[string]interface{}, 0)
+	err := scanRows(db, `SELECT s.srvname::text, w.fdwname::text, pg_get_userbyid(s.srvowner)::text, array_to_json(s.srvoptions)::text
+		FROM pg_foreign_server s JOIN pg_foreign_data_wrapper w ON w.oid = s.srvfdw ORDER BY 1`, nil,
+		func(scan func(...interface{}) error) error {
+			var name, wrapper, owner string
+			var options sql.NullString
+			if err := scan(&name, &wrapper, &owner, &options); err != nil {
+				return err
+			}
+			o, err := parseOptionArray(options)
+			if err != nil {
+				return err
+			}
+			servers = append(servers, map[string]interface{}{"name": name, "wrapper": wrapper, "owner": owner, "options": o})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// umoptions is null unless this role may see it; the password is never shown
+	mappings := make([]map[string]interface{}, 0)
+	err = scanRows(db, `SELECT srvname::text, usename::text, array_to_json(umoptions)::text FROM pg_user_mappings ORDER BY 1, 2`, nil,
+		func(scan func(...interface{}) error) error {
+			var server, user string
+			var options sql.NullString
+			if err := scan(&server, &user, &options); err != nil {
+				return err
+			}
+			o, err := parseOptionArray(options)
+			if err != nil {
+				return err
+			}
+			m := map[string]interface{}{"server": server, "user": user, "remote_user": nil, "password_set": nil}
+			if options.Valid {
+				m["remote_user"] = nullIfEmpty(o["user"])
+				_, hasPassword := o["password"]
+				m["password_set"] = hasPassword
+			}
+			mappings = append(mappings, m)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]map[string]interface{}, 0)
+	err = scanRows(db, `SELECT n.nspname::text, c.relname::text, s.srvname::text, array_to_json(ft.ftoptions)::text
+		FROM pg_foreign_table ft
+		JOIN pg_class c ON c.oid = ft.ftrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_foreign_server s ON s.oid = ft.ftserver
+		ORDER BY 1, 2`, nil, func(scan func(...interface{}) error) error {
+		var schema, name, server string
+		var options sql.NullString
+		if err := scan(&schema, &name, &server, &options); err != nil {
+			return err
+		}
+		o, err := parseOptionArray(options)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, map[string]interface{}{"schema": schema, "name": name, "server": server, "options": o})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"servers": servers, "user_mappings": mappings, "foreign_tables": tables}, nil
+}
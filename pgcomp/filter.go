@@ -0,0 +1,201 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// filterSpec is one entry of the "filter" input. Entries are ANDed into the
+// WHERE clause of table mode. With Path set the column is treated as jsonb
+// and the value at that path is compared instead of the column itself.
+type filterSpec struct {
+	Column string          `json:"column"`
+	Op     string          `json:"op"`
+	Value  json.RawMessage `json:"value"`
+	Path   json.RawMessage `json:"path"` // "a.b.c" or ["a","b","c"]
+
+	path  []string
+	value interface{}
+}
+
+var filterOps = []string{"=", "!=", "<>", "<", "<=", ">", ">=", "like", "ilike", "in", "is_null", "not_null", "contains"}
+
+func parseFilter(val string) ([]filterSpec, error) {
+	var filters []filterSpec
+	if err := json.Unmarshal([]byte(val), &filters); err != nil {
+		return nil, fmt.Errorf("filter must be a JSON array of {column, op, value, path}: %v", err)
+	}
+	for i := range filters {
+		f := &filters[i]
+		f.Op = strings.ToLower(f.Op)
+		if f.Op == "" {
+			f.Op = "="
+		}
+		if !containsString(filterOps, f.Op) {
+			return nil, fmt.Errorf("invalid filter op %q, allowed: %s", f.Op, strings.Join(filterOps, ", "))
+		}
+		if f.Column == "" {
+			return nil, fmt.Errorf("filter %d needs a column", i)
+		}
+		var err error
+		if f.path, err = parseJSONPath(f.Path); err != nil {
+			return nil, fmt.Errorf("filter on %s: %v", f.Column, err)
+		}
+		if f.Op == "is_null" || f.Op == "not_null" {
+			continue
+		}
+		if len(f.Value) == 0 {
+			return nil, fmt.Errorf("filter %s on %s needs a value", f.Op, f.Column)
+		}
+		dec := json.NewDecoder(bytes.NewReader(f.Value))
+		dec.UseNumber()
+		if err := dec.Decode(&f.value); err != nil {
+			return nil, fmt.Errorf("filter on %s: invalid value: %v", f.Column, err)
+		}
+		switch v := f.value.(type) {
+		case nil:
+			return nil, fmt.Errorf("filter on %s: use op is_null instead of a null value", f.Column)
+		case map[string]interface{}:
+			if f.Op != "contains" {
+				return nil, fmt.Errorf("filter on %s: object values are only allowed with op contains", f.Column)
+			}
+		case []interface{}:
+			if f.Op != "in" && f.Op != "contains" {
+				return nil, fmt.Errorf("filter on %s: array values are only allowed with ops in and contains", f.Column)
+			}
+			if f.Op == "in" {
+				if len(v) == 0 {
+					return nil, fmt.Errorf("filter on %s: in needs at least one value", f.Column)
+				}
+				for _, e := range v {
+					switch e.(type) {
+					case string, json.Number, bool:
+					default:
+						return nil, fmt.Errorf("filter on %s: in values must be scalars", f.Column)
+					}
+				}
+			}
+		default:
+			if f.Op == "in" {
+				return nil, fmt.Errorf("filter on %s: in needs an array value", f.Column)
+			}
+		}
+	}
+	return filters, nil
+}
+
+// parseJSONPath accepts a dotted string or a JSON array of keys. Keys are
+// limited to letters, digits, '_' and '-' so the rendered path literal needs
+// no escaping.
+func parseJSONPath(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var parts []string
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		parts = strings.Split(s, ".")
+	} else if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("path must be a dotted string or an array of keys")
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("path is empty")
+	}
+	for _, p := range parts {
+		if p == "" {
+			return nil, fmt.Errorf("path has an empty component")
+		}
+		for _, r := range p {
+			if !(r == '_' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+				return nil, fmt.Errorf("invalid path component %q", p)
+			}
+		}
+	}
+	return parts, nil
+}
+
+// render returns the boolean SQL expression for the filter, quoting the
+// column through column and binding every value through bind.
+func (f filterSpec) render(column func(string) (string, error), bind func(interface{}) string) (string, error) {
+	col, err := column(f.Column)
+	if err != nil {
+		return "", err
+	}
+	pathLit := ""
+	if len(f.path) > 0 {
+		pathLit = "'{" + strings.Join(f.path, ",") + "}'"
+	}
+
+	if f.Op == "contains" {
+		doc, _ := json.Marshal(f.value)
+		if pathLit != "" {
+			col += " #> " + pathLit
+		}
+		return fmt.Sprintf("%s @> %s::jsonb", col, bind(string(doc))), nil
+	}
+
+	expr := col
+	if pathLit != "" {
+		expr = col + " #>> " + pathLit
+		// The extracted value is text; cast it so numbers and booleans
+		// compare by value rather than lexically.
+		if cast := jsonCast(f.value); cast != "" {
+			expr = "(" + expr + ")::" + cast
+		}
+	}
+
+	switch f.Op {
+	case "is_null":
+		return expr + " IS NULL", nil
+	case "not_null":
+		return expr + " IS NOT NULL", nil
+	case "in":
+		vals := f.value.([]interface{})
+		strs := make([]string, len(vals))
+		for i, v := range vals {
+			strs[i] = fmt.Sprint(v)
+		}
+		return fmt.Sprintf("%s = ANY(%s)", expr, bind(pq.Array(strs))), nil
+	case "like", "ilike":
+		return fmt.Sprintf("%s %s %s", expr, strings.ToUpper(f.Op), bind(fmt.Sprint(f.value))), nil
+	}
+	op := f.Op
+	if op == "!=" {
+		op = "<>"
+	}
+	return fmt.Sprintf("%s %s %s", expr, op, bind(bindValue(f.value))), nil
+}
+
+// jsonCast is the type a text value extracted from jsonb is cast to before
+// comparing with v; empty means compare as text.
+func jsonCast(v interface{}) string {
+	switch t := v.(type) {
+	case json.Number:
+		return "numeric"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		if len(t) == 0 {
+			return ""
+		}
+		cast := jsonCast(t[0])
+		for _, e := range t[1:] {
+			if jsonCast(e) != cast {
+				return ""
+			}
+		}
+		return cast
+	}
+	return ""
+}
+
+func bindValue(v interface{}) interface{} {
+	if n, ok := v.(json.Number); ok {
+		return n.String()
+	}
+	return v
+}
@@ -0,0 +1,275 @@
+package pgcomp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// sqlOperatorChars make up operators, which fingerprintSQL always writes
+// surrounded by single spaces (except the :: cast).
+const sqlOperatorChars = "+-*/<>=~!@#%^&|`?"
+
+// sqlKeywords are upper-cased by fingerprintSQL; other bare words keep
+// their spelling.
+var sqlKeywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`ALL ALTER AND ANY ARRAY AS ASC ASYMMETRIC BEGIN BETWEEN BOTH BY CALL CASE
+		CAST CHECK COALESCE COLLATE COLUMN COMMIT CONCURRENTLY CONFLICT CONSTRAINT COPY CREATE CROSS CURRENT_DATE
+		CURRENT_TIMESTAMP CURRENT_USER DEFAULT DELETE DESC DISTINCT DO DROP ELSE END EXCEPT EXISTS EXPLAIN
+		FALSE FETCH FILTER FIRST FOR FOREIGN FROM FULL GRANT GROUP HAVING ILIKE IN INDEX INNER INSERT
+		INTERSECT INTERVAL INTO IS JOIN LATERAL LEADING LEFT LIKE LIMIT LOCKED MATERIALIZED MERGE NATURAL
+		NOT NOTHING NOWAIT NULL NULLS OF OFFSET ON ONLY OR ORDER OUTER OVER PARTITION PRIMARY RECURSIVE
+		REFERENCES RETURNING RIGHT ROLLBACK ROW ROWS SELECT SET SHARE SHOW SIMILAR SKIP SOME SYMMETRIC TABLE
+		THEN TO TRAILING TRUE TRUNCATE UNION UNIQUE UPDATE USING VALUES VIEW WHEN WHERE WINDOW WITH`) {
+		sqlKeywords[k] = true
+	}
+}
+
+// fingerprintSQL normalizes a statement the way pg_stat_statements does
+// for constants: every literal becomes a parameter placeholder, numbered
+// after the highest $n already in the text. Comments are dropped,
+// whitespace is collapsed and keywords are upper-cased, so the same
+// statement always produces the same text. stripped is the same text
+// with every placeholder written as ?, which is what the hash covers so
+// renumbering does not change it.
+func fingerprintSQL(sql string) (normalized, stripped string) {
+	r := []rune(sql)
+	next := maxParamNumber(r) + 1
+
+	var norm, strip strings.Builder
+	space := false
+	emit := func(n, s string) {
+		// Nothing is spaced off an opening bracket or a qualifying dot
+		if out := norm.String(); space && out != "" && !strings.HasSuffix(out, "(") && !strings.HasSuffix(out, ".") && !strings.HasSuffix(out, "[") {
+			norm.WriteByte(' ')
+			strip.WriteByte(' ')
+		}
+		space = false
+		norm.WriteString(n)
+		strip.WriteString(s)
+	}
+	constant := func() {
+		emit("$"+strconv.Itoa(next), "?")
+		next++
+	}
+	// A minus directly before a number is part of the constant unless
+	// it follows an operand, as in a-1
+	operandBefore := func() bool {
+		s := strings.TrimRight(norm.String(), " ")
+		if s == "" {
+			return false
+		}
+		last := rune(s[len(s)-1])
+		if last == ')' || last == '"' || unicode.IsDigit(last) {
+			return true
+		}
+		if unicode.IsLetter(last) || last == '_' {
+			w := s[strings.LastIndexFunc(s, func(c rune) bool { return !(unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_') })+1:]
+			return !sqlKeywords[strings.ToUpper(w)]
+		}
+		return false
+	}
+
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			space = true
+			i++
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+			space = true
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			i = skipBlockComment(r, i)
+			space = true
+		case c == '\'':
+			i = skipQuoted(r, i, c)
+			constant()
+		case (c == 'E' || c == 'e' || c == 'B' || c == 'b' || c == 'X' || c == 'x') && i+1 < len(r) && r[i+1] == '\'':
+			if c == 'E' || c == 'e' {
+				i = skipEscapeString(r, i+1)
+			} else {
+				i = skipQuoted(r, i+1, '\'')
+			}
+			constant()
+		case c == '"':
+			j := skipQuoted(r, i, c)
+			emit(string(r[i:j]), string(r[i:j]))
+			i = j
+		case c == '$':
+			if tag, ok := dollarTag(r, i); ok {
+				i = skipDollarQuoted(r, i, tag)
+				constant()
+				break
+			}
+			j := i + 1
+			for j < len(r) && unicode.IsDigit(r[j]) {
+				j++
+			}
+			emit(string(r[i:j]), "?")
+			i = j
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(r) && unicode.IsDigit(r[i+1])):
+			i = skipNumber(r, i)
+			constant()
+		case c == '-' && i+1 < len(r) && (unicode.IsDigit(r[i+1]) || r[i+1] == '.') && !operandBefore():
+			i = skipNumber(r, i+1)
+			constant()
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_' || r[j] == '$') {
+				j++
+			}
+			w := string(r[i:j])
+			if up := strings.ToUpper(w); sqlKeywords[up] {
+				w = up
+			}
+			emit(w, w)
+			i = j
+		case strings.ContainsRune(sqlOperatorChars, c):
+			j := i
+			for j < len(r) && strings.ContainsRune(sqlOperatorChars, r[j]) {
+				j++
+			}
+			// In =-1 the minus belongs to the constant
+			if j-i > 1 && r[j-1] == '-' && j < len(r) && unicode.IsDigit(r[j]) {
+				j--
+			}
+			op := string(r[i:j])
+			i = j
+			if op == "::" {
+				space = false
+				norm.WriteString(op)
+				strip.WriteString(op)
+				break
+			}
+			space = true
+			emit(op, op)
+			space = true
+		case c == '(':
+			// f(x) for calls, IN (x) after keywords and operators
+			space = !operandBefore()
+			emit("(", "(")
+			i++
+		default:
+			// Other punctuation binds to what precedes it: f(a, b), t.c
+			norm.WriteRune(c)
+			strip.WriteRune(c)
+			space = c == ','
+			i++
+		}
+	}
+	trim := func(s string) string { return strings.TrimRight(strings.TrimSpace(s), "; ") }
+	return trim(norm.String()), trim(strip.String())
+}
+
+// fingerprintHash is the short hash of the stripped fingerprint.
+func fingerprintHash(stripped string) string {
+	sum := sha256.Sum256([]byte(stripped))
+	return hex.EncodeToString(sum[:8])
+}
+
+func fingerprintResult(sql string) map[string]interface{} {
+	norm, stripped := fingerprintSQL(sql)
+	return map[string]interface{}{"fingerprint": norm, "fingerprint_hash": fingerprintHash(stripped)}
+}
+
+// maxParamNumber returns the highest $n placeholder outside literals.
+func maxParamNumber(r []rune) int {
+	max := 0
+	for i := 0; i < len(r); {
+		switch c := r[i]; {
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			i = skipBlockComment(r, i)
+		case c == '\'' || c == '"':
+			i = skipQuoted(r, i, c)
+		case (c == 'E' || c == 'e') && i+1 < len(r) && r[i+1] == '\'':
+			i = skipEscapeString(r, i+1)
+		case unicode.IsLetter(c) || c == '_':
+			for i < len(r) && (unicode.IsLetter(r[i]) || unicode.IsDigit(r[i]) || r[i] == '_' || r[i] == '$') {
+				i++
+			}
+		case c == '$':
+			if tag, ok := dollarTag(r, i); ok {
+				i = skipDollarQuoted(r, i, tag)
+				break
+			}
+			j := i + 1
+			for j < len(r) && unicode.IsDigit(r[j]) {
+				j++
+			}
+			if n, err := strconv.Atoi(string(r[i+1 : j])); err == nil && n > max {
+				max = n
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return max
+}
+
+// skipBlockComment returns the index just past the (possibly nested)
+// comment opened at r[i].
+func skipBlockComment(r []rune, i int) int {
+	depth := 0
+	for i < len(r) {
+		if r[i] == '/' && i+1 < len(r) && r[i+1] == '*' {
+			depth++
+			i += 2
+		} else if r[i] == '*' && i+1 < len(r) && r[i+1] == '/' {
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		} else {
+			i++
+		}
+	}
+	return i
+}
+
+// skipNumber returns the index just past the numeric literal at r[i]:
+// digits with an optional fraction and exponent, or 0x/0o/0b forms.
+func skipNumber(r []rune, i int) int {
+	isNum := func(c rune) bool { return unicode.IsDigit(c) || c == '_' }
+	if i+1 < len(r) && r[i] == '0' && strings.ContainsRune("xXoObB", r[i+1]) {
+		i += 2
+		for i < len(r) && (unicode.Is(unicode.ASCII_Hex_Digit, r[i]) || r[i] == '_') {
+			i++
+		}
+		return i
+	}
+	for i < len(r) && isNum(r[i]) {
+		i++
+	}
+	if i < len(r) && r[i] == '.' && !(i+1 < len(r) && r[i+1] == '.') {
+		i++
+		for i < len(r) && isNum(r[i]) {
+			i++
+		}
+	}
+	if i < len(r) && (r[i] == 'e' || r[i] == 'E') {
+		j := i + 1
+		if j < len(r) && (r[j] == '+' || r[j] == '-') {
+			j++
+		}
+		if j < len(r) && unicode.IsDigit(r[j]) {
+			i = j
+			for i < len(r) && unicode.IsDigit(r[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
@@ -0,0 +1,387 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxGenerateRows bounds one generate request.
+const maxGenerateRows = 1000000
+
+// fkSampleLimit is how many existing keys fk_sample draws from.
+const fkSampleLimit = 10000
+
+// generateColumn is one column of the "spec" input of generate mode.
+type generateColumn struct {
+	Type string `json:"type"` // sequence, random_int, random_decimal, choice, pattern, date_range, fk_sample
+
+	Start   *float64      `json:"start"` // sequence, default 1
+	Step    *float64      `json:"step"`  // sequence, default 1
+	Min     float64       `json:"min"`   // random_int, random_decimal
+	Max     float64       `json:"max"`
+	Scale   int           `json:"scale"`   // random_decimal, default 2
+	Values  []interface{} `json:"values"`  // choice
+	Pattern string        `json:"pattern"` // # digit, ? letter, * letter or digit
+	From    string        `json:"from"`    // date_range: dates, or timestamps
+	To      string        `json:"to"`
+	Table   string        `json:"table"` // fk_sample: referenced table and column
+	Column  string        `json:"column"`
+
+	from, to time.Time
+	dateOnly bool
+	sample   []interface{}
+}
+
+// generateOptions are the inputs of the generate data_type.
+type generateOptions struct {
+	Count int64
+	Spec  map[string]*generateColumn
+	Seed  *uint64
+}
+
+var generateTypes = []string{"sequence", "random_int", "random_decimal", "choice", "pattern", "date_range", "fk_sample"}
+
+func parseGenerateSpec(val string) (map[string]*generateColumn, error) {
+	var spec map[string]*generateColumn
+	if err := json.Unmarshal([]byte(val), &spec); err != nil {
+		return nil, fmt.Errorf("spec must be a JSON object of column to {type, ...}: %v", err)
+	}
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("spec is empty")
+	}
+	for name, c := range spec {
+		if c == nil {
+			return nil, fmt.Errorf("spec for %s is null", name)
+		}
+		c.Type = strings.ToLower(c.Type)
+		switch c.Type {
+		case "sequence":
+		case "random_int", "random_decimal":
+			if c.Max < c.Min {
+				return nil, fmt.Errorf("%s: max is below min", name)
+			}
+			if c.Type == "random_decimal" && c.Scale == 0 {
+				c.Scale = 2
+			}
+			if c.Scale < 0 || c.Scale > 15 {
+				return nil, fmt.Errorf("%s: scale must be between 0 and 15", name)
+			}
+		case "choice":
+			if len(c.Values) == 0 {
+				return nil, fmt.Errorf("%s: choice needs values", name)
+			}
+		case "pattern":
+			if c.Pattern == "" {
+				return nil, fmt.Errorf("%s: pattern needs a pattern", name)
+			}
+		case "date_range":
+			var err error
+			if c.from, c.dateOnly, err = parseGenerateTime(c.From); err != nil {
+				return nil, fmt.Errorf("%s: invalid from: %v", name, err)
+			}
+			var toDateOnly bool
+			if c.to, toDateOnly, err = parseGenerateTime(c.To); err != nil {
+				return nil, fmt.Errorf("%s: invalid to: %v", name, err)
+			}
+			c.dateOnly = c.dateOnly && toDateOnly
+			if c.to.Before(c.from) {
+				return nil, fmt.Errorf("%s: to is before from", name)
+			}
+		case "fk_sample":
+			if c.Table == "" || c.Column == "" {
+				return nil, fmt.Errorf("%s: fk_sample needs table and column", name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: invalid type %q, allowed: %s", name, c.Type, strings.Join(generateTypes, ", "))
+		}
+	}
+	return spec, nil
+}
+
+func parseGenerateTime(s string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, false, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("expected YYYY-MM-DD or YYYY-MM-DD HH:MM:SS")
+}
+
+// generateRows inserts opts.Count generated rows into table in batches. db
+// should be the request transaction. Without a seed a random one is used
+// and reported, so any run can be repeated.
+func generateRows(db querier, table string, opts generateOptions) (interface{}, error) {
+	if opts.Count <= 0 {
+		return nil, fmt.Errorf("count is required for generate")
+	}
+	if opts.Count > maxGenerateRows {
+		return nil, fmt.Errorf("count is limited to %d rows per request", maxGenerateRows)
+	}
+	if len(opts.Spec) == 0 {
+		return nil, fmt.Errorf("spec is required for generate")
+	}
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	relCols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(relCols))
+	for i, c := range relCols {
+		known[i] = c.Name
+	}
+
+	names := make([]string, 0, len(opts.Spec))
+	for name := range opts.Spec {
+		if !containsString(known, name) {
+			return nil, fmt.Errorf("column %q does not exist in %s", name, rel.Name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := opts.Spec[name]
+		if c.Type != "fk_sample" {
+			continue
+		}
+		if c.sample, err = sampleKeys(db, c.Table, c.Column); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	var seed uint64
+	if opts.Seed != nil {
+		seed = *opts.Seed
+	} else {
+		seed = rand.Uint64()
+	}
+	rng := rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15))
+
+	keys, err := primaryKey(db, rel)
+	if err != nil {
+		return nil, err
+	}
+
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = pq.QuoteIdentifier(n)
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", rel.Name, strings.Join(quoted, ", "))
+	returning := ""
+	if len(keys) == 1 {
+		returning = " RETURNING " + pq.QuoteIdentifier(keys[0]) + "::text"
+	}
+
+	perBatch := int64(importBatchRows)
+	if maxRows := int64(maxBindParams / len(names)); perBatch > maxRows {
+		perBatch = maxRows
+	}
+
+	var created int64
+	var minKey, maxKey string
+	for done := int64(0); done < opts.Count; {
+		n := opts.Count - done
+		if n > perBatch {
+			n = perBatch
+		}
+		var args []interface{}
+		values := make([]string, n)
+		for r := int64(0); r < n; r++ {
+			ph := make([]string, len(names))
+			for i, name := range names {
+				args = append(args, opts.Spec[name].value(rng, done+r))
+				ph[i] = "$" + strconv.Itoa(len(args))
+			}
+			values[r] = "(" + strings.Join(ph, ", ") + ")"
+		}
+		stmt := prefix + strings.Join(values, ", ") + returning
+		logSQL(prefix+"...", nil)
+
+		if returning == "" {
+			res, err := db.Exec(stmt, args...)
+			if err != nil {
+				return nil, err
+			}
+			affected, _ := res.RowsAffected()
+			created += affected
+		} else {
+			rows, err := db.Query(stmt, args...)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var k string
+				if err := rows.Scan(&k); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				if created == 0 || compareKeys(k, minKey) < 0 {
+					minKey = k
+				}
+				if created == 0 || compareKeys(k, maxKey) > 0 {
+					maxKey = k
+				}
+				created++
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+		}
+		done += n
+	}
+
+	res := map[string]interface{}{"table": rel.Name, "created": created, "seed": strconv.FormatUint(seed, 10)}
+	if returning != "" && created > 0 {
+		res["keys"] = map[string]interface{}{keys[0]: map[string]interface{}{"min": minKey, "max": maxKey}}
+	}
+	return res, nil
+}
+
+// value produces the column's value for row i (0-based).
+func (c *generateColumn) value(rng *rand.Rand, i int64) interface{} {
+	switch c.Type {
+	case "sequence":
+		start, step := 1.0, 1.0
+		if c.Start != nil {
+			start = *c.Start
+		}
+		if c.Step != nil {
+			step = *c.Step
+		}
+		return strconv.FormatFloat(start+step*float64(i), 'f', -1, 64)
+	case "random_int":
+		lo, hi := int64(math.Ceil(c.Min)), int64(math.Floor(c.Max))
+		if hi < lo {
+			return lo
+		}
+		return lo + rng.Int64N(hi-lo+1)
+	case "random_decimal":
+		return strconv.FormatFloat(c.Min+rng.Float64()*(c.Max-c.Min), 'f', c.Scale, 64)
+	case "choice":
+		return generateArg(c.Values[rng.IntN(len(c.Values))])
+	case "pattern":
+		const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+		const alnum = letters + "0123456789"
+		var b strings.Builder
+		for _, r := range c.Pattern {
+			switch r {
+			case '#':
+				b.WriteByte(byte('0' + rng.IntN(10)))
+			case '?':
+				b.WriteByte(letters[rng.IntN(len(letters))])
+			case '*':
+				b.WriteByte(alnum[rng.IntN(len(alnum))])
+			default:
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	case "date_range":
+		span := c.to.Sub(c.from)
+		if c.dateOnly {
+			days := int64(span / (24 * time.Hour))
+			return c.from.AddDate(0, 0, int(rng.Int64N(days+1))).Format("2006-01-02")
+		}
+		var off time.Duration
+		if span > 0 {
+			off = time.Duration(rng.Int64N(int64(span)))
+		}
+		return c.from.Add(off).Format("2006-01-02 15:04:05")
+	case "fk_sample":
+		if len(c.sample) == 0 {
+			return nil
+		}
+		return c.sample[rng.IntN(len(c.sample))]
+	}
+	return nil
+}
+
+func generateArg(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return v
+}
+
+// sampleKeys reads up to fkSampleLimit distinct values of column from
+// table, in order so a seeded run picks the same keys.
+func sampleKeys(db querier, table, column string) ([]interface{}, error) {
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	q := fmt.Sprintf("SELECT DISTINCT %s::text FROM %s WHERE %s IS NOT NULL ORDER BY 1 LIMIT %d",
+		pq.QuoteIdentifier(column), rel.Name, pq.QuoteIdentifier(column), fkSampleLimit)
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []interface{}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no rows to sample %s from", rel.Name, column)
+	}
+	return keys, nil
+}
+
+// primaryKey returns the primary key columns of rel, in key order.
+func primaryKey(db querier, rel *relation) ([]string, error) {
+	rows, err := db.Query(`SELECT a.attname FROM pg_index i
+		CROSS JOIN LATERAL unnest(i.indkey) WITH ORDINALITY AS k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		WHERE i.indrelid = $1 AND i.indisprimary
+		ORDER BY k.ord`, rel.OID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	return cols, rows.Err()
+}
+
+// compareKeys orders key text numerically when both sides are numbers.
+func compareKeys(a, b string) int {
+	ra, okA := new(big.Rat).SetString(a)
+	rb, okB := new(big.Rat).SetString(b)
+	if okA && okB {
+		return ra.Cmp(rb)
+	}
+	return strings.Compare(a, b)
+}
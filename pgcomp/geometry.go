@@ -0,0 +1,413 @@
+package pgcomp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var geometryFormats = []string{"geojson", "wkt", "ewkb"}
+
+// geometryColumns picks the geometry and geography columns out of cols
+// with the SRID from their type modifier, nil when unconstrained.
+func geometryColumns(cols []columnInfo) map[string]interface{} {
+	geoms := map[string]interface{}{}
+	for _, c := range cols {
+		if c.TypName != "geometry" && c.TypName != "geography" {
+			continue
+		}
+		// PostGIS packs the SRID into bits 8-28 of the typmod (TYPMOD_GET_SRID)
+		var srid int32
+		if c.TypMod > 0 {
+			srid = ((c.TypMod & 0x0FFFFF00) - (c.TypMod & 0x10000000)) >> 8
+		}
+		if srid > 0 {
+			geoms[c.Name] = int64(srid)
+		} else {
+			geoms[c.Name] = nil
+		}
+	}
+	return geoms
+}
+
+// geometrySelect wraps a quoted geometry column for the requested format,
+// keeping the column name. ewkb is the server's own output and is left as is.
+func geometrySelect(quoted, format string) string {
+	switch format {
+	case "geojson":
+		return fmt.Sprintf("ST_AsGeoJSON(%s) AS %s", quoted, quoted)
+	case "wkt":
+		return fmt.Sprintf("ST_AsText(%s) AS %s", quoted, quoted)
+	}
+	return quoted
+}
+
+// geometryOutput converts geometry values while result rows are built:
+// columns table mode already rewrote only need GeoJSON text turned into
+// JSON, anything else arriving as hex EWKB is decoded client-side. SRIDs
+// gathers the SRID per column for the response metadata.
+type geometryOutput struct {
+	format    string
+	rewritten map[string]interface{}
+	SRIDs     map[string]interface{}
+}
+
+func newGeometryOutput(format string, rewritten map[string]interface{}) *geometryOutput {
+	g := &geometryOutput{format: format, rewritten: rewritten, SRIDs: map[string]interface{}{}}
+	for c, srid := range rewritten {
+		g.SRIDs[c] = srid
+	}
+	return g
+}
+
+func (g *geometryOutput) apply(col, dbType string, val interface{}) interface{} {
+	s, ok := val.(string)
+	if !ok {
+		return val
+	}
+	if _, ok := g.rewritten[col]; ok {
+		if g.format == "geojson" {
+			return json.RawMessage(s)
+		}
+		return val
+	}
+	if dbType != geometryType && dbType != geographyType && dbType != unknownType {
+		return val
+	}
+	geom, srid, err := decodeEWKB(s)
+	if err != nil {
+		if dbType != unknownType {
+			logger.Warn("could not decode geometry value", "column", col, "error", err.Error())
+		}
+		return val
+	}
+	if _, seen := g.SRIDs[col]; !seen {
+		if srid > 0 {
+			g.SRIDs[col] = srid
+		} else {
+			g.SRIDs[col] = nil
+		}
+	}
+	switch g.format {
+	case "geojson":
+		return geom.geoJSON()
+	case "wkt":
+		return geom.wkt()
+	}
+	return val
+}
+
+// geom is a decoded simple-feature geometry. coords holds []float64 for a
+// point, [][]float64 for a line string or multipoint, [][][]float64 for a
+// polygon or multilinestring and [][][][]float64 for a multipolygon.
+type geom struct {
+	kind   string // GeoJSON type name
+	z, m   bool
+	coords interface{}
+	geoms  []*geom // GeometryCollection members
+}
+
+var wkbKinds = map[uint32]string{
+	1: "Point", 2: "LineString", 3: "Polygon", 4: "MultiPoint",
+	5: "MultiLineString", 6: "MultiPolygon", 7: "GeometryCollection",
+}
+
+// EWKB type flags
+const (
+	ewkbZ    = 0x80000000
+	ewkbM    = 0x40000000
+	ewkbSRID = 0x20000000
+)
+
+type wkbReader struct {
+	b   []byte
+	pos int
+}
+
+// decodeEWKB decodes the hex EWKB text PostGIS outputs for geometry and
+// geography values. Curved and surface types are not supported.
+func decodeEWKB(s string) (*geom, int64, error) {
+	if len(s) < 10 || len(s)%2 != 0 {
+		return nil, 0, fmt.Errorf("not hex EWKB")
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, 0, fmt.Errorf("not hex EWKB")
+	}
+	r := &wkbReader{b: b}
+	g, srid, err := r.geometry()
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.pos != len(b) {
+		return nil, 0, fmt.Errorf("trailing bytes after geometry")
+	}
+	return g, srid, nil
+}
+
+func (r *wkbReader) geometry() (*geom, int64, error) {
+	if r.pos >= len(r.b) {
+		return nil, 0, fmt.Errorf("truncated geometry")
+	}
+	var order binary.ByteOrder
+	switch r.b[r.pos] {
+	case 0:
+		order = binary.BigEndian
+	case 1:
+		order = binary.LittleEndian
+	default:
+		return nil, 0, fmt.Errorf("invalid byte order")
+	}
+	r.pos++
+	typ, err := r.uint32(order)
+	if err != nil {
+		return nil, 0, err
+	}
+	var srid int64
+	if typ&ewkbSRID != 0 {
+		v, err := r.uint32(order)
+		if err != nil {
+			return nil, 0, err
+		}
+		srid = int64(int32(v))
+	}
+	g := &geom{z: typ&ewkbZ != 0, m: typ&ewkbM != 0}
+	base := typ & 0x0FFFFFFF
+	// ISO WKB encodes dimensions as 1000 (Z), 2000 (M) and 3000 (ZM)
+	switch base / 1000 {
+	case 1:
+		g.z = true
+	case 2:
+		g.m = true
+	case 3:
+		g.z, g.m = true, true
+	}
+	base %= 1000
+	if g.kind = wkbKinds[base]; g.kind == "" {
+		return nil, 0, fmt.Errorf("unsupported geometry type %d", base)
+	}
+
+	dims := 2
+	if g.z {
+		dims++
+	}
+	if g.m {
+		dims++
+	}
+	switch base {
+	case 1:
+		g.coords, err = r.point(order, dims)
+	case 2:
+		g.coords, err = r.points(order, dims)
+	case 3:
+		g.coords, err = r.rings(order, dims)
+	default:
+		n, err := r.uint32(order)
+		if err != nil {
+			return nil, 0, err
+		}
+		var parts []*geom
+		for i := uint32(0); i < n; i++ {
+			part, _, err := r.geometry()
+			if err != nil {
+				return nil, 0, err
+			}
+			parts = append(parts, part)
+		}
+		g.setParts(base, parts)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return g, srid, nil
+}
+
+func (g *geom) setParts(base uint32, parts []*geom) {
+	switch base {
+	case 4:
+		pts := make([][]float64, 0, len(parts))
+		for _, p := range parts {
+			pts = append(pts, p.coords.([]float64))
+		}
+		g.coords = pts
+	case 5:
+		lines := make([][][]float64, 0, len(parts))
+		for _, p := range parts {
+			lines = append(lines, p.coords.([][]float64))
+		}
+		g.coords = lines
+	case 6:
+		polys := make([][][][]float64, 0, len(parts))
+		for _, p := range parts {
+			polys = append(polys, p.coords.([][][]float64))
+		}
+		g.coords = polys
+	default:
+		g.geoms = parts
+	}
+}
+
+func (r *wkbReader) uint32(order binary.ByteOrder) (uint32, error) {
+	if r.pos+4 > len(r.b) {
+		return 0, fmt.Errorf("truncated geometry")
+	}
+	v := order.Uint32(r.b[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *wkbReader) point(order binary.ByteOrder, dims int) ([]float64, error) {
+	if r.pos+8*dims > len(r.b) {
+		return nil, fmt.Errorf("truncated geometry")
+	}
+	p := make([]float64, dims)
+	for i := range p {
+		p[i] = math.Float64frombits(order.Uint64(r.b[r.pos:]))
+		r.pos += 8
+	}
+	if math.IsNaN(p[0]) && math.IsNaN(p[1]) {
+		return []float64{}, nil // POINT EMPTY
+	}
+	return p, nil
+}
+
+func (r *wkbReader) points(order binary.ByteOrder, dims int) ([][]float64, error) {
+	n, err := r.uint32(order)
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > (len(r.b)-r.pos)/(8*dims) {
+		return nil, fmt.Errorf("truncated geometry")
+	}
+	pts := make([][]float64, n)
+	for i := range pts {
+		if pts[i], err = r.point(order, dims); err != nil {
+			return nil, err
+		}
+	}
+	return pts, nil
+}
+
+func (r *wkbReader) rings(order binary.ByteOrder, dims int) ([][][]float64, error) {
+	n, err := r.uint32(order)
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > (len(r.b)-r.pos)/4 {
+		return nil, fmt.Errorf("truncated geometry")
+	}
+	rings := make([][][]float64, n)
+	for i := range rings {
+		if rings[i], err = r.points(order, dims); err != nil {
+			return nil, err
+		}
+	}
+	return rings, nil
+}
+
+// geoJSON renders g as a GeoJSON geometry object. GeoJSON has no measure
+// ordinate, so M values are dropped.
+func (g *geom) geoJSON() map[string]interface{} {
+	if g.kind == "GeometryCollection" {
+		members := make([]interface{}, len(g.geoms))
+		for i, p := range g.geoms {
+			members[i] = p.geoJSON()
+		}
+		return map[string]interface{}{"type": g.kind, "geometries": members}
+	}
+	keep := 2
+	if g.z {
+		keep = 3
+	}
+	return map[string]interface{}{"type": g.kind, "coordinates": trimCoords(g.coords, keep)}
+}
+
+func trimCoords(c interface{}, keep int) interface{} {
+	switch v := c.(type) {
+	case []float64:
+		if len(v) > keep {
+			return v[:keep]
+		}
+		return v
+	case [][]float64:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = trimCoords(v[i], keep)
+		}
+		return out
+	case [][][]float64:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = trimCoords(v[i], keep)
+		}
+		return out
+	case [][][][]float64:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = trimCoords(v[i], keep)
+		}
+		return out
+	}
+	return c
+}
+
+// wkt renders g in the form ST_AsText produces.
+func (g *geom) wkt() string {
+	name := strings.ToUpper(g.kind)
+	switch {
+	case g.z && g.m:
+		name += " ZM"
+	case g.z:
+		name += " Z"
+	case g.m:
+		name += " M"
+	}
+	if g.kind == "GeometryCollection" {
+		if len(g.geoms) == 0 {
+			return name + " EMPTY"
+		}
+		parts := make([]string, len(g.geoms))
+		for i, p := range g.geoms {
+			parts[i] = p.wkt()
+		}
+		return name + "(" + strings.Join(parts, ",") + ")"
+	}
+	body := wktCoords(g.coords)
+	if body == "()" || body == "" {
+		return name + " EMPTY"
+	}
+	return name + body
+}
+
+func wktCoords(c interface{}) string {
+	join := func(n int, f func(int) string) string {
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = f(i)
+		}
+		return "(" + strings.Join(parts, ",") + ")"
+	}
+	switch v := c.(type) {
+	case []float64:
+		return "(" + wktPoint(v) + ")"
+	case [][]float64:
+		return join(len(v), func(i int) string { return wktPoint(v[i]) })
+	case [][][]float64:
+		return join(len(v), func(i int) string { return wktCoords(v[i]) })
+	case [][][][]float64:
+		return join(len(v), func(i int) string { return wktCoords(v[i]) })
+	}
+	return ""
+}
+
+func wktPoint(p []float64) string {
+	parts := make([]string, len(p))
+	for i, f := range p {
+		parts[i] = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strings.Join(parts, " ")
+}
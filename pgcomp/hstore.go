@@ -0,0 +1,124 @@
+package pgcomp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// decodeHstore parses the hstore text form ("a"=>"1", "b"=>NULL) into a
+// map; NULL values become nil.
+func decodeHstore(s string) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	i := 0
+	skipSpace := func() {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+			i++
+		}
+	}
+	// token reads a quoted or bare item and reports whether it was quoted
+	token := func() (string, bool, error) {
+		skipSpace()
+		if i >= len(s) {
+			return "", false, fmt.Errorf("unexpected end of hstore")
+		}
+		var b strings.Builder
+		if s[i] == '"' {
+			for i++; i < len(s); i++ {
+				switch s[i] {
+				case '\\':
+					if i+1 >= len(s) {
+						return "", false, fmt.Errorf("unterminated escape in hstore")
+					}
+					i++
+					b.WriteByte(s[i])
+				case '"':
+					i++
+					return b.String(), true, nil
+				default:
+					b.WriteByte(s[i])
+				}
+			}
+			return "", false, fmt.Errorf("unterminated quote in hstore")
+		}
+		start := i
+		for i < len(s) && s[i] != ',' && s[i] != '=' && s[i] != ' ' && s[i] != '"' {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			i++
+		}
+		if i == start {
+			return "", false, fmt.Errorf("expected key or value at offset %d", i)
+		}
+		return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(s[start:i]), false, nil
+	}
+
+	for {
+		skipSpace()
+		if i >= len(s) {
+			return m, nil
+		}
+		key, _, err := token()
+		if err != nil {
+			return nil, err
+		}
+		skipSpace()
+		if !strings.HasPrefix(s[i:], "=>") {
+			return nil, fmt.Errorf("expected => after key %q", key)
+		}
+		i += 2
+		val, quoted, err := token()
+		if err != nil {
+			return nil, err
+		}
+		if !quoted && strings.EqualFold(val, "NULL") {
+			m[key] = nil
+		} else {
+			m[key] = val
+		}
+		skipSpace()
+		if i < len(s) {
+			if s[i] != ',' {
+				return nil, fmt.Errorf("expected , at offset %d", i)
+			}
+			i++
+		}
+	}
+}
+
+// encodeHstore renders m in hstore input syntax with keys sorted so the
+// same object always produces the same text.
+func encodeHstore(m map[string]interface{}) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		v := "NULL"
+		if m[k] != nil {
+			v = quote(fmt.Sprint(m[k]))
+		}
+		pairs[i] = quote(k) + "=>" + v
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// hstoreArg converts a parameter of the form {"hstore": {...}} into hstore
+// text so it binds to an hstore placeholder; other values pass through.
+func hstoreArg(arg interface{}) interface{} {
+	obj, ok := arg.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return arg
+	}
+	inner, ok := obj["hstore"].(map[string]interface{})
+	if !ok {
+		return arg
+	}
+	return encodeHstore(inner)
+}
@@ -0,0 +1,116 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// idempotencyCleanupRows caps the expired keys one request deletes.
+const idempotencyCleanupRows = 100
+
+// idempotencySpec is the "idempotency" input. The table needs a unique
+// key column (text) and a timestamptz column, by default
+//
+//	key text PRIMARY KEY, created_at timestamptz NOT NULL
+type idempotencySpec struct {
+	Table      string  `json:"table"`
+	Key        string  `json:"key"`
+	TTLHours   float64 `json:"ttl_hours"` // 0 keeps keys forever
+	KeyColumn  string  `json:"key_column"`
+	TimeColumn string  `json:"time_column"`
+}
+
+func parseIdempotency(val string) (*idempotencySpec, error) {
+	var spec idempotencySpec
+	if err := json.Unmarshal([]byte(val), &spec); err != nil {
+		return nil, fmt.Errorf("invalid idempotency: %v", err)
+	}
+	if spec.Table == "" || spec.Key == "" {
+		return nil, fmt.Errorf("idempotency requires table and key")
+	}
+	if spec.TTLHours < 0 {
+		return nil, fmt.Errorf("idempotency ttl_hours must not be negative")
+	}
+	if spec.KeyColumn == "" {
+		spec.KeyColumn = "key"
+	}
+	if spec.TimeColumn == "" {
+		spec.TimeColumn = "created_at"
+	}
+	return &spec, nil
+}
+
+// claimIdempotencyKey records spec.Key in the request transaction before
+// the statement runs. It reports duplicate, with when the key was first
+// recorded, when the key is already there and younger than the TTL; an
+// expired key is taken over as if new. Since the claim is part of the
+// transaction, a failed request releases the key for its retry, and a
+// concurrent request with the same key waits for this one to finish.
+// Up to idempotencyCleanupRows other expired keys are deleted on the way.
+func claimIdempotencyKey(db querier, spec *idempotencySpec) (bool, time.Time, map[string]interface{}, error) {
+	var at time.Time
+	rel, err := resolveRelation(db, spec.Table)
+	if err != nil {
+		return false, at, nil, fmt.Errorf("idempotency table: %w", err)
+	}
+	relCols, err := rel.columns(db)
+	if err != nil {
+		return false, at, nil, err
+	}
+	known := make([]string, len(relCols))
+	for i, c := range relCols {
+		known[i] = c.Name
+	}
+	for _, c := range []string{spec.KeyColumn, spec.TimeColumn} {
+		if !containsString(known, c) {
+			return false, at, nil, fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+		}
+	}
+	key, ts := pq.QuoteIdentifier(spec.KeyColumn), pq.QuoteIdentifier(spec.TimeColumn)
+	ttl := strconv.FormatFloat(spec.TTLHours, 'f', -1, 64) + " hours"
+
+	q := fmt.Sprintf("INSERT INTO %s AS i (%s, %s) VALUES ($1, now()) ON CONFLICT (%s) DO NOTHING", rel.Name, key, ts, key)
+	args := []interface{}{spec.Key}
+	if spec.TTLHours > 0 {
+		q = fmt.Sprintf("INSERT INTO %s AS i (%s, %s) VALUES ($1, now()) ON CONFLICT (%s) DO UPDATE SET %s = EXCLUDED.%s WHERE i.%s < now() - $2::interval",
+			rel.Name, key, ts, key, ts, ts, ts)
+		args = append(args, ttl)
+	}
+	// xmax is set on a row the conflict branch updated
+	q += " RETURNING i.xmax::text <> '0'"
+	logSQL(q, args)
+	var renewed bool
+	err = db.QueryRow(q, args...).Scan(&renewed)
+	if err == sql.ErrNoRows {
+		q = fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", ts, rel.Name, key)
+		logSQL(q, []interface{}{spec.Key})
+		if err := db.QueryRow(q, spec.Key).Scan(&at); err != nil {
+			return false, at, nil, err
+		}
+		return true, at, nil, nil
+	}
+	if err != nil {
+		return false, at, nil, err
+	}
+
+	info := map[string]interface{}{"key": spec.Key, "expired_key_renewed": renewed, "expired_keys_deleted": int64(0)}
+	if spec.TTLHours > 0 {
+		// SKIP LOCKED keeps concurrent requests from queueing on each
+		// other's cleanup
+		q = fmt.Sprintf("DELETE FROM %s WHERE %s IN (SELECT %s FROM %s WHERE %s < now() - $1::interval AND %s <> $2 LIMIT %d FOR UPDATE SKIP LOCKED)",
+			rel.Name, key, key, rel.Name, ts, key, idempotencyCleanupRows)
+		logSQL(q, []interface{}{ttl, spec.Key})
+		res, err := db.Exec(q, ttl, spec.Key)
+		if err != nil {
+			return false, at, nil, err
+		}
+		n, _ := res.RowsAffected()
+		info["expired_keys_deleted"] = n
+	}
+	return false, at, info, nil
+}
@@ -0,0 +1,394 @@
+package pgcomp
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// importBatchRows is how many rows go into one multi-row INSERT.
+const importBatchRows = 500
+
+// maxReportedImportErrors caps the row errors echoed in the result.
+const maxReportedImportErrors = 100
+
+// importMapping is one entry of the "mapping" input: where a table column
+// comes from in the CSV and how the raw text is coerced.
+type importMapping struct {
+	CSVColumn   string `json:"csv_column"` // header name, or 1-based position
+	TableColumn string `json:"table_column"`
+	Type        string `json:"type"`   // text (default), integer, numeric, date, timestamp, boolean
+	Format      string `json:"format"` // date/timestamp: e.g. DD/MM/YYYY; numeric: "," for decimal comma
+	// AssumeTimezone and YearPivot complete Format for date/timestamp, see
+	// dateFormat
+	AssumeTimezone string `json:"assume_timezone"`
+	YearPivot      *int   `json:"year_pivot"`
+	// NumberLocale overrides the number_locale input for this column
+	NumberLocale *numberLocale `json:"number_locale"`
+
+	index    int
+	date     *dateFormat
+	dateType string        // date, timestamp or timestamptz: what date is written as
+	locale   *numberLocale // set when the table column is numeric
+	integer  bool
+}
+
+var importTypes = []string{"text", "integer", "numeric", "date", "timestamp", "boolean"}
+
+// importOptions are the inputs of the import data_type.
+type importOptions struct {
+	File      string
+	Mapping   []importMapping
+	Delimiter rune
+	MaxErrors int // rows that may be skipped before the import aborts
+	// NumberLocale reads the values of numeric table columns; a mapping
+	// entry's number_locale takes precedence
+	NumberLocale *numberLocale
+	// DateFormats reads the values of date columns mapped as text
+	DateFormats map[string]*dateFormat
+	// OverrideIdentity loads GENERATED ALWAYS identity columns with
+	// OVERRIDING SYSTEM VALUE instead of dropping them from the mapping.
+	OverrideIdentity bool
+	Progress         *progress
+	// Checkpoint commits the load in batches (commit_every); it is also
+	// the querier the rows are written through.
+	Checkpoint *checkpointer
+}
+
+// importError is one rejected CSV value.
+type importError struct {
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func parseImportMapping(val string) ([]importMapping, error) {
+	var m []importMapping
+	if err := json.Unmarshal([]byte(val), &m); err != nil {
+		return nil, fmt.Errorf("mapping must be a JSON array of {csv_column, table_column, type, format}: %v", err)
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("mapping is empty")
+	}
+	for i := range m {
+		e := &m[i]
+		if e.CSVColumn == "" || e.TableColumn == "" {
+			return nil, fmt.Errorf("mapping entry %d needs csv_column and table_column", i)
+		}
+		e.Type = strings.ToLower(e.Type)
+		switch e.Type {
+		case "":
+			e.Type = "text"
+		case "int", "bigint":
+			e.Type = "integer"
+		case "decimal", "number":
+			e.Type = "numeric"
+		case "bool":
+			e.Type = "boolean"
+		}
+		if !containsString(importTypes, e.Type) {
+			return nil, fmt.Errorf("invalid mapping type %q, allowed: %s", e.Type, strings.Join(importTypes, ", "))
+		}
+		if e.Type == "date" || e.Type == "timestamp" {
+			e.date = &dateFormat{Format: e.Format, AssumeTimezone: e.AssumeTimezone, YearPivot: e.YearPivot}
+			if err := e.date.prepare(); err != nil {
+				return nil, fmt.Errorf("mapping entry %d: %v", i, err)
+			}
+			e.dateType = e.Type
+		}
+		if l := e.NumberLocale; l != nil {
+			if len(l.Columns) > 0 {
+				return nil, fmt.Errorf("mapping entry %d: number_locale cannot have columns", i)
+			}
+			if err := l.check(); err != nil {
+				return nil, fmt.Errorf("mapping entry %d: number_locale: %v", i, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+// importCSV loads the mapped columns of a CSV file with a header row into
+// table using batched INSERTs. db should be the request transaction so a
+// failed load leaves nothing behind.
+func importCSV(db querier, table string, opts importOptions) (interface{}, error) {
+	if opts.File == "" {
+		return nil, fmt.Errorf("input_file is required for import")
+	}
+	if len(opts.Mapping) == 0 {
+		return nil, fmt.Errorf("mapping is required for import")
+	}
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(cols))
+	for i, c := range cols {
+		known[i] = c.Name
+	}
+
+	f, err := os.Open(opts.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input_file: %v", err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input_file: %v", err)
+	}
+	opts.Progress.expect(0, st.Size())
+	in := &countingReader{r: f}
+	r := csv.NewReader(in)
+	if opts.Delimiter != 0 {
+		r.Comma = opts.Delimiter
+	}
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+
+	targets := make([]string, len(opts.Mapping))
+	for i, m := range opts.Mapping {
+		if !containsString(known, m.TableColumn) {
+			return nil, fmt.Errorf("column %q does not exist in %s", m.TableColumn, rel.Name)
+		}
+		targets[i] = m.TableColumn
+	}
+	keep, stripped, overriding := splitReadOnly(targets, cols, opts.OverrideIdentity)
+	var mapping []importMapping
+	for _, m := range opts.Mapping {
+		if containsString(keep, m.TableColumn) {
+			mapping = append(mapping, m)
+		}
+	}
+	if len(mapping) == 0 {
+		return nil, fmt.Errorf("mapping only targets generated or identity columns")
+	}
+	types := make(map[string]string, len(cols))
+	for _, c := range cols {
+		types[c.Name] = c.TypName
+	}
+	quoted := make([]string, len(mapping))
+	for i := range mapping {
+		m := &mapping[i]
+		quoted[i] = pq.QuoteIdentifier(m.TableColumn)
+		// Only where a number is expected, and not over an explicit type
+		if containsString(numericTypes, types[m.TableColumn]) && (m.Type == "text" || m.Type == "numeric" || m.Type == "integer") {
+			m.locale = m.NumberLocale
+			if m.locale == nil {
+				m.locale = opts.NumberLocale.column(m.TableColumn)
+			}
+			m.integer = strings.HasPrefix(types[m.TableColumn], "int")
+		}
+		if typ := types[m.TableColumn]; containsString(dateTypes, typ) {
+			if f, ok := opts.DateFormats[m.TableColumn]; ok && m.Type == "text" {
+				m.date = f
+			}
+			if m.date != nil {
+				m.dateType = typ
+			}
+		}
+		m.index = -1
+		for j, h := range header {
+			if h == m.CSVColumn {
+				m.index = j
+				break
+			}
+		}
+		if m.index < 0 {
+			if n, err := strconv.Atoi(m.CSVColumn); err == nil && n >= 1 && n <= len(header) {
+				m.index = n - 1
+			} else {
+				return nil, fmt.Errorf("csv_column %q is not in the CSV header", m.CSVColumn)
+			}
+		}
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) ", rel.Name, strings.Join(quoted, ", "))
+	if overriding {
+		prefix += "OVERRIDING SYSTEM VALUE "
+	}
+	prefix += "VALUES "
+
+	// A resumed load skips rows by position, so the file must not change
+	if err := opts.Checkpoint.begin(hashInput(rel.Name, st.Size(), st.ModTime().UnixNano(), opts.Mapping, opts.Delimiter)); err != nil {
+		return nil, err
+	}
+
+	// line counts data rows as a spreadsheet would: the header is row 1
+	line := 1
+	var batch [][]interface{}
+	var loaded, skipped int64
+	var rowErrors []importError
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var args []interface{}
+		values := make([]string, len(batch))
+		for i, row := range batch {
+			ph := make([]string, len(row))
+			for j, v := range row {
+				args = append(args, v)
+				ph[j] = "$" + strconv.Itoa(len(args))
+			}
+			values[i] = "(" + strings.Join(ph, ", ") + ")"
+		}
+		stmt := prefix + strings.Join(values, ", ")
+		logSQL(prefix+"...", nil)
+		res, err := db.Exec(stmt, args...)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		loaded += n
+		batch = batch[:0]
+		return opts.Checkpoint.flushed(int64(line-1), n)
+	}
+
+	perBatch := importBatchRows
+	if maxRows := maxBindParams / len(mapping); perBatch > maxRows {
+		perBatch = maxRows
+	}
+	perBatch = opts.Checkpoint.batchRows(perBatch)
+
+	var readBytes int64
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV row %d: %v", line, err)
+		}
+		opts.Progress.add(1, in.n-readBytes)
+		readBytes = in.n
+		if opts.Checkpoint.skip(int64(line - 1)) {
+			continue
+		}
+
+		row := make([]interface{}, len(mapping))
+		var bad []importError
+		for i, m := range mapping {
+			raw := ""
+			if m.index < len(rec) {
+				raw = rec[m.index]
+			}
+			v, err := coerceImportValue(raw, m)
+			if err != nil {
+				bad = append(bad, importError{Row: line, Column: m.TableColumn, Value: raw, Reason: err.Error()})
+				continue
+			}
+			row[i] = v
+		}
+		if len(bad) > 0 {
+			skipped++
+			if len(rowErrors) < maxReportedImportErrors {
+				rowErrors = append(rowErrors, bad...)
+			}
+			if skipped > int64(opts.MaxErrors) {
+				lost := "nothing was loaded"
+				if opts.Checkpoint != nil {
+					lost = "the rows since the last committed batch were not loaded"
+				}
+				ce := newError("import_failed", "import aborted after %d invalid rows (max_errors %d); %s", skipped, opts.MaxErrors, lost)
+				ce.Details = map[string]interface{}{"errors": rowErrors}
+				return nil, ce
+			}
+			continue
+		}
+		batch = append(batch, row)
+		if len(batch) >= perBatch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	if rowErrors == nil {
+		rowErrors = []importError{}
+	}
+	res := map[string]interface{}{"table": rel.Name, "loaded": loaded, "skipped": skipped, "errors": rowErrors}
+	opts.Progress.finish(res)
+	if err := opts.Checkpoint.finish(res); err != nil {
+		return nil, err
+	}
+	return writeResult(res, stripped), nil
+}
+
+// coerceImportValue trims raw and converts it per the mapping. An empty
+// value is NULL.
+func coerceImportValue(raw string, m importMapping) (interface{}, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return nil, nil
+	}
+	if m.locale != nil {
+		return m.locale.parse(s, m.integer)
+	}
+	if m.date != nil {
+		return m.date.parse(s, m.dateType)
+	}
+	switch m.Type {
+	case "integer":
+		s = strings.NewReplacer(" ", "", "\u00a0", "").Replace(s)
+		if m.Format == "," {
+			s = strings.ReplaceAll(s, ".", "")
+		} else {
+			s = strings.ReplaceAll(s, ",", "")
+		}
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("not an integer")
+		}
+		return s, nil
+	case "numeric":
+		s = strings.NewReplacer(" ", "", "\u00a0", "").Replace(s)
+		if m.Format == "," {
+			// decimal comma: 1.234,56
+			s = strings.ReplaceAll(s, ".", "")
+			s = strings.ReplaceAll(s, ",", ".")
+		} else {
+			s = strings.ReplaceAll(s, ",", "")
+		}
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, fmt.Errorf("not a number")
+		}
+		return s, nil
+	case "boolean":
+		switch strings.ToLower(s) {
+		case "true", "t", "yes", "y", "1", "on":
+			return true, nil
+		case "false", "f", "no", "n", "0", "off":
+			return false, nil
+		}
+		return nil, fmt.Errorf("not a boolean")
+	}
+	return s, nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+// Fixed btree page and tuple overheads used by the bloat estimate: the
+// page header, the btree special space, and per tuple the index tuple
+// header and its line pointer.
+const (
+	btreePageOverhead  = 24 + 16
+	btreeTupleOverhead = 8 + 4
+)
+
+// indexReport answers the index_report data_type: every index of table
+// (when non-empty), of schema, or of all user schemas, with its size, how
+// often it was scanned, whether it is valid, and an estimated bloat.
+// Scan counts only cover the time since stats_reset, which is reported
+// alongside because a promoted standby starts with empty statistics.
+func indexReport(db querier, table, schema string) (interface{}, error) {
+	var relOID interface{}
+	if table != "" {
+		rel, err := resolveRelation(db, table)
+		if err != nil {
+			return nil, err
+		}
+		relOID = rel.OID
+	}
+
+	var statsReset sql.NullTime
+	var started time.Time
+	if err := db.QueryRow(`SELECT (SELECT stats_reset FROM pg_stat_database WHERE datname = current_database()),
+		pg_postmaster_start_time()`).Scan(&statsReset, &started); err != nil {
+		return nil, err
+	}
+
+	// The bloat estimate follows the usual catalog-based approach: the size
+	// the index would have when packed to its fillfactor, from the row
+	// count and the average width of the key columns in pg_stats, compared
+	// with its actual size. It needs a btree over plain columns with
+	// statistics; the others get no estimate.
+	rows, err := db.Query(`SELECT n.nspname::text, t.relname::text, c.relname::text, am.amname::text,
+			pg_relation_size(c.oid), c.relpages, c.reltuples::float8,
+			COALESCE(s.idx_scan, 0), COALESCE(s.idx_tup_read, 0),
+			i.indisvalid, i.indisunique, i.indisprimary,
+			COALESCE(substring(array_to_string(c.reloptions, ',') FROM 'fillfactor=([0-9]+)')::int, 90),
+			current_setting('block_size')::int,
+			0 = ANY(i.indkey::int2[]) OR i.indnatts <> (
+				SELECT count(*) FROM pg_attribute a JOIN pg_stats st
+					ON st.schemaname = n.nspname AND st.tablename = t.relname AND st.attname = a.attname
+				WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey::int2[])),
+			(SELECT COALESCE(sum((1 - st.null_frac) * st.avg_width), 0)::float8 FROM pg_attribute a JOIN pg_stats st
+				ON st.schemaname = n.nspname AND st.tablename = t.relname AND st.attname = a.attname
+			WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey::int2[]))
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_am am ON am.oid = c.relam
+		LEFT JOIN pg_stat_all_indexes s ON s.indexrelid = i.indexrelid
+		WHERE ($1::oid IS NULL OR i.indrelid = $1::oid)
+			AND ($2 = '' OR n.nspname = $2)
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname !~ '^pg_toast'
+		ORDER BY pg_relation_size(c.oid) DESC, 1, 2, 3`, relOID, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := make([]map[string]interface{}, 0)
+	var unused, invalid int
+	for rows.Next() {
+		var nsp, tbl, name, method string
+		var size, pages, scans, tupRead int64
+		var tuples, width float64
+		var valid, unique, primary, noEstimate bool
+		var fillfactor, blockSize int
+		if err := rows.Scan(&nsp, &tbl, &name, &method, &size, &pages, &tuples, &scans, &tupRead,
+			&valid, &unique, &primary, &fillfactor, &blockSize, &noEstimate, &width); err != nil {
+			return nil, err
+		}
+		r := map[string]interface{}{
+			"schema":      nsp,
+			"table":       tbl,
+			"index":       name,
+			"method":      method,
+			"size_bytes":  size,
+			"scans":       scans,
+			"tuples_read": tupRead,
+			"unused":      scans == 0,
+			"valid":       valid,
+			"unique":      unique,
+			"primary":     primary,
+			// Unused unique indexes still enforce a constraint
+			"enforces_constraint": unique || primary,
+			"bloat_pct":           nil,
+			"bloat_bytes":         nil,
+		}
+		if method == "btree" && !noEstimate && tuples >= 0 && pages > 1 {
+			pct, wasted := btreeBloat(pages, tuples, width, fillfactor, blockSize)
+			r["bloat_pct"] = pct
+			r["bloat_bytes"] = wasted
+		}
+		if scans == 0 {
+			unused++
+		}
+		if !valid {
+			invalid++
+		}
+		indexes = append(indexes, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{
+		"indexes":        indexes,
+		"unused":         unused,
+		"invalid":        invalid,
+		"stats_reset":    nil,
+		"server_started": started.Format(time.RFC3339),
+	}
+	if statsReset.Valid {
+		res["stats_reset"] = statsReset.Time.Format(time.RFC3339)
+	}
+	return res, nil
+}
+
+// btreeBloat estimates how much of an index of pages pages is free space,
+// given its row count, the average key width and its fillfactor.
+func btreeBloat(pages int64, tuples, width float64, fillfactor, blockSize int) (float64, int64) {
+	tupleSize := btreeTupleOverhead + math.Ceil(width/8)*8 // MAXALIGN
+	perPage := math.Floor(float64(blockSize-btreePageOverhead) * float64(fillfactor) / 100 / tupleSize)
+	if perPage < 1 {
+		return 0, 0
+	}
+	expected := int64(math.Ceil(tuples/perPage)) + 1 // plus the metapage
+	if expected >= pages {
+		return 0, 0
+	}
+	wasted := pages - expected
+	return math.Round(float64(wasted)/float64(pages)*1000) / 10, wasted * int64(blockSize)
+}
@@ -0,0 +1,370 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The database of docker-compose.yml. Tests that need it skip when it is
+// not running.
+const (
+	fixtureHost = "localhost"
+	fixturePort = "55432"
+	fixtureUser = "component"
+)
+
+// fixtureDB connects to the compose database and reloads
+// testdata/fixtures.sql, so every test starts from the same rows.
+func fixtureDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable connect_timeout=2",
+		fixtureHost, fixturePort, fixtureUser, fixtureUser, fixtureUser)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Skipf("fixture database not reachable (docker compose up -d): %v", err)
+	}
+	fixtures, err := os.ReadFile("testdata/fixtures.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS fixtures CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(fixtures)); err != nil {
+		t.Fatalf("loading fixtures: %v", err)
+	}
+	return db
+}
+
+// runFixture runs one request against the compose database with driver.
+func runFixture(t *testing.T, driver string, params ...string) Response {
+	t.Helper()
+	conn := []string{"host", fixtureHost, "port", fixturePort, "username", fixtureUser,
+		"password", fixtureUser, "dbname", fixtureUser, "driver", driver}
+	return runParams(t, append(conn, params...)...)
+}
+
+// resultRows returns the result of out as rows of objects, by id.
+func resultRows(t *testing.T, out Response) map[string]map[string]interface{} {
+	t.Helper()
+	list, ok := out.Result.([]interface{})
+	if !ok {
+		t.Fatalf("result is %T, want rows", out.Result)
+	}
+	rows := make(map[string]map[string]interface{}, len(list))
+	for _, r := range list {
+		row, ok := r.(map[string]interface{})
+		if !ok {
+			t.Fatalf("row is %T, want an object", r)
+		}
+		rows[fmt.Sprint(row["id"])] = row
+	}
+	return rows
+}
+
+// field checks that row holds want under key, compared as printed.
+func field(t *testing.T, row map[string]interface{}, key string, want interface{}) {
+	t.Helper()
+	if got := row[key]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s = %#v, want %#v", key, got, want)
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	cases := []struct {
+		name   string
+		params []string
+		fails  bool   // an error is expected
+		code   string // the expected error code
+		check  func(t *testing.T, out Response)
+	}{
+		{"table", []string{"data_type", "table", "object_name", "fixtures.exotic"}, false, "", func(t *testing.T, out Response) {
+			rows := resultRows(t, out)
+			if len(rows) != 3 {
+				t.Fatalf("%d rows, want 3", len(rows))
+			}
+			field(t, rows["1"], "amount", "12345678901234567890123456789012345678")
+			field(t, rows["1"], "ratio", "1234567890.0123456789")
+			field(t, rows["1"], "mood", "happy")
+			field(t, rows["1"], "flag", true)
+			field(t, rows["2"], "amount", "-99999999999999999999999999999999999999")
+			field(t, rows["2"], "measure", "NaN")
+			field(t, rows["2"], "ratio", "0.0000000000")
+			for key, v := range rows["3"] {
+				if key != "id" && v != nil {
+					t.Errorf("row 3: %s = %#v, want null", key, v)
+				}
+			}
+		}},
+		{"query", []string{"data_type", "query", "query", "SELECT id, amount, mood::text AS mood, flag FROM fixtures.exotic ORDER BY id"}, false, "", func(t *testing.T, out Response) {
+			rows := resultRows(t, out)
+			if len(rows) != 3 {
+				t.Fatalf("%d rows, want 3", len(rows))
+			}
+			field(t, rows["1"], "amount", "12345678901234567890123456789012345678")
+			field(t, rows["2"], "mood", "sad")
+			field(t, rows["3"], "flag", nil)
+		}},
+		{"query parameters", []string{"data_type", "query", "query", "SELECT id, code FROM fixtures.parent WHERE id = $1", "parameters", "[2]"}, false, "", func(t *testing.T, out Response) {
+			rows := resultRows(t, out)
+			if len(rows) != 1 {
+				t.Fatalf("%d rows, want 1", len(rows))
+			}
+			field(t, rows["2"], "code", "two")
+		}},
+		{"list_enum", []string{"data_type", "list_enum", "object_name", "fixtures.mood"}, false, "", func(t *testing.T, out Response) {
+			res, _ := out.Result.(map[string]interface{})
+			field(t, res, "type", "fixtures.mood")
+			field(t, res, "labels", []interface{}{"sad", "ok", "happy"})
+		}},
+		{"exists", []string{"data_type", "exists", "object_name", "fixtures.parent"}, false, "", func(t *testing.T, out Response) {
+			res, _ := out.Result.(map[string]interface{})
+			field(t, res, "exists", true)
+		}},
+		{"exists missing", []string{"data_type", "exists", "object_name", "fixtures.nothing"}, false, "", func(t *testing.T, out Response) {
+			res, _ := out.Result.(map[string]interface{})
+			field(t, res, "exists", false)
+		}},
+		{"describe", []string{"data_type", "describe", "object_name", "fixtures.child"}, false, "", func(t *testing.T, out Response) {
+			if out.Result == nil {
+				t.Error("describe returned no result")
+			}
+		}},
+		{"insert", []string{"data_type", "insert", "object_name", "fixtures.parent", "rows", `[{"id": 3, "code": "three"}]`}, false, "", func(t *testing.T, out Response) {
+			res, _ := out.Result.(map[string]interface{})
+			field(t, res, "inserted", 1)
+		}},
+		{"unique violation", []string{"data_type", "insert", "object_name", "fixtures.parent", "rows", `[{"id": 4, "code": "one"}]`}, true, "unique_violation", func(t *testing.T, out Response) {
+			if !strings.Contains(out.Error, "code = one") {
+				t.Errorf("error %q does not name the duplicate value", out.Error)
+			}
+			field(t, out.Details, "table", "fixtures.parent")
+		}},
+		{"foreign key violation", []string{"data_type", "insert", "object_name", "fixtures.child", "rows", `[{"id": 11, "parent_id": 99}]`}, true, "foreign_key_violation", func(t *testing.T, out Response) {
+			field(t, out.Details, "referenced_table", "fixtures.parent")
+		}},
+		{"check violation", []string{"data_type", "insert", "object_name", "fixtures.parent", "rows", `[{"id": 5, "code": ""}]`}, true, "check_violation", nil},
+		{"enum label", []string{"data_type", "insert", "object_name", "fixtures.exotic", "rows", `[{"mood": "angry"}]`}, true, "validation_failed", func(t *testing.T, out Response) {
+			if !strings.Contains(fmt.Sprint(out.Details), "invalid value 'angry' for enum fixtures.mood") {
+				t.Errorf("details %v do not name the label", out.Details)
+			}
+		}},
+		{"update", []string{"data_type", "update", "object_name", "fixtures.parent", "key_columns", "id", "rows", `[{"id": 2, "code": "deux"}, {"id": 42, "code": "x"}]`}, false, "", func(t *testing.T, out Response) {
+			res, _ := out.Result.(map[string]interface{})
+			field(t, res, "updated", 1)
+			field(t, res, "not_found", []interface{}{1})
+		}},
+		{"missing table", []string{"data_type", "table", "object_name", "fixtures.nothing"}, true, "", nil},
+	}
+	for _, d := range drivers {
+		// The cases write, so each driver starts from the fixtures
+		fixtureDB(t)
+		for _, c := range cases {
+			t.Run(d.name+"/"+c.name, func(t *testing.T) {
+				out := runFixture(t, d.name, c.params...)
+				if (out.Error != "") != c.fails {
+					t.Fatalf("error %q, want an error: %v", out.Error, c.fails)
+				}
+				if out.Code != c.code {
+					t.Errorf("code %q, want %q (error %q)", out.Code, c.code, out.Error)
+				}
+				if c.check != nil {
+					c.check(t, out)
+				}
+			})
+		}
+	}
+}
+
+// A null in a row writes NULL, an absent key leaves the column to the
+// server and defaults writes DEFAULT, on insert and on update.
+func TestWriteNullAbsentDefault(t *testing.T) {
+	type noteQty struct{ note, qty sql.NullString }
+	for _, d := range drivers {
+		db := fixtureDB(t)
+		if _, err := db.Exec(`CREATE TABLE fixtures.defaulted (
+			id   integer PRIMARY KEY,
+			note text DEFAULT 'none',
+			qty  integer DEFAULT 7)`); err != nil {
+			t.Fatal(err)
+		}
+		read := func(id int) noteQty {
+			var r noteQty
+			if err := db.QueryRow("SELECT note, qty::text FROM fixtures.defaulted WHERE id = $1", id).Scan(&r.note, &r.qty); err != nil {
+				t.Fatalf("%s: row %d: %v", d.name, id, err)
+			}
+			return r
+		}
+		null := sql.NullString{}
+		val := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+		write := func(params ...string) {
+			t.Helper()
+			if out := runFixture(t, d.name, append([]string{"object_name", "fixtures.defaulted"}, params...)...); out.Error != "" {
+				t.Fatalf("%s: %v: %s", d.name, params, out.Error)
+			}
+		}
+
+		write("data_type", "insert", "rows", `[{"id": 1, "note": null, "qty": null}, {"id": 2}, {"id": 3, "note": "x"}]`)
+		write("data_type", "insert", "defaults", "qty", "rows", `[{"id": 4, "note": "y"}]`)
+		for id, want := range map[int]noteQty{
+			1: {null, null},
+			2: {val("none"), val("7")},
+			3: {val("x"), val("7")},
+			4: {val("y"), val("7")},
+		} {
+			if got := read(id); got != want {
+				t.Errorf("%s: after insert row %d = %+v, want %+v", d.name, id, got, want)
+			}
+		}
+
+		write("data_type", "update", "key_columns", "id", "rows", `[{"id": 3, "qty": null}, {"id": 4, "note": null}]`)
+		write("data_type", "update", "key_columns", "id", "defaults", "note,qty", "rows", `[{"id": 1}]`)
+		for id, want := range map[int]noteQty{
+			1: {val("none"), val("7")},
+			3: {val("x"), null},
+			4: {null, val("7")},
+		} {
+			if got := read(id); got != want {
+				t.Errorf("%s: after update row %d = %+v, want %+v", d.name, id, got, want)
+			}
+		}
+
+		out := runFixture(t, d.name, "data_type", "insert", "object_name", "fixtures.defaulted",
+			"defaults", "qty", "rows", `[{"id": 5, "qty": null}]`)
+		if !strings.Contains(out.Error, "also listed in defaults") {
+			t.Errorf("%s: a column both set and defaulted: error %q", d.name, out.Error)
+		}
+	}
+}
+
+// role and rls_settings put a request under the ledger's RLS policy: only
+// the tenant's rows are visible, and none without a tenant.
+func TestRowLevelSecurity(t *testing.T) {
+	ledger := []string{"data_type", "query", "query", "SELECT id, tenant_id FROM fixtures.ledger ORDER BY id"}
+	cases := []struct {
+		name    string
+		context []string
+		ids     []string
+	}{
+		{"tenant 1", []string{"role", "fixtures_tenant", "rls_settings", `{"app.tenant_id": "1"}`}, []string{"1", "2"}},
+		{"tenant 2", []string{"role", "fixtures_tenant", "rls_settings", `{"app.tenant_id": "2"}`}, []string{"3"}},
+		{"unknown tenant", []string{"role", "fixtures_tenant", "rls_settings", `{"app.tenant_id": "99"}`}, nil},
+		{"role without a tenant", []string{"role", "fixtures_tenant"}, nil},
+		// The compose user is a superuser, which no policy applies to
+		{"no role", []string{"rls_settings", `{"app.tenant_id": "1"}`}, []string{"1", "2", "3", "4"}},
+	}
+	fixtureDB(t)
+	for _, d := range drivers {
+		for _, c := range cases {
+			t.Run(d.name+"/"+c.name, func(t *testing.T) {
+				out := runFixture(t, d.name, append(append([]string{}, ledger...), c.context...)...)
+				if out.Error != "" {
+					t.Fatalf("error %q", out.Error)
+				}
+				rows := resultRows(t, out)
+				if len(rows) != len(c.ids) {
+					t.Errorf("%d rows, want %v", len(rows), c.ids)
+				}
+				for _, id := range c.ids {
+					if _, ok := rows[id]; !ok {
+						t.Errorf("row %s missing from %v", id, rows)
+					}
+				}
+			})
+		}
+	}
+
+	out := runFixture(t, "postgres", "data_type", "query", "query", "SELECT 1", "role", "fixtures_missing")
+	if out.Code != "role_not_allowed" {
+		t.Errorf("missing role: code %q, error %q", out.Code, out.Error)
+	}
+}
+
+// The role and settings of a request end with its transaction, so the
+// next transaction on the same pooled connection sees neither.
+func TestSessionContextDoesNotLeak(t *testing.T) {
+	db := fixtureDB(t)
+	db.SetMaxOpenConns(1)
+	var user string
+	var pid int
+	if err := db.QueryRow("SELECT current_user, pg_backend_pid()").Scan(&user, &pid); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applySessionContext(tx, "fixtures_tenant", map[string]string{"app.tenant_id": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	var inside string
+	var visible int
+	if err := tx.QueryRow("SELECT current_user, (SELECT count(*) FROM fixtures.ledger)").Scan(&inside, &visible); err != nil {
+		t.Fatal(err)
+	}
+	if inside != "fixtures_tenant" || visible != 1 {
+		t.Errorf("inside the request: user %s, %d rows, want fixtures_tenant and 1", inside, visible)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var after string
+	var afterPID int
+	var setting sql.NullString
+	if err := db.QueryRow("SELECT current_user, pg_backend_pid(), current_setting('app.tenant_id', true), (SELECT count(*) FROM fixtures.ledger)").
+		Scan(&after, &afterPID, &setting, &visible); err != nil {
+		t.Fatal(err)
+	}
+	if afterPID != pid {
+		t.Fatalf("backend %d, want the same connection %d", afterPID, pid)
+	}
+	// A setting once set reads back as empty, not NULL, for the session
+	if after != user || setting.String != "" || visible != 4 {
+		t.Errorf("next request: user %s, app.tenant_id %q, %d rows; want %s, unset and 4", after, setting.String, visible, user)
+	}
+}
+
+// A select that fails after it ran, while its rows are read, still leaves
+// an audit row with the failure.
+func TestAuditFailedSelect(t *testing.T) {
+	audit := []string{"audit", `{"table": "fixtures.audit_log", "actor": "auditor"}`,
+		"data_type", "query", "query", "SELECT id, code FROM fixtures.parent ORDER BY id"}
+	for _, d := range drivers {
+		db := fixtureDB(t)
+		if out := runFixture(t, d.name, audit...); out.Error != "" {
+			t.Fatalf("%s: %s", d.name, out.Error)
+		}
+		// A computed column may not replace a result column; that is only
+		// found on the first row
+		out := runFixture(t, d.name, append(audit, "computed_columns", `[{"name": "code", "expr": "1"}]`)...)
+		if out.Code != "computed_column_error" {
+			t.Fatalf("%s: code %q, error %q", d.name, out.Code, out.Error)
+		}
+		rows, err := db.Query("SELECT outcome, coalesce(error, '') FROM fixtures.audit_log ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for rows.Next() {
+			var outcome, text string
+			if err := rows.Scan(&outcome, &text); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, outcome+": "+text)
+		}
+		rows.Close()
+		if len(got) != 2 || got[0] != "success: " || !strings.HasPrefix(got[1], "failure: ") ||
+			!strings.Contains(got[1], "already a result column") {
+			t.Errorf("%s: audit rows %q, want a success and the computed column failure", d.name, got)
+		}
+	}
+}
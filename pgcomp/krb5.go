@@ -0,0 +1,137 @@
+package pgcomp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/lib/pq"
+)
+
+// krbGSS is a pure-Go Kerberos GSSAPI provider for both drivers. Like
+// libpq it takes its configuration from the environment: KRB5_CONFIG
+// (default /etc/krb5.conf), then a keytab from KRB5_CLIENT_KTNAME or else
+// the credential cache from KRB5CCNAME (default /tmp/krb5cc_<uid>).
+type krbGSS struct {
+	cli *client.Client
+}
+
+var registerGSSOnce sync.Once
+
+// registerGSS installs krbGSS as the drivers' GSS provider. principal is
+// the client principal used with a keytab; a cache names its own.
+func registerGSS(principal string) {
+	registerGSSOnce.Do(func() {
+		pq.RegisterGSSProvider(func() (pq.GSS, error) { return newKrbGSS(principal) })
+		pgconn.RegisterGSSProvider(func() (pgconn.GSS, error) { return newKrbGSS(principal) })
+	})
+}
+
+func newKrbGSS(principal string) (*krbGSS, error) {
+	cfgPath := os.Getenv("KRB5_CONFIG")
+	if cfgPath == "" {
+		cfgPath = "/etc/krb5.conf"
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return nil, newError("gssapi_failed", "failed to load Kerberos configuration %s: %v (set KRB5_CONFIG to the krb5.conf to use)", cfgPath, err)
+	}
+
+	var cli *client.Client
+	if ktPath := strings.TrimPrefix(os.Getenv("KRB5_CLIENT_KTNAME"), "FILE:"); ktPath != "" {
+		kt, err := keytab.Load(ktPath)
+		if err != nil {
+			return nil, newError("gssapi_no_credentials", "failed to load keytab %s: %v", ktPath, err)
+		}
+		name, realm := splitPrincipal(principal, cfg.LibDefaults.DefaultRealm)
+		cli = client.NewWithKeytab(name, realm, kt, cfg, client.DisablePAFXFAST(true))
+	} else {
+		ccPath, err := credentialCachePath()
+		if err != nil {
+			return nil, err
+		}
+		cc, err := credentials.LoadCCache(ccPath)
+		if err != nil {
+			return nil, newError("gssapi_no_credentials", "no Kerberos credentials in %s: %v; run kinit for the service principal, or set KRB5CCNAME to a credential cache or KRB5_CLIENT_KTNAME to a keytab", ccPath, err)
+		}
+		if cli, err = client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true)); err != nil {
+			return nil, newError("gssapi_no_credentials", "Kerberos credential cache %s is unusable: %v; run kinit again", ccPath, err)
+		}
+	}
+	if err := cli.Login(); err != nil {
+		return nil, newError("gssapi_failed", "Kerberos login failed: %v", err)
+	}
+	return &krbGSS{cli: cli}, nil
+}
+
+// splitPrincipal splits user@REALM; a principal without a realm is in
+// defaultRealm.
+func splitPrincipal(principal, defaultRealm string) (name, realm string) {
+	if at := strings.LastIndexByte(principal, '@'); at >= 0 {
+		return principal[:at], principal[at+1:]
+	}
+	return principal, defaultRealm
+}
+
+// credentialCachePath resolves KRB5CCNAME; only FILE caches are supported.
+func credentialCachePath() (string, error) {
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", newError("gssapi_no_credentials", "KRB5CCNAME is not set and the current user is unknown: %v", err)
+		}
+		return "/tmp/krb5cc_" + u.Uid, nil
+	}
+	if kind, path, ok := strings.Cut(name, ":"); ok {
+		if kind != "FILE" {
+			return "", newError("gssapi_no_credentials", "KRB5CCNAME %s: only FILE credential caches are supported", name)
+		}
+		return path, nil
+	}
+	return name, nil
+}
+
+func (g *krbGSS) GetInitToken(host, service string) ([]byte, error) {
+	return g.GetInitTokenFromSPN(service + "/" + host)
+}
+
+// GetInitTokenFromSpn is the lib/pq spelling of GetInitTokenFromSPN.
+func (g *krbGSS) GetInitTokenFromSpn(spn string) ([]byte, error) {
+	return g.GetInitTokenFromSPN(spn)
+}
+
+func (g *krbGSS) GetInitTokenFromSPN(spn string) ([]byte, error) {
+	spn, _, _ = strings.Cut(spn, "@")
+	tkt, key, err := g.cli.GetServiceTicket(spn)
+	if err != nil {
+		return nil, newError("gssapi_failed", "failed to get a Kerberos ticket for %s: %v", spn, err)
+	}
+	tok, err := spnego.NewKRB5TokenAPREQ(g.cli, tkt, key,
+		[]int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf, gssapi.ContextFlagMutual}, []int{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build GSSAPI token: %v", err)
+	}
+	return tok.Marshal()
+}
+
+func (g *krbGSS) Continue(inToken []byte) (bool, []byte, error) {
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(inToken); err != nil {
+		return false, nil, fmt.Errorf("failed to parse GSSAPI reply: %v", err)
+	}
+	if !tok.IsAPRep() {
+		return false, nil, errors.New("server replied to GSSAPI with something other than an AP-REP")
+	}
+	return true, nil, nil
+}
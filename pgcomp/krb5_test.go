@@ -0,0 +1,236 @@
+package pgcomp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/lib/pq"
+)
+
+func TestSplitPrincipal(t *testing.T) {
+	for _, c := range []struct{ in, name, realm string }{
+		{"svc_erp", "svc_erp", "EXAMPLE.TEST"},
+		{"svc_erp@CORP.TEST", "svc_erp", "CORP.TEST"},
+		{"svc/host@CORP.TEST", "svc/host", "CORP.TEST"},
+		{"odd@name@CORP.TEST", "odd@name", "CORP.TEST"},
+	} {
+		if name, realm := splitPrincipal(c.in, "EXAMPLE.TEST"); name != c.name || realm != c.realm {
+			t.Errorf("splitPrincipal(%q) = %q, %q; want %q, %q", c.in, name, realm, c.name, c.realm)
+		}
+	}
+}
+
+func TestCredentialCachePath(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, c := range []struct{ env, want, err string }{
+		{"", "/tmp/krb5cc_" + u.Uid, ""},
+		{"/var/run/erp/krb5cc", "/var/run/erp/krb5cc", ""},
+		{"FILE:/var/run/erp/krb5cc", "/var/run/erp/krb5cc", ""},
+		{"KEYRING:persistent:1000", "", "only FILE credential caches are supported"},
+		{"DIR:/run/user/1000/krb5cc", "", "only FILE credential caches are supported"},
+	} {
+		t.Setenv("KRB5CCNAME", c.env)
+		got, err := credentialCachePath()
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) || errorCode(err) != "gssapi_no_credentials" {
+				t.Errorf("KRB5CCNAME=%s: %q, %v; want a gssapi_no_credentials error with %q", c.env, got, err, c.err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("KRB5CCNAME=%s: %q, %v; want %q", c.env, got, err, c.want)
+		}
+	}
+}
+
+// errorCode is the componentError code of err, or "".
+func errorCode(err error) string {
+	var ce *componentError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return ""
+}
+
+// writeKrb5Conf writes a krb5.conf for EXAMPLE.TEST whose KDC refuses
+// connections, so a login fails at once and no KDC is needed.
+func writeKrb5Conf(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdc := l.Addr().String()
+	l.Close()
+	path := filepath.Join(t.TempDir(), "krb5.conf")
+	conf := fmt.Sprintf(`[libdefaults]
+  default_realm = EXAMPLE.TEST
+  dns_lookup_kdc = false
+  dns_lookup_realm = false
+  udp_preference_limit = 1
+
+[realms]
+  EXAMPLE.TEST = {
+    kdc = %s
+  }
+`, kdc)
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The environment decides where the configuration and credentials come
+// from; each failure names what to fix.
+func TestNewKrbGSSConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	conf := writeKrb5Conf(t)
+	kt := keytab.New()
+	if err := kt.AddEntry("svc_erp", "EXAMPLE.TEST", "secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	ktBytes, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ktPath := filepath.Join(dir, "svc.keytab")
+	if err := os.WriteFile(ktPath, ktBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage")
+	if err := os.WriteFile(garbage, []byte("not a keytab or cache"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name                  string
+		config, keytab, cache string
+		code, msg             string
+	}{
+		{"missing krb5.conf", filepath.Join(dir, "absent.conf"), "", "", "gssapi_failed", "set KRB5_CONFIG"},
+		{"missing keytab", conf, filepath.Join(dir, "absent.keytab"), "", "gssapi_no_credentials", "failed to load keytab"},
+		{"unreadable keytab", conf, garbage, "", "gssapi_no_credentials", "failed to load keytab " + garbage},
+		{"keytab, no KDC", conf, ktPath, "", "gssapi_failed", "Kerberos login failed"},
+		{"FILE keytab, no KDC", conf, "FILE:" + ktPath, "", "gssapi_failed", "Kerberos login failed"},
+		{"missing cache", conf, "", filepath.Join(dir, "absent_cc"), "gssapi_no_credentials", "run kinit"},
+		{"unreadable cache", conf, "", "FILE:" + garbage, "gssapi_no_credentials", "no Kerberos credentials in " + garbage},
+		{"keyring cache", conf, "", "KEYRING:persistent:1000", "gssapi_no_credentials", "only FILE"},
+	}
+	for _, c := range cases {
+		t.Setenv("KRB5_CONFIG", c.config)
+		t.Setenv("KRB5_CLIENT_KTNAME", c.keytab)
+		t.Setenv("KRB5CCNAME", c.cache)
+		_, err := newKrbGSS("svc_erp")
+		if err == nil || errorCode(err) != c.code || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%s: %v; want a %s error with %q", c.name, err, c.code, c.msg)
+		}
+	}
+}
+
+// fakeGSS records the service principal the driver asks a token for and
+// then fails the authentication.
+type fakeGSS struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (g *fakeGSS) GetInitToken(host, service string) ([]byte, error) {
+	return g.GetInitTokenFromSPN(service + "/" + host)
+}
+
+func (g *fakeGSS) GetInitTokenFromSpn(spn string) ([]byte, error) { return g.GetInitTokenFromSPN(spn) }
+
+func (g *fakeGSS) GetInitTokenFromSPN(spn string) ([]byte, error) {
+	g.mu.Lock()
+	g.calls = append(g.calls, spn)
+	g.mu.Unlock()
+	return nil, errors.New("fake GSS stops here")
+}
+
+func (g *fakeGSS) Continue([]byte) (bool, []byte, error) { return false, nil, errors.New("unexpected") }
+
+// gssServer accepts connections and answers every startup message with
+// AuthenticationGSS, the way a server with a gss pg_hba.conf line does.
+func gssServer(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				var n uint32
+				if binary.Read(c, binary.BigEndian, &n) != nil || n < 8 {
+					return
+				}
+				if _, err := io.CopyN(io.Discard, c, int64(n-4)); err != nil {
+					return
+				}
+				c.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 7})
+				io.Copy(io.Discard, c)
+			}(c)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// auth_method gssapi and krb_srv_name reach both drivers: the token is
+// asked for krb_srv_name/host, postgres/host by default.
+func TestGSSServicePrincipal(t *testing.T) {
+	fake := &fakeGSS{}
+	// Use up registerGSS so connectHost keeps the fake provider
+	registerGSSOnce.Do(func() {})
+	pq.RegisterGSSProvider(func() (pq.GSS, error) { return fake, nil })
+	pgconn.RegisterGSSProvider(func() (pgconn.GSS, error) { return fake, nil })
+	port := gssServer(t)
+
+	for _, d := range drivers {
+		for _, c := range []struct{ srvName, spn string }{
+			{"", "postgres/127.0.0.1"},
+			{"pg_erp", "pg_erp/127.0.0.1"},
+		} {
+			fake.calls = nil
+			cfg := connConfig{Username: "svc_erp", DBName: "erp", SSLMode: "disable", AuthMethod: "gssapi",
+				KrbSrvName: c.srvName, Driver: d.name, ConnectTimeout: 5 * time.Second}
+			db, err := connectHost(cfg, "127.0.0.1", port, "")
+			if err == nil {
+				db.Close()
+				t.Fatalf("%s: connected through the fake server", d.name)
+			}
+			fake.mu.Lock()
+			calls := fake.calls
+			fake.mu.Unlock()
+			if len(calls) == 0 {
+				t.Errorf("%s, krb_srv_name %q: no GSS token asked for (%v)", d.name, c.srvName, err)
+			}
+			for _, spn := range calls {
+				if spn != c.spn {
+					t.Errorf("%s, krb_srv_name %q: token asked for %s, want %s", d.name, c.srvName, spn, c.spn)
+				}
+			}
+		}
+	}
+}
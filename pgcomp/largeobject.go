@@ -0,0 +1,172 @@
+package pgcomp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Access modes for lo_open, from libpq-fs.h.
+const (
+	invWrite = 0x20000
+	invRead  = 0x40000
+)
+
+// loChunkSize is how much is moved per loread/lowrite call, so large
+// objects are streamed rather than held in memory.
+const loChunkSize = 256 * 1024
+
+// largeObjectOptions are the inputs of the largeobject data_type.
+type largeObjectOptions struct {
+	OID        uint32
+	OutputFile string // read: write the content here instead of returning it
+	InputFile  string // write: read the content from this file
+	Content    string // write: base64 content when no input_file is given
+}
+
+// manageLargeObject implements the largeobject data_type. The lo_*
+// descriptors only live for the duration of a transaction, so db must be
+// one.
+func manageLargeObject(db querier, operation string, opts largeObjectOptions) (interface{}, error) {
+	switch operation {
+	case "read":
+		if opts.OID == 0 {
+			return nil, fmt.Errorf("oid is required for largeobject read")
+		}
+		return readLargeObject(db, opts)
+	case "write":
+		return writeLargeObject(db, opts)
+	case "unlink":
+		if opts.OID == 0 {
+			return nil, fmt.Errorf("oid is required for largeobject unlink")
+		}
+		if _, err := db.Exec("SELECT lo_unlink($1)", opts.OID); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"oid": opts.OID, "unlinked": true}, nil
+	}
+	return nil, fmt.Errorf("unknown largeobject operation %q (allowed: read, write, unlink)", operation)
+}
+
+func readLargeObject(db querier, opts largeObjectOptions) (interface{}, error) {
+	var fd int
+	if err := db.QueryRow("SELECT lo_open($1, $2)", opts.OID, invRead).Scan(&fd); err != nil {
+		return nil, err
+	}
+	defer db.Exec("SELECT lo_close($1)", fd)
+
+	var w io.Writer
+	var buf strings.Builder
+	var enc io.WriteCloser
+	var f *os.File
+	if opts.OutputFile != "" {
+		var err error
+		if f, err = os.Create(opts.OutputFile); err != nil {
+			return nil, fmt.Errorf("failed to create output_file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	} else {
+		enc = base64.NewEncoder(base64.StdEncoding, &buf)
+		w = enc
+	}
+
+	sum := sha256.New()
+	var size int64
+	for {
+		var chunk []byte
+		if err := db.QueryRow("SELECT loread($1, $2)", fd, loChunkSize).Scan(&chunk); err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		sum.Write(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return nil, fmt.Errorf("failed to write output_file: %v", err)
+		}
+		size += int64(len(chunk))
+	}
+
+	res := map[string]interface{}{"oid": opts.OID, "size": size, "sha256": hex.EncodeToString(sum.Sum(nil))}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write output_file: %v", err)
+		}
+		res["output_file"] = opts.OutputFile
+	} else {
+		enc.Close()
+		res["content"] = buf.String()
+	}
+	return res, nil
+}
+
+// writeLargeObject creates a new large object, or truncates and rewrites
+// the one named by oid, from input_file or base64 content.
+func writeLargeObject(db querier, opts largeObjectOptions) (interface{}, error) {
+	var src io.Reader
+	switch {
+	case opts.InputFile != "":
+		f, err := os.Open(opts.InputFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open input_file: %v", err)
+		}
+		defer f.Close()
+		src = f
+	case opts.Content != "":
+		src = base64.NewDecoder(base64.StdEncoding, strings.NewReader(opts.Content))
+	default:
+		return nil, fmt.Errorf("input_file or content is required for largeobject write")
+	}
+
+	oid := opts.OID
+	created := oid == 0
+	if created {
+		if err := db.QueryRow("SELECT lo_create(0)").Scan(&oid); err != nil {
+			return nil, err
+		}
+	}
+	var fd int
+	if err := db.QueryRow("SELECT lo_open($1, $2)", oid, invWrite).Scan(&fd); err != nil {
+		return nil, err
+	}
+	defer db.Exec("SELECT lo_close($1)", fd)
+	if !created {
+		if _, err := db.Exec("SELECT lo_truncate($1, 0)", fd); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := sha256.New()
+	size, err := copyToLargeObject(db, fd, src, sum)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"oid": oid, "created": created, "size": size, "sha256": hex.EncodeToString(sum.Sum(nil))}, nil
+}
+
+func copyToLargeObject(db querier, fd int, src io.Reader, sum hash.Hash) (int64, error) {
+	buf := make([]byte, loChunkSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			if _, werr := db.Exec("SELECT lowrite($1, $2)", fd, buf[:n]); werr != nil {
+				return 0, werr
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read content: %v", err)
+		}
+	}
+}
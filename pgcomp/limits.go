@@ -0,0 +1,159 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// requestLimits bound what one request may bring, so a malformed caller
+// fails with limit_exceeded instead of growing the process without end.
+// Every limit can be changed from the environment by a deployment that
+// trusts its callers; 0 lifts it.
+type requestLimits struct {
+	InputBytes int64 // stdin, MAX_INPUT_BYTES
+	Parameters int   // entries of a parameters array, MAX_PARAMETERS
+	Statements int   // entries of statements, MAX_STATEMENTS
+	SQLBytes   int   // one statement, given or generated, MAX_SQL_BYTES
+}
+
+var limits = requestLimits{
+	InputBytes: 64 << 20,
+	Parameters: maxBindParams,
+	Statements: 1000,
+	SQLBytes:   4 << 20,
+}
+
+// loadLimits applies the environment's overrides.
+func loadLimits() error {
+	for env, set := range map[string]func(int64){
+		"MAX_INPUT_BYTES": func(n int64) { limits.InputBytes = n },
+		"MAX_PARAMETERS":  func(n int64) { limits.Parameters = int(n) },
+		"MAX_STATEMENTS":  func(n int64) { limits.Statements = int(n) },
+		"MAX_SQL_BYTES":   func(n int64) { limits.SQLBytes = int(n) },
+	} {
+		val := os.Getenv(env)
+		if val == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non-negative integer", env)
+		}
+		set(n)
+	}
+	return nil
+}
+
+func limitExceeded(limit string, max int64, env, format string, args ...interface{}) error {
+	ce := newError("limit_exceeded", format, args...)
+	ce.Details = map[string]interface{}{"limit": limit, "max": max, "env": env}
+	return ce
+}
+
+// cappedReader fails the read that goes past max bytes, so the decoder
+// stops there rather than after the whole payload is in memory.
+type cappedReader struct {
+	r    io.Reader
+	left int64
+	max  int64
+}
+
+func capInput(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &cappedReader{r: io.LimitReader(r, max+1), left: max, max: max}
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.left < 0 {
+		return 0, limitExceeded("input_bytes", c.max, "MAX_INPUT_BYTES", "input is larger than %d bytes", c.max)
+	}
+	return n, err
+}
+
+// decodeInput reads the request document from r. params is walked entry
+// by entry, so a too large input fails on the entry that crosses the limit.
+func decodeInput(r io.Reader) (Request, error) {
+	var input Request
+	dec := json.NewDecoder(capInput(r, limits.InputBytes))
+	if err := expectDelim(dec, '{'); err != nil {
+		return input, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return input, err
+		}
+		if key, _ := tok.(string); key != "params" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return input, err
+			}
+			continue
+		}
+		if err := decodeArray(dec, 0, "", "", func(dec *json.Decoder) error {
+			var p Param
+			if err := dec.Decode(&p); err != nil {
+				return err
+			}
+			input.Params = append(input.Params, p)
+			return nil
+		}); err != nil {
+			return input, err
+		}
+	}
+	return input, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q, found %v", want, tok)
+	}
+	return nil
+}
+
+// decodeArray streams a JSON array from dec, calling each per entry, and
+// fails on the entry past max (0 is unlimited). A null is an empty array.
+// limit and env name the limit in the error.
+func decodeArray(dec *json.Decoder, max int, limit, env string, each func(*json.Decoder) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("expected a JSON array, found %v", tok)
+	}
+	for n := 0; dec.More(); n++ {
+		if max > 0 && n == max {
+			return limitExceeded(limit, int64(max), env, "more than %d %s", max, strings.ReplaceAll(limit, "_", " "))
+		}
+		if err := each(dec); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// checkSQLLength refuses a statement longer than MAX_SQL_BYTES before it
+// is sent.
+func checkSQLLength(stmt string) error {
+	if limits.SQLBytes > 0 && len(stmt) > limits.SQLBytes {
+		return limitExceeded("sql_bytes", int64(limits.SQLBytes), "MAX_SQL_BYTES", "statement of %d bytes is longer than %d bytes", len(stmt), limits.SQLBytes)
+	}
+	return nil
+}
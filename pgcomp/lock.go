@@ -0,0 +1,79 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// lockSpec is the "lock" input: a row locking clause for table and query
+// selects. The locks last until the request transaction ends, so the rows
+// are worked on in the same request, e.g. with data_type transaction.
+type lockSpec struct {
+	Mode string `json:"mode"` // update (default), no_key_update, share or key_share
+	Wait string `json:"wait"` // wait (default), nowait or skip_locked
+}
+
+var lockModes = map[string]string{
+	"update":        "FOR UPDATE",
+	"no_key_update": "FOR NO KEY UPDATE",
+	"share":         "FOR SHARE",
+	"key_share":     "FOR KEY SHARE",
+}
+
+var lockWaits = map[string]string{"wait": "", "nowait": " NOWAIT", "skip_locked": " SKIP LOCKED"}
+
+func parseLock(val string) (*lockSpec, error) {
+	var l lockSpec
+	if err := json.Unmarshal([]byte(val), &l); err != nil {
+		return nil, fmt.Errorf("lock must be a JSON object {mode, wait}: %v", err)
+	}
+	if err := l.normalize(); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// normalize applies the defaults and checks mode and wait.
+func (l *lockSpec) normalize() error {
+	l.Mode = strings.ToLower(l.Mode)
+	if l.Mode == "" {
+		l.Mode = "update"
+	}
+	l.Wait = strings.ToLower(l.Wait)
+	if l.Wait == "" {
+		l.Wait = "wait"
+	}
+	if _, ok := lockModes[l.Mode]; !ok {
+		return fmt.Errorf("invalid lock mode %q, allowed: update, no_key_update, share, key_share", l.Mode)
+	}
+	if _, ok := lockWaits[l.Wait]; !ok {
+		return fmt.Errorf("invalid lock wait %q, allowed: wait, nowait, skip_locked", l.Wait)
+	}
+	return nil
+}
+
+// clause renders the locking clause, e.g. FOR UPDATE SKIP LOCKED.
+func (l *lockSpec) clause() string {
+	return lockModes[l.Mode] + lockWaits[l.Wait]
+}
+
+// lockQuery applies l to a free-form query. A locking clause on a
+// sub-select locks the rows of the tables it reads, so the query is
+// wrapped rather than edited.
+func lockQuery(query string, l *lockSpec) string {
+	q := strings.TrimRight(strings.TrimSpace(query), ";")
+	return "SELECT * FROM (" + q + ") AS locked " + l.clause()
+}
+
+// lockedError maps lock_not_available (55P03), raised by NOWAIT or a
+// lock_timeout, to code locked; other errors are returned unchanged.
+func lockedError(err error) error {
+	if se := asServerError(err); se != nil && se.Code == "55P03" {
+		ce := newError("locked", "rows are locked by another transaction: %s", se.Message)
+		ce.Details = map[string]interface{}{"sqlstate": se.Code}
+		ce.cause = err
+		return ce
+	}
+	return err
+}
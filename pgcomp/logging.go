@@ -0,0 +1,50 @@
+package pgcomp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logger writes structured JSON lines to stderr; stdout is reserved for the
+// result document. It discards everything until setupLogging enables it.
+var logger = slog.New(slog.DiscardHandler)
+
+// setupLogging enables logging at the level from the log_level input, or the
+// LOG_LEVEL environment variable when the input is absent.
+func setupLogging(level string) error {
+	if level == "" {
+		level = os.Getenv("LOG_LEVEL")
+	}
+	if level == "" {
+		return nil
+	}
+
+	var l slog.Level
+	switch strings.ToLower(level) {
+	case "error":
+		l = slog.LevelError
+	case "warn", "warning":
+		l = slog.LevelWarn
+	case "info":
+		l = slog.LevelInfo
+	case "debug":
+		l = slog.LevelDebug
+	default:
+		return fmt.Errorf("log_level must be one of: error, warn, info, debug")
+	}
+	logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l}))
+	return nil
+}
+
+// logSQL records a statement about to run. Parameter values are only
+// written at debug level; otherwise just their count is.
+func logSQL(sql string, args []interface{}) {
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Debug("executing statement", "sql", sql, "params", args)
+		return
+	}
+	logger.Info("executing statement", "sql", sql, "param_count", len(args))
+}
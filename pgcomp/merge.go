@@ -0,0 +1,248 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// maxBindParams is the protocol limit on parameters in one statement.
+const maxBindParams = 65535
+
+// mergeOptions are the inputs of the merge data_type.
+type mergeOptions struct {
+	Rows          []map[string]interface{}
+	KeyColumns    []string
+	OnUpdate      map[string]string // column -> set (default), keep, add or coalesce
+	DeleteMissing bool              // delete target rows absent from rows (PostgreSQL 17+)
+	Validate      bool              // pre-check rows against the table before merging
+	// OverrideIdentity inserts GENERATED ALWAYS identity values from rows
+	// with OVERRIDING SYSTEM VALUE instead of dropping them.
+	OverrideIdentity bool
+}
+
+var mergeUpdateActions = []string{"set", "keep", "add", "coalesce"}
+
+func parseMergeRows(val string) ([]map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(val)))
+	dec.UseNumber()
+	var rows []map[string]interface{}
+	if err := dec.Decode(&rows); err != nil {
+		return nil, fmt.Errorf("rows must be a JSON array of objects: %v", err)
+	}
+	return rows, nil
+}
+
+func parseMergeOnUpdate(val string) (map[string]string, error) {
+	var m map[string]string
+	if err := json.Unmarshal([]byte(val), &m); err != nil {
+		return nil, fmt.Errorf("on_update must be a JSON object of column to action: %v", err)
+	}
+	for c, a := range m {
+		a = strings.ToLower(a)
+		if !containsString(mergeUpdateActions, a) {
+			return nil, fmt.Errorf("invalid on_update action %q for %s, allowed: %s", a, c, strings.Join(mergeUpdateActions, ", "))
+		}
+		m[c] = a
+	}
+	return m, nil
+}
+
+// mergeRows runs MERGE INTO target USING (VALUES ...) built from opts.
+// Every row must carry the same columns. From PostgreSQL 17 the per-action
+// counts come from RETURNING merge_action(); before that only the command
+// tag total is available.
+func mergeRows(db querier, target string, opts mergeOptions) (interface{}, error) {
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version < 150000 {
+		return nil, newError("unsupported_version", "merge requires PostgreSQL 15 or later (server is %d.%d)", version/10000, version%10000)
+	}
+	if opts.DeleteMissing && version < 170000 {
+		return nil, newError("unsupported_version", "delete_missing requires PostgreSQL 17 or later (WHEN NOT MATCHED BY SOURCE)")
+	}
+	if len(opts.Rows) == 0 {
+		return nil, fmt.Errorf("rows is required for merge")
+	}
+	if len(opts.KeyColumns) == 0 {
+		return nil, fmt.Errorf("key_columns is required for merge")
+	}
+
+	rel, err := resolveRelation(db, target)
+	if err != nil {
+		return nil, err
+	}
+	relCols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for _, c := range relCols {
+		types[c.Name] = c.TypeSQL
+	}
+	if err := rejectRows(relCols, opts.Rows, opts.Validate); err != nil {
+		return nil, err
+	}
+
+	cols := make([]string, 0, len(opts.Rows[0]))
+	for c := range opts.Rows[0] {
+		if _, ok := types[c]; !ok {
+			return nil, fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+		}
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	for _, k := range opts.KeyColumns {
+		if !containsString(cols, k) {
+			return nil, fmt.Errorf("key column %q is missing from rows", k)
+		}
+	}
+	for c := range opts.OnUpdate {
+		if !containsString(cols, c) {
+			return nil, fmt.Errorf("on_update column %q is missing from rows", c)
+		}
+	}
+	if len(opts.Rows)*len(cols) > maxBindParams {
+		return nil, fmt.Errorf("merge of %d rows x %d columns exceeds the %d parameter limit; split the rows", len(opts.Rows), len(cols), maxBindParams)
+	}
+
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = pq.QuoteIdentifier(c)
+	}
+
+	var args []interface{}
+	values := make([]string, len(opts.Rows))
+	for r, row := range opts.Rows {
+		if len(row) != len(cols) {
+			return nil, fmt.Errorf("row %d has different columns than row 0", r)
+		}
+		ph := make([]string, len(cols))
+		for i, c := range cols {
+			v, ok := row[c]
+			if !ok {
+				return nil, fmt.Errorf("row %d is missing column %q", r, c)
+			}
+			args = append(args, mergeValue(v))
+			// VALUES has no target to infer types from, so cast each value
+			ph[i] = "$" + strconv.Itoa(len(args)) + "::" + types[c]
+		}
+		values[r] = "(" + strings.Join(ph, ", ") + ")"
+	}
+
+	on := make([]string, len(opts.KeyColumns))
+	for i, k := range opts.KeyColumns {
+		q := pq.QuoteIdentifier(k)
+		on[i] = fmt.Sprintf("t.%s = s.%s", q, q)
+	}
+
+	// Generated and GENERATED ALWAYS identity columns are only matched on,
+	// never updated, and inserted only when overriding
+	insertCols, stripped, overriding := splitReadOnly(cols, relCols, opts.OverrideIdentity)
+	updatable, _, _ := splitReadOnly(cols, relCols, false)
+
+	var sets []string
+	for i, c := range cols {
+		if containsString(opts.KeyColumns, c) || !containsString(updatable, c) {
+			continue
+		}
+		q := quoted[i]
+		switch opts.OnUpdate[c] {
+		case "keep":
+			continue
+		case "add":
+			sets = append(sets, fmt.Sprintf("%s = t.%s + s.%s", q, q, q))
+		case "coalesce":
+			sets = append(sets, fmt.Sprintf("%s = COALESCE(s.%s, t.%s)", q, q, q))
+		default:
+			sets = append(sets, fmt.Sprintf("%s = s.%s", q, q))
+		}
+	}
+
+	insQuoted := make([]string, len(insertCols))
+	srcCols := make([]string, len(insertCols))
+	for i, c := range insertCols {
+		insQuoted[i] = pq.QuoteIdentifier(c)
+		srcCols[i] = "s." + insQuoted[i]
+	}
+
+	stmt := fmt.Sprintf("MERGE INTO %s AS t USING (VALUES %s) AS s(%s) ON %s",
+		rel.Name, strings.Join(values, ", "), strings.Join(quoted, ", "), strings.Join(on, " AND "))
+	if len(sets) > 0 {
+		stmt += " WHEN MATCHED THEN UPDATE SET " + strings.Join(sets, ", ")
+	} else {
+		stmt += " WHEN MATCHED THEN DO NOTHING"
+	}
+	switch {
+	case len(insertCols) == 0:
+		stmt += " WHEN NOT MATCHED THEN INSERT DEFAULT VALUES"
+	case overriding:
+		stmt += fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) OVERRIDING SYSTEM VALUE VALUES (%s)", strings.Join(insQuoted, ", "), strings.Join(srcCols, ", "))
+	default:
+		stmt += fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s)", strings.Join(insQuoted, ", "), strings.Join(srcCols, ", "))
+	}
+	if opts.DeleteMissing {
+		stmt += " WHEN NOT MATCHED BY SOURCE THEN DELETE"
+	}
+	if err := checkSQLLength(stmt); err != nil {
+		return nil, err
+	}
+
+	if version < 170000 {
+		logSQL(stmt, args)
+		res, err := db.Exec(stmt, args...)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := res.RowsAffected()
+		return writeResult(map[string]interface{}{"merged": n}, stripped), nil
+	}
+
+	stmt += " RETURNING merge_action()"
+	logSQL(stmt, args)
+	rows, err := db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int64{"INSERT": 0, "UPDATE": 0, "DELETE": 0}
+	var total int64
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			return nil, err
+		}
+		counts[action]++
+		total++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return writeResult(map[string]interface{}{
+		"merged":   total,
+		"inserted": counts["INSERT"],
+		"updated":  counts["UPDATE"],
+		"deleted":  counts["DELETE"],
+	}, stripped), nil
+}
+
+// mergeValue turns a decoded JSON value into a bind argument: numbers keep
+// their exact text and objects and arrays are sent as JSON for json/jsonb
+// columns.
+func mergeValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		return t.String()
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+	return v
+}
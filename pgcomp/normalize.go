@@ -0,0 +1,155 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"math"
+	"strconv"
+)
+
+// Type names for extension-defined types, whose OIDs differ per database.
+// pgx reports unknown types by OID and markExtensionTypes maps those onto
+// these names; lib/pq reports "" for every non-builtin type, so such
+// columns become unknownType and are only decoded when the value parses.
+const (
+	hstoreType    = "HSTORE"
+	geometryType  = "GEOMETRY"
+	geographyType = "GEOGRAPHY"
+	unknownType   = "?"
+)
+
+var extensionTypes = map[string]string{
+	"hstore":    hstoreType,
+	"geometry":  geometryType,
+	"geography": geographyType,
+}
+
+// columnTypeNames returns the server type name of every result column as
+// reported by the driver. pgx names every type in its type map and reports
+// the bare OID for the rest; lib/pq only knows the built-in types and
+// returns "" otherwise.
+func columnTypeNames(rows *sql.Rows) []string {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil
+	}
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.DatabaseTypeName()
+	}
+	return names
+}
+
+// normalizeValue converts a scanned driver value into the value emitted in
+// the result, so both drivers produce the same JSON for the same row.
+func normalizeValue(val interface{}, dbType string) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		s := string(v)
+		switch dbType {
+		case "OID", "XID", "CID":
+			// pgx decodes these to integers; lib/pq hands back the text form
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n
+			}
+		case "NUMERIC":
+			return plainNumeric(s)
+		case hstoreType, unknownType:
+			return normalizeHstore(s, dbType)
+		}
+		return s
+	case string:
+		switch dbType {
+		case "NUMERIC":
+			return plainNumeric(v)
+		case hstoreType:
+			return normalizeHstore(v, dbType)
+		}
+	case float64:
+		// JSON has no NaN or infinities; they keep the server's spelling,
+		// as numeric NaN does
+		return specialFloat(v, val)
+	case float32:
+		return specialFloat(float64(v), val)
+	}
+	return val
+}
+
+// specialFloat returns the server's text for NaN and the infinities, and
+// val for every other f.
+func specialFloat(f float64, val interface{}) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return val
+}
+
+// normalizeHstore decodes s, keeping the text when it does not parse. A
+// column only guessed to be hstore must also be non-empty, since the empty
+// string is a valid (empty) hstore.
+func normalizeHstore(s, dbType string) interface{} {
+	if dbType == unknownType && s == "" {
+		return s
+	}
+	m, err := decodeHstore(s)
+	if err != nil {
+		return s
+	}
+	return m
+}
+
+// markExtensionTypes rewrites the entries of types that are, or under
+// lib/pq may be, one of extensionTypes. It uses the pool rather than the
+// request transaction because the result set is still open on that
+// connection.
+func markExtensionTypes(db *sql.DB, types []string) []string {
+	candidate := false
+	for _, t := range types {
+		if t == "" || isOIDName(t) {
+			candidate = true
+			break
+		}
+	}
+	if !candidate {
+		return types
+	}
+
+	rows, err := db.Query("SELECT oid::text, typname::text FROM pg_type WHERE typname IN ('hstore', 'geometry', 'geography')")
+	if err != nil {
+		logger.Warn("extension type lookup failed", "error", err.Error())
+		return types
+	}
+	defer rows.Close()
+	byOID := map[string]string{}
+	for rows.Next() {
+		var oid, name string
+		if rows.Scan(&oid, &name) == nil {
+			byOID[oid] = extensionTypes[name]
+		}
+	}
+	if len(byOID) == 0 {
+		return types
+	}
+
+	out := make([]string, len(types))
+	for i, t := range types {
+		switch {
+		case t == "":
+			out[i] = unknownType
+		case byOID[t] != "":
+			out[i] = byOID[t]
+		default:
+			out[i] = t
+		}
+	}
+	return out
+}
+
+func isOIDName(t string) bool {
+	_, err := strconv.ParseUint(t, 10, 32)
+	return err == nil
+}
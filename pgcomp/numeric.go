@@ -0,0 +1,217 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// moneyOID is the built-in money type. pgx has no codec for it and reports
+// it by OID; lib/pq names it MONEY.
+const moneyOID = "790"
+
+func isMoneyType(dbType string) bool {
+	return dbType == "MONEY" || dbType == moneyOID
+}
+
+// plainNumeric returns a numeric's text without exponent notation, so
+// exact amounts never reach consumers as 1.5e+21. Text that is already
+// plain, and NaN or Infinity, is returned unchanged.
+func plainNumeric(s string) string {
+	e := strings.IndexAny(s, "eE")
+	if e < 0 || strings.Contains(s, "Inf") {
+		return s
+	}
+	exp, err := strconv.Atoi(s[e+1:])
+	if err != nil {
+		return s
+	}
+	mantissa := s[:e]
+	scale := 0
+	if dot := strings.IndexByte(mantissa, '.'); dot >= 0 {
+		scale = len(mantissa) - dot - 1
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return s
+	}
+	if scale -= exp; scale < 0 {
+		scale = 0
+	}
+	return r.FloatString(scale)
+}
+
+// moneyFormat is how the server's lc_monetary renders money, learnt from
+// a sample value so any locale can be parsed back to a plain numeric.
+type moneyFormat struct {
+	decimal string // "" when the locale has no fractional digits
+}
+
+// loadMoneyFormat renders 1234.5 as money on the server and reads the
+// decimal separator off the result: "$1,234.50", "1.234,50 €", "￥1,235".
+// It uses the pool because the result set is still open on the request
+// connection.
+func loadMoneyFormat(db *sql.DB) (*moneyFormat, error) {
+	var sample string
+	if err := db.QueryRow("SELECT 1234.5::numeric::money::text").Scan(&sample); err != nil {
+		return nil, err
+	}
+	f := &moneyFormat{}
+	r := []rune(sample)
+	end := len(r) - 1
+	for end >= 0 && !isDigit(r[end]) {
+		end--
+	}
+	start := end
+	for start >= 0 && isDigit(r[start]) {
+		start--
+	}
+	// The sample's fraction reads 5, 50 or 500; a locale without one
+	// rounds to 1,235 and ends in 235 instead.
+	if tail := string(r[start+1 : end+1]); start >= 0 && strings.TrimRight(tail, "0") == "5" {
+		f.decimal = string(r[start])
+	}
+	return f, nil
+}
+
+func isDigit(r rune) bool { return r >= '0' && r <= '9' }
+
+// parse converts a money text value to a plain numeric string.
+func (f *moneyFormat) parse(s string) (string, error) {
+	neg := strings.ContainsAny(s, "-(")
+	var b strings.Builder
+	seenDecimal := false
+	for _, r := range s {
+		switch {
+		case isDigit(r):
+			b.WriteRune(r)
+		case f.decimal != "" && string(r) == f.decimal && !seenDecimal:
+			b.WriteByte('.')
+			seenDecimal = true
+		}
+	}
+	out := b.String()
+	if out == "" || out == "." {
+		return "", fmt.Errorf("no digits in money value %q", s)
+	}
+	if neg {
+		out = "-" + out
+	}
+	return out, nil
+}
+
+// moneyNormalizer turns money columns into plain numeric strings. The
+// server format is only looked up when a money column is present.
+type moneyNormalizer struct {
+	format *moneyFormat
+}
+
+func newMoneyNormalizer(db *sql.DB, types []string) *moneyNormalizer {
+	for _, t := range types {
+		if isMoneyType(t) {
+			f, err := loadMoneyFormat(db)
+			if err != nil {
+				logger.Warn("money format lookup failed", "error", err.Error())
+				return nil
+			}
+			return &moneyNormalizer{format: f}
+		}
+	}
+	return nil
+}
+
+func (m *moneyNormalizer) apply(dbType string, val interface{}) interface{} {
+	if m == nil || !isMoneyType(dbType) {
+		return val
+	}
+	s, ok := val.(string)
+	if !ok {
+		return val
+	}
+	n, err := m.format.parse(s)
+	if err != nil {
+		return val
+	}
+	return n
+}
+
+// numberFormat is the "number_format" input: display formatting for the
+// listed columns. Values become strings; other columns are untouched.
+type numberFormat struct {
+	Columns           []string `json:"columns"`
+	DecimalSeparator  string   `json:"decimal_separator"`
+	ThousandSeparator string   `json:"thousand_separator"`
+	MinDecimals       int      `json:"min_decimals"`
+}
+
+func parseNumberFormat(val string) (*numberFormat, error) {
+	f := &numberFormat{DecimalSeparator: "."}
+	if err := json.Unmarshal([]byte(val), f); err != nil {
+		return nil, fmt.Errorf("invalid number_format: %v", err)
+	}
+	if len(f.Columns) == 0 {
+		return nil, fmt.Errorf("number_format needs columns")
+	}
+	if f.DecimalSeparator == "" || f.DecimalSeparator == f.ThousandSeparator {
+		return nil, fmt.Errorf("number_format decimal_separator must be set and differ from thousand_separator")
+	}
+	if f.MinDecimals < 0 || f.MinDecimals > 30 {
+		return nil, fmt.Errorf("number_format min_decimals must be between 0 and 30")
+	}
+	return f, nil
+}
+
+func (f *numberFormat) apply(col string, val interface{}) interface{} {
+	if f == nil || !containsString(f.Columns, col) {
+		return val
+	}
+	var s string
+	switch v := val.(type) {
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return val
+	}
+	if _, ok := new(big.Rat).SetString(s); !ok || strings.ContainsAny(s, "eE") {
+		return val
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	intPart, frac := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		intPart, frac = s[:dot], s[dot+1:]
+	}
+	for len(frac) < f.MinDecimals {
+		frac += "0"
+	}
+	if f.ThousandSeparator != "" && len(intPart) > 3 {
+		var b strings.Builder
+		lead := len(intPart) % 3
+		if lead > 0 {
+			b.WriteString(intPart[:lead])
+		}
+		for i := lead; i < len(intPart); i += 3 {
+			if b.Len() > 0 {
+				b.WriteString(f.ThousandSeparator)
+			}
+			b.WriteString(intPart[i : i+3])
+		}
+		intPart = b.String()
+	}
+	out := intPart
+	if frac != "" {
+		out += f.DecimalSeparator + frac
+	}
+	if neg {
+		out = "-" + out
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestPlainNumeric(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"1234.50", "1234.50"},
+		{"123450e-2", "1234.50"},
+		{"1.5e+21", "1500000000000000000000"},
+		{"1e-30", "0.000000000000000000000000000001"},
+		{"-1.23E-5", "-0.0000123"},
+		{"12345678901234567890123456789012345678", "12345678901234567890123456789012345678"},
+		{"99999999999999999999999999999999999999e0", "99999999999999999999999999999999999999"},
+		{"NaN", "NaN"},
+		{"Infinity", "Infinity"},
+		{"-Infinity", "-Infinity"},
+	} {
+		if got := plainNumeric(c.in); got != c.want {
+			t.Errorf("plainNumeric(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+// Numerics and bigints reach the JSON output with every digit: numerics
+// as plain strings, bigint as an exact integer, whichever driver read them.
+func TestNumericJSONRoundTrip(t *testing.T) {
+	cases := []struct {
+		dbType string
+		raw    interface{}
+		want   string // the JSON of the value in the output
+	}{
+		{"NUMERIC", []byte("12345678901234567890123456789012345678"), `"12345678901234567890123456789012345678"`},
+		{"NUMERIC", "12345678901234567890123456789012345678e-10", `"1234567890123456789012345678.9012345678"`},
+		{"NUMERIC", []byte("-99999999999999999999999999999999999999"), `"-99999999999999999999999999999999999999"`},
+		{"NUMERIC", "1e-30", `"0.000000000000000000000000000001"`},
+		{"NUMERIC", []byte("NaN"), `"NaN"`},
+		{"INT8", int64(9007199254740993), `9007199254740993`},
+		{"INT8", int64(-9223372036854775808), `-9223372036854775808`},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		r := &responder{w: &buf}
+		r.write(Response{Result: []map[string]interface{}{{"v": normalizeValue(c.raw, c.dbType)}}})
+		want := `{"result":[{"v":` + c.want + `}],"error":""}`
+		if got := strings.TrimSpace(buf.String()); got != want {
+			t.Errorf("%#v: output %s, want %s", c.raw, got, want)
+			continue
+		}
+
+		// and the decoded value is the stored one, digit for digit
+		var doc struct {
+			Result []map[string]interface{} `json:"result"`
+		}
+		dec := json.NewDecoder(&buf)
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Trim(c.want, `"`); s != "NaN" {
+			in, _ := new(big.Rat).SetString(fmt.Sprint(doc.Result[0]["v"]))
+			exact, _ := new(big.Rat).SetString(s)
+			if in == nil || in.Cmp(exact) != 0 {
+				t.Errorf("%#v: decoded %v, want %v", c.raw, in, exact)
+			}
+		}
+	}
+}
+
+func TestMoneyParse(t *testing.T) {
+	for _, c := range []struct {
+		decimal, in, want string
+	}{
+		{".", "$1,234.50", "1234.50"},
+		{".", "-$1,234.50", "-1234.50"},
+		{".", "($5.00)", "-5.00"},
+		{",", "1.234,50 €", "1234.50"},
+		{"", "￥1,235", "1235"},
+		{".", "$92,233,720,368,547,758.07", "92233720368547758.07"},
+	} {
+		got, err := (&moneyFormat{decimal: c.decimal}).parse(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("parse(%q) with decimal %q = %q, %v; want %q", c.in, c.decimal, got, err, c.want)
+		}
+	}
+	if _, err := (&moneyFormat{decimal: "."}).parse("$"); err == nil {
+		t.Error("a money value without digits parsed")
+	}
+}
+
+func TestNumberFormatApply(t *testing.T) {
+	f := &numberFormat{Columns: []string{"amount"}, DecimalSeparator: ",", ThousandSeparator: ".", MinDecimals: 2}
+	for _, c := range []struct {
+		col string
+		in  interface{}
+		out interface{}
+	}{
+		{"amount", "1234567.5", "1.234.567,50"},
+		{"amount", "-1234", "-1.234,00"},
+		{"amount", int64(9007199254740993), "9.007.199.254.740.993,00"},
+		{"amount", "12345678901234567890123456789012345678", "12.345.678.901.234.567.890.123.456.789.012.345.678,00"},
+		{"amount", "NaN", "NaN"},
+		{"other", "1234.5", "1234.5"},
+	} {
+		if got := f.apply(c.col, c.in); got != c.out {
+			t.Errorf("apply(%s, %v) = %v, want %v", c.col, c.in, got, c.out)
+		}
+	}
+}
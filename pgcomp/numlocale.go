@@ -0,0 +1,153 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// numberLocale is how amounts are written in the data being loaded, e.g.
+// {"decimal_separator": ",", "thousand_separator": ".", "strip_chars": "€"}
+// for "€ 1.234,56". Columns overrides it per table column; an override
+// replaces the whole locale, so one column can be read without
+// separators at all.
+type numberLocale struct {
+	DecimalSeparator  string                   `json:"decimal_separator"` // default "."
+	ThousandSeparator string                   `json:"thousand_separator"`
+	StripChars        string                   `json:"strip_chars"` // removed wherever they appear
+	Columns           map[string]*numberLocale `json:"columns"`
+}
+
+// numericTypes are the column types a number locale applies to.
+var numericTypes = []string{"numeric", "money", "float4", "float8", "int2", "int4", "int8"}
+
+var plainNumber = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?$`)
+
+func parseNumberLocale(val string) (*numberLocale, error) {
+	var l numberLocale
+	if err := json.Unmarshal([]byte(val), &l); err != nil {
+		return nil, fmt.Errorf("number_locale must be a JSON object of {decimal_separator, thousand_separator, strip_chars, columns}: %v", err)
+	}
+	if err := l.check(); err != nil {
+		return nil, fmt.Errorf("number_locale: %v", err)
+	}
+	for c, cl := range l.Columns {
+		if cl == nil {
+			return nil, fmt.Errorf("number_locale: columns %q is null", c)
+		}
+		if len(cl.Columns) > 0 {
+			return nil, fmt.Errorf("number_locale: columns %q cannot have columns of its own", c)
+		}
+		if err := cl.check(); err != nil {
+			return nil, fmt.Errorf("number_locale: columns %q: %v", c, err)
+		}
+	}
+	return &l, nil
+}
+
+func (l *numberLocale) check() error {
+	if l.DecimalSeparator == "" {
+		l.DecimalSeparator = "."
+	}
+	for _, sep := range []string{l.DecimalSeparator, l.ThousandSeparator} {
+		if sep != "" && (utf8.RuneCountInString(sep) != 1 || strings.ContainsAny(sep, "0123456789+-")) {
+			return fmt.Errorf("separator %q must be a single character that is not a digit or sign", sep)
+		}
+	}
+	if l.DecimalSeparator == l.ThousandSeparator {
+		return fmt.Errorf("decimal_separator and thousand_separator must differ")
+	}
+	if strings.ContainsAny(l.StripChars, "0123456789") || strings.Contains(l.StripChars, l.DecimalSeparator) {
+		return fmt.Errorf("strip_chars must not contain digits or the decimal separator")
+	}
+	return nil
+}
+
+// column is the locale for the table column name; nil for a nil l.
+func (l *numberLocale) column(name string) *numberLocale {
+	if l == nil {
+		return nil
+	}
+	if cl, ok := l.Columns[name]; ok {
+		return cl
+	}
+	return l
+}
+
+// parse turns s, written in the locale, into the plain number text the
+// server reads: strip_chars and spaces go, thousand separators go, the
+// decimal separator becomes "."; "99,-" is 99 and a trailing minus or
+// parentheses make it negative. For an integer column a fraction of
+// zeros is dropped.
+func (l *numberLocale) parse(s string, integer bool) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(l.StripChars, r) || r == ' ' || r == '\u00a0' || r == '\u202f' {
+			return -1
+		}
+		return r
+	}, s)
+	neg := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		neg, s = true, s[1:len(s)-1]
+	}
+	s = strings.TrimSuffix(s, l.DecimalSeparator+"-")
+	if strings.HasSuffix(s, "-") {
+		neg, s = !neg, strings.TrimSuffix(s, "-")
+	}
+	if l.ThousandSeparator != "" {
+		s = strings.ReplaceAll(s, l.ThousandSeparator, "")
+	}
+	s = strings.Replace(s, l.DecimalSeparator, ".", 1)
+	if !plainNumber.MatchString(s) {
+		return "", fmt.Errorf("not a number in number_locale (decimal %q, thousands %q)", l.DecimalSeparator, l.ThousandSeparator)
+	}
+	if neg {
+		if strings.HasPrefix(s, "-") {
+			return "", fmt.Errorf("not a number: more than one minus sign")
+		}
+		s = "-" + strings.TrimPrefix(s, "+")
+	}
+	if integer {
+		if i := strings.IndexByte(s, '.'); i >= 0 {
+			if strings.Trim(s[i+1:], "0") != "" {
+				return "", fmt.Errorf("not an integer")
+			}
+			s = s[:i]
+		}
+	}
+	return s, nil
+}
+
+// applyRows rewrites, in place, the string values rows hold for numeric
+// columns. The values that do not parse are returned, reported against
+// their row (0-based, as validate reports) and left unchanged.
+func (l *numberLocale) applyRows(cols []columnInfo, rows []map[string]interface{}) []importError {
+	if l == nil {
+		return nil
+	}
+	var bad []importError
+	for _, c := range cols {
+		if !containsString(numericTypes, c.TypName) {
+			continue
+		}
+		cl := l.column(c.Name)
+		integer := strings.HasPrefix(c.TypName, "int")
+		for r, row := range rows {
+			s, ok := row[c.Name].(string)
+			if !ok {
+				continue
+			}
+			v, err := cl.parse(s, integer)
+			if err != nil {
+				if len(bad) < maxReportedImportErrors {
+					bad = append(bad, importError{Row: r, Column: c.Name, Value: s, Reason: err.Error()})
+				}
+				continue
+			}
+			row[c.Name] = v
+		}
+	}
+	return bad
+}
@@ -0,0 +1,178 @@
+package pgcomp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const defaultOrphanSamples = 20
+
+// orphanOptions are the inputs of the orphans data_type.
+type orphanOptions struct {
+	Columns       []string // the child's referencing columns
+	Parent        string
+	ParentColumns []string // default the parent's primary key
+	// IncludeNulls counts rows with a NULL key column as orphans; a
+	// foreign key (MATCH SIMPLE) does not check them
+	IncludeNulls bool
+	Samples      int64
+	Suggest      bool // return the ALTER TABLE adding the foreign key
+}
+
+// findOrphans answers the orphans data_type: the rows of child whose key
+// has no match in the parent, counted and sampled with an anti-join, the
+// rows a foreign key from child to the parent would reject.
+// parent_key_unique tells whether the parent columns have the unique
+// constraint or index a foreign key needs.
+func findOrphans(db querier, child string, opts orphanOptions) (interface{}, error) {
+	if len(opts.Columns) == 0 {
+		return nil, fmt.Errorf("columns (the child's key) is required for orphans")
+	}
+	if opts.Parent == "" {
+		return nil, fmt.Errorf("parent_table is required for orphans")
+	}
+	if opts.Samples <= 0 {
+		opts.Samples = defaultOrphanSamples
+	}
+	crel, err := resolveRelation(db, child)
+	if err != nil {
+		return nil, err
+	}
+	prel, err := resolveRelation(db, opts.Parent)
+	if err != nil {
+		return nil, fmt.Errorf("parent_table: %w", err)
+	}
+	parentCols := opts.ParentColumns
+	if len(parentCols) == 0 {
+		if parentCols, err = primaryKey(db, prel); err != nil {
+			return nil, err
+		}
+		if len(parentCols) == 0 {
+			return nil, fmt.Errorf("%s has no primary key; give parent_columns", prel.Name)
+		}
+	}
+	if len(parentCols) != len(opts.Columns) {
+		return nil, fmt.Errorf("columns has %d column(s) but the parent key %d", len(opts.Columns), len(parentCols))
+	}
+	for _, c := range []struct {
+		rel  *relation
+		cols []string
+	}{{crel, opts.Columns}, {prel, parentCols}} {
+		relCols, err := c.rel.columns(db)
+		if err != nil {
+			return nil, err
+		}
+		known := make([]string, len(relCols))
+		for i, rc := range relCols {
+			known[i] = rc.Name
+		}
+		for _, name := range c.cols {
+			if !containsString(known, name) {
+				return nil, fmt.Errorf("column %q does not exist in %s", name, c.rel.Name)
+			}
+		}
+	}
+
+	var match, nullKey, childKeys, parentKeys []string
+	for i, c := range opts.Columns {
+		ck, pk := pq.QuoteIdentifier(c), pq.QuoteIdentifier(parentCols[i])
+		match = append(match, fmt.Sprintf("p.%s = c.%s", pk, ck))
+		nullKey = append(nullKey, "c."+ck+" IS NULL")
+		childKeys = append(childKeys, ck)
+		parentKeys = append(parentKeys, pk)
+	}
+	anyNull := "(" + strings.Join(nullKey, " OR ") + ")"
+	missing := fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s AS p WHERE %s)", prel.Name, strings.Join(match, " AND "))
+
+	q := fmt.Sprintf("SELECT count(*) FILTER (WHERE NOT %s AND %s), count(*) FILTER (WHERE %s) FROM %s AS c",
+		anyNull, missing, anyNull, crel.Name)
+	logSQL(q, nil)
+	var orphans, nullRows int64
+	if err := db.QueryRow(q).Scan(&orphans, &nullRows); err != nil {
+		return nil, err
+	}
+	unique, err := uniqueKey(db, prel, parentCols)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{
+		"child":             crel.Name,
+		"columns":           opts.Columns,
+		"parent":            prel.Name,
+		"parent_columns":    parentCols,
+		"orphan_rows":       orphans,
+		"null_key_rows":     nullRows,
+		"nulls_included":    opts.IncludeNulls,
+		"parent_key_unique": unique,
+		"samples":           []orderedRow{},
+	}
+	cond := "NOT " + anyNull + " AND " + missing
+	if opts.IncludeNulls {
+		res["orphan_rows"] = orphans + nullRows
+		cond = missing
+	}
+
+	if res["orphan_rows"].(int64) > 0 {
+		q = fmt.Sprintf("SELECT c.* FROM %s AS c WHERE %s LIMIT %d", crel.Name, cond, opts.Samples)
+		logSQL(q, nil)
+		rows, err := db.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		if res["samples"], err = collectRows(rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Suggest {
+		var relname string
+		if err := db.QueryRow("SELECT relname::text FROM pg_class WHERE oid = $1", crel.OID).Scan(&relname); err != nil {
+			return nil, err
+		}
+		name := foreignKeyName(relname, opts.Columns)
+		res["constraint"] = map[string]interface{}{
+			"name": name,
+			"alter": fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)",
+				crel.Name, pq.QuoteIdentifier(name), strings.Join(childKeys, ", "), prel.Name, strings.Join(parentKeys, ", ")),
+			// NULL keys pass a foreign key whatever include_nulls says
+			"would_succeed": unique && orphans == 0,
+		}
+	}
+	return res, nil
+}
+
+// uniqueKey reports whether rel has a primary key, unique constraint or
+// unique index on exactly cols, in any order, that a foreign key can
+// reference: immediate, not partial and without expressions. INCLUDE
+// columns are not part of the key.
+func uniqueKey(db querier, rel *relation, cols []string) (bool, error) {
+	sorted := append([]string(nil), cols...)
+	sort.Strings(sorted)
+	var ok bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_index i
+		WHERE i.indrelid = $1 AND i.indisunique AND i.indimmediate
+		AND i.indpred IS NULL AND i.indexprs IS NULL
+		AND (SELECT array_agg(a.attname::text ORDER BY a.attname::text COLLATE "C") FROM unnest(i.indkey) WITH ORDINALITY AS k(attnum, ord)
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+			WHERE k.ord <= i.indnkeyatts) = $2::text[])`,
+		rel.OID, pq.Array(sorted)).Scan(&ok)
+	return ok, err
+}
+
+// foreignKeyName is the name PostgreSQL itself would give the constraint,
+// table_col1_col2_fkey, cut to the 63 byte identifier limit.
+func foreignKeyName(table string, cols []string) string {
+	name := table + "_" + strings.Join(cols, "_")
+	if len(name) > 58 {
+		n := 58
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+	return name + "_fkey"
+}
@@ -0,0 +1,125 @@
+package pgcomp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// defaultStreamRows is how many rows of a select are kept in memory before
+// the result is streamed instead; see resultStream.
+const defaultStreamRows = 10000
+
+// currentEnvelopeVersion is the newest response layout. Version 1 is the
+// original flat {result, error} document and stays the default.
+const currentEnvelopeVersion = 2
+
+// responder writes the single JSON document a request produces, in the
+// envelope version the caller opted into.
+type responder struct {
+	w         io.Writer
+	version   int
+	requestID string
+	warnings  []string
+	stream    *resultStream // set once a result is being streamed
+}
+
+// warn records a non-fatal problem. Warnings are only reported in envelope
+// version 2 and later.
+func (r *responder) warn(format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+func (r *responder) write(out Response) {
+	if r.stream != nil {
+		r.stream.finish(out)
+		return
+	}
+	r.encode(r.w, out)
+}
+
+func (r *responder) encode(w io.Writer, out Response) {
+	enc := json.NewEncoder(w)
+	if r.version < 2 {
+		enc.Encode(out)
+		return
+	}
+	warnings := r.warnings
+	if warnings == nil {
+		warnings = []string{}
+	}
+	enc.Encode(Envelope{
+		EnvelopeVersion: r.version,
+		RequestID:       r.requestID,
+		Response:        out,
+		Warnings:        warnings,
+	})
+}
+
+// frame is the document write would produce for out, split around its
+// result: what comes before the result value and what follows it.
+func (r *responder) frame(out Response) (before, after []byte) {
+	out.Result = nil
+	var buf bytes.Buffer
+	r.encode(&buf, out)
+	// No string value can hold this unescaped, so the first match is the key
+	const key = `"result":null`
+	doc := buf.Bytes()
+	i := bytes.Index(doc, []byte(key)) + len(`"result":`)
+	return doc[:i], doc[i+len("null"):]
+}
+
+// resultStream writes a select result row by row as it is read, so memory
+// stays at one row however large the result. The document is the one
+// write produces: the envelope up to the result, the rows, then the rest
+// of the envelope, written by the responder's final write. An error that
+// comes after the first rows is reported in that final write next to the
+// rows already sent: meta "streamed" is true for every streamed result and
+// "complete" is false when error is set.
+type resultStream struct {
+	r     *responder
+	w     *bufio.Writer
+	close string // ends the result value
+	rows  int
+}
+
+// startStream begins the result: open is written before the first row
+// and close after the last.
+func (r *responder) startStream(open, close string) *resultStream {
+	before, _ := r.frame(Response{})
+	s := &resultStream{r: r, w: bufio.NewWriterSize(r.w, 64<<10), close: close}
+	s.w.Write(before)
+	s.w.WriteString(open)
+	r.stream = s
+	return s
+}
+
+// row writes one element of the result array.
+func (s *resultStream) row(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.rows > 0 {
+		s.w.WriteByte(',')
+	}
+	s.rows++
+	_, err = s.w.Write(b)
+	return err
+}
+
+// finish closes the result and writes out's other fields after it; out's
+// Result has been streamed already and is ignored.
+func (s *resultStream) finish(out Response) {
+	if out.Meta == nil {
+		out.Meta = map[string]interface{}{}
+	}
+	out.Meta["streamed"] = true
+	out.Meta["complete"] = out.Error == ""
+	s.w.WriteString(s.close)
+	_, after := s.r.frame(out)
+	s.w.Write(after)
+	s.w.Flush()
+}
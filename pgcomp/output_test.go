@@ -0,0 +1,159 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRows(n int) []map[string]interface{} {
+	rows := make([]map[string]interface{}, n)
+	for i := range rows {
+		rows[i] = testRow(i)
+	}
+	return rows
+}
+
+func testRow(i int) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      int64(i),
+		"name":    "customer <" + fmt.Sprint(i) + ">",
+		"amount":  "1234.56",
+		"created": "2026-01-01T00:00:00Z",
+		"active":  i%2 == 0,
+	}
+}
+
+// A streamed result is the document the buffered path writes, in every
+// envelope version.
+func TestStreamMatchesWrite(t *testing.T) {
+	rows := testRows(3)
+	keys := []string{"id", "name", "amount", "created", "active"}
+	cases := []struct {
+		name        string
+		result      interface{}
+		open, close string
+		row         func(map[string]interface{}) interface{}
+	}{
+		{"objects", rows, "[", "]", func(m map[string]interface{}) interface{} { return m }},
+		{"query order", orderRows(rows, keys), "[", "]", func(m map[string]interface{}) interface{} {
+			return orderedRow{keys: keys, values: m}
+		}},
+		{"compact", compactRows(rows, keys), `{"columns":["id","name","amount","created","active"],"rows":[`, "]}", func(m map[string]interface{}) interface{} {
+			vals := make([]interface{}, len(keys))
+			for j, k := range keys {
+				vals[j] = m[k]
+			}
+			return vals
+		}},
+	}
+	for _, c := range cases {
+		for _, version := range []int{1, 2} {
+			var want, got bytes.Buffer
+			meta := map[string]interface{}{"tenant": "acme"}
+			wr := &responder{w: &want, version: version, requestID: `a "result":null`}
+			wr.warn("late warning")
+			wr.write(Response{Result: c.result, Meta: map[string]interface{}{"tenant": "acme", "streamed": true, "complete": true}})
+
+			sr := &responder{w: &got, version: version, requestID: `a "result":null`}
+			s := sr.startStream(c.open, c.close)
+			for _, m := range rows {
+				if err := s.row(c.row(m)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sr.warn("late warning")
+			sr.write(Response{Meta: meta})
+			if want.String() != got.String() {
+				t.Errorf("%s, version %d:\nwant %s\ngot  %s", c.name, version, want.String(), got.String())
+			}
+		}
+	}
+}
+
+// An error after the first rows closes the document with the rows sent so
+// far and the error, marked incomplete.
+func TestStreamErrorFrame(t *testing.T) {
+	var buf bytes.Buffer
+	r := &responder{w: &buf, version: 2}
+	s := r.startStream("[", "]")
+	s.row(testRow(0))
+	r.write(errorOutput("row error", fmt.Errorf("connection reset by peer")))
+
+	var doc struct {
+		Result []map[string]interface{} `json:"result"`
+		Error  string                   `json:"error"`
+		Meta   map[string]interface{}   `json:"meta"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("not one JSON document: %v\n%s", err, buf.String())
+	}
+	if len(doc.Result) != 1 || doc.Error != "row error: connection reset by peer" {
+		t.Errorf("result %v, error %q", doc.Result, doc.Error)
+	}
+	if doc.Meta["streamed"] != true || doc.Meta["complete"] != false {
+		t.Errorf("meta %v, want streamed and not complete", doc.Meta)
+	}
+}
+
+const benchResultRows = 1000000
+
+// peakHeap runs f and reports the largest live heap seen while it ran, in
+// MB, as the peak-heap-MB metric.
+func peakHeap(b *testing.B, f func()) {
+	runtime.GC()
+	var peak uint64
+	var done int32
+	stopped := make(chan struct{})
+	go func() {
+		var m runtime.MemStats
+		for atomic.LoadInt32(&done) == 0 {
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak {
+				peak = m.HeapAlloc
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(stopped)
+	}()
+	f()
+	atomic.StoreInt32(&done, 1)
+	<-stopped
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+}
+
+// BenchmarkResultBuffered is the select path below stream_rows: every row
+// is kept, then the result is encoded at once.
+func BenchmarkResultBuffered(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		peakHeap(b, func() {
+			rows := make([]map[string]interface{}, 0)
+			for j := 0; j < benchResultRows; j++ {
+				rows = append(rows, testRow(j))
+			}
+			(&responder{w: io.Discard, version: 2}).write(Response{Result: rows})
+		})
+	}
+}
+
+// BenchmarkResultStreamed is the select path above stream_rows: each row
+// is encoded as it is produced.
+func BenchmarkResultStreamed(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		peakHeap(b, func() {
+			r := &responder{w: io.Discard, version: 2}
+			s := r.startStream("[", "]")
+			for j := 0; j < benchResultRows; j++ {
+				s.row(testRow(j))
+			}
+			r.write(Response{})
+		})
+	}
+}
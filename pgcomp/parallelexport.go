@@ -0,0 +1,346 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultExportWorkers = 4
+	maxExportWorkers     = 64
+	// defaultPartsPerWorker splits finer than the worker count, so a
+	// worker that drew a dense range does not hold up the rest
+	defaultPartsPerWorker = 4
+)
+
+// parallelExportOptions are the inputs of the parallel_export data_type.
+type parallelExportOptions struct {
+	File        string // parts go to File.00001, File.00002, ...
+	Format      string // ndjson (default) or csv
+	Workers     int
+	Parts       int
+	SplitColumn string // default the first primary key column
+	Progress    *progress
+}
+
+// keyRange is one part of parallel_export: the rows with From <= Column <
+// To, either bound open when nil, plus the NULLs when Nulls is set. The
+// bounds are text cast to Type, the column's type.
+type keyRange struct {
+	Column string
+	Type   string
+	From   *string
+	To     *string
+	Nulls  bool
+}
+
+func (r *keyRange) render(column func(string) (string, error), bind func(interface{}) string) (string, error) {
+	col, err := column(r.Column)
+	if err != nil {
+		return "", err
+	}
+	var cond string
+	if r.From != nil {
+		cond = col + " >= " + bind(*r.From) + "::" + r.Type
+	}
+	if r.To != nil {
+		if cond != "" {
+			cond += " AND "
+		}
+		cond += col + " < " + bind(*r.To) + "::" + r.Type
+	}
+	switch {
+	case !r.Nulls:
+		return cond, nil
+	case cond == "":
+		return "", nil
+	}
+	return "(" + cond + " OR " + col + " IS NULL)", nil
+}
+
+// exportParallel answers the parallel_export data_type. A coordinator
+// transaction exports its snapshot and splits the table into key ranges;
+// workers, each on its own connection, join that snapshot with SET
+// TRANSACTION SNAPSHOT and write the ranges to part files concurrently,
+// so the parts together are one consistent copy of the table. Ranges
+// without rows produce no part file.
+func exportParallel(db *sql.DB, name string, tq tableQuery, opts parallelExportOptions) (interface{}, error) {
+	if opts.File == "" {
+		return nil, fmt.Errorf("output_file is required for parallel_export")
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = "ndjson"
+	case "ndjson", "csv":
+	default:
+		return nil, fmt.Errorf("file_format must be one of: ndjson, csv")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = defaultExportWorkers
+	}
+	if opts.Workers > maxExportWorkers {
+		return nil, fmt.Errorf("concurrency must be at most %d for parallel_export", maxExportWorkers)
+	}
+	if opts.Parts <= 0 {
+		opts.Parts = opts.Workers * defaultPartsPerWorker
+	}
+	start := time.Now()
+
+	coord, snap, err := beginSnapshot(db, &snapshotSpec{Isolation: "repeatable_read", Export: true})
+	if err != nil {
+		return nil, err
+	}
+	// The snapshot can be joined only while the coordinator is open
+	defer coord.Rollback()
+	snapshotID := snap["snapshot_id"].(string)
+
+	rel, err := resolveRelation(coord, name)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rel.columns(coord)
+	if err != nil {
+		return nil, err
+	}
+	split := opts.SplitColumn
+	if split == "" {
+		pk, err := primaryKey(coord, rel)
+		if err != nil {
+			return nil, err
+		}
+		if len(pk) == 0 {
+			return nil, newError("no_primary_key", "%s has no primary key; give split_column", rel.Name)
+		}
+		split = pk[0]
+	}
+	var splitCol *columnInfo
+	for i := range cols {
+		if cols[i].Name == split {
+			splitCol = &cols[i]
+		}
+	}
+	if splitCol == nil {
+		return nil, fmt.Errorf("split_column %q does not exist in %s", split, rel.Name)
+	}
+	bounds, method, err := splitBounds(coord, rel, splitCol, opts.Parts)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]keyRange, len(bounds)+1)
+	for i := range ranges {
+		ranges[i] = keyRange{Column: split, Type: splitCol.TypeSQL, Nulls: i == 0 && !splitCol.NotNull}
+		if i > 0 {
+			ranges[i].From = &bounds[i-1]
+		}
+		if i < len(bounds) {
+			ranges[i].To = &bounds[i]
+		}
+	}
+	if len(tq.Filter) == 0 {
+		var estimate float64
+		if err := coord.QueryRow("SELECT reltuples::float8 FROM pg_class WHERE oid = $1", rel.OID).Scan(&estimate); err == nil && estimate > 0 {
+			opts.Progress.expect(int64(estimate), 0)
+		}
+	}
+
+	workers := opts.Workers
+	if workers > len(ranges) {
+		workers = len(ranges)
+	}
+	type partResult struct {
+		file     string
+		rows     int64
+		duration time.Duration
+	}
+	results := make([]partResult, len(ranges))
+	jobs := make(chan int, len(ranges))
+	for i := range ranges {
+		jobs <- i
+	}
+	close(jobs)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wtx, _, err := beginSnapshot(db, &snapshotSpec{Isolation: "repeatable_read", SnapshotID: snapshotID})
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer wtx.Rollback()
+			for i := range jobs {
+				if failed() {
+					return
+				}
+				t := tq
+				t.keyRange = &ranges[i]
+				part := fmt.Sprintf("%s.%05d", opts.File, i+1)
+				began := time.Now()
+				n, _, err := writeExportPart(db, wtx, name, &t, part, 0, opts.Format, opts.Progress)
+				if err != nil {
+					fail(fmt.Errorf("part %d: %w", i+1, err))
+					return
+				}
+				results[i] = partResult{rows: n, duration: time.Since(began)}
+				if n > 0 {
+					results[i].file = part
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var parts []map[string]interface{}
+	var total int64
+	empty := 0
+	for i, r := range results {
+		if r.file == "" {
+			empty++
+			continue
+		}
+		entry := map[string]interface{}{"file": r.file, "rows": r.rows, "duration_ms": r.duration.Milliseconds()}
+		if ranges[i].From != nil {
+			entry["from"] = *ranges[i].From
+		}
+		if ranges[i].To != nil {
+			entry["to"] = *ranges[i].To
+		}
+		parts = append(parts, entry)
+		total += r.rows
+	}
+	if firstErr != nil {
+		ce := newError("parallel_export_failed", "parallel_export failed, the part files written are incomplete: %v", firstErr)
+		ce.Details = map[string]interface{}{"parts_written": parts}
+		ce.cause = firstErr
+		return nil, ce
+	}
+	if parts == nil {
+		parts = []map[string]interface{}{}
+	}
+	res := map[string]interface{}{
+		"snapshot_id":  snapshotID,
+		"snapshot_at":  snap["started_at"],
+		"split_column": split,
+		"split_method": method,
+		"workers":      workers,
+		"format":       opts.Format,
+		"parts":        parts,
+		"empty_ranges": empty,
+		"rows_written": total,
+		"duration_ms":  time.Since(start).Milliseconds(),
+	}
+	opts.Progress.finish(res)
+	return res, nil
+}
+
+// splitBounds returns up to parts-1 increasing bounds of col, as text:
+// evenly spaced between min and max for integer columns, otherwise taken
+// from the planner's histogram. Without statistics (method "none") the
+// table is exported as a single part; ANALYZE fixes that.
+func splitBounds(db querier, rel *relation, col *columnInfo, parts int) ([]string, string, error) {
+	if parts <= 1 {
+		return nil, "none", nil
+	}
+	quoted := pq.QuoteIdentifier(col.Name)
+	switch col.TypName {
+	case "int2", "int4", "int8":
+		var lo, hi sql.NullString
+		q := fmt.Sprintf("SELECT min(%s)::text, max(%s)::text FROM %s", quoted, quoted, rel.Name)
+		logSQL(q, nil)
+		if err := db.QueryRow(q).Scan(&lo, &hi); err != nil {
+			return nil, "", err
+		}
+		if !lo.Valid {
+			return nil, "min_max", nil
+		}
+		min, _ := new(big.Int).SetString(lo.String, 10)
+		max, _ := new(big.Int).SetString(hi.String, 10)
+		span := new(big.Int).Sub(max, min)
+		span.Add(span, big.NewInt(1))
+		var bounds []string
+		for k := 1; k < parts; k++ {
+			b := new(big.Int).Mul(span, big.NewInt(int64(k)))
+			b.Quo(b, big.NewInt(int64(parts)))
+			b.Add(b, min)
+			s := b.String()
+			if b.Cmp(min) > 0 && (len(bounds) == 0 || bounds[len(bounds)-1] != s) {
+				bounds = append(bounds, s)
+			}
+		}
+		return bounds, "min_max", nil
+	}
+
+	// inherited statistics, when present, cover the children too
+	var raw sql.NullString
+	err := db.QueryRow(`SELECT array_to_json(s.histogram_bounds::text::text[])::text FROM pg_stats s
+		JOIN pg_namespace n ON n.nspname = s.schemaname
+		JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = s.tablename
+		WHERE c.oid = $1 AND s.attname = $2 AND s.histogram_bounds IS NOT NULL
+		ORDER BY s.inherited DESC LIMIT 1`, rel.OID, col.Name).Scan(&raw)
+	if err == sql.ErrNoRows || err == nil && !raw.Valid {
+		return nil, "none", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var hist []string
+	if err := json.Unmarshal([]byte(raw.String), &hist); err != nil {
+		return nil, "", err
+	}
+	var bounds []string
+	for k := 1; k < parts; k++ {
+		// the first and last entries are the sampled min and max
+		i := k * (len(hist) - 1) / parts
+		if i > 0 && (len(bounds) == 0 || bounds[len(bounds)-1] != hist[i]) {
+			bounds = append(bounds, hist[i])
+		}
+	}
+	return bounds, "histogram", nil
+}
+
+// writeCSVRow writes the values of m in keys order. NULL is an empty
+// field, and values without a plain text form are written as JSON.
+func writeCSVRow(cw *csv.Writer, keys []string, m map[string]interface{}) error {
+	rec := make([]string, len(keys))
+	for i, k := range keys {
+		v := m[k]
+		if v == nil {
+			continue
+		}
+		if s, ok := exprText(v); ok {
+			rec[i] = s
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		rec[i] = string(raw)
+	}
+	return cw.Write(rec)
+}
@@ -0,0 +1,185 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// partitionOptions carries the inputs of the partition data_type.
+type partitionOptions struct {
+	Name        string // partition for detach and drop
+	Suffix      string // create_range: partition is <parent>_<suffix>
+	From, To    string // create_range bounds: a value or a JSON array for multi-column keys
+	IfNotExists bool
+	Confirm     string // detach and drop: must repeat the partition name
+}
+
+// managePartitions implements the partition data_type on the partitioned
+// table parent. DDL cannot take bind parameters, so bounds are rendered as
+// quoted literals and every statement run is echoed in the result.
+func managePartitions(db querier, parent, operation string, opts partitionOptions) (interface{}, error) {
+	rel, err := resolveRelation(db, parent)
+	if err != nil {
+		return nil, err
+	}
+	if rel.Kind != "partitioned_table" {
+		return nil, fmt.Errorf("%s is not a partitioned table", rel.Name)
+	}
+
+	switch operation {
+	case "", "list":
+		return listPartitions(db, rel)
+	case "create_range":
+		return createRangePartition(db, rel, opts)
+	case "detach", "drop":
+	default:
+		return nil, fmt.Errorf("unknown partition operation %q (allowed: list, create_range, detach, drop)", operation)
+	}
+
+	if opts.Name == "" {
+		return nil, fmt.Errorf("name is required for partition %s", operation)
+	}
+	part, err := resolveRelation(db, opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	var attached bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_inherits WHERE inhrelid = $1 AND inhparent = $2)", part.OID, rel.OID).Scan(&attached); err != nil {
+		return nil, err
+	}
+	if !attached {
+		return nil, fmt.Errorf("%s is not a partition of %s", part.Name, rel.Name)
+	}
+	if opts.Confirm != opts.Name && opts.Confirm != part.Name {
+		return nil, fmt.Errorf("partition %s needs confirm set to the partition name (%s)", operation, opts.Name)
+	}
+
+	var stmt string
+	res := map[string]interface{}{"partition": part.Name}
+	if operation == "detach" {
+		stmt = fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", rel.Name, part.Name)
+		res["detached"] = true
+	} else {
+		stmt = "DROP TABLE " + part.Name
+		res["dropped"] = true
+	}
+	logSQL(stmt, nil)
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+	res["sql"] = stmt
+	return res, nil
+}
+
+func listPartitions(db querier, rel *relation) (interface{}, error) {
+	rows, err := db.Query(`SELECT c.oid::regclass::text, pg_get_expr(c.relpartbound, c.oid), c.relkind::text, c.reltuples
+		FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1
+		ORDER BY c.oid::regclass::text`, rel.OID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := []map[string]interface{}{}
+	for rows.Next() {
+		var name, kind string
+		var bound sql.NullString
+		var tuples float64
+		if err := rows.Scan(&name, &bound, &kind, &tuples); err != nil {
+			return nil, err
+		}
+		p := map[string]interface{}{"name": name, "bound": nullString(bound), "kind": relKinds[kind], "row_estimate": nil}
+		if tuples >= 0 {
+			p["row_estimate"] = int64(tuples)
+		}
+		parts = append(parts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"parent": rel.Name, "partitions": parts}, nil
+}
+
+func createRangePartition(db querier, rel *relation, opts partitionOptions) (interface{}, error) {
+	var strategy string
+	if err := db.QueryRow("SELECT partstrat::text FROM pg_partitioned_table WHERE partrelid = $1", rel.OID).Scan(&strategy); err != nil {
+		return nil, err
+	}
+	if strategy != "r" {
+		return nil, fmt.Errorf("%s is not range partitioned", rel.Name)
+	}
+	if opts.Suffix == "" || opts.From == "" || opts.To == "" {
+		return nil, fmt.Errorf("suffix, from and to are required for partition create_range")
+	}
+	for _, r := range opts.Suffix {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return nil, fmt.Errorf("invalid partition suffix %q: use letters, digits and _", opts.Suffix)
+		}
+	}
+	from, err := partitionBound(opts.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %v", err)
+	}
+	to, err := partitionBound(opts.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to: %v", err)
+	}
+
+	var schema, table string
+	if err := db.QueryRow("SELECT n.nspname, c.relname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = $1", rel.OID).Scan(&schema, &table); err != nil {
+		return nil, err
+	}
+	name := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table+"_"+opts.Suffix)
+	stmt := fmt.Sprintf("CREATE TABLE %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)", name, rel.Name, from, to)
+
+	existing, err := lookupRelation(db, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if !opts.IfNotExists {
+			return nil, fmt.Errorf("relation %s already exists", existing.Name)
+		}
+		return map[string]interface{}{"partition": existing.Name, "exists": true, "created": false, "sql": stmt}, nil
+	}
+
+	logSQL(stmt, nil)
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"partition": name, "exists": false, "created": true, "sql": stmt}, nil
+}
+
+// partitionBound renders a FROM/TO bound: one value or a JSON array of
+// values, each quoted as a literal unless it is MINVALUE or MAXVALUE.
+func partitionBound(val string) (string, error) {
+	var items []interface{}
+	if strings.HasPrefix(val, "[") {
+		if err := json.Unmarshal([]byte(val), &items); err != nil {
+			return "", err
+		}
+		if len(items) == 0 {
+			return "", fmt.Errorf("bound is empty")
+		}
+	} else {
+		items = []interface{}{val}
+	}
+	out := make([]string, len(items))
+	for i, it := range items {
+		if it == nil {
+			return "", fmt.Errorf("bounds cannot be null")
+		}
+		s := fmt.Sprint(it)
+		if up := strings.ToUpper(s); up == "MINVALUE" || up == "MAXVALUE" {
+			out[i] = up
+		} else {
+			out[i] = pq.QuoteLiteral(s)
+		}
+	}
+	return strings.Join(out, ", "), nil
+}
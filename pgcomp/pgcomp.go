@@ -0,0 +1,87 @@
+// Package pgcomp is the PostgreSQL component. The postgresql-plugin
+// command runs one request through Run; Go services can run requests in
+// their own process with Execute, building them and reading the result
+// with the component's own types. The JSON encoding of Request and
+// Response is the component's wire format and does not change.
+//
+// The whole component is this one package for now: Run still dispatches
+// every data_type itself, and the configuration, connection, execution and
+// encoding code is not split into packages of its own yet.
+package pgcomp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Request is the document the component reads from stdin.
+type Request struct {
+	Params []Param `json:"params"`
+}
+
+// Param is one input: its name (host, data_type, query, ...) and its value,
+// always a string.
+type Param struct {
+	InputName string `json:"inputname"`
+	CompValue string `json:"compvalue"`
+}
+
+// Response is the envelope version 1 document the component writes to
+// stdout. Version 2 adds envelope_version, request_id and warnings around
+// the same fields; see Envelope.
+type Response struct {
+	Result  interface{}            `json:"result"`
+	Error   string                 `json:"error"`
+	Code    string                 `json:"code,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Meta    map[string]interface{} `json:"meta,omitempty"`
+}
+
+// Envelope is the version 2 response: the version 1 fields plus the
+// envelope version, the caller's request_id and a warnings array that is
+// always present.
+type Envelope struct {
+	EnvelopeVersion int    `json:"envelope_version"`
+	RequestID       string `json:"request_id,omitempty"`
+	Response
+	Warnings []string `json:"warnings"`
+}
+
+// Execute runs req as the command runs the document on its stdin and
+// returns the response, in the envelope version req asks for. A version 1
+// response has EnvelopeVersion 1 and no request_id or warnings. A request
+// that fails is reported in Error and Code, as on the wire; the error is
+// only for a response that cannot be read back. Numbers in Result are
+// json.Number, so bigints and numerics keep every digit.
+//
+// args are the command's arguments: Execute(ctx, req, "--policy", file)
+// applies a deployment policy. Without --policy the POLICY_FILE
+// environment variable is read, as by the command.
+//
+// ctx is only checked before the request starts: Run takes no context, so
+// a running request is not cancelled. Like Run, Execute shares package
+// state (limits, logger, catalog caches) with every other request in the
+// process.
+func Execute(ctx context.Context, req Request, args ...string) (Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return Envelope{}, err
+	}
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return Envelope{}, err
+	}
+	var out bytes.Buffer
+	Run(bytes.NewReader(raw), &out, args)
+	var env Envelope
+	dec := json.NewDecoder(&out)
+	dec.UseNumber()
+	if err := dec.Decode(&env); err != nil {
+		return Envelope{}, fmt.Errorf("reading the response: %v", err)
+	}
+	if env.EnvelopeVersion == 0 {
+		env.EnvelopeVersion = 1
+	}
+	return env, nil
+}
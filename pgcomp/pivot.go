@@ -0,0 +1,203 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const defaultPivotMaxColumns = 100
+
+// pivotSpec is the "pivot" input: rows are grouped by RowKey and the
+// distinct values of ColumnKey become columns holding the aggregated Value.
+type pivotSpec struct {
+	RowKey     string `json:"row_key"`
+	ColumnKey  string `json:"column_key"`
+	Value      string `json:"value"`
+	Aggregate  string `json:"aggregate"` // sum (default), count, min, max, avg, first
+	MaxColumns int    `json:"max_columns"`
+}
+
+func parsePivot(val string) (*pivotSpec, error) {
+	var p pivotSpec
+	if err := json.Unmarshal([]byte(val), &p); err != nil {
+		return nil, fmt.Errorf("invalid pivot: %v", err)
+	}
+	if p.RowKey == "" || p.ColumnKey == "" || p.Value == "" {
+		return nil, fmt.Errorf("pivot requires row_key, column_key and value")
+	}
+	p.Aggregate = strings.ToLower(p.Aggregate)
+	if p.Aggregate == "" {
+		p.Aggregate = "sum"
+	}
+	switch p.Aggregate {
+	case "sum", "count", "min", "max", "avg", "first":
+	default:
+		return nil, fmt.Errorf("pivot aggregate must be one of: sum, count, min, max, avg, first")
+	}
+	if p.MaxColumns <= 0 {
+		p.MaxColumns = defaultPivotMaxColumns
+	}
+	return &p, nil
+}
+
+// pivotCell accumulates the values that land in one output cell.
+type pivotCell struct {
+	count   int64
+	sum     *big.Rat
+	kind    string // int, float or decimal: how sum/min/max are reported
+	scale   int    // decimal places of the widest decimal input
+	best    interface{}
+	bestRat *big.Rat
+	first   interface{}
+}
+
+// applyPivot reshapes rows into one row per distinct row_key, in the order
+// the keys first appear, with one column per distinct column_key value.
+// Missing combinations are null. It returns the generated column names.
+func applyPivot(rows []map[string]interface{}, p *pivotSpec) ([]map[string]interface{}, []string, error) {
+	var rowOrder, colOrder []string
+	rowKeys := map[string]interface{}{}
+	seenCols := map[string]bool{}
+	cells := map[string]map[string]*pivotCell{}
+
+	for i, r := range rows {
+		for _, c := range []string{p.RowKey, p.ColumnKey, p.Value} {
+			if _, ok := r[c]; !ok {
+				return nil, nil, fmt.Errorf("pivot column %q is not in the result", c)
+			}
+		}
+		rk := fmt.Sprint(r[p.RowKey])
+		ck := fmt.Sprint(r[p.ColumnKey])
+		if _, ok := rowKeys[rk]; !ok {
+			rowKeys[rk] = r[p.RowKey]
+			rowOrder = append(rowOrder, rk)
+			cells[rk] = map[string]*pivotCell{}
+		}
+		if !seenCols[ck] {
+			if len(colOrder) >= p.MaxColumns {
+				return nil, nil, fmt.Errorf("pivot would produce more than %d columns (row %d adds %q); raise max_columns if this is intended", p.MaxColumns, i, ck)
+			}
+			seenCols[ck] = true
+			colOrder = append(colOrder, ck)
+		}
+		cell := cells[rk][ck]
+		if cell == nil {
+			cell = &pivotCell{}
+			cells[rk][ck] = cell
+		}
+		if err := cell.add(r[p.Value], p.Aggregate); err != nil {
+			return nil, nil, fmt.Errorf("pivot row %d: %v", i, err)
+		}
+	}
+
+	out := make([]map[string]interface{}, 0, len(rowOrder))
+	for _, rk := range rowOrder {
+		m := map[string]interface{}{p.RowKey: rowKeys[rk]}
+		for _, ck := range colOrder {
+			if cell := cells[rk][ck]; cell != nil {
+				m[ck] = cell.result(p.Aggregate)
+			} else {
+				m[ck] = nil
+			}
+		}
+		out = append(out, m)
+	}
+	return out, colOrder, nil
+}
+
+func (c *pivotCell) add(v interface{}, agg string) error {
+	if c.count == 0 {
+		c.first = v
+	}
+	if v == nil {
+		return nil
+	}
+	c.count++
+	if agg == "count" || agg == "first" {
+		return nil
+	}
+
+	r, kind, scale, ok := toRat(v)
+	if !ok {
+		if agg == "min" || agg == "max" {
+			// Non-numeric values compare as text
+			s := fmt.Sprint(v)
+			if c.best == nil || (agg == "min" && s < fmt.Sprint(c.best)) || (agg == "max" && s > fmt.Sprint(c.best)) {
+				c.best = v
+			}
+			return nil
+		}
+		return fmt.Errorf("value %v is not numeric", v)
+	}
+	if c.kind == "" || kind == "decimal" || (kind == "float" && c.kind == "int") {
+		c.kind = kind
+	}
+	if scale > c.scale {
+		c.scale = scale
+	}
+	if c.sum == nil {
+		c.sum = new(big.Rat)
+	}
+	c.sum.Add(c.sum, r)
+	if c.bestRat == nil || (agg == "min" && r.Cmp(c.bestRat) < 0) || (agg == "max" && r.Cmp(c.bestRat) > 0) {
+		c.bestRat, c.best = r, v
+	}
+	return nil
+}
+
+func (c *pivotCell) result(agg string) interface{} {
+	switch agg {
+	case "count":
+		return c.count
+	case "first":
+		return c.first
+	case "min", "max":
+		return c.best
+	case "avg":
+		if c.sum == nil || c.count == 0 {
+			return nil
+		}
+		f, _ := new(big.Rat).Quo(c.sum, big.NewRat(c.count, 1)).Float64()
+		return f
+	}
+	if c.sum == nil {
+		return nil
+	}
+	switch c.kind {
+	case "int":
+		return c.sum.Num().Int64()
+	case "float":
+		f, _ := c.sum.Float64()
+		return f
+	}
+	// Sums of numeric columns stay exact decimal strings
+	return c.sum.FloatString(c.scale)
+}
+
+// toRat converts a result value to an exact rational, reporting how the
+// value was represented and, for decimal strings, its number of decimals.
+func toRat(v interface{}) (*big.Rat, string, int, bool) {
+	switch t := v.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(t), "int", 0, true
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(t) == nil {
+			return nil, "", 0, false
+		}
+		return r, "float", 0, true
+	case string:
+		r, ok := new(big.Rat).SetString(t)
+		if !ok {
+			return nil, "", 0, false
+		}
+		scale := 0
+		if i := strings.IndexByte(t, '.'); i >= 0 {
+			scale = len(t) - i - 1
+		}
+		return r, "decimal", scale, true
+	}
+	return nil, "", 0, false
+}
@@ -0,0 +1,252 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+)
+
+// policyEnv names the policy file when --policy is not given.
+const policyEnv = "POLICY_FILE"
+
+// policy is the deployment's allow-list, loaded from the file given with
+// --policy or POLICY_FILE. It restricts every request of the deployment;
+// no input can widen it. A rule that is left out does not restrict.
+type policy struct {
+	DataTypes []string `json:"data_types"`
+	// Schemas and Tables are glob patterns ("sales", "sales.order_*")
+	// matched against the catalog names of the objects a request names, so
+	// quoting or search_path cannot make a name match differently than it
+	// resolves
+	Schemas     []string `json:"schemas"`
+	Tables      []string `json:"tables"`
+	AllowQuery  *bool    `json:"allow_query"` // SQL text given in the request
+	AllowDDL    *bool    `json:"allow_ddl"`
+	AllowDML    *bool    `json:"allow_dml"`
+	MaxRows     int64    `json:"max_rows"`     // rows a request may return
+	MaxAffected int64    `json:"max_affected"` // rows a request may write
+
+	file string
+}
+
+// loadPolicy reads the policy named by args or the environment, nil when
+// there is none. Only JSON is understood.
+func loadPolicy(args []string) (*policy, error) {
+	file := os.Getenv(policyEnv)
+	for i, a := range args {
+		switch {
+		case a == "--policy" && i+1 < len(args):
+			file = args[i+1]
+		case strings.HasPrefix(a, "--policy="):
+			file = strings.TrimPrefix(a, "--policy=")
+		}
+	}
+	if file == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, newError("policy_config", "failed to read policy file: %v", err)
+	}
+	p := &policy{file: file}
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, newError("policy_config", "policy file %s is not a valid JSON policy: %v", file, err)
+	}
+	for _, pat := range append(append([]string{}, p.Schemas...), p.Tables...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, newError("policy_config", "policy pattern %q is invalid: %v", pat, err)
+		}
+	}
+	for _, t := range p.DataTypes {
+		if !containsString(dataTypes, t) {
+			return nil, newError("policy_config", "policy data_types lists unknown data_type %q", t)
+		}
+	}
+	return p, nil
+}
+
+// denied is the policy_denied error for rule.
+func (p *policy) denied(rule, format string, args ...interface{}) error {
+	ce := newError("policy_denied", format, args...)
+	ce.Details = map[string]interface{}{"rule": rule, "policy_file": p.file}
+	return ce
+}
+
+func allowed(b *bool) bool {
+	return b == nil || *b
+}
+
+// ddlDataTypes and dmlDataTypes are the data_types that change the schema
+// or the data themselves, whatever SQL the request carries.
+var (
+	ddlDataTypes = []string{"extensions", "roles", "database", "partition", "comments", "fdw", "matview_refresh", "restore",
+		"list_triggers"}
+	// A procedure is called for what it does, so CALL counts as a write
+	dmlDataTypes = []string{"insert", "update", "delete", "merge", "import", "generate", "staged_load", "copy_between",
+		"sync", "restore", "dequeue", "ack", "nack", "largeobject", "cdc_advance", "commit_prepared", "rollback_prepared",
+		"stored_procedure"}
+)
+
+// checkRequest applies the rules that need no connection: the data_type,
+// SQL text in the request and what it does, and the row limit asked for.
+// A policy with schemas or tables refuses SQL text altogether.
+// sqlTexts are the request's SQL: query, the transaction statements, a
+// template as rendered, the precondition and verify checks and the
+// staged_load validations.
+func (p *policy) checkRequest(dataType, operation string, sqlTexts []string, limit int64) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.DataTypes) > 0 && !containsString(p.DataTypes, dataType) {
+		return p.denied("data_types", "data_type %s is not allowed by the policy", dataType)
+	}
+	if !allowed(p.AllowQuery) && (len(sqlTexts) > 0 || dataType == "restore") {
+		return p.denied("allow_query", "the policy does not allow SQL text in requests")
+	}
+	// SQL text can name any relation, and only the objects a request names
+	// are resolved against the patterns
+	if (len(p.Schemas) > 0 || len(p.Tables) > 0) && (len(sqlTexts) > 0 || dataType == "restore") {
+		rule := "tables"
+		if len(p.Schemas) > 0 {
+			rule = "schemas"
+		}
+		return p.denied(rule, "the policy restricts schemas and tables, so SQL text in requests is not allowed")
+	}
+	// Listing and reading through a management data_type changes nothing
+	reading := operation == "" || operation == "list" || operation == "get"
+	if !allowed(p.AllowDDL) && containsString(ddlDataTypes, dataType) && (!reading || dataType == "restore" || dataType == "matview_refresh") {
+		return p.denied("allow_ddl", "the policy does not allow schema changes (data_type %s)", dataType)
+	}
+	if !allowed(p.AllowDML) && containsString(dmlDataTypes, dataType) && (dataType != "largeobject" || operation != "read") {
+		return p.denied("allow_dml", "the policy does not allow data changes (data_type %s)", dataType)
+	}
+	for _, text := range sqlTexts {
+		ddl, dml := statementKinds(text)
+		if ddl && !allowed(p.AllowDDL) {
+			return p.denied("allow_ddl", "the policy does not allow schema changes; the SQL contains DDL")
+		}
+		if dml && !allowed(p.AllowDML) {
+			return p.denied("allow_dml", "the policy does not allow data changes; the SQL writes data")
+		}
+	}
+	if p.MaxRows > 0 && limit > p.MaxRows {
+		return p.denied("max_rows", "limit %d exceeds the policy's max_rows %d", limit, p.MaxRows)
+	}
+	return nil
+}
+
+// checkObjects applies the schema and table rules to the relations and
+// schemas a request names. Names are resolved by the server, as the
+// data_types resolve them, within the request transaction, so a tenant's
+// search_path counts; a name the policy cannot resolve is refused.
+func (p *policy) checkObjects(db querier, names []string, schemas []string) error {
+	if p == nil || len(p.Schemas) == 0 && len(p.Tables) == 0 {
+		return nil
+	}
+	for _, s := range schemas {
+		if s != "" && !p.schemaAllowed(s) {
+			return p.denied("schemas", "schema %q is not allowed by the policy", s)
+		}
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		var nsp, rel string
+		err := db.QueryRow(`SELECT n.nspname, c.relname FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = to_regclass($1)`, name).Scan(&nsp, &rel)
+		if err == sql.ErrNoRows {
+			// stored_procedure and stored_function name a routine
+			err = db.QueryRow(`SELECT n.nspname, p.proname FROM pg_proc p
+				JOIN pg_namespace n ON n.oid = p.pronamespace WHERE p.oid = to_regproc($1)`, name).Scan(&nsp, &rel)
+		}
+		if err == sql.ErrNoRows {
+			// list_enum names a type
+			err = db.QueryRow(`SELECT n.nspname, t.typname FROM pg_type t
+				JOIN pg_namespace n ON n.oid = t.typnamespace WHERE t.oid = to_regtype($1)`, name).Scan(&nsp, &rel)
+		}
+		if err == sql.ErrNoRows {
+			return p.denied("tables", "%q cannot be resolved, so the policy cannot allow it", name)
+		}
+		if err != nil {
+			return err
+		}
+		if !p.schemaAllowed(nsp) {
+			return p.denied("schemas", "schema %q of %s is not allowed by the policy", nsp, name)
+		}
+		if len(p.Tables) > 0 && !p.tableAllowed(nsp, rel) {
+			return p.denied("tables", "%s.%s is not allowed by the policy", nsp, rel)
+		}
+	}
+	return nil
+}
+
+func (p *policy) schemaAllowed(schema string) bool {
+	if len(p.Schemas) == 0 {
+		return true
+	}
+	for _, pat := range p.Schemas {
+		if ok, _ := path.Match(pat, schema); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tableAllowed matches schema.table against the table patterns; a
+// pattern without a schema part matches the table in any schema.
+func (p *policy) tableAllowed(schema, table string) bool {
+	for _, pat := range p.Tables {
+		sp, tp := "*", pat
+		if i := strings.Index(pat, "."); i >= 0 {
+			sp, tp = pat[:i], pat[i+1:]
+		}
+		okS, _ := path.Match(sp, schema)
+		okT, _ := path.Match(tp, table)
+		if okS && okT {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRows and checkAffected apply the ceilings to what a request
+// returned or wrote; a write over max_affected is rolled back.
+func (p *policy) checkRows(n int64) error {
+	if p != nil && p.MaxRows > 0 && n > p.MaxRows {
+		return p.denied("max_rows", "the result has more than the policy's max_rows %d rows", p.MaxRows)
+	}
+	return nil
+}
+
+func (p *policy) checkAffected(n int64) error {
+	if p != nil && p.MaxAffected > 0 && n > p.MaxAffected {
+		return p.denied("max_affected", "the request wrote %d rows, more than the policy's max_affected %d; rolled back", n, p.MaxAffected)
+	}
+	return nil
+}
+
+// affectedRows adds up the rows a data_type's result reports as written.
+func affectedRows(result interface{}) int64 {
+	m, ok := result.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	if n, ok := m["merged"].(int64); ok {
+		return n
+	}
+	var total int64
+	for _, k := range []string{"inserted", "loaded", "copied", "updated", "deleted", "rows_affected", "executed"} {
+		switch n := m[k].(type) {
+		case int64:
+			total += n
+		case int:
+			total += int64(n)
+		}
+	}
+	return total
+}
@@ -0,0 +1,109 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheckRequest(t *testing.T) {
+	no := false
+	cases := []struct {
+		name      string
+		pol       policy
+		dataType  string
+		operation string
+		sql       []string
+		rule      string // "" when allowed
+	}{
+		{"triggers listed without ddl", policy{AllowDDL: &no}, "list_triggers", "list", nil, ""},
+		{"trigger disabled without ddl", policy{AllowDDL: &no}, "list_triggers", "disable", nil, "allow_ddl"},
+		{"trigger enabled without ddl", policy{AllowDDL: &no}, "list_triggers", "enable", nil, "allow_ddl"},
+		{"procedure called without dml", policy{AllowDML: &no}, "stored_procedure", "", nil, "allow_dml"},
+		{"function called without dml", policy{AllowDML: &no}, "stored_function", "", nil, ""},
+		{"query under a table list", policy{Tables: []string{"sales.*"}}, "query", "", []string{"SELECT * FROM hr.salaries"}, "tables"},
+		{"query under a schema list", policy{Schemas: []string{"sales"}}, "query", "", []string{"SELECT 1"}, "schemas"},
+		{"transaction under a table list", policy{Tables: []string{"orders"}}, "transaction", "", []string{"DELETE FROM orders", "DELETE FROM hr.salaries"}, "tables"},
+		{"verify under a table list", policy{Tables: []string{"orders"}}, "insert", "", []string{"SELECT count(*) = 1 FROM orders"}, "tables"},
+		{"restore under a schema list", policy{Schemas: []string{"sales"}}, "restore", "", nil, "schemas"},
+		{"table under a table list", policy{Tables: []string{"orders"}}, "table", "", nil, ""},
+		{"query without lists", policy{}, "query", "", []string{"SELECT 1"}, ""},
+		{"ddl in a query", policy{AllowDDL: &no}, "query", "", []string{"DROP TABLE orders"}, "allow_ddl"},
+		{"dml in a query", policy{AllowDML: &no}, "query", "", []string{"WITH d AS (DELETE FROM orders RETURNING 1) SELECT 1"}, "allow_dml"},
+		{"data_type not listed", policy{DataTypes: []string{"table"}}, "query", "", nil, "data_types"},
+	}
+	for _, c := range cases {
+		err := c.pol.checkRequest(c.dataType, c.operation, c.sql, 0)
+		if c.rule == "" {
+			if err != nil {
+				t.Errorf("%s: denied: %v", c.name, err)
+			}
+			continue
+		}
+		ce, ok := err.(*componentError)
+		if !ok || ce.Code != "policy_denied" {
+			t.Errorf("%s: got %v, want policy_denied", c.name, err)
+			continue
+		}
+		if rule := ce.Details["rule"]; rule != c.rule {
+			t.Errorf("%s: denied by %v, want %s", c.name, rule, c.rule)
+		}
+	}
+}
+
+func TestPolicyTableAllowed(t *testing.T) {
+	p := policy{Tables: []string{"sales.order_*", "audit_log"}}
+	for _, c := range []struct {
+		schema, table string
+		want          bool
+	}{
+		{"sales", "order_lines", true},
+		{"sales", "customers", false},
+		{"hr", "order_lines", false},
+		{"hr", "audit_log", true},
+	} {
+		if got := p.tableAllowed(c.schema, c.table); got != c.want {
+			t.Errorf("tableAllowed(%s, %s) = %v, want %v", c.schema, c.table, got, c.want)
+		}
+	}
+}
+
+// TestPolicyRequestSQL runs whole requests under a policy file, so the SQL
+// a request carries outside query is known to reach checkRequest. Each is
+// refused before anything connects.
+func TestPolicyRequestSQL(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy string
+		params string
+		rule   string
+	}{
+		{"staged_load validation under a table list", `{"tables": ["sales.*"]}`,
+			`{"inputname":"data_type","compvalue":"staged_load"},{"inputname":"object_name","compvalue":"sales.orders"},` +
+				`{"inputname":"validations","compvalue":"[{\"name\":\"leak\",\"query\":\"SELECT * FROM hr.salaries\"}]"}`, "tables"},
+		{"staged_load validation without allow_query", `{"allow_query": false}`,
+			`{"inputname":"data_type","compvalue":"staged_load"},{"inputname":"object_name","compvalue":"orders"},` +
+				`{"inputname":"validations","compvalue":"[{\"name\":\"leak\",\"query\":\"SELECT * FROM pg_authid\"}]"}`, "allow_query"},
+		{"template under a table list", `{"tables": ["sales.*"]}`,
+			`{"inputname":"data_type","compvalue":"template"},{"inputname":"query","compvalue":"COMMENT ON TABLE {{t}} IS {{c}}"},` +
+				`{"inputname":"values","compvalue":"{\"t\":{\"kind\":\"identifier\",\"value\":\"hr.salaries\"},\"c\":\"x\"}"}`, "tables"},
+	}
+	for _, c := range cases {
+		file := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(file, []byte(c.policy), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		Run(strings.NewReader(`{"params":[`+conn+`,`+c.params+`]}`), &out, []string{"--policy", file})
+		var resp Response
+		if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", c.name, err, out.Bytes())
+		}
+		if resp.Code != "policy_denied" || resp.Details["rule"] != c.rule {
+			t.Errorf("%s: got %s %v (%s), want policy_denied by %s", c.name, resp.Code, resp.Details["rule"], resp.Error, c.rule)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// postProcess holds the post_filter, post_order_by and post_limit inputs.
+// They work on the rows a function, procedure or query returned, after
+// the database produced all of them, for functions that take no filter
+// arguments of their own.
+type postProcess struct {
+	Filter  []filterSpec
+	OrderBy []postOrder
+	Limit   int64
+}
+
+// postOrder is one "column [asc|desc]" entry of post_order_by. Nulls sort
+// last ascending and first descending, as on the server.
+type postOrder struct {
+	Column string
+	Desc   bool
+}
+
+func parsePostOrderBy(val string) ([]postOrder, error) {
+	entries, err := parseColumns(val)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]postOrder, 0, len(entries))
+	for _, e := range entries {
+		f := strings.Fields(e)
+		o := postOrder{Column: f[0]}
+		if len(f) > 2 {
+			return nil, fmt.Errorf("post_order_by entry %q must be a column optionally followed by asc or desc", e)
+		}
+		if len(f) == 2 {
+			switch strings.ToLower(f[1]) {
+			case "asc":
+			case "desc":
+				o.Desc = true
+			default:
+				return nil, fmt.Errorf("post_order_by entry %q must be a column optionally followed by asc or desc", e)
+			}
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+func (p postProcess) empty() bool {
+	return len(p.Filter) == 0 && len(p.OrderBy) == 0 && p.Limit <= 0
+}
+
+// apply filters, orders and limits rows, in that order, and returns the
+// counts for meta.post_filter.
+func (p *postProcess) apply(rows []map[string]interface{}) ([]map[string]interface{}, map[string]interface{}, error) {
+	info := map[string]interface{}{"rows_returned_by_database": len(rows)}
+	kept := rows[:0:0]
+	for i, r := range rows {
+		ok, err := matchFilters(p.Filter, r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("post_filter row %d: %v", i, err)
+		}
+		if ok {
+			kept = append(kept, r)
+		}
+	}
+	info["filtered_out"] = len(rows) - len(kept)
+
+	if len(p.OrderBy) > 0 {
+		for _, o := range p.OrderBy {
+			if len(kept) > 0 {
+				if _, ok := kept[0][o.Column]; !ok {
+					return nil, nil, fmt.Errorf("post_order_by column %q is not in the result", o.Column)
+				}
+			}
+		}
+		sort.SliceStable(kept, func(i, j int) bool {
+			for _, o := range p.OrderBy {
+				c := compareValues(kept[i][o.Column], kept[j][o.Column])
+				if o.Desc {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+	}
+
+	limited := 0
+	if p.Limit > 0 && int64(len(kept)) > p.Limit {
+		limited = len(kept) - int(p.Limit)
+		kept = kept[:p.Limit]
+	}
+	info["limited_out"] = limited
+	info["rows"] = len(kept)
+	return kept, info, nil
+}
+
+func matchFilters(filters []filterSpec, row map[string]interface{}) (bool, error) {
+	for _, f := range filters {
+		ok, err := f.match(row)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// match is render evaluated on a result row instead of in SQL. Values
+// with a path, or compared with contains, are read as JSON. As on the
+// server, a null value matches nothing but is_null.
+func (f filterSpec) match(row map[string]interface{}) (bool, error) {
+	v, ok := row[f.Column]
+	if !ok {
+		return false, fmt.Errorf("filter column %q is not in the result", f.Column)
+	}
+	if len(f.path) > 0 || f.Op == "contains" {
+		var err error
+		if v, err = jsonValue(v); err != nil {
+			return false, fmt.Errorf("filter on %s: %v", f.Column, err)
+		}
+		for _, k := range f.path {
+			obj, _ := v.(map[string]interface{})
+			v = obj[k]
+		}
+	}
+
+	switch f.Op {
+	case "is_null":
+		return v == nil, nil
+	case "not_null":
+		return v != nil, nil
+	}
+	if v == nil {
+		return false, nil
+	}
+	switch f.Op {
+	case "contains":
+		return jsonContains(v, f.value), nil
+	case "in":
+		for _, e := range f.value.([]interface{}) {
+			if compareValues(v, e) == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "like", "ilike":
+		s, ok := exprText(v)
+		if !ok {
+			return false, fmt.Errorf("filter %s on %s: %s value", f.Op, f.Column, exprTypeName(v))
+		}
+		return likePattern(fmt.Sprint(f.value), f.Op == "ilike").MatchString(s), nil
+	}
+
+	if _, isNum := f.value.(json.Number); isNum {
+		if _, ok := filterNumber(v); !ok {
+			return false, fmt.Errorf("filter %s on %s: value %v is not a number", f.Op, f.Column, v)
+		}
+	}
+	c := compareValues(v, f.value)
+	switch f.Op {
+	case "=":
+		return c == 0, nil
+	case "!=", "<>":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+// jsonValue reads a row value as a JSON document: json and jsonb columns
+// arrive as their text, hstore as a map.
+func jsonValue(v interface{}) (interface{}, error) {
+	raw, isText := v.(string)
+	if !isText {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(b)
+	}
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		if isText {
+			return nil, fmt.Errorf("value is not JSON")
+		}
+		return nil, err
+	}
+	return doc, nil
+}
+
+// jsonContains is jsonb @>: objects contain the keys of want with
+// contained values, arrays contain every element of want, and scalars
+// are equal.
+func jsonContains(have, want interface{}) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		h, ok := have.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, wv := range w {
+			hv, ok := h[k]
+			if !ok || !jsonContains(hv, wv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		h, ok := have.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, wv := range w {
+			found := false
+			for _, hv := range h {
+				if jsonContains(hv, wv) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case nil:
+		return have == nil
+	}
+	if have == nil {
+		return false
+	}
+	switch have.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return compareValues(have, want) == 0
+}
+
+// compareValues orders two values: nulls after everything else, numbers
+// by value, booleans false first and anything else as text.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	if ra, ok := filterNumber(a); ok {
+		if rb, ok := filterNumber(b); ok {
+			return ra.Cmp(rb)
+		}
+	}
+	if ba, ok := a.(bool); ok {
+		if bb, ok := b.(bool); ok {
+			switch {
+			case ba == bb:
+				return 0
+			case bb:
+				return -1
+			}
+			return 1
+		}
+	}
+	sa, ok := exprText(a)
+	if !ok {
+		sa = fmt.Sprint(a)
+	}
+	sb, ok := exprText(b)
+	if !ok {
+		sb = fmt.Sprint(b)
+	}
+	return strings.Compare(sa, sb)
+}
+
+// filterNumber reads a row or filter value as a number; text counts when
+// it is a plain decimal, as numeric columns arrive.
+func filterNumber(v interface{}) (*big.Rat, bool) {
+	if n, ok := v.(json.Number); ok {
+		// JSON numbers may have an exponent
+		return new(big.Rat).SetString(n.String())
+	}
+	r, _, _, ok := exprNumber(v)
+	return r, ok
+}
+
+// likePattern translates a LIKE pattern, with % and _ wildcards and \ as
+// the escape, into an anchored regular expression.
+func likePattern(pattern string, fold bool) *regexp.Regexp {
+	var b bytes.Buffer
+	if fold {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '%':
+			b.WriteString("(?s:.*)")
+		case c == '_':
+			b.WriteString("(?s:.)")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
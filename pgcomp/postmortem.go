@@ -0,0 +1,162 @@
+package pgcomp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// diagnosticsTimeout bounds the catalog queries run after a failure.
+const diagnosticsTimeout = 5 * time.Second
+
+// conflictStates are the SQLSTATEs worth a post-mortem: the statement lost
+// against another session.
+var conflictStates = map[string]string{
+	"40P01": "deadlock",
+	"40001": "serialization_failure",
+	"55P03": "lock_not_available",
+}
+
+// deadlockPID finds the process ids in a deadlock report, e.g. "Process
+// 123 waits for ShareLock on transaction 456; blocked by process 789."
+var deadlockPID = regexp.MustCompile(`[Pp]rocess (\d+)`)
+
+// withDiagnostics attaches a post-mortem to err when it is a conflict
+// error: the other sessions named by the server, the lock waits at this
+// moment and the statements this request ran. self is the backend pid of
+// the request transaction, 0 when unknown, so it is not reported as one of
+// the others. That transaction is aborted by then, so the queries go
+// through the pool on a fresh connection. err is returned unchanged for
+// other errors, and the original error is kept when the capture itself
+// fails.
+func withDiagnostics(db *sql.DB, err error, self int, statements []string) error {
+	se := asServerError(err)
+	if se == nil || conflictStates[se.Code] == "" {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+
+	diag := map[string]interface{}{
+		"kind":       conflictStates[se.Code],
+		"sqlstate":   se.Code,
+		"detail":     nullIfEmpty(se.Detail),
+		"statements": statements,
+	}
+
+	if self != 0 {
+		diag["pid"] = self
+	}
+
+	others := make([]map[string]interface{}, 0)
+	seen := map[int]bool{self: true}
+	for _, m := range deadlockPID.FindAllStringSubmatch(se.Detail, -1) {
+		pid, _ := strconv.Atoi(m[1])
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		s, qerr := sessionActivity(ctx, db, pid)
+		if qerr != nil {
+			logger.Warn("diagnostics capture failed", "error", qerr.Error())
+			return err
+		}
+		others = append(others, s)
+	}
+	diag["other_sessions"] = others
+
+	waits, qerr := blockedSessions(ctx, db)
+	if qerr != nil {
+		logger.Warn("diagnostics capture failed", "error", qerr.Error())
+		return err
+	}
+	diag["lock_waits"] = waits
+
+	// Keep the code and details already attached, e.g. by transaction
+	out := &componentError{Code: conflictStates[se.Code], Message: err.Error(), Details: map[string]interface{}{}, cause: err}
+	var ce *componentError
+	if errors.As(err, &ce) {
+		out.Code = ce.Code
+		for k, v := range ce.Details {
+			out.Details[k] = v
+		}
+	}
+	out.Details["diagnostics"] = diag
+	return out
+}
+
+// sessionActivity is what pg_stat_activity shows for pid; visible is false
+// once the session has gone or is hidden from this role.
+func sessionActivity(ctx context.Context, db *sql.DB, pid int) (map[string]interface{}, error) {
+	var user, app, state, waitType, wait, query sql.NullString
+	var xactStart, queryStart sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT usename::text, application_name, state, wait_event_type, wait_event,
+			query, xact_start, query_start
+		FROM pg_stat_activity WHERE pid = $1`, pid).Scan(&user, &app, &state, &waitType, &wait, &query, &xactStart, &queryStart)
+	if err == sql.ErrNoRows {
+		return map[string]interface{}{"pid": pid, "visible": false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"pid":              pid,
+		"visible":          true,
+		"user":             nullString(user),
+		"application_name": nullString(app),
+		"state":            nullString(state),
+		"wait_event_type":  nullString(waitType),
+		"wait_event":       nullString(wait),
+		"query":            nullString(query),
+		"xact_start":       nullTime(xactStart),
+		"query_start":      nullTime(queryStart),
+	}, nil
+}
+
+// blockedSessions lists the sessions of this database currently blocked by
+// others, with the pids blocking them.
+func blockedSessions(ctx context.Context, db *sql.DB) ([]map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, `SELECT pid, array_to_json(pg_blocking_pids(pid))::text, wait_event_type, wait_event,
+			query, EXTRACT(EPOCH FROM now() - query_start)::float8
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND cardinality(pg_blocking_pids(pid)) > 0
+		ORDER BY query_start`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var pid int
+		var blockedBy string
+		var waitType, wait, query sql.NullString
+		var waiting sql.NullFloat64
+		if err := rows.Scan(&pid, &blockedBy, &waitType, &wait, &query, &waiting); err != nil {
+			return nil, err
+		}
+		w := map[string]interface{}{
+			"pid":             pid,
+			"blocked_by":      json.RawMessage(blockedBy),
+			"wait_event_type": nullString(waitType),
+			"wait_event":      nullString(wait),
+			"query":           nullString(query),
+			"waiting_seconds": nil,
+		}
+		if waiting.Valid {
+			w["waiting_seconds"] = waiting.Float64
+		}
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+func nullTime(t sql.NullTime) interface{} {
+	if t.Valid {
+		return t.Time.Format(time.RFC3339)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// checkSpec is a guard query with an expectation, used by the precondition
+// and verify inputs.
+type checkSpec struct {
+	SQL        string          `json:"sql"`
+	Parameters json.RawMessage `json:"parameters"`
+	Expect     string          `json:"expect"` // true, zero, rows or no_rows
+}
+
+func parseCheckSpec(input, val string) (*checkSpec, error) {
+	var spec checkSpec
+	if err := json.Unmarshal([]byte(val), &spec); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", input, err)
+	}
+	if spec.SQL == "" {
+		return nil, fmt.Errorf("%s requires sql", input)
+	}
+	if spec.Expect == "" {
+		spec.Expect = "true"
+	}
+	switch spec.Expect {
+	case "true", "zero", "rows", "no_rows":
+	default:
+		return nil, fmt.Errorf("%s expect must be one of: true, zero, rows, no_rows", input)
+	}
+	return &spec, nil
+}
+
+// evaluateCheck runs the guard query and reports whether its expectation
+// holds along with what it saw: "true" wants the first column of the first
+// row to be true, "zero" wants it to be 0 (as in SELECT count(*) ... WHERE
+// <violation>), "rows" wants at least one row and "no_rows" none.
+func evaluateCheck(db querier, spec *checkSpec) (bool, map[string]interface{}, error) {
+	var args []interface{}
+	if len(spec.Parameters) > 0 {
+		var err error
+		if args, err = parseArgs(string(spec.Parameters)); err != nil {
+			return false, nil, fmt.Errorf("invalid parameters: %v", err)
+		}
+	}
+
+	logSQL(spec.SQL, args)
+	rows, err := db.Query(spec.SQL, args...)
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return false, nil, err
+	}
+	var count int64
+	var first interface{}
+	for rows.Next() {
+		if count == 0 && len(columns) > 0 {
+			dest := make([]interface{}, len(columns))
+			for i := range dest {
+				dest[i] = new(interface{})
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return false, nil, err
+			}
+			first = normalizeValue(*(dest[0].(*interface{})), "")
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+
+	var ok bool
+	switch spec.Expect {
+	case "true":
+		ok = count > 0 && truthy(first)
+	case "zero":
+		ok = count > 0 && isZero(first)
+	case "rows":
+		ok = count > 0
+	case "no_rows":
+		ok = count == 0
+	}
+	return ok, map[string]interface{}{
+		"expect":    spec.Expect,
+		"satisfied": ok,
+		"rows":      count,
+		"value":     first,
+	}, nil
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case int64:
+		return t != 0
+	case float64:
+		return t != 0
+	case string:
+		return isTrue(t) || t == "t"
+	}
+	return false
+}
+
+func isZero(v interface{}) bool {
+	switch t := v.(type) {
+	case int64:
+		return t == 0
+	case float64:
+		return t == 0
+	case string:
+		return strings.Trim(t, "0.") == "" && t != ""
+	}
+	return false
+}
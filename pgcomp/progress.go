@@ -0,0 +1,171 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultProgressInterval is how often long loads and exports report
+// progress unless progress_interval says otherwise.
+const defaultProgressInterval = 5 * time.Second
+
+// progressOptions are the progress_interval and progress_file inputs.
+type progressOptions struct {
+	Interval time.Duration
+	File     string // rewritten with the latest report for an orchestrator to poll
+}
+
+// progress tracks the rows and bytes a long operation has processed and
+// reports them to the log and the progress file every interval. The
+// methods do nothing on a nil *progress, so handlers can call them
+// unconditionally, and are safe for concurrent use.
+type progress struct {
+	mu        sync.Mutex
+	operation string
+	opts      progressOptions
+	start     time.Time
+	last      time.Time
+	rows      int64
+	bytes     int64
+	// What the operation expects to process, 0 when unknown; the ETA is
+	// based on rows when known, else on bytes.
+	totalRows  int64
+	totalBytes int64
+}
+
+func newProgress(operation string, opts progressOptions) *progress {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultProgressInterval
+	}
+	now := time.Now()
+	return &progress{operation: operation, opts: opts, start: now, last: now}
+}
+
+// expect sets the totals the ETA is computed against.
+func (p *progress) expect(rows, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.totalRows, p.totalBytes = rows, bytes
+}
+
+// add counts processed rows and bytes and reports once the interval has
+// passed since the last report.
+func (p *progress) add(rows, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rows += rows
+	p.bytes += bytes
+	if time.Since(p.last) >= p.opts.Interval {
+		p.report(false)
+	}
+}
+
+// finish writes the final report and adds the totals to res.
+func (p *progress) finish(res map[string]interface{}) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := p.report(true)
+	delete(r, "eta_seconds")
+	res["progress"] = r
+}
+
+func (p *progress) report(done bool) map[string]interface{} {
+	p.last = time.Now()
+	elapsed := p.last.Sub(p.start)
+	r := map[string]interface{}{
+		"operation":       p.operation,
+		"rows":            p.rows,
+		"bytes":           p.bytes,
+		"elapsed_ms":      elapsed.Milliseconds(),
+		"rows_per_second": nil,
+		"eta_seconds":     nil,
+		"done":            done,
+		"updated_at":      p.last.UTC().Format(time.RFC3339),
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		r["rows_per_second"] = math.Round(float64(p.rows) / secs)
+		switch {
+		case done:
+			r["eta_seconds"] = 0
+		case p.totalRows > 0 && p.rows > 0:
+			r["eta_seconds"] = eta(p.totalRows-p.rows, float64(p.rows)/secs)
+		case p.totalBytes > 0 && p.bytes > 0:
+			r["eta_seconds"] = eta(p.totalBytes-p.bytes, float64(p.bytes)/secs)
+		}
+	}
+	logger.Info("progress", "operation", p.operation, "rows", p.rows, "bytes", p.bytes,
+		"elapsed_ms", elapsed.Milliseconds(), "eta_seconds", r["eta_seconds"], "done", done)
+	if p.opts.File != "" {
+		raw, _ := json.Marshal(r)
+		if err := writeFileAtomic(p.opts.File, raw); err != nil {
+			logger.Warn("failed to write progress_file", "error", err.Error())
+		}
+	}
+	return r
+}
+
+// eta is the seconds left for remaining at rate per second, 0 once an
+// estimated total has been passed.
+func eta(remaining int64, rate float64) int64 {
+	if remaining <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(float64(remaining) / rate))
+}
+
+// writeFileAtomic replaces path with raw through a rename, so a reader
+// never sees a half written file.
+func writeFileAtomic(path string, raw []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// countingReader counts the bytes read through it, for progress on
+// inputs that are consumed as a stream.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,272 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// queueSpec is the "queue" input: which columns of a jobs table carry the
+// queue state and the values they move through. Every field has a
+// default, so tables following the usual layout need no queue input.
+type queueSpec struct {
+	StatusColumn   string `json:"status_column"`    // default status
+	ReadyValue     string `json:"ready_value"`      // default ready
+	ClaimedValue   string `json:"claimed_value"`    // default processing
+	DoneValue      string `json:"done_value"`       // default done
+	FailedValue    string `json:"failed_value"`     // default failed
+	LockedByColumn string `json:"locked_by_column"` // default locked_by
+	LockedAtColumn string `json:"locked_at_column"` // default locked_at
+	AttemptsColumn string `json:"attempts_column"`  // default attempts
+	OrderBy        string `json:"order_by"`         // default the primary key
+	// MaxAttempts moves a nacked row to FailedValue once its attempts
+	// reach it; 0 requeues forever.
+	MaxAttempts int64 `json:"max_attempts"`
+	// VisibilityTimeout lets dequeue take over rows claimed more than this
+	// many seconds ago, from consumers that died without ack or nack.
+	VisibilityTimeout int64 `json:"visibility_timeout_s"`
+}
+
+// queueOptions are the inputs of the dequeue, ack and nack data_types.
+type queueOptions struct {
+	Spec   queueSpec
+	Worker string // locked_by value; defaults to the host name
+}
+
+func parseQueueSpec(val string) (queueSpec, error) {
+	var q queueSpec
+	if err := json.Unmarshal([]byte(val), &q); err != nil {
+		return q, fmt.Errorf("queue must be a JSON object: %v", err)
+	}
+	if q.MaxAttempts < 0 || q.VisibilityTimeout < 0 {
+		return q, fmt.Errorf("queue max_attempts and visibility_timeout_s cannot be negative")
+	}
+	return q, nil
+}
+
+func (q *queueSpec) setDefaults() {
+	def := func(s *string, v string) {
+		if *s == "" {
+			*s = v
+		}
+	}
+	def(&q.StatusColumn, "status")
+	def(&q.ReadyValue, "ready")
+	def(&q.ClaimedValue, "processing")
+	def(&q.DoneValue, "done")
+	def(&q.FailedValue, "failed")
+	def(&q.LockedByColumn, "locked_by")
+	def(&q.LockedAtColumn, "locked_at")
+	def(&q.AttemptsColumn, "attempts")
+}
+
+// queueTable is a jobs table resolved for one queue operation.
+type queueTable struct {
+	rel   *relation
+	spec  queueSpec
+	pk    []string
+	types map[string]string
+}
+
+func openQueue(db querier, table string, opts *queueOptions) (*queueTable, error) {
+	opts.Spec.setDefaults()
+	if opts.Worker == "" {
+		opts.Worker, _ = os.Hostname()
+	}
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	q := &queueTable{rel: rel, spec: opts.Spec, types: map[string]string{}}
+	for _, c := range cols {
+		q.types[c.Name] = c.TypeSQL
+	}
+	s := opts.Spec
+	for _, c := range []string{s.StatusColumn, s.LockedByColumn, s.LockedAtColumn, s.AttemptsColumn, s.OrderBy} {
+		if _, ok := q.types[c]; c != "" && !ok {
+			return nil, fmt.Errorf("queue column %q does not exist in %s", c, rel.Name)
+		}
+	}
+	if q.pk, err = primaryKey(db, rel); err != nil {
+		return nil, err
+	}
+	if len(q.pk) == 0 {
+		return nil, newError("no_primary_key", "a queue needs a primary key on %s", rel.Name)
+	}
+	return q, nil
+}
+
+func (q *queueTable) col(c string) string { return pq.QuoteIdentifier(c) }
+
+// dequeue claims up to limit ready rows matching filters in one statement:
+// the inner SELECT ... FOR UPDATE SKIP LOCKED picks rows no other consumer
+// holds and the UPDATE marks them claimed by the worker. The claim is
+// committed with the request, so the rows stay claimed while they are
+// worked on outside the database.
+func dequeue(db querier, table string, filters []filterSpec, limit int64, opts queueOptions) (interface{}, error) {
+	q, err := openQueue(db, table, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 1
+	}
+	s := q.spec
+
+	var args []interface{}
+	bind := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	column := func(c string) (string, error) {
+		if _, ok := q.types[c]; !ok {
+			return "", fmt.Errorf("column %q does not exist in %s", c, q.rel.Name)
+		}
+		return q.col(c), nil
+	}
+
+	status := q.col(s.StatusColumn)
+	sets := []string{
+		status + " = " + bind(s.ClaimedValue) + "::" + q.types[s.StatusColumn],
+		q.col(s.LockedByColumn) + " = " + bind(opts.Worker) + "::" + q.types[s.LockedByColumn],
+		q.col(s.LockedAtColumn) + " = now()",
+	}
+
+	ready := status + " = " + bind(s.ReadyValue) + "::" + q.types[s.StatusColumn]
+	if s.VisibilityTimeout > 0 {
+		ready = fmt.Sprintf("(%s OR (%s = %s::%s AND %s < now() - %s::bigint * interval '1 second'))",
+			ready, status, bind(s.ClaimedValue), q.types[s.StatusColumn], q.col(s.LockedAtColumn), bind(s.VisibilityTimeout))
+	}
+	conds := []string{ready}
+	for _, f := range filters {
+		cond, err := f.render(column, bind)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+
+	pk := make([]string, len(q.pk))
+	for i, k := range q.pk {
+		pk[i] = q.col(k)
+	}
+	order := strings.Join(pk, ", ")
+	if s.OrderBy != "" {
+		order = q.col(s.OrderBy) + ", " + order
+	}
+
+	stmt := fmt.Sprintf(`UPDATE %s AS q SET %s WHERE (%s) IN (
+		SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT %s FOR UPDATE SKIP LOCKED)
+		RETURNING to_jsonb(q)::text`,
+		q.rel.Name, strings.Join(sets, ", "), strings.Join(pk, ", "),
+		strings.Join(pk, ", "), q.rel.Name, strings.Join(conds, " AND "), order, bind(limit))
+	logSQL(stmt, args)
+	rows, err := db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	claimed := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(strings.NewReader(doc))
+		dec.UseNumber()
+		var row map[string]interface{}
+		if err := dec.Decode(&row); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"claimed": len(claimed), "worker": opts.Worker, "rows": claimed}, nil
+}
+
+// settleQueue is ack and nack: it moves the rows identified by the key
+// objects in keys out of the claimed state, but only while this worker
+// still holds them. ack marks them done; nack returns them to ready and
+// counts the attempt, or marks them failed once max_attempts is reached.
+// Keys that are not (or no longer) claimed by the worker are reported by
+// index in not_claimed.
+func settleQueue(db querier, table, operation string, keys []map[string]interface{}, opts queueOptions) (interface{}, error) {
+	q, err := openQueue(db, table, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("rows (the primary keys of the claimed rows) is required for %s", operation)
+	}
+	s := q.spec
+	status := q.col(s.StatusColumn)
+	statusType := q.types[s.StatusColumn]
+
+	var settled int64
+	notClaimed := make([]int, 0)
+	for r, key := range keys {
+		var args []interface{}
+		bind := func(v interface{}) string {
+			args = append(args, v)
+			return "$" + strconv.Itoa(len(args))
+		}
+
+		var sets []string
+		switch operation {
+		case "ack":
+			sets = []string{status + " = " + bind(s.DoneValue) + "::" + statusType}
+		case "nack":
+			attempts := q.col(s.AttemptsColumn)
+			next := bind(s.ReadyValue) + "::" + statusType
+			if s.MaxAttempts > 0 {
+				next = fmt.Sprintf("CASE WHEN COALESCE(%s, 0) + 1 >= %s::bigint THEN %s::%s ELSE %s END",
+					attempts, bind(s.MaxAttempts), bind(s.FailedValue), statusType, next)
+			}
+			sets = []string{
+				status + " = " + next,
+				attempts + " = COALESCE(" + attempts + ", 0) + 1",
+				q.col(s.LockedByColumn) + " = NULL",
+				q.col(s.LockedAtColumn) + " = NULL",
+			}
+		}
+
+		where := []string{
+			status + " = " + bind(s.ClaimedValue) + "::" + statusType,
+			q.col(s.LockedByColumn) + " = " + bind(opts.Worker) + "::" + q.types[s.LockedByColumn],
+		}
+		for _, k := range q.pk {
+			v, ok := key[k]
+			if !ok || v == nil {
+				return nil, fmt.Errorf("row %d: primary key column %q must be present and not null", r, k)
+			}
+			where = append(where, q.col(k)+" = "+bind(mergeValue(v))+"::"+q.types[k])
+		}
+
+		stmt := fmt.Sprintf("UPDATE %s SET %s WHERE %s", q.rel.Name, strings.Join(sets, ", "), strings.Join(where, " AND "))
+		logSQL(stmt, args)
+		res, err := db.Exec(stmt, args...)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", r, err)
+		}
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			notClaimed = append(notClaimed, r)
+		}
+		settled += n
+	}
+	key := "acked"
+	if operation == "nack" {
+		key = "nacked"
+	}
+	return map[string]interface{}{key: settled, "not_claimed": notClaimed}, nil
+}
@@ -0,0 +1,203 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// relation is a catalog-resolved table-like object. Name is the canonical,
+// already-quoted form produced by regclass output, so it can be spliced into
+// SQL text as-is regardless of schema qualification or mixed case.
+type relation struct {
+	OID  uint32
+	Name string
+	Kind string
+}
+
+var relKinds = map[string]string{
+	"r": "table",
+	"v": "view",
+	"m": "materialized_view",
+	"p": "partitioned_table",
+	"f": "foreign_table",
+	"S": "sequence",
+	"i": "index",
+	"I": "partitioned_index",
+	"c": "composite_type",
+	"t": "toast_table",
+}
+
+// lookupRelation resolves a user supplied name (e.g. orders, public.orders,
+// "Sales"."Orders") the same way PostgreSQL would in a FROM clause. A nil
+// relation with a nil error means the name does not exist.
+func lookupRelation(db querier, name string) (*relation, error) {
+	var rel relation
+	var kind string
+	err := db.QueryRow(`SELECT c.oid, c.oid::regclass::text, c.relkind::text
+		FROM pg_class c WHERE c.oid = to_regclass($1)`, name).Scan(&rel.OID, &rel.Name, &kind)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rel.Kind = relKinds[kind]
+	if rel.Kind == "" {
+		rel.Kind = kind
+	}
+	return &rel, nil
+}
+
+// resolveRelation is lookupRelation for callers that need the object to exist.
+func resolveRelation(db querier, name string) (*relation, error) {
+	rel, err := lookupRelation(db, name)
+	if err != nil {
+		return nil, err
+	}
+	if rel == nil {
+		return nil, fmt.Errorf("relation %q does not exist", name)
+	}
+	return rel, nil
+}
+
+// columnInfo is one live column of a relation with its type.
+type columnInfo struct {
+	Name    string
+	TypeOID uint32
+	TypName string
+	TypMod  int32
+	TypeSQL string // format_type output, usable in a cast
+	NotNull bool
+	// HasDefault is set for columns the server fills when omitted: a
+	// default, an identity or a generated column.
+	HasDefault bool
+	Identity   string // "a" (GENERATED ALWAYS), "d" (BY DEFAULT) or ""
+	Generated  string // "s" (stored), "v" (virtual) or ""
+	// EnumLabels are the labels of an enum column in sort order, nil for
+	// any other type.
+	EnumLabels []string
+}
+
+// readOnly reports why a plain INSERT cannot write the column, or "".
+// Generated columns only accept DEFAULT; GENERATED ALWAYS identity columns
+// need OVERRIDING SYSTEM VALUE.
+func (c columnInfo) readOnly() string {
+	switch {
+	case c.Generated != "":
+		return "generated"
+	case c.Identity == "a":
+		return "identity"
+	}
+	return ""
+}
+
+// columns returns the relation's live (non-dropped) columns in order.
+// attidentity and attgenerated are read through to_jsonb because they do
+// not exist on every supported server version.
+func (r *relation) columns(db querier) ([]columnInfo, error) {
+	rows, err := db.Query(`SELECT a.attname, a.atttypid, t.typname, a.atttypmod, format_type(a.atttypid, a.atttypmod),
+			a.attnotnull, a.atthasdef OR coalesce(to_jsonb(a)->>'attidentity', '') <> ''
+				OR coalesce(to_jsonb(a)->>'attgenerated', '') <> '',
+			coalesce(to_jsonb(a)->>'attidentity', ''), coalesce(to_jsonb(a)->>'attgenerated', ''),
+			t.typtype = 'e'
+		FROM pg_attribute a JOIN pg_type t ON t.oid = a.atttypid
+		WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum`, r.OID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []columnInfo
+	var enums []int
+	for rows.Next() {
+		var c columnInfo
+		var enum bool
+		if err := rows.Scan(&c.Name, &c.TypeOID, &c.TypName, &c.TypMod, &c.TypeSQL, &c.NotNull, &c.HasDefault, &c.Identity, &c.Generated, &enum); err != nil {
+			return nil, err
+		}
+		if enum {
+			enums = append(enums, len(cols))
+		}
+		cols = append(cols, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The labels are read once the column rows are closed; a transaction
+	// runs one query at a time
+	rows.Close()
+	for _, i := range enums {
+		if cols[i].EnumLabels, err = enumLabels(db, cols[i].TypeOID); err != nil {
+			return nil, err
+		}
+	}
+	return cols, nil
+}
+
+// describeRelation answers the describe data_type: the columns of name
+// with what a form needs to know about them, comments included. read_only marks generated
+// and GENERATED ALWAYS identity columns, which inserts leave to the server.
+func describeRelation(db querier, name string) (interface{}, error) {
+	rel, err := resolveRelation(db, name)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := relationComments(db, rel)
+	if err != nil {
+		return nil, err
+	}
+	colComments := comments["columns"].(map[string]interface{})
+	out := make([]map[string]interface{}, len(cols))
+	for i, c := range cols {
+		identity := map[string]string{"a": "always", "d": "by_default"}[c.Identity]
+		generated := map[string]string{"s": "stored", "v": "virtual"}[c.Generated]
+		out[i] = map[string]interface{}{
+			"name":        c.Name,
+			"type":        c.TypeSQL,
+			"not_null":    c.NotNull,
+			"has_default": c.HasDefault,
+			"identity":    nullIfEmpty(identity),
+			"generated":   nullIfEmpty(generated),
+			"read_only":   c.readOnly() != "",
+			"comment":     colComments[c.Name],
+		}
+	}
+	return map[string]interface{}{"relation": rel.Name, "kind": rel.Kind, "comment": comments["comment"], "columns": out}, nil
+}
+
+// selectable reports whether rows can be read from the relation directly.
+func (r *relation) selectable() bool {
+	switch r.Kind {
+	case "table", "view", "materialized_view", "partitioned_table", "foreign_table":
+		return true
+	}
+	return false
+}
+
+// relationExists answers the exists data_type: whether name resolves, what
+// kind of object it is and, when checkEmpty is set, whether it has no rows.
+func relationExists(db querier, name string, checkEmpty bool) (interface{}, error) {
+	res := map[string]interface{}{"exists": false, "kind": nil, "empty": nil}
+
+	rel, err := lookupRelation(db, name)
+	if err != nil {
+		return nil, err
+	}
+	if rel == nil {
+		return res, nil
+	}
+	res["exists"] = true
+	res["kind"] = rel.Kind
+
+	if checkEmpty && rel.selectable() {
+		var hasRows bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM " + rel.Name + " LIMIT 1)").Scan(&hasRows); err != nil {
+			return nil, err
+		}
+		res["empty"] = !hasRows
+	}
+	return res, nil
+}
@@ -0,0 +1,111 @@
+package pgcomp
+
+import (
+	"database/sql"
+)
+
+// replicationStatus reports replication health from whichever side of the
+// pair we are connected to. All LSN arithmetic happens server-side.
+func replicationStatus(db querier) (interface{}, error) {
+	var inRecovery bool
+	if err := db.QueryRow("SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return nil, err
+	}
+
+	if inRecovery {
+		var receiveLSN, replayLSN sql.NullString
+		var lagSeconds sql.NullFloat64
+		var lastReplay sql.NullTime
+		err := db.QueryRow(`SELECT pg_last_wal_receive_lsn()::text, pg_last_wal_replay_lsn()::text,
+				pg_last_xact_replay_timestamp(),
+				CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+					ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END`).
+			Scan(&receiveLSN, &replayLSN, &lastReplay, &lagSeconds)
+		if err != nil {
+			return nil, err
+		}
+		res := map[string]interface{}{
+			"role":               "standby",
+			"in_recovery":        true,
+			"last_receive_lsn":   nullString(receiveLSN),
+			"last_replay_lsn":    nullString(replayLSN),
+			"last_replay_at":     nil,
+			"replay_lag_seconds": nil,
+			"replay_lag_bytes":   nil,
+		}
+		if lastReplay.Valid {
+			res["last_replay_at"] = lastReplay.Time
+		}
+		if lagSeconds.Valid {
+			res["replay_lag_seconds"] = lagSeconds.Float64
+		}
+		var lagBytes sql.NullInt64
+		if err := db.QueryRow("SELECT pg_wal_lsn_diff(pg_last_wal_receive_lsn(), pg_last_wal_replay_lsn())::bigint").Scan(&lagBytes); err != nil {
+			return nil, err
+		}
+		if lagBytes.Valid {
+			res["replay_lag_bytes"] = lagBytes.Int64
+		}
+		return res, nil
+	}
+
+	var currentLSN string
+	if err := db.QueryRow("SELECT pg_current_wal_lsn()::text").Scan(&currentLSN); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT application_name, client_addr::text, state, sync_state,
+			sent_lsn::text, write_lsn::text, flush_lsn::text, replay_lsn::text,
+			pg_wal_lsn_diff(pg_current_wal_lsn(), sent_lsn)::bigint,
+			pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn)::bigint,
+			EXTRACT(EPOCH FROM replay_lag)
+		FROM pg_stat_replication
+		ORDER BY application_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replicas := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var app, client, state, syncState, sent, write, flush, replay sql.NullString
+		var sendLag, replayLag sql.NullInt64
+		var replayLagSeconds sql.NullFloat64
+		if err := rows.Scan(&app, &client, &state, &syncState, &sent, &write, &flush, &replay, &sendLag, &replayLag, &replayLagSeconds); err != nil {
+			return nil, err
+		}
+		r := map[string]interface{}{
+			"application_name":   nullString(app),
+			"client_addr":        nullString(client),
+			"state":              nullString(state),
+			"sync_state":         nullString(syncState),
+			"sent_lsn":           nullString(sent),
+			"write_lsn":          nullString(write),
+			"flush_lsn":          nullString(flush),
+			"replay_lsn":         nullString(replay),
+			"send_lag_bytes":     nil,
+			"replay_lag_bytes":   nil,
+			"replay_lag_seconds": nil,
+		}
+		if sendLag.Valid {
+			r["send_lag_bytes"] = sendLag.Int64
+		}
+		if replayLag.Valid {
+			r["replay_lag_bytes"] = replayLag.Int64
+		}
+		if replayLagSeconds.Valid {
+			r["replay_lag_seconds"] = replayLagSeconds.Float64
+		}
+		replicas = append(replicas, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"role":        "primary",
+		"in_recovery": false,
+		"current_lsn": currentLSN,
+		"replicas":    replicas,
+	}, nil
+}
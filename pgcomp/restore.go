@@ -0,0 +1,219 @@
+package pgcomp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// maxReportedRestoreErrors caps the failed statements echoed in the
+	// result of a restore that continues past errors.
+	maxReportedRestoreErrors = 100
+	// restoreStatementExcerpt is how much of a failing statement is shown
+	restoreStatementExcerpt = 200
+)
+
+// restoreOptions are the inputs of the restore data_type.
+type restoreOptions struct {
+	File        string // plain or gzipped SQL
+	StopOnError bool   // false runs each statement under a savepoint and reports failures
+	DryRun      bool   // only split and count; nothing is connected or run
+	Progress    *progress
+	Checkpoint  *checkpointer
+}
+
+// restoreError is one failed statement of a restore.
+type restoreError struct {
+	Index     int    `json:"index"` // 0-based, in file order
+	Line      int    `json:"line"`
+	Statement string `json:"statement"`
+	Error     string `json:"error"`
+	SQLState  string `json:"sqlstate,omitempty"`
+}
+
+// readScript reads a SQL file, transparently gunzipping it when it starts
+// with the gzip magic bytes.
+func readScript(file string) (string, int64, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read input_file: %v", err)
+	}
+	size := int64(len(raw))
+	if len(raw) >= 2 && raw[0] == 0x1f && raw[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to decompress input_file: %v", err)
+		}
+		if raw, err = io.ReadAll(zr); err != nil {
+			return "", 0, fmt.Errorf("failed to decompress input_file: %v", err)
+		}
+	}
+	return string(raw), size, nil
+}
+
+// transactionControl reports whether st begins or ends a transaction. The
+// restore owns the transaction, so a dump's own BEGIN and COMMIT are
+// skipped instead of run.
+func transactionControl(st string) bool {
+	word := strings.ToUpper(strings.Fields(st)[0])
+	switch word {
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT":
+		// ROLLBACK TO SAVEPOINT is not transaction control, but a dump that
+		// relies on one cannot be restored statement by statement anyway
+		return true
+	}
+	return false
+}
+
+// restoreScript answers the restore data_type: it runs the statements of
+// a SQL file in order inside the request transaction, or in commit_every
+// batches when checkpointed. With stop_on_error (the default) the first
+// failure aborts the restore and reports where in the file it happened;
+// otherwise each statement runs under a savepoint and the failures are
+// collected. psql meta-commands and COPY FROM stdin are refused up front,
+// since they need a client to run them.
+func restoreScript(db querier, opts restoreOptions) (interface{}, error) {
+	if opts.File == "" {
+		return nil, fmt.Errorf("input_file is required for restore")
+	}
+	script, size, err := readScript(opts.File)
+	if err != nil {
+		return nil, err
+	}
+	stmts := splitScript(script)
+	lines := strings.Count(script, "\n")
+	if !strings.HasSuffix(script, "\n") && script != "" {
+		lines++
+	}
+
+	control := 0
+	for i, st := range stmts {
+		upper := strings.ToUpper(st.Text)
+		switch {
+		case strings.HasPrefix(st.Text, "\\"):
+			return nil, restoreRefused(i, st, "psql meta-commands are not supported")
+		case strings.HasPrefix(upper, "COPY ") && strings.Contains(upper, "FROM STDIN"):
+			return nil, restoreRefused(i, st, "COPY FROM stdin is not supported; dump with --inserts or use data_type import")
+		case transactionControl(st.Text):
+			control++
+		}
+	}
+	res := map[string]interface{}{
+		"file":                        opts.File,
+		"bytes":                       size,
+		"lines":                       lines,
+		"statements":                  len(stmts),
+		"skipped_transaction_control": control,
+	}
+	if opts.DryRun {
+		res["dry_run"] = true
+		return res, nil
+	}
+
+	st, err := os.Stat(opts.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input_file: %v", err)
+	}
+	// A resumed restore skips statements by position, so the file must not change
+	if err := opts.Checkpoint.begin(hashInput(opts.File, size, st.ModTime().UnixNano())); err != nil {
+		return nil, err
+	}
+	opts.Progress.expect(int64(len(stmts)), 0)
+
+	var executed, resumed int
+	var failures []restoreError
+	failed := 0
+	for i, s := range stmts {
+		opts.Progress.add(1, int64(len(s.Text)))
+		if opts.Checkpoint.skip(int64(i + 1)) {
+			resumed++
+			continue
+		}
+		if transactionControl(s.Text) {
+			continue
+		}
+
+		savepoint := fmt.Sprintf("restore_stmt_%d", i)
+		if !opts.StopOnError {
+			if _, err := db.Exec("SAVEPOINT " + savepoint); err != nil {
+				return nil, err
+			}
+		}
+		logSQL(s.Text, nil)
+		_, err := db.Exec(s.Text)
+		if err == nil {
+			if !opts.StopOnError {
+				if _, err := db.Exec("RELEASE SAVEPOINT " + savepoint); err != nil {
+					return nil, err
+				}
+			}
+			executed++
+			if err := opts.Checkpoint.flushed(int64(i+1), 1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		re := restoreError{Index: i, Line: s.Line, Statement: excerpt(s.Text), Error: err.Error(), SQLState: sqlState(err)}
+		if opts.StopOnError {
+			lost := "nothing was restored"
+			if opts.Checkpoint != nil {
+				lost = "the statements since the last committed batch were rolled back"
+			}
+			ce := newError("restore_failed", "statement %d (line %d) failed, %s: %v", i, s.Line, lost, err)
+			ce.Details = map[string]interface{}{
+				"index":     re.Index,
+				"line":      re.Line,
+				"statement": re.Statement,
+				"sqlstate":  re.SQLState,
+				"executed":  executed,
+			}
+			ce.cause = err
+			return nil, ce
+		}
+		if _, rerr := db.Exec("ROLLBACK TO SAVEPOINT " + savepoint); rerr != nil {
+			return nil, rerr
+		}
+		failed++
+		if len(failures) < maxReportedRestoreErrors {
+			failures = append(failures, re)
+		}
+		if err := opts.Checkpoint.flushed(int64(i+1), 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if failures == nil {
+		failures = []restoreError{}
+	}
+	res["executed"] = executed
+	res["failed"] = failed
+	res["errors"] = failures
+	if resumed > 0 {
+		res["resumed_statements"] = resumed
+	}
+	opts.Progress.finish(res)
+	if err := opts.Checkpoint.finish(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func restoreRefused(i int, st scriptStatement, reason string) error {
+	ce := newError("restore_unsupported", "statement %d (line %d): %s", i, st.Line, reason)
+	ce.Details = map[string]interface{}{"index": i, "line": st.Line, "statement": excerpt(st.Text)}
+	return ce
+}
+
+// excerpt shortens a statement for an error report.
+func excerpt(s string) string {
+	r := []rune(s)
+	if len(r) <= restoreStatementExcerpt {
+		return s
+	}
+	return string(r[:restoreStatementExcerpt]) + "..."
+}
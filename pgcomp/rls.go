@@ -0,0 +1,86 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// settingName is a custom (dotted) configuration parameter name; the
+// server only accepts unknown parameters in that form.
+var settingName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)+$`)
+
+// parseRLSSettings reads the rls_settings input, a JSON object of setting
+// names to string values, and checks each name starts with prefix.
+func parseRLSSettings(val, prefix string) (map[string]string, error) {
+	var settings map[string]string
+	if err := json.Unmarshal([]byte(val), &settings); err != nil {
+		return nil, fmt.Errorf("rls_settings must be a JSON object of strings: %v", err)
+	}
+	for k := range settings {
+		if !settingName.MatchString(k) {
+			return nil, fmt.Errorf("rls_settings key %q is not a valid setting name (e.g. app.tenant_id)", k)
+		}
+		if !strings.HasPrefix(k, prefix) {
+			return nil, fmt.Errorf("rls_settings key %q does not start with the allowed prefix %q", k, prefix)
+		}
+	}
+	return settings, nil
+}
+
+// applySessionContext switches to role and sets the RLS settings for the
+// rest of the transaction tx. Both are transaction-local, so they end with
+// it and never reach the next user of the connection.
+func applySessionContext(tx querier, role string, settings map[string]string) error {
+	if role != "" {
+		var member bool
+		err := tx.QueryRow("SELECT pg_has_role(current_user, oid, 'MEMBER') FROM pg_roles WHERE rolname = $1", role).Scan(&member)
+		if err == sql.ErrNoRows || (err == nil && !member) {
+			return newError("role_not_allowed", "role %q does not exist or the connecting user is not a member of it", role)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("SET LOCAL ROLE " + pq.QuoteIdentifier(role)); err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedKeys(settings) {
+		if _, err := tx.Exec("SELECT set_config($1, $2, true)", k, settings[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// effectiveSettings reads back the current value of each setting, nil
+// when it is not set.
+func effectiveSettings(db querier, settings map[string]string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(settings))
+	for _, k := range sortedKeys(settings) {
+		var v *string
+		if err := db.QueryRow("SELECT current_setting($1, true)", k).Scan(&v); err != nil {
+			return nil, err
+		}
+		if v != nil {
+			out[k] = *v
+		} else {
+			out[k] = nil
+		}
+	}
+	return out, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
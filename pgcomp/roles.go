@@ -0,0 +1,248 @@
+package pgcomp
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// roleOptions carries the inputs of the roles data_type.
+type roleOptions struct {
+	Name       string
+	Password   string
+	Login      bool
+	ValidUntil string
+	Grant      string // JSON grantSpec for grant/revoke
+}
+
+// grantSpec is the structured form of a GRANT/REVOKE request.
+type grantSpec struct {
+	Privilege  string `json:"privilege"`   // e.g. "SELECT" or "SELECT,INSERT"
+	ObjectType string `json:"object_type"` // table, schema or all_tables_in_schema
+	On         string `json:"on"`
+	To         string `json:"to"`
+}
+
+var grantPrivileges = map[string][]string{
+	"table":                {"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER", "ALL"},
+	"all_tables_in_schema": {"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER", "ALL"},
+	"schema":               {"USAGE", "CREATE", "ALL"},
+}
+
+// manageRoles implements the roles data_type. Passwords never appear in
+// statement text: they are sent as SCRAM-SHA-256 verifiers computed here, the
+// same way psql's \password does it.
+func manageRoles(db querier, operation string, opts roleOptions) (interface{}, error) {
+	switch operation {
+	case "", "list":
+		return listRoles(db)
+	case "create":
+		return createRole(db, opts)
+	case "alter_password":
+		return alterRolePassword(db, opts)
+	case "grant", "revoke":
+		return grantRevoke(db, operation, opts.Grant)
+	}
+	return nil, fmt.Errorf("unknown roles operation %q (allowed: list, create, alter_password, grant, revoke)", operation)
+}
+
+func listRoles(db querier) (interface{}, error) {
+	rows, err := db.Query(`SELECT r.rolname, r.rolsuper, r.rolinherit, r.rolcreaterole, r.rolcreatedb,
+			r.rolcanlogin, r.rolreplication, r.rolconnlimit, r.rolvaliduntil,
+			COALESCE(array_to_json(ARRAY(
+				SELECT g.rolname FROM pg_auth_members m JOIN pg_roles g ON g.oid = m.roleid
+				WHERE m.member = r.oid ORDER BY g.rolname))::text, '[]')
+		FROM pg_roles r
+		WHERE r.rolname !~ '^pg_'
+		ORDER BY r.rolname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var name, memberOf string
+		var super, inherit, createRole, createDB, login, replication bool
+		var connLimit int
+		var validUntil sql.NullTime
+		if err := rows.Scan(&name, &super, &inherit, &createRole, &createDB, &login, &replication, &connLimit, &validUntil, &memberOf); err != nil {
+			return nil, err
+		}
+		var members []string
+		if err := json.Unmarshal([]byte(memberOf), &members); err != nil {
+			return nil, err
+		}
+		r := map[string]interface{}{
+			"name":        name,
+			"superuser":   super,
+			"inherit":     inherit,
+			"create_role": createRole,
+			"create_db":   createDB,
+			"login":       login,
+			"replication": replication,
+			"conn_limit":  connLimit,
+			"valid_until": nil,
+			"member_of":   members,
+		}
+		if validUntil.Valid {
+			r["valid_until"] = validUntil.Time.Format(time.RFC3339)
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+func createRole(db querier, opts roleOptions) (interface{}, error) {
+	if opts.Name == "" {
+		return nil, fmt.Errorf("name is required for roles create")
+	}
+	stmt := "CREATE ROLE " + pq.QuoteIdentifier(opts.Name)
+	if opts.Login {
+		stmt += " LOGIN"
+	} else {
+		stmt += " NOLOGIN"
+	}
+	clause, err := passwordClause(opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(stmt + clause); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"role": opts.Name, "created": true, "login": opts.Login}, nil
+}
+
+func alterRolePassword(db querier, opts roleOptions) (interface{}, error) {
+	if opts.Name == "" || opts.Password == "" {
+		return nil, fmt.Errorf("name and role_password are required for roles alter_password")
+	}
+	clause, err := passwordClause(opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("ALTER ROLE " + pq.QuoteIdentifier(opts.Name) + clause); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"role": opts.Name, "password_changed": true}, nil
+}
+
+// passwordClause renders the PASSWORD / VALID UNTIL part of CREATE/ALTER ROLE.
+func passwordClause(opts roleOptions) (string, error) {
+	var clause string
+	if opts.Password != "" {
+		verifier, err := scramVerifier(opts.Password)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash role password")
+		}
+		clause += " PASSWORD " + pq.QuoteLiteral(verifier)
+	}
+	if opts.ValidUntil != "" {
+		if _, err := time.Parse(time.RFC3339, opts.ValidUntil); err != nil {
+			if _, err := time.Parse("2006-01-02", opts.ValidUntil); err != nil && opts.ValidUntil != "infinity" {
+				return "", fmt.Errorf("valid_until must be an RFC3339 timestamp, a date or infinity")
+			}
+		}
+		clause += " VALID UNTIL " + pq.QuoteLiteral(opts.ValidUntil)
+	}
+	return clause, nil
+}
+
+// scramVerifier builds a SCRAM-SHA-256 password verifier in the format
+// stored in pg_authid (RFC 5802 / RFC 7677).
+func scramVerifier(password string) (string, error) {
+	const iterations = 4096
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(salted, "Server Key")
+
+	enc := base64.StdEncoding
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations,
+		enc.EncodeToString(salt), enc.EncodeToString(storedKey[:]), enc.EncodeToString(serverKey)), nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+func grantRevoke(db querier, operation, raw string) (interface{}, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("grant is required for roles %s", operation)
+	}
+	var g grantSpec
+	if err := json.Unmarshal([]byte(raw), &g); err != nil {
+		return nil, fmt.Errorf("invalid grant: %v", err)
+	}
+	if g.ObjectType == "" {
+		g.ObjectType = "table"
+	}
+	allowed, ok := grantPrivileges[g.ObjectType]
+	if !ok {
+		return nil, fmt.Errorf("invalid grant object_type %q (allowed: table, schema, all_tables_in_schema)", g.ObjectType)
+	}
+	if g.On == "" || g.To == "" || g.Privilege == "" {
+		return nil, fmt.Errorf("grant requires privilege, on and to")
+	}
+
+	var privs []string
+	for _, p := range strings.Split(g.Privilege, ",") {
+		p = strings.ToUpper(strings.TrimSpace(p))
+		if !containsString(allowed, p) {
+			return nil, fmt.Errorf("invalid privilege %q for %s (allowed: %s)", p, g.ObjectType, strings.Join(allowed, ", "))
+		}
+		privs = append(privs, p)
+	}
+
+	var target string
+	switch g.ObjectType {
+	case "table":
+		rel, err := resolveRelation(db, g.On)
+		if err != nil {
+			return nil, err
+		}
+		target = "TABLE " + rel.Name
+	case "schema":
+		target = "SCHEMA " + pq.QuoteIdentifier(g.On)
+	case "all_tables_in_schema":
+		target = "ALL TABLES IN SCHEMA " + pq.QuoteIdentifier(g.On)
+	}
+
+	var stmt string
+	if operation == "grant" {
+		stmt = fmt.Sprintf("GRANT %s ON %s TO %s", strings.Join(privs, ", "), target, pq.QuoteIdentifier(g.To))
+	} else {
+		stmt = fmt.Sprintf("REVOKE %s ON %s FROM %s", strings.Join(privs, ", "), target, pq.QuoteIdentifier(g.To))
+	}
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"statement": stmt}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
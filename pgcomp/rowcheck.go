@@ -0,0 +1,203 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxRowProblems caps the problems reported by checkRows.
+const maxRowProblems = 1000
+
+// rowProblem is one reason a row would be rejected by the table.
+type rowProblem struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column"`
+	Problem string `json:"problem"`
+}
+
+var dateLayouts = []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339, time.RFC3339Nano, "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05.999999", "2006-01-02 15:04:05.999999Z07:00"}
+
+// checkRows pre-checks rows against the table's columns so problems can be
+// reported per row and column without sending anything to the server.
+// Only what the catalog states is checked: unknown columns, missing NOT
+// NULL columns without defaults, varchar/char lengths, numeric, integer
+// and boolean syntax and ranges, date syntax and enum labels.
+func checkRows(cols []columnInfo, rows []map[string]interface{}) []rowProblem {
+	byName := make(map[string]columnInfo, len(cols))
+	for _, c := range cols {
+		byName[c.Name] = c
+	}
+	var problems []rowProblem
+	add := func(row int, col, format string, args ...interface{}) bool {
+		problems = append(problems, rowProblem{Row: row, Column: col, Problem: fmt.Sprintf(format, args...)})
+		return len(problems) < maxRowProblems
+	}
+
+	for i, row := range rows {
+		for name, v := range row {
+			c, ok := byName[name]
+			if !ok {
+				if !add(i, name, "unknown column") {
+					return problems
+				}
+				continue
+			}
+			if v == nil {
+				if c.NotNull && !add(i, name, "null value in a NOT NULL column") {
+					return problems
+				}
+				continue
+			}
+			if p := checkValue(c, v); p != "" && !add(i, name, "%s", p) {
+				return problems
+			}
+		}
+		for _, c := range cols {
+			if _, ok := row[c.Name]; !ok && c.NotNull && !c.HasDefault {
+				if !add(i, c.Name, "missing NOT NULL column without a default") {
+					return problems
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// checkEnums reports the values of enum columns that are not one of the
+// enum's labels. Unlike checkRows it runs on every write: the server's
+// own error for a bad label names neither the column nor the labels.
+func checkEnums(cols []columnInfo, rows []map[string]interface{}) []rowProblem {
+	var problems []rowProblem
+	for i, row := range rows {
+		for _, c := range cols {
+			v, ok := row[c.Name]
+			if !ok || v == nil || c.EnumLabels == nil {
+				continue
+			}
+			if p := enumProblem(c, v); p != "" {
+				problems = append(problems, rowProblem{Row: i, Column: c.Name, Problem: p})
+				if len(problems) == maxRowProblems {
+					return problems
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// rejectRows is the validation_failed error for the problems checkRows
+// (with validate) or checkEnums finds in rows, or nil.
+func rejectRows(cols []columnInfo, rows []map[string]interface{}, validate bool) error {
+	var problems []rowProblem
+	if validate {
+		problems = checkRows(cols, rows)
+	} else {
+		problems = checkEnums(cols, rows)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	ce := newError("validation_failed", "%d problem(s) found in rows; nothing was written", len(problems))
+	ce.Details = map[string]interface{}{"problems": problems}
+	return ce
+}
+
+// enumProblem returns why v is not a label of the enum column c, or "".
+// Labels are matched exactly, as the server matches them.
+func enumProblem(c columnInfo, v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Sprintf("expected a label of enum %s, allowed: [%s]", c.TypeSQL, strings.Join(c.EnumLabels, ", "))
+	}
+	if containsString(c.EnumLabels, s) {
+		return ""
+	}
+	return fmt.Sprintf("invalid value '%s' for enum %s, allowed: [%s]", s, c.TypeSQL, strings.Join(c.EnumLabels, ", "))
+}
+
+// checkValue returns why v does not fit column c, or "".
+func checkValue(c columnInfo, v interface{}) string {
+	if c.EnumLabels != nil {
+		return enumProblem(c, v)
+	}
+	s, isText := v.(string)
+	if n, ok := v.(json.Number); ok {
+		s, isText = n.String(), true
+	}
+	if _, ok := v.(bool); ok {
+		if c.TypName == "bool" {
+			return ""
+		}
+		s, isText = fmt.Sprint(v), true
+	}
+
+	switch c.TypName {
+	case "varchar", "bpchar":
+		if !isText {
+			return ""
+		}
+		// the typmod stores the declared length plus VARHDRSZ
+		if c.TypMod > 4 {
+			if max := int(c.TypMod - 4); utf8.RuneCountInString(s) > max {
+				return fmt.Sprintf("value is %d characters, %s allows %d", utf8.RuneCountInString(s), c.TypeSQL, max)
+			}
+		}
+	case "int2", "int4", "int8":
+		bits := map[string]int{"int2": 16, "int4": 32, "int8": 64}[c.TypName]
+		if !isText {
+			return fmt.Sprintf("expected an integer for %s", c.TypeSQL)
+		}
+		if _, err := strconv.ParseInt(strings.TrimSpace(s), 10, bits); err != nil {
+			if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+				return fmt.Sprintf("%s is out of range for %s", s, c.TypeSQL)
+			}
+			return fmt.Sprintf("%q is not an integer", s)
+		}
+	case "numeric", "float4", "float8":
+		if !isText {
+			return fmt.Sprintf("expected a number for %s", c.TypeSQL)
+		}
+		r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+		if !ok {
+			return fmt.Sprintf("%q is not a number", s)
+		}
+		if c.TypName == "numeric" && c.TypMod > 4 {
+			// numeric(p,s) is packed as ((p << 16) | s) + VARHDRSZ
+			precision, scale := int((c.TypMod-4)>>16), int((c.TypMod-4)&0xffff)
+			intDigits := len(new(big.Int).Quo(new(big.Int).Abs(r.Num()), r.Denom()).String())
+			if r.Abs(r).Cmp(big.NewRat(1, 1)) < 0 {
+				intDigits = 0
+			}
+			if intDigits > precision-scale {
+				return fmt.Sprintf("%s overflows %s", s, c.TypeSQL)
+			}
+		}
+	case "bool":
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "t", "f", "true", "false", "yes", "no", "on", "off", "1", "0", "y", "n":
+		default:
+			return fmt.Sprintf("%q is not a boolean", s)
+		}
+	case "date", "timestamp", "timestamptz":
+		if !isText {
+			return fmt.Sprintf("expected a date for %s", c.TypeSQL)
+		}
+		t := strings.TrimSpace(s)
+		switch strings.ToLower(t) {
+		case "infinity", "-infinity", "now", "today", "tomorrow", "yesterday":
+			return ""
+		}
+		for _, layout := range dateLayouts {
+			if _, err := time.Parse(layout, t); err == nil {
+				return ""
+			}
+		}
+		return fmt.Sprintf("%q is not a valid date (expected YYYY-MM-DD[ HH:MM:SS])", s)
+	}
+	return ""
+}
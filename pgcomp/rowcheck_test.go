@@ -0,0 +1,74 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var statusColumn = columnInfo{Name: "status", TypName: "order_status", TypeSQL: "order_status", EnumLabels: []string{"new", "paid", "shipped"}}
+
+func TestCheckEnums(t *testing.T) {
+	cols := []columnInfo{{Name: "id", TypName: "int4", TypeSQL: "integer"}, statusColumn}
+	rows := []map[string]interface{}{
+		{"id": "1", "status": "paid"},
+		{"id": "2", "status": "Paid"},
+		{"id": "3", "status": nil},
+		{"id": "4"},
+		{"id": "x", "status": json.Number("2")}, // a bad integer is left to validate
+	}
+	want := []rowProblem{
+		{Row: 1, Column: "status", Problem: "invalid value 'Paid' for enum order_status, allowed: [new, paid, shipped]"},
+		{Row: 4, Column: "status", Problem: "expected a label of enum order_status, allowed: [new, paid, shipped]"},
+	}
+	if got := checkEnums(cols, rows); !reflect.DeepEqual(got, want) {
+		t.Errorf("checkEnums:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestRejectRows(t *testing.T) {
+	cols := []columnInfo{{Name: "id", TypName: "int4", TypeSQL: "integer"}, statusColumn}
+	rows := []map[string]interface{}{{"id": "x", "status": "lost"}}
+
+	err := rejectRows(cols, rows, false)
+	ce, ok := err.(*componentError)
+	if !ok || ce.Code != "validation_failed" {
+		t.Fatalf("rejectRows without validate = %v, want validation_failed", err)
+	}
+	if got := ce.Details["problems"].([]rowProblem); len(got) != 1 || got[0].Column != "status" {
+		t.Errorf("without validate only the enum is checked, got %v", got)
+	}
+
+	err = rejectRows(cols, rows, true)
+	if got := err.(*componentError).Details["problems"].([]rowProblem); len(got) != 2 {
+		t.Errorf("with validate both columns are checked, got %v", got)
+	}
+
+	if err := rejectRows(cols, []map[string]interface{}{{"id": "1", "status": "new"}}, true); err != nil {
+		t.Errorf("valid row rejected: %v", err)
+	}
+}
+
+func TestCheckValue(t *testing.T) {
+	cases := []struct {
+		col  columnInfo
+		v    interface{}
+		want string
+	}{
+		{statusColumn, "shipped", ""},
+		{statusColumn, "lost", "invalid value 'lost' for enum order_status, allowed: [new, paid, shipped]"},
+		{columnInfo{TypName: "varchar", TypMod: 7, TypeSQL: "character varying(3)"}, "abcd", "value is 4 characters, character varying(3) allows 3"},
+		{columnInfo{TypName: "int2", TypeSQL: "smallint"}, "40000", "40000 is out of range for smallint"},
+		{columnInfo{TypName: "int4", TypeSQL: "integer"}, json.Number("12"), ""},
+		{columnInfo{TypName: "numeric", TypMod: (5<<16 | 2) + 4, TypeSQL: "numeric(5,2)"}, "1234.5", "1234.5 overflows numeric(5,2)"},
+		{columnInfo{TypName: "numeric", TypMod: (5<<16 | 2) + 4, TypeSQL: "numeric(5,2)"}, "0.001", ""},
+		{columnInfo{TypName: "bool", TypeSQL: "boolean"}, "maybe", `"maybe" is not a boolean`},
+		{columnInfo{TypName: "date", TypeSQL: "date"}, "2026-02-30", `"2026-02-30" is not a valid date (expected YYYY-MM-DD[ HH:MM:SS])`},
+		{columnInfo{TypName: "date", TypeSQL: "date"}, "infinity", ""},
+	}
+	for _, c := range cases {
+		if got := checkValue(c.col, c.v); got != c.want {
+			t.Errorf("checkValue(%s, %v) = %q, want %q", c.col.TypeSQL, c.v, got, c.want)
+		}
+	}
+}
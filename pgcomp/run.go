@@ -0,0 +1,2288 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/lib/pq"
+)
+
+// Run answers the request document read from stdin with one JSON
+// document on stdout; args are the command line arguments (--policy).
+// Package state such as the limits, the logger and the catalog caches
+// lives as long as the process, so callers running several requests in
+// one process share it.
+func Run(stdin io.Reader, stdout io.Writer, args []string) {
+	if err := loadLimits(); err != nil {
+		json.NewEncoder(stdout).Encode(Response{Error: err.Error()})
+		return
+	}
+	input, err := decodeInput(stdin)
+	if err != nil {
+		json.NewEncoder(stdout).Encode(errorOutput("failed to decode input", err))
+		return
+	}
+
+	var (
+		host       string
+		port       int
+		username   string
+		password   string
+		dbname     string
+		sslmode    = "disable"
+		dataType   = "query" // query, table, stored_procedure, stored_function
+		objectName string
+		query      string
+		parameters string // JSON array of arguments
+
+		exactIfUnder  int64 // estimate_count: run a real count(*) below this estimate
+		checkEmpty    bool  // exists: also report whether the relation has rows
+		concurrently  bool  // matview_refresh: REFRESH ... CONCURRENTLY
+		schema        string
+		operation     string // sub-command for management modes
+		name          string
+		roleOpts      roleOptions
+		dbOpts        databaseOptions
+		maintenanceDB = "postgres" // database: where CREATE/DROP DATABASE is issued from
+		hostList      string       // JSON array alternative to a comma-separated host
+		sessionAttrs  = "any"      // target_session_attrs: any, read-write, read-only
+		route         string       // "auto" sends read-only requests to read_hosts
+		readHostList  string
+		authMethod    string // "" for password auth, aws_iam for RDS IAM tokens, vault, gssapi
+		awsRegion     string
+		vaultCfg      vaultConfig
+		krbSrvName    string
+		clientEnc     string // client_encoding of the session
+		keepAlive     *net.KeepAliveConfig
+		idleTxMS      int64        // idle_in_transaction_session_timeout for the request transaction
+		sshCfg        sshConfig    // reach the database through this jump host
+		connTimeout   int64        // seconds per connection attempt
+		connRetries   int          // extra sweeps over the hosts on network failure
+		ipFamily      = "any"      // ipv4, ipv6 or any
+		driver        = "postgres" // database/sql driver: postgres (lib/pq) or pgx
+		strict        bool         // reject unknown/duplicate inputs and bad enum values
+		failOnDupCols bool         // refuse result sets with repeated column names
+		columnOrder   string       // "query" or "name"; query from envelope version 2 on
+		rowLayout     = "objects"  // or "compact": columns once, rows as arrays
+		strictSet     bool
+		envelopeVer   = 1 // response layout, see output.go
+		envelopeErr   error
+		requestID     string // echoed verbatim in envelope version 2
+		logLevel      string // stderr logging: error, warn, info, debug (or LOG_LEVEL)
+		slowMS        int64  // warn when execution takes at least this long
+		explainOnSlow bool
+		audit         *auditSpec // record the statement in an audit table
+		auditRequired bool
+		cacheDir      string // cache read results as files in this directory
+		cacheTTL      int64  // seconds a cached result stays fresh
+		cacheBypass   bool
+		precondition  *checkSpec       // run the request only if this check holds
+		idempotency   *idempotencySpec // run the request once per key
+		verify        *checkSpec       // invariant checked before commit
+		benchOpts     benchmarkOptions
+		tq            = tableQuery{GeometryFormat: "geojson"} // table mode: columns, limit, sample, ...
+		pivot         *pivotSpec                              // reshape the rows client-side
+		numFormat     *numberFormat                           // display formatting for chosen columns
+		computed      []computedColumn                        // columns derived client-side from each row
+		post          postProcess                             // filter, order and limit result rows client-side
+		streamRows    = defaultStreamRows                     // select rows held before the result is streamed; 0 never
+		encryptCols   []string                                // written through pgp_sym_encrypt
+		decryptCols   []string                                // read through pgp_sym_decrypt
+		cryptoKeyIn   string
+		cryptoSource  string
+		cryptoKeyFile string
+		signing       *signSpec // sign written files or the result
+		signatureFile string    // verify_signature: default input_file + ".sig"
+		loOpts        largeObjectOptions
+		mergeOpts     mergeOptions
+		writeOpts     writeOptions
+		deleteOpts    deleteOptions
+		queueOpts     queueOptions
+		topOpts       topQueriesOptions
+		captureDiag   bool // post-mortem on deadlock and serialization errors
+		tmplValues    map[string]templateValue
+		echoSQL       bool
+		showPoolStats bool // meta.pool_stats: the pool's counters and connection retries
+		commentOpts   commentOptions
+		peer          peerInputs // second connection of schema_diff, copy_between and sync
+		suggestAlter  bool
+		copyOpts      copyOptions
+		fdwOpts       fdwOptions
+		verifyOpts    verifyCopyOptions
+		progressOpts  progressOptions
+		checkpointOpt checkpointOptions
+		checkpoints   *checkpointer // commit_every batches of insert, import, restore or copy_between
+		analyzeOpts   analyzeOptions
+		stagedOpts    stagedOptions
+		dupOpts       duplicateOptions
+		orphanOpts    orphanOptions
+		analyzeDB     querier // where the loaded table lives, the second connection for copy_between
+		partOpts      partitionOptions
+		prepareAs     string // end the request transaction with PREPARE TRANSACTION
+		gid           string
+		cdcOpts       cdcOptions
+		confirm       string // repeats the name of the object a destructive operation targets
+		lsn           string // wal diff: the position upto_lsn is measured from
+		importOpts    importOptions
+		genOpts       generateOptions
+		exportOpts    exportOptions
+		parallelOpts  parallelExportOptions
+		restoreOpts   = restoreOptions{StopOnError: true}
+		syncOpts      syncOptions
+		fanoutOpts    fanoutOptions
+		statements    []batchStatement
+		snapshot      *snapshotSpec // transaction: one read-only snapshot for every statement
+		snapInfo      map[string]interface{}
+		setRole       string // SET LOCAL ROLE for the request transaction
+		rlsRaw        string
+		rlsPrefix     = "app." // rls_settings keys must start with this
+		tenant        string   // schema the request transaction's search_path starts with
+		tenantPattern = defaultTenantPattern
+		rlsSettings   map[string]string
+	)
+
+	// inputErr is the first malformed input value; it is reported once the
+	// responder is set up
+	var inputErr error
+	badInput := func(err error) {
+		if inputErr == nil {
+			inputErr = err
+		}
+	}
+
+	var (
+		unknownInputs   []string
+		duplicateInputs []string
+		seenInputs      = map[string]bool{}
+	)
+
+	// Extract parameters
+	for _, p := range input.Params {
+		val := strings.TrimSpace(p.CompValue)
+		key := strings.ToLower(p.InputName)
+		if seenInputs[key] {
+			duplicateInputs = append(duplicateInputs, p.InputName)
+		}
+		seenInputs[key] = true
+
+		switch key {
+		case "host":
+			host = val
+		case "port":
+			var err error
+			if port, err = parsePort(val); err != nil {
+				badInput(err)
+			}
+		case "username":
+			username = val
+		case "password":
+			password = val
+		case "dbname":
+			dbname = val
+		case "sslmode":
+			if val != "" {
+				sslmode = val
+			}
+		case "data_type":
+			if val != "" {
+				dataType = strings.ToLower(val)
+			}
+		case "object_name":
+			objectName = val
+		case "query":
+			query = val
+		case "parameters":
+			parameters = val
+		case "exact_if_under":
+			var err error
+			exactIfUnder, err = parseCount(key, val)
+			badInput(err)
+		case "check_empty":
+			checkEmpty = isTrue(val)
+		case "concurrently":
+			concurrently = isTrue(val)
+		case "schema":
+			schema = val
+		case "operation":
+			operation = strings.ToLower(val)
+		case "name":
+			name = val
+		case "oid":
+			if val != "" {
+				oid, err := strconv.ParseUint(val, 10, 32)
+				if err != nil || oid == 0 {
+					badInput(fmt.Errorf("invalid oid %q", val))
+				}
+				loOpts.OID = uint32(oid)
+			}
+		case "output_file":
+			loOpts.OutputFile = val
+			exportOpts.File = val
+			parallelOpts.File = val
+		case "snapshot":
+			var err error
+			snapshot, err = parseSnapshot(val)
+			badInput(err)
+		case "statements":
+			var err error
+			statements, err = parseBatchStatements(val)
+			badInput(err)
+		case "role":
+			setRole = val
+		case "rls_settings":
+			rlsRaw = val
+		case "rls_prefix":
+			rlsPrefix = val
+		case "tenant":
+			tenant = val
+		case "tenant_pattern":
+			if val != "" {
+				tenantPattern = val
+			}
+		case "state_file":
+			exportOpts.StateFile = val
+			checkpointOpt.StateFile = val
+		case "commit_every":
+			if val != "" {
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					badInput(fmt.Errorf("invalid commit_every %q", val))
+				}
+				checkpointOpt.Every = n
+			}
+		case "validations":
+			if val != "" {
+				var err error
+				stagedOpts.Validations, err = parseStagedValidations(val)
+				badInput(err)
+			}
+		case "strategy":
+			stagedOpts.Strategy = strings.ToLower(val)
+		case "analyze_after":
+			analyzeOpts.After = isTrue(val)
+		case "analyze_if_rows_over":
+			if val != "" {
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("invalid analyze_if_rows_over %q", val))
+				}
+				analyzeOpts.IfRowsOver = n
+			}
+		case "resume":
+			checkpointOpt.Resume = isTrue(val)
+		case "chunk_rows":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n <= 0 {
+					badInput(fmt.Errorf("invalid chunk_rows %q", val))
+				}
+				exportOpts.ChunkRows = n
+			}
+		case "input_file":
+			loOpts.InputFile = val
+			importOpts.File = val
+			restoreOpts.File = val
+		case "mapping":
+			if val != "" {
+				var err error
+				importOpts.Mapping, err = parseImportMapping(val)
+				badInput(err)
+			}
+		case "delimiter":
+			if val != "" {
+				r := []rune(val)
+				if len(r) != 1 {
+					badInput(fmt.Errorf("delimiter must be a single character"))
+				}
+				importOpts.Delimiter = r[0]
+			}
+		case "max_errors":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("invalid max_errors %q", val))
+				}
+				importOpts.MaxErrors = n
+			}
+		case "content":
+			loOpts.Content = val
+		case "role_password":
+			roleOpts.Password = val
+		case "login":
+			roleOpts.Login = isTrue(val)
+		case "valid_until":
+			roleOpts.ValidUntil = val
+		case "grant":
+			roleOpts.Grant = val
+		case "owner":
+			dbOpts.Owner = val
+		case "encoding":
+			dbOpts.Encoding = val
+		case "template":
+			dbOpts.Template = val
+		case "lc_collate":
+			dbOpts.LcCollate = val
+		case "force":
+			dbOpts.Force = isTrue(val)
+		case "hosts":
+			hostList = val
+		case "target_session_attrs":
+			if val != "" {
+				sessionAttrs = strings.ToLower(val)
+			}
+		case "route":
+			route = strings.ToLower(val)
+		case "read_hosts":
+			readHostList = val
+		case "auth_method":
+			authMethod = strings.ToLower(val)
+		case "aws_region":
+			awsRegion = val
+		case "connect_timeout":
+			if val != "" {
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("invalid connect_timeout %q", val))
+				}
+				connTimeout = n
+			}
+		case "connect_retries":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 || n > 20 {
+					badInput(fmt.Errorf("connect_retries must be between 0 and 20, got %q", val))
+				}
+				connRetries = n
+			}
+		case "keepalives", "keepalives_idle", "keepalives_interval", "keepalives_count":
+			if val == "" {
+				break
+			}
+			if keepAlive == nil {
+				keepAlive = &net.KeepAliveConfig{Enable: true}
+			}
+			if key == "keepalives" {
+				keepAlive.Enable = isTrue(val) || val == "1"
+				break
+			}
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				badInput(fmt.Errorf("%s must be a positive number, got %q", key, val))
+			}
+			switch key {
+			case "keepalives_idle":
+				keepAlive.Idle = time.Duration(n) * time.Second
+			case "keepalives_interval":
+				keepAlive.Interval = time.Duration(n) * time.Second
+			default:
+				keepAlive.Count = n
+			}
+		case "idle_in_transaction_session_timeout_ms":
+			if val != "" {
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("invalid idle_in_transaction_session_timeout_ms %q", val))
+				}
+				idleTxMS = n
+			}
+		case "ip_family":
+			if val != "" {
+				ipFamily = strings.ToLower(val)
+				if !containsString([]string{"any", "ipv4", "ipv6"}, ipFamily) {
+					badInput(fmt.Errorf("ip_family must be one of: any, ipv4, ipv6"))
+				}
+			}
+		case "ssh_host":
+			sshCfg.Host = val
+		case "ssh_port":
+			if val != "" {
+				var err error
+				sshCfg.Port, err = parsePort(val)
+				badInput(err)
+			}
+		case "ssh_user":
+			sshCfg.User = val
+		case "ssh_key_file":
+			sshCfg.KeyFile = val
+		case "ssh_password":
+			sshCfg.Password = val
+		case "ssh_known_hosts":
+			sshCfg.KnownHosts = val
+		case "ssh_insecure_ignore_host_key":
+			sshCfg.Insecure = isTrue(val)
+		case "krb_srv_name":
+			krbSrvName = val
+		case "vault_addr":
+			vaultCfg.Addr = val
+		case "vault_role":
+			vaultCfg.Role = val
+		case "vault_mount":
+			vaultCfg.Mount = val
+		case "vault_token_source":
+			vaultCfg.TokenSource = strings.ToLower(val)
+		case "vault_token_file":
+			vaultCfg.TokenFile = val
+		case "vault_auth_role":
+			vaultCfg.AuthRole = val
+		case "client_encoding":
+			clientEnc = val
+		case "driver":
+			switch strings.ToLower(val) {
+			case "", "pq", "lib/pq", "postgres":
+				driver = "postgres"
+			default:
+				driver = strings.ToLower(val)
+			}
+		case "maintenance_db":
+			if val != "" {
+				maintenanceDB = val
+			}
+		case "column_order":
+			columnOrder = strings.ToLower(val)
+			if columnOrder != "" && !containsString(columnOrders, columnOrder) {
+				badInput(fmt.Errorf("column_order must be one of: %s", strings.Join(columnOrders, ", ")))
+			}
+		case "output_representation":
+			if val != "" {
+				rowLayout = strings.ToLower(val)
+				if !containsString(outputRepresentations, rowLayout) {
+					badInput(fmt.Errorf("output_representation must be one of: %s", strings.Join(outputRepresentations, ", ")))
+				}
+			}
+		case "stream_rows":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("stream_rows must be a non-negative integer"))
+				}
+				streamRows = n
+			}
+		case "pool_stats":
+			showPoolStats = isTrue(val)
+		case "fail_on_duplicate_columns":
+			failOnDupCols = isTrue(val)
+		case "strict":
+			strict, strictSet = isTrue(val), true
+		case "envelope_version":
+			envelopeVer, envelopeErr = parseEnvelopeVersion(val)
+		case "request_id":
+			requestID = val
+		case "log_level":
+			logLevel = val
+		case "slow_ms":
+			var err error
+			slowMS, err = parseCount(key, val)
+			badInput(err)
+		case "explain_on_slow":
+			explainOnSlow = isTrue(val)
+		case "audit":
+			if val != "" {
+				var err error
+				audit, err = parseAuditSpec(val)
+				badInput(err)
+			}
+		case "audit_required":
+			auditRequired = isTrue(val)
+		case "cache_dir":
+			cacheDir = val
+		case "cache_ttl_seconds":
+			var err error
+			cacheTTL, err = parseCount(key, val)
+			badInput(err)
+		case "cache_bypass":
+			cacheBypass = isTrue(val)
+		case "iterations", "warmup", "concurrency", "statement_cache":
+			n, err := parseCount(key, val)
+			badInput(err)
+			switch key {
+			case "iterations":
+				benchOpts.Iterations = int(n)
+			case "warmup":
+				benchOpts.Warmup = int(n)
+			case "concurrency":
+				// One meaning for every data_type that runs work in
+				// parallel: benchmark connections, parallel_export workers
+				// and fanout targets at a time
+				benchOpts.Concurrency = int(n)
+				parallelOpts.Workers = int(n)
+			case "statement_cache":
+				benchOpts.StmtCache = int(n)
+			}
+		case "parts":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n <= 0 {
+					badInput(fmt.Errorf("invalid parts %q", val))
+				}
+				parallelOpts.Parts = n
+			}
+		case "split_column":
+			parallelOpts.SplitColumn = val
+		case "file_format":
+			parallelOpts.Format = strings.ToLower(val)
+		case "allow_write_benchmark":
+			benchOpts.AllowWrite = isTrue(val)
+		case "columns":
+			if val != "" {
+				var err error
+				tq.Columns, err = parseColumns(val)
+				badInput(err)
+			}
+		case "limit":
+			var err error
+			tq.Limit, err = parseCount(key, val)
+			badInput(err)
+		case "sample":
+			if val != "" {
+				var err error
+				tq.Sample, err = parseSample(val)
+				badInput(err)
+			}
+		case "distinct":
+			tq.Distinct = isTrue(val)
+		case "lock":
+			if val != "" {
+				var err error
+				tq.Lock, err = parseLock(val)
+				badInput(err)
+			}
+		case "aggregate":
+			if val != "" {
+				var err error
+				tq.Aggregate, err = parseAggregate(val)
+				badInput(err)
+			}
+		case "group_by":
+			if val != "" {
+				var err error
+				tq.GroupBy, err = parseColumns(val)
+				badInput(err)
+			}
+		case "filter":
+			if val != "" {
+				var err error
+				tq.Filter, err = parseFilter(val)
+				badInput(err)
+			}
+		case "search":
+			if val != "" {
+				var err error
+				tq.Search, err = parseSearch(val)
+				badInput(err)
+			}
+		case "geometry_format":
+			if val != "" {
+				tq.GeometryFormat = strings.ToLower(val)
+				if !containsString(geometryFormats, tq.GeometryFormat) {
+					badInput(fmt.Errorf("geometry_format must be one of: %s", strings.Join(geometryFormats, ", ")))
+				}
+			}
+		case "rows":
+			if val != "" {
+				var err error
+				mergeOpts.Rows, err = parseMergeRows(val)
+				writeOpts.Rows = mergeOpts.Rows
+				badInput(err)
+			}
+		case "key_columns":
+			if val != "" {
+				var err error
+				mergeOpts.KeyColumns, err = parseColumns(val)
+				writeOpts.KeyColumns = mergeOpts.KeyColumns
+				verifyOpts.KeyColumns = mergeOpts.KeyColumns
+				badInput(err)
+			}
+		case "on_update":
+			if val != "" {
+				var err error
+				mergeOpts.OnUpdate, err = parseMergeOnUpdate(val)
+				badInput(err)
+			}
+		case "delete_missing":
+			mergeOpts.DeleteMissing = isTrue(val)
+		case "validate":
+			mergeOpts.Validate = isTrue(val)
+			writeOpts.Validate = mergeOpts.Validate
+		case "host2":
+			peer.Host = val
+		case "port2":
+			var err error
+			if peer.Port, err = parsePort(val); err != nil {
+				badInput(err)
+			}
+		case "username2":
+			peer.Username = val
+		case "password2":
+			peer.Password = val
+		case "dbname2":
+			peer.DBName = val
+		case "sslmode2":
+			peer.SSLMode = val
+		case "connection_uri2":
+			peer.URI = val
+		case "truncate":
+			copyOpts.Truncate = isTrue(val)
+		case "column_mapping":
+			if val != "" {
+				var err error
+				copyOpts.Mapping, err = parseColumnMapping(val)
+				badInput(err)
+			}
+		case "progress_interval":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n <= 0 {
+					badInput(fmt.Errorf("invalid progress_interval %q", val))
+				}
+				progressOpts.Interval = time.Duration(n) * time.Second
+			}
+		case "progress_file":
+			progressOpts.File = val
+		case "target_table":
+			verifyOpts.Target = val
+		case "buckets":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("invalid buckets %q", val))
+				}
+				verifyOpts.Buckets = n
+			}
+		case "fdw":
+			if val != "" {
+				var err error
+				fdwOpts.Spec, err = parseFDWSpec(val)
+				badInput(err)
+			}
+		case "remote_password":
+			fdwOpts.Password = val
+		case "suggest_alter":
+			suggestAlter = isTrue(val)
+		case "comment":
+			comment := val
+			commentOpts.Table = &comment
+		case "column_comments":
+			if val != "" {
+				var err error
+				commentOpts.Columns, err = parseColumnComments(val)
+				badInput(err)
+			}
+		case "values":
+			if val != "" {
+				var err error
+				tmplValues, err = parseTemplateValues(val)
+				badInput(err)
+			}
+		case "echo_sql":
+			echoSQL = isTrue(val)
+		case "capture_diagnostics":
+			captureDiag = isTrue(val)
+		case "order_by":
+			topOpts.OrderBy = strings.ToLower(val)
+			if val != "" && !containsString(topQueryOrders, topOpts.OrderBy) {
+				badInput(fmt.Errorf("order_by must be one of: %s", strings.Join(topQueryOrders, ", ")))
+			}
+		case "reset_stats":
+			topOpts.Reset = isTrue(val)
+		case "queue":
+			if val != "" {
+				var err error
+				queueOpts.Spec, err = parseQueueSpec(val)
+				badInput(err)
+			}
+		case "worker":
+			queueOpts.Worker = val
+		case "explain_dependencies":
+			deleteOpts.ExplainDependencies = isTrue(val)
+		case "check_only":
+			deleteOpts.CheckOnly = isTrue(val)
+		case "cascade_preview":
+			deleteOpts.CascadePreview = isTrue(val)
+		case "expected_version":
+			writeOpts.ExpectedVersion = val
+		case "version_column":
+			writeOpts.VersionColumn = val
+		case "include_xmin":
+			tq.IncludeXmin = isTrue(val)
+		case "override_identity":
+			writeOpts.OverrideIdentity = isTrue(val)
+			mergeOpts.OverrideIdentity = writeOpts.OverrideIdentity
+			importOpts.OverrideIdentity = writeOpts.OverrideIdentity
+			copyOpts.OverrideIdentity = writeOpts.OverrideIdentity
+		case "defaults":
+			if val != "" {
+				var err error
+				writeOpts.Defaults, err = parseColumns(val)
+				badInput(err)
+			}
+		case "suffix":
+			partOpts.Suffix = val
+		case "from":
+			partOpts.From = val
+		case "to":
+			partOpts.To = val
+		case "if_not_exists":
+			partOpts.IfNotExists = isTrue(val)
+		case "confirm":
+			confirm = val
+		case "prepare_as":
+			prepareAs = val
+		case "gid":
+			gid = val
+		case "slot_name":
+			cdcOpts.Slot = val
+		case "upto_lsn":
+			cdcOpts.UptoLSN = val
+		case "lsn":
+			lsn = val
+		case "count":
+			if val != "" {
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("invalid count %q", val))
+				}
+				genOpts.Count = n
+			}
+		case "spec":
+			if val != "" {
+				var err error
+				genOpts.Spec, err = parseGenerateSpec(val)
+				badInput(err)
+			}
+		case "seed":
+			if val != "" {
+				n, err := strconv.ParseUint(val, 10, 64)
+				if err != nil {
+					badInput(fmt.Errorf("invalid seed %q", val))
+				}
+				genOpts.Seed = &n
+			}
+		case "pivot":
+			if val != "" {
+				var err error
+				pivot, err = parsePivot(val)
+				badInput(err)
+			}
+		case "number_locale":
+			if val != "" {
+				l, err := parseNumberLocale(val)
+				badInput(err)
+				writeOpts.NumberLocale, importOpts.NumberLocale = l, l
+			}
+		case "date_formats":
+			if val != "" {
+				f, err := parseDateFormats(val)
+				badInput(err)
+				writeOpts.DateFormats, importOpts.DateFormats = f, f
+			}
+		case "number_format":
+			if val != "" {
+				var err error
+				numFormat, err = parseNumberFormat(val)
+				badInput(err)
+			}
+		case "parent_table":
+			orphanOpts.Parent = val
+		case "parent_columns":
+			if val != "" {
+				var err error
+				orphanOpts.ParentColumns, err = parseColumns(val)
+				badInput(err)
+			}
+		case "include_nulls":
+			orphanOpts.IncludeNulls = isTrue(val)
+		case "include_rows":
+			dupOpts.IncludeRows = isTrue(val)
+		case "ignore_nulls":
+			dupOpts.IgnoreNulls = isTrue(val)
+		case "encrypt_columns":
+			if val != "" {
+				var err error
+				encryptCols, err = parseColumns(val)
+				badInput(err)
+			}
+		case "decrypt_columns":
+			if val != "" {
+				var err error
+				decryptCols, err = parseColumns(val)
+				badInput(err)
+			}
+		case "crypto_key":
+			cryptoKeyIn = val
+		case "crypto_key_source":
+			cryptoSource = strings.ToLower(val)
+		case "crypto_key_file":
+			cryptoKeyFile = val
+		case "sign":
+			if val != "" {
+				var err error
+				signing, err = parseSignSpec(val)
+				badInput(err)
+			}
+		case "signature_file":
+			signatureFile = val
+		case "targets":
+			if val != "" {
+				var err error
+				fanoutOpts.Targets, err = parseFanoutTargets(val)
+				badInput(err)
+			}
+		case "target_timeout":
+			if val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					badInput(fmt.Errorf("invalid target_timeout %q", val))
+				}
+				fanoutOpts.Timeout = n
+			}
+		case "fail_fast":
+			fanoutOpts.FailFast = isTrue(val)
+		case "source_table":
+			syncOpts.SourceTable = val
+		case "allow_delete":
+			syncOpts.AllowDelete = isTrue(val)
+		case "plan_only":
+			syncOpts.PlanOnly = isTrue(val)
+		case "stop_on_error":
+			restoreOpts.StopOnError = isTrue(val)
+		case "dry_run":
+			restoreOpts.DryRun = isTrue(val)
+		case "post_filter":
+			if val != "" {
+				var err error
+				post.Filter, err = parseFilter(val)
+				badInput(err)
+			}
+		case "post_order_by":
+			if val != "" {
+				var err error
+				post.OrderBy, err = parsePostOrderBy(val)
+				badInput(err)
+			}
+		case "post_limit":
+			if val != "" {
+				var err error
+				post.Limit, err = parseCount(key, val)
+				badInput(err)
+			}
+		case "computed_columns":
+			if val != "" {
+				var err error
+				computed, err = parseComputedColumns(val)
+				badInput(err)
+			}
+		case "idempotency":
+			if val != "" {
+				var err error
+				idempotency, err = parseIdempotency(val)
+				badInput(err)
+			}
+		case "precondition":
+			if val != "" {
+				var err error
+				precondition, err = parseCheckSpec("precondition", val)
+				badInput(err)
+			}
+		case "verify":
+			if val != "" {
+				var err error
+				verify, err = parseCheckSpec("verify", val)
+				badInput(err)
+			}
+		default:
+			unknownInputs = append(unknownInputs, p.InputName)
+		}
+	}
+
+	resp := &responder{w: stdout, version: envelopeVer, requestID: requestID}
+	if envelopeErr != nil {
+		resp.write(Response{Error: envelopeErr.Error()})
+		return
+	}
+	if err := setupLogging(logLevel); err != nil {
+		resp.write(Response{Error: err.Error()})
+		return
+	}
+	// Strict validation is the default from envelope version 2 on
+	if !strictSet && envelopeVer >= 2 {
+		strict = true
+	}
+	if columnOrder == "" {
+		columnOrder = "name"
+		if envelopeVer >= 2 {
+			columnOrder = "query"
+		}
+	}
+
+	if rlsRaw != "" {
+		var err error
+		rlsSettings, err = parseRLSSettings(rlsRaw, rlsPrefix)
+		badInput(err)
+	}
+	if tenant != "" {
+		badInput(checkTenant(tenant, tenantPattern))
+	}
+
+	if inputErr != nil {
+		resp.write(errorOutput("", inputErr))
+		return
+	}
+	if strict {
+		if problems := strictProblems(unknownInputs, duplicateInputs, dataType, sslmode); len(problems) > 0 {
+			ce := newError("invalid_input", "invalid input: %s", strings.Join(problems, "; "))
+			ce.Details = map[string]interface{}{"problems": problems}
+			resp.write(errorOutput("", ce))
+			return
+		}
+	} else {
+		for _, name := range unknownInputs {
+			resp.warn("unknown input %q ignored", name)
+		}
+		for _, name := range duplicateInputs {
+			resp.warn("input %q given more than once, last value wins", name)
+		}
+	}
+
+	// CREATE/DROP DATABASE can't target the database we're connected to
+	if dataType == "database" {
+		dbname = maintenanceDB
+	}
+
+	if hostList == "" {
+		hostList = host
+	}
+	hosts, err := parseHosts(hostList)
+	if err != nil {
+		resp.write(Response{Error: err.Error()})
+		return
+	}
+
+	// Validate connection params
+	if len(hosts) == 0 || username == "" || dbname == "" {
+		resp.write(Response{Error: "host, username, and dbname are required"})
+		return
+	}
+	if port == 0 {
+		port = 5432
+	}
+	switch sessionAttrs {
+	case "any", "read-write", "read-only":
+	default:
+		resp.write(Response{Error: "target_session_attrs must be one of: any, read-write, read-only"})
+		return
+	}
+
+	switch authMethod {
+	case "", "password", "aws_iam", "vault", "gssapi":
+	default:
+		resp.write(Response{Error: "auth_method must be one of: password, aws_iam, vault, gssapi"})
+		return
+	}
+
+	if driver != "postgres" && driver != "pgx" {
+		resp.write(Response{Error: "driver must be one of: pq, pgx"})
+		return
+	}
+	// lib/pq refuses any other encoding when it connects
+	if clientEnc != "" && !utf8Encoding(clientEnc) && driver != "pgx" {
+		resp.write(Response{Error: "client_encoding other than UTF8 needs driver pgx"})
+		return
+	}
+
+	var readHosts []string
+	switch route {
+	case "", "primary":
+	case "auto":
+		if readHosts, err = parseHosts(readHostList); err != nil {
+			resp.write(Response{Error: err.Error()})
+			return
+		}
+	default:
+		resp.write(Response{Error: "route must be one of: primary, auto"})
+		return
+	}
+
+	// One key serves both directions; it is only ever bound, never spliced
+	if len(encryptCols) > 0 || len(decryptCols) > 0 {
+		key, err := cryptoKey(cryptoSource, cryptoKeyIn, cryptoKeyFile)
+		if err != nil {
+			resp.write(errorOutput("", err))
+			return
+		}
+		if len(encryptCols) > 0 {
+			writeOpts.Encrypt = &columnCrypto{Columns: encryptCols, key: key}
+		}
+		if len(decryptCols) > 0 {
+			tq.Decrypt = &columnCrypto{Columns: decryptCols, key: key}
+		}
+	}
+
+	// The deployment's policy comes before anything is connected or read
+	pol, perr := loadPolicy(args)
+	if perr == nil {
+		var requestSQL []string
+		if query != "" {
+			requestSQL = append(requestSQL, query)
+		}
+		for _, st := range statements {
+			requestSQL = append(requestSQL, st.Query)
+		}
+		// A template is also checked as it will run, with its values in
+		if dataType == "template" && query != "" {
+			if rendered, err := renderTemplate(query, tmplValues); err == nil {
+				requestSQL = append(requestSQL, rendered)
+			}
+		}
+		for _, c := range []*checkSpec{precondition, verify} {
+			if c != nil {
+				requestSQL = append(requestSQL, c.SQL)
+			}
+		}
+		// staged_load runs each validation and returns its sample rows
+		for _, v := range stagedOpts.Validations {
+			requestSQL = append(requestSQL, v.Query)
+		}
+		perr = pol.checkRequest(dataType, operation, requestSQL, tq.Limit)
+	}
+	if perr != nil {
+		resp.write(errorOutput("", perr))
+		return
+	}
+
+	// role, rls_settings and tenant are set on the request transaction, so
+	// they cannot apply to a data_type that runs outside one or on
+	// connections of its own
+	sessionContext := setRole != "" || len(rlsSettings) > 0 || tenant != ""
+	if sessionContext && (outsideTransaction(dataType) || poolDataType(dataType)) {
+		resp.write(Response{Error: fmt.Sprintf("role, rls_settings and tenant cannot be used with data_type %s", dataType)})
+		return
+	}
+
+	// Load the key now, so a bad one fails before anything is written
+	if signing != nil {
+		if err := signing.loadKey(dataType == "verify_signature"); err != nil {
+			resp.write(errorOutput("", err))
+			return
+		}
+	}
+	if dataType == "verify_signature" {
+		if signing == nil {
+			resp.write(Response{Error: "sign (algorithm and key) is required for verify_signature"})
+			return
+		}
+		result, err := verifySignature(signing, loOpts.InputFile, signatureFile)
+		if err != nil {
+			resp.write(errorOutput("", err))
+			return
+		}
+		resp.write(Response{Result: result})
+		return
+	}
+
+	// A restore dry run only reads and splits the file
+	if dataType == "restore" && restoreOpts.DryRun {
+		result, err := restoreScript(nil, restoreOpts)
+		if err != nil {
+			resp.write(errorOutput("", err))
+			return
+		}
+		resp.write(Response{Result: result})
+		return
+	}
+
+	// fingerprint only looks at the text; nothing is connected or run
+	if dataType == "fingerprint" {
+		if query == "" {
+			resp.write(Response{Error: "query is required for fingerprint"})
+			return
+		}
+		resp.write(Response{Result: fingerprintResult(query)})
+		return
+	}
+
+	// Writes are never cached; an idempotency key is a write of its own
+	readOnly := readOnlyRequest(dataType, query) && tq.Lock == nil && idempotency == nil
+	// Neither is plaintext: cache files are plain storage, which is what
+	// encrypted columns are kept out of
+	secret := tq.Decrypt != nil || cryptoKeyIn != "" || cryptoKeyFile != "" || cryptoSource != "" ||
+		strings.Contains(strings.ToLower(query), "decrypt")
+	if cacheDir != "" && cacheTTL > 0 && readOnly && secret {
+		resp.warn("results that are decrypted or carry a key are not cached")
+	}
+	var cache *resultCache
+	if cacheDir != "" && cacheTTL > 0 && readOnly && !secret {
+		cache = newResultCache(cacheDir, time.Duration(cacheTTL)*time.Second, input, pol)
+	}
+
+	var tunnel *sshTunnel
+	if sshCfg.Host != "" {
+		if tunnel, err = openSSHTunnel(sshCfg); err != nil {
+			resp.write(errorOutput("", err))
+			return
+		}
+		defer tunnel.Close()
+	}
+
+	cfg := connConfig{
+		Hosts:              hosts,
+		Port:               port,
+		Username:           username,
+		Password:           password,
+		DBName:             dbname,
+		SSLMode:            sslmode,
+		TargetSessionAttrs: sessionAttrs,
+		AuthMethod:         authMethod,
+		AWSRegion:          awsRegion,
+		Vault:              vaultCfg,
+		KrbSrvName:         krbSrvName,
+		ClientEncoding:     clientEnc,
+		Tunnel:             tunnel,
+		ConnectTimeout:     time.Duration(connTimeout) * time.Second,
+		ConnectRetries:     connRetries,
+		IPFamily:           ipFamily,
+		KeepAlive:          keepAlive,
+		Driver:             driver,
+	}
+	// fanout connects to each of its targets instead
+	if dataType == "fanout" {
+		args, err := parseArgs(parameters)
+		if err != nil {
+			resp.write(errorOutput("invalid parameters", err))
+			return
+		}
+		fanoutOpts.Concurrency = benchOpts.Concurrency
+		result, err := runFanout(cfg, query, args, fanoutOpts)
+		if err != nil {
+			resp.write(errorOutput("", err))
+			return
+		}
+		resp.write(Response{Result: result})
+		return
+	}
+	db, target, err := connectRouted(cfg, readHosts, readOnly)
+	if err != nil {
+		resp.write(errorOutput("", err))
+		return
+	}
+	defer db.Close()
+
+	// A SQL_ASCII database keeps whatever bytes were written, in no
+	// declared encoding; JSON output replaces those that are not UTF-8
+	if readsRows(dataType, query) {
+		if enc, err := serverEncoding(db); err == nil && enc == "SQL_ASCII" {
+			resp.warn("server_encoding is SQL_ASCII: string values may not be valid UTF-8 and invalid bytes are replaced with U+FFFD; check_encoding finds them")
+		}
+	}
+
+	// Only report the host when there was a choice to make
+	var meta map[string]interface{}
+	if len(hosts) > 1 || sessionAttrs != "any" || route == "auto" || target.Addresses > 1 || target.Attempts > 1 {
+		meta = map[string]interface{}{"host": target.Addr}
+	}
+	if target.Addresses > 1 {
+		meta["address"] = target.IP
+	}
+	if target.Attempts > 1 {
+		meta["connect_attempts"] = target.Attempts
+	}
+	if route == "auto" {
+		meta["route"] = "primary"
+		if target.Read {
+			meta["route"] = "read"
+		}
+	}
+
+	var rows *sql.Rows
+	var execResult sql.Result
+	var result interface{}
+	var stmtSQL string // the statement run for the request, when there is exactly one
+	var stmtArgs []interface{}
+	isSelect := false
+
+	logger.Info("request started", "data_type", dataType, "host", target.Addr, "request_id", requestID)
+	start := time.Now()
+
+	// The precondition, the idempotency key, the request and the
+	// verification share one transaction, so nothing can change between a
+	// check and the statement it guards, a failed request releases its key
+	// and a failed verification can still be rolled back. Large
+	// object descriptors only exist inside a transaction; import, generate,
+	// insert, update, comments and fdw must apply all or nothing;
+	// transaction and delete need one for their savepoints, staged_load for
+	// its temporary table, row locks are held until it ends and prepare_as
+	// needs one to prepare. Some modes cannot run inside a transaction
+	// block.
+	if prepareAs != "" && outsideTransaction(dataType) {
+		resp.write(Response{Error: fmt.Sprintf("prepare_as cannot be used with data_type %s", dataType)})
+		return
+	}
+	var dbtx querier = db
+	var tx requestTx
+	var backendPID int
+	if idempotency != nil && (outsideTransaction(dataType) || dataType == "copy_between") {
+		resp.write(Response{Error: fmt.Sprintf("idempotency cannot be used with data_type %s", dataType)})
+		return
+	}
+	if snapshot != nil && (dataType != "transaction" || prepareAs != "" || idempotency != nil) {
+		resp.write(Response{Error: "snapshot is for data_type transaction and cannot be combined with prepare_as or idempotency"})
+		return
+	}
+	// A checkpointed insert, import or restore commits its own batches
+	// instead of sharing the request transaction
+	checkpointed := checkpointOpt.Every > 0 && (dataType == "insert" || dataType == "import" || dataType == "restore")
+	// A write the policy caps must stay undone until its count is known
+	policyTx := pol != nil && pol.MaxAffected > 0 && !readOnlyRequest(dataType, query)
+	if checkpointed && policyTx {
+		resp.write(Response{Error: "commit_every cannot be used under a policy with max_affected"})
+		return
+	}
+	if checkpointed && (precondition != nil || verify != nil || idempotency != nil || prepareAs != "" || sessionContext) {
+		resp.write(Response{Error: "commit_every cannot be combined with precondition, verify, idempotency, prepare_as, role, rls_settings or tenant"})
+		return
+	}
+	if checkpointed {
+		checkpoints = newCheckpointer(db, checkpointOpt)
+		defer checkpoints.close()
+		dbtx = checkpoints
+	} else if (precondition != nil || verify != nil || idempotency != nil || dataType == "largeobject" || dataType == "import" || dataType == "generate" || dataType == "transaction" || dataType == "insert" || dataType == "update" || dataType == "delete" || dataType == "comments" || dataType == "fdw" || dataType == "staged_load" || dataType == "restore" || dataType == "sync" || tq.Lock != nil || prepareAs != "" || sessionContext || policyTx) && !outsideTransaction(dataType) {
+		if prepareAs != "" {
+			tx, err = beginPrepared(db, prepareAs)
+		} else if snapshot != nil {
+			var stx *sql.Tx
+			if stx, snapInfo, err = beginSnapshot(db, snapshot); err == nil {
+				tx = stx
+			}
+		} else {
+			tx, err = db.Begin()
+		}
+		if err != nil {
+			resp.write(errorOutput("failed to begin transaction", err))
+			return
+		}
+		defer tx.Rollback()
+		dbtx = tx
+		// A killed component must not leave locks held by an idle transaction
+		if idleTxMS > 0 {
+			if _, err := tx.Exec("SELECT set_config('idle_in_transaction_session_timeout', $1, true)", strconv.FormatInt(idleTxMS, 10)); err != nil {
+				resp.write(errorOutput("failed to set idle_in_transaction_session_timeout", err))
+				return
+			}
+		}
+		if err := applySessionContext(tx, setRole, rlsSettings); err != nil {
+			resp.write(errorOutput("failed to apply role/rls_settings", err))
+			return
+		}
+		if err := applyTenant(tx, tenant); err != nil {
+			resp.write(errorOutput("failed to apply tenant", err))
+			return
+		}
+		// Told apart from the other parties of a deadlock in the post-mortem
+		if captureDiag {
+			tx.QueryRow("SELECT pg_backend_pid()").Scan(&backendPID)
+		}
+	}
+
+	// The objects the request names on this connection; copy_between's
+	// table and a second connection's are not the deployment's
+	if pol != nil {
+		var objects []string
+		switch {
+		case dataType == "export_schema":
+			objects, _ = parseColumns(objectName)
+		case dataType != "copy_between":
+			objects = append(objects, objectName)
+		}
+		if !peer.set() {
+			objects = append(objects, verifyOpts.Target, syncOpts.SourceTable)
+		}
+		if err := pol.checkObjects(dbtx, objects, []string{schema}); err != nil {
+			resp.write(errorOutput("", err))
+			return
+		}
+	}
+
+	// A cached result is only served once the policy has allowed the
+	// objects the request names
+	if cache != nil && !cacheBypass {
+		if out, age, ok := cache.load(); ok {
+			if out.Meta == nil {
+				out.Meta = map[string]interface{}{}
+			}
+			out.Meta["cached"] = true
+			out.Meta["cache_age_seconds"] = int64(age.Seconds())
+			logger.Info("served from cache", "data_type", dataType, "age_seconds", int64(age.Seconds()))
+			resp.write(out)
+			return
+		}
+	}
+
+	if precondition != nil {
+		ok, detail, err := evaluateCheck(dbtx, precondition)
+		if err != nil {
+			logger.Error("precondition failed", "error", err.Error())
+			resp.write(errorOutput("precondition error", &componentError{Code: "precondition_error", Message: err.Error()}))
+			return
+		}
+		if !ok {
+			logger.Info("precondition not satisfied, skipping", "data_type", dataType)
+			resp.write(Response{Result: map[string]interface{}{"skipped": true, "precondition": detail}, Meta: meta})
+			return
+		}
+	}
+
+	if idempotency != nil {
+		duplicate, at, info, err := claimIdempotencyKey(dbtx, idempotency)
+		if err != nil {
+			logger.Error("idempotency key could not be recorded", "error", err.Error())
+			resp.write(errorOutput("idempotency error", err))
+			return
+		}
+		if duplicate {
+			logger.Info("idempotency key seen before, skipping", "data_type", dataType, "key", idempotency.Key)
+			resp.write(Response{Result: map[string]interface{}{"duplicate": true, "idempotency_key": idempotency.Key, "original_at": at.UTC().Format(time.RFC3339Nano)}, Meta: meta})
+			return
+		}
+		if meta == nil {
+			meta = map[string]interface{}{}
+		}
+		meta["idempotency"] = info
+	}
+
+	switch dataType {
+	case "table":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for table"})
+			return
+		}
+		if !post.empty() {
+			resp.write(Response{Error: "post_filter, post_order_by and post_limit are for function, procedure and query results; use filter and limit, which table mode runs on the server"})
+			return
+		}
+		var args []interface{}
+		rows, stmtSQL, args, err = queryTable(dbtx, objectName, &tq)
+		stmtArgs = args
+		isSelect = true
+
+	case "stored_procedure":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for stored_procedure"})
+			return
+		}
+		args, argsErr := parseArgs(parameters)
+		if argsErr != nil {
+			resp.write(errorOutput("invalid parameters", argsErr))
+			return
+		}
+
+		placeholders := make([]string, len(args))
+		for i := range args {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		}
+
+		q := fmt.Sprintf("CALL %s(%s)", objectName, strings.Join(placeholders, ","))
+		stmtSQL, stmtArgs = q, args
+		logSQL(q, args)
+		rows, err = dbtx.Query(q, args...)
+		isSelect = true
+
+	case "stored_function":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for stored_function"})
+			return
+		}
+		args, argsErr := parseArgs(parameters)
+		if argsErr != nil {
+			resp.write(errorOutput("invalid parameters", argsErr))
+			return
+		}
+
+		placeholders := make([]string, len(args))
+		for i := range args {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		}
+
+		// SELECT * FROM func(args) is safer for returning tables
+		q := fmt.Sprintf("SELECT * FROM %s(%s)", objectName, strings.Join(placeholders, ","))
+		stmtSQL, stmtArgs = q, args
+		logSQL(q, args)
+		rows, err = dbtx.Query(q, args...)
+		isSelect = true
+
+	case "estimate_count":
+		if objectName == "" && query == "" {
+			resp.write(Response{Error: "object_name or query is required for estimate_count"})
+			return
+		}
+		result, err = estimateCount(dbtx, objectName, query, parameters, exactIfUnder)
+
+	case "exists":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for exists"})
+			return
+		}
+		result, err = relationExists(dbtx, objectName, checkEmpty)
+
+	case "duplicates":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for duplicates"})
+			return
+		}
+		dupOpts.Columns, dupOpts.Filter, dupOpts.Limit = tq.Columns, tq.Filter, tq.Limit
+		result, err = findDuplicates(dbtx, objectName, dupOpts)
+
+	case "check_encoding":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for check_encoding"})
+			return
+		}
+		result, err = checkEncoding(dbtx, objectName, encodingCheckOptions{Columns: tq.Columns, KeyColumns: mergeOpts.KeyColumns, Limit: tq.Limit})
+
+	case "orphans":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name (the child table) is required for orphans"})
+			return
+		}
+		orphanOpts.Columns, orphanOpts.Samples, orphanOpts.Suggest = tq.Columns, tq.Limit, suggestAlter
+		result, err = findOrphans(dbtx, objectName, orphanOpts)
+
+	case "merge":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for merge"})
+			return
+		}
+		result, err = mergeRows(dbtx, objectName, mergeOpts)
+
+	case "comments":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for comments"})
+			return
+		}
+		result, err = manageComments(dbtx, objectName, operation, commentOpts)
+
+	case "schema_diff":
+		peerDB, perr := openPeer(cfg, peer, dataType)
+		if perr != nil {
+			resp.write(errorOutput("", perr))
+			return
+		}
+		defer peerDB.Close()
+		result, err = schemaDiff(dbtx, peerDB, schema, suggestAlter)
+
+	case "copy_between":
+		if objectName == "" || query == "" {
+			resp.write(Response{Error: "object_name (the target table) and query are required for copy_between"})
+			return
+		}
+		args, argsErr := parseArgs(parameters)
+		if argsErr != nil {
+			resp.write(errorOutput("invalid parameters", argsErr))
+			return
+		}
+		peerDB, perr := openPeer(cfg, peer, dataType)
+		if perr != nil {
+			resp.write(errorOutput("", perr))
+			return
+		}
+		defer peerDB.Close()
+		copyOpts.Progress = newProgress(dataType, progressOpts)
+		if checkpointOpt.Every > 0 {
+			checkpoints = newCheckpointer(peerDB, checkpointOpt)
+			defer checkpoints.close()
+			copyOpts.Checkpoint = checkpoints
+		}
+		analyzeDB = peerDB
+		result, err = copyBetween(dbtx, peerDB, query, args, objectName, copyOpts)
+
+	case "verify_copy":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for verify_copy"})
+			return
+		}
+		var target querier = dbtx
+		if peer.set() {
+			peerDB, perr := openPeer(cfg, peer, dataType)
+			if perr != nil {
+				resp.write(errorOutput("", perr))
+				return
+			}
+			defer peerDB.Close()
+			target = peerDB
+		}
+		verifyOpts.Report = tq.Limit
+		result, err = verifyCopy(dbtx, target, objectName, verifyOpts)
+
+	case "sync":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name (the target table) is required for sync"})
+			return
+		}
+		args, argsErr := parseArgs(parameters)
+		if argsErr != nil {
+			resp.write(errorOutput("invalid parameters", argsErr))
+			return
+		}
+		// The source may live on the second connection; the target is
+		// always written in the request transaction
+		var source querier = dbtx
+		if peer.set() {
+			peerDB, perr := openPeer(cfg, peer, dataType)
+			if perr != nil {
+				resp.write(errorOutput("", perr))
+				return
+			}
+			defer peerDB.Close()
+			source = peerDB
+		}
+		syncOpts.Query, syncOpts.Args = query, args
+		syncOpts.KeyColumns = mergeOpts.KeyColumns
+		syncOpts.OverrideIdentity = writeOpts.OverrideIdentity
+		syncOpts.Sample = tq.Limit
+		result, err = syncTarget(source, dbtx, !peer.set(), objectName, syncOpts)
+
+	case "describe":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for describe"})
+			return
+		}
+		result, err = describeRelation(dbtx, objectName)
+
+	case "insert", "update":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for " + dataType})
+			return
+		}
+		if dataType == "insert" {
+			writeOpts.Progress = newProgress(dataType, progressOpts)
+			writeOpts.Checkpoint = checkpoints
+			result, err = insertRows(dbtx, objectName, writeOpts)
+		} else {
+			result, err = updateRows(dbtx, objectName, writeOpts)
+		}
+
+	case "dequeue", "ack", "nack":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for " + dataType})
+			return
+		}
+		if dataType == "dequeue" {
+			result, err = dequeue(dbtx, objectName, tq.Filter, tq.Limit, queueOpts)
+		} else {
+			result, err = settleQueue(dbtx, objectName, dataType, writeOpts.Rows, queueOpts)
+		}
+
+	case "delete":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for delete"})
+			return
+		}
+		result, err = deleteRows(dbtx, objectName, writeOpts, deleteOpts)
+
+	case "wal":
+		result, err = manageWAL(dbtx, operation, lsn, cdcOpts.UptoLSN, confirm)
+
+	case "partition":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for partition"})
+			return
+		}
+		partOpts.Name, partOpts.Confirm = name, confirm
+		result, err = managePartitions(dbtx, objectName, operation, partOpts)
+
+	case "commit_prepared", "rollback_prepared":
+		result, err = finishPrepared(dbtx, dataType, gid)
+
+	case "list_prepared":
+		result, err = listPrepared(dbtx)
+
+	case "cdc_peek", "cdc_advance":
+		cdcOpts.Limit = tq.Limit
+		if dataType == "cdc_peek" {
+			result, err = cdcPeek(dbtx, cdcOpts)
+		} else {
+			result, err = cdcAdvance(dbtx, cdcOpts)
+		}
+
+	case "list_triggers":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for list_triggers"})
+			return
+		}
+		result, err = manageTriggers(dbtx, objectName, operation, name, confirm)
+
+	case "list_constraints":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for list_constraints"})
+			return
+		}
+		result, err = listConstraints(dbtx, objectName)
+
+	case "import":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for import"})
+			return
+		}
+		importOpts.Progress = newProgress(dataType, progressOpts)
+		importOpts.Checkpoint = checkpoints
+		result, err = importCSV(dbtx, objectName, importOpts)
+
+	case "staged_load":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for staged_load"})
+			return
+		}
+		result, err = stagedLoad(dbtx, objectName, stagedOpts, importOpts, writeOpts)
+
+	case "generate":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for generate"})
+			return
+		}
+		result, err = generateRows(dbtx, objectName, genOpts)
+
+	case "export":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for export"})
+			return
+		}
+		exportOpts.Progress = newProgress(dataType, progressOpts)
+		result, err = exportTable(db, objectName, tq, exportOpts)
+
+	case "export_schema":
+		names, perr := parseColumns(objectName)
+		if perr != nil {
+			resp.write(Response{Error: "object_name: " + perr.Error()})
+			return
+		}
+		result, err = exportSchema(db, names, exportOpts.File)
+
+	case "restore":
+		restoreOpts.Progress = newProgress(dataType, progressOpts)
+		restoreOpts.Checkpoint = checkpoints
+		result, err = restoreScript(dbtx, restoreOpts)
+
+	case "parallel_export":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for parallel_export"})
+			return
+		}
+		parallelOpts.Progress = newProgress(dataType, progressOpts)
+		result, err = exportParallel(db, objectName, tq, parallelOpts)
+
+	case "list_enum":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for list_enum"})
+			return
+		}
+		result, err = listEnum(dbtx, objectName)
+
+	case "matview_refresh":
+		if objectName == "" {
+			resp.write(Response{Error: "object_name is required for matview_refresh"})
+			return
+		}
+		result, err = refreshMatview(dbtx, objectName, concurrently)
+
+	case "list_views":
+		result, err = listViews(dbtx, schema)
+
+	case "extensions":
+		result, err = manageExtensions(dbtx, operation, name, schema)
+
+	case "fdw":
+		result, err = manageFDW(dbtx, operation, name, fdwOpts)
+
+	case "roles":
+		roleOpts.Name = name
+		result, err = manageRoles(dbtx, operation, roleOpts)
+
+	case "database":
+		dbOpts.Name = name
+		result, err = manageDatabase(db, operation, dbOpts)
+
+	case "largeobject":
+		result, err = manageLargeObject(dbtx, operation, loOpts)
+
+	case "transaction":
+		result, err = runBatch(dbtx, statements)
+		if err == nil {
+			snapshot.hold(snapInfo)
+		}
+		if snapInfo != nil {
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["snapshot"] = snapInfo
+		}
+
+	case "connection_info":
+		clientOpts := map[string]interface{}{}
+		if keepAlive != nil {
+			clientOpts["keepalives"] = keepAlive.Enable
+			clientOpts["keepalives_idle_seconds"] = int64(keepAlive.Idle.Seconds())
+			clientOpts["keepalives_interval_seconds"] = int64(keepAlive.Interval.Seconds())
+			clientOpts["keepalives_count"] = keepAlive.Count
+		}
+		if idleTxMS > 0 {
+			clientOpts["idle_in_transaction_session_timeout_ms"] = idleTxMS
+		}
+		if setRole != "" {
+			clientOpts["role"] = setRole
+		}
+		if tenant != "" {
+			clientOpts["tenant"] = tenant
+		}
+		if clientEnc != "" {
+			clientOpts["client_encoding"] = clientEnc
+		}
+		if len(rlsSettings) > 0 {
+			if clientOpts["rls_settings"], err = effectiveSettings(dbtx, rlsSettings); err != nil {
+				break
+			}
+		}
+		result, err = connectionInfo(dbtx, clientOpts)
+
+	case "index_report":
+		result, err = indexReport(dbtx, objectName, schema)
+
+	case "top_queries":
+		topOpts.Limit = tq.Limit
+		result, err = topQueries(dbtx, topOpts)
+
+	case "replication_status":
+		result, err = replicationStatus(dbtx)
+
+	case "capabilities":
+		result, err = capabilities(dbtx)
+
+	case "benchmark":
+		if query == "" {
+			resp.write(Response{Error: "query is required for benchmark"})
+			return
+		}
+		stmtSQL = query
+		result, err = runBenchmark(db, query, parameters, benchOpts)
+
+	case "template":
+		if query == "" {
+			resp.write(Response{Error: "query (the template) is required for template"})
+			return
+		}
+		if stmtSQL, err = renderTemplate(query, tmplValues); err != nil {
+			break
+		}
+		if err = checkSQLLength(stmtSQL); err != nil {
+			break
+		}
+		logSQL(stmtSQL, nil)
+		if isSelect = classifyStatement(stmtSQL).ReturnsRows; isSelect {
+			rows, err = dbtx.Query(stmtSQL)
+		} else {
+			execResult, err = dbtx.Exec(stmtSQL)
+		}
+
+	case "query":
+		fallthrough
+	default:
+		if query == "" {
+			resp.write(Response{Error: "query is required"})
+			return
+		}
+		isSelect = classifyStatement(query).ReturnsRows
+
+		stmtSQL = query
+		if tq.Lock != nil {
+			if !isSelect {
+				resp.write(Response{Error: "lock needs a query that returns rows"})
+				return
+			}
+			stmtSQL = lockQuery(query, tq.Lock)
+		}
+		if err = checkSQLLength(stmtSQL); err != nil {
+			break
+		}
+		logSQL(stmtSQL, nil)
+		if dbtx != querier(db) {
+			if isSelect {
+				rows, err = dbtx.Query(stmtSQL)
+			} else {
+				execResult, err = dbtx.Exec(query)
+			}
+			break
+		}
+		// A connection cut between connecting and the statement (a firewall
+		// dropping it, a restarted server) is retried once on a new one;
+		// inside a transaction the work done so far is gone with it
+		pinned := &pinnedStatement{db: db}
+		defer pinned.close()
+		before := connectionRetries
+		if isSelect {
+			rows, _, err = pinned.run(stmtSQL, true, classifyStatement(stmtSQL).ReadOnly)
+		} else {
+			_, execResult, err = pinned.run(query, false, false)
+		}
+		if n := connectionRetries - before; n > 0 {
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["connection_retries"] = n
+		}
+	}
+
+	// A row value for a generated or identity column would fail on the
+	// server with an error users rarely understand; such columns are
+	// dropped instead and reported
+	if res, ok := result.(map[string]interface{}); ok {
+		if cols, ok := res["stripped_columns"].([]string); ok {
+			resp.warn("generated or identity columns were not written: %s", strings.Join(cols, ", "))
+		}
+		if fks, ok := res["deferred_constraints"].([]string); ok && len(fks) > 0 {
+			resp.warn("circular or self-referencing foreign keys are added after the data: %s", strings.Join(fks, ", "))
+		}
+	}
+
+	auditObject := objectName
+	if auditObject == "" {
+		auditObject = name
+	}
+	// writeAuditRow records the outcome; it only fails the request when the
+	// audit is required.
+	writeAuditRow := func(rows int64, execErr error) error {
+		if audit == nil {
+			return nil
+		}
+		aerr := writeAudit(db, audit, auditRecord{
+			DataType:   dataType,
+			ObjectName: auditObject,
+			SQL:        stmtSQL,
+			Parameters: parameters,
+			Rows:       rows,
+			Duration:   time.Since(start),
+			Err:        execErr,
+		})
+		if aerr == nil {
+			return nil
+		}
+		logger.Error("audit write failed", "table", audit.Table, "error", aerr.Error())
+		resp.warn("audit row could not be written: %v", aerr)
+		if auditRequired {
+			return newError("audit_failed", "audit row could not be written: %v", aerr)
+		}
+		return nil
+	}
+
+	if err != nil {
+		logger.Error("execution failed", "data_type", dataType, "duration_ms", time.Since(start).Milliseconds(), "error", err.Error())
+		err = checkpoints.failed(lockedError(err))
+		// The transaction is aborted, so the catalog is read through the pool
+		err = explainConstraint(db, err)
+		if captureDiag {
+			statementsRun := make([]string, 0, len(statements))
+			for _, st := range statements {
+				statementsRun = append(statementsRun, st.Query)
+			}
+			if stmtSQL != "" {
+				statementsRun = append(statementsRun, stmtSQL)
+			}
+			err = withDiagnostics(db, err, backendPID, statementsRun)
+		}
+		writeAuditRow(0, err)
+		resp.write(errorOutput("execution error", err))
+		return
+	}
+
+	var out Response
+	var rowCount int64
+	if isSelect && rows != nil {
+		defer rows.Close()
+		columns, err := rows.Columns()
+		if err != nil {
+			writeAuditRow(0, err)
+			resp.write(Response{Error: fmt.Sprintf("columns error: %v", err)})
+			return
+		}
+
+		// A row is a map, so repeated names would silently overwrite each other
+		keys, dupCols := dedupeColumns(columns)
+		if len(dupCols) > 0 {
+			if failOnDupCols {
+				ce := newError("duplicate_columns", "result has duplicate column names: %s", strings.Join(dupCols, ", "))
+				ce.Details = map[string]interface{}{"columns": describeColumns(columns, keys)}
+				writeAuditRow(0, ce)
+				resp.write(errorOutput("", ce))
+				return
+			}
+			resp.warn("duplicate column names renamed with a numeric suffix: %s", strings.Join(dupCols, ", "))
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["columns"] = describeColumns(columns, keys)
+		}
+
+		types := markExtensionTypes(db, columnTypeNames(rows))
+		geo := newGeometryOutput(tq.GeometryFormat, tq.geometry)
+		comp := newCompositeDecoder(db, resultTypeOIDs(columns, types, tq.columnOIDs))
+		money := newMoneyNormalizer(db, types)
+		rowKeys := keys
+		for _, c := range computed {
+			rowKeys = append(rowKeys, c.Name)
+		}
+		// Past streamRows rows the result is written as it is read, unless
+		// something after the loop needs every row at once
+		canStream := streamRows > 0 && post.empty() && pivot == nil && signing == nil &&
+			cache == nil && verify == nil && !policyTx && (pol == nil || pol.MaxRows == 0)
+		var stream *resultStream
+		// emit writes a streamed row: vals when the row was built as its
+		// array, else the map in the layout asked for
+		emit := func(m map[string]interface{}, vals []interface{}) error {
+			switch {
+			case vals != nil:
+				return stream.row(vals)
+			case rowLayout == "compact":
+				vals := make([]interface{}, len(rowKeys))
+				for j, k := range rowKeys {
+					vals[j] = m[k]
+				}
+				return stream.row(vals)
+			case columnOrder == "query":
+				return stream.row(orderedRow{keys: rowKeys, values: m})
+			}
+			return stream.row(m)
+		}
+
+		scanner := newRowScanner(keys, func(i int, val interface{}) interface{} {
+			if v, ok := comp.apply(i, val); ok {
+				return v
+			}
+			var dbType string
+			if i < len(types) {
+				dbType = types[i]
+			}
+			v := money.apply(dbType, normalizeValue(val, dbType))
+			return geo.apply(columns[i], dbType, v)
+		})
+		// A compact result without computed columns, post_filter or pivot
+		// never needs a row as a map: each row goes straight into its array,
+		// and a streamed one reuses the same array
+		direct := rowLayout == "compact" && len(computed) == 0 && post.empty() && pivot == nil
+		var arrays [][]interface{}
+		var row []interface{}
+
+		results := make([]map[string]interface{}, 0)
+		var n int64
+		for rows.Next() {
+			if err := scanner.scan(rows); err != nil {
+				writeAuditRow(n, err)
+				resp.write(Response{Error: fmt.Sprintf("scan error: %v", err)})
+				return
+			}
+
+			var m map[string]interface{}
+			if direct {
+				if stream == nil {
+					row = make([]interface{}, len(keys))
+				}
+				scanner.array(row)
+				if numFormat != nil {
+					for i, key := range keys {
+						row[i] = numFormat.apply(key, row[i])
+					}
+				}
+			} else {
+				m = scanner.object(len(rowKeys))
+				// Computed columns see the values before number_format turns
+				// them into display strings, and can be formatted themselves
+				if err := applyComputed(computed, int(n), m); err != nil {
+					writeAuditRow(n, err)
+					resp.write(errorOutput("", err))
+					return
+				}
+				if numFormat != nil {
+					for k, v := range m {
+						m[k] = numFormat.apply(k, v)
+					}
+				}
+			}
+			n++
+			if err := pol.checkRows(n); err != nil {
+				writeAuditRow(0, err)
+				resp.write(errorOutput("", err))
+				return
+			}
+			if stream != nil {
+				if err := emit(m, row); err != nil {
+					writeAuditRow(n, err)
+					resp.write(Response{Error: fmt.Sprintf("encode error: %v", err)})
+					return
+				}
+				continue
+			}
+			if direct {
+				arrays = append(arrays, row)
+			} else {
+				results = append(results, m)
+			}
+			if canStream && n > int64(streamRows) {
+				open, close := "[", "]"
+				if rowLayout == "compact" {
+					cols, _ := json.Marshal(rowKeys)
+					open, close = `{"columns":`+string(cols)+`,"rows":[`, "]}"
+				}
+				stream = resp.startStream(open, close)
+				for _, r := range results {
+					if err := emit(r, nil); err != nil {
+						writeAuditRow(n, err)
+						resp.write(Response{Error: fmt.Sprintf("encode error: %v", err)})
+						return
+					}
+				}
+				for _, r := range arrays {
+					if err := emit(nil, r); err != nil {
+						writeAuditRow(n, err)
+						resp.write(Response{Error: fmt.Sprintf("encode error: %v", err)})
+						return
+					}
+				}
+				results, arrays = nil, nil
+			}
+		}
+		// Next also stops on a dropped connection, a cancelled query or a
+		// row the driver could not decode; the rows so far are not the result
+		if err := rows.Err(); err != nil {
+			logger.Error("reading rows failed", "data_type", dataType, "rows", n, "error", err.Error())
+			writeAuditRow(n, err)
+			resp.write(errorOutput("row error", err))
+			return
+		}
+		rowCount = n
+
+		if len(geo.SRIDs) > 0 {
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["geometry_srid"] = geo.SRIDs
+		}
+
+		if !post.empty() {
+			var info map[string]interface{}
+			if results, info, err = post.apply(results); err != nil {
+				writeAuditRow(rowCount, err)
+				resp.write(errorOutput("post_filter error", err))
+				return
+			}
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			// The database still produced every row
+			meta["post_filter"] = info
+			rowCount = int64(len(results))
+		}
+
+		if pivot != nil {
+			var pivotCols []string
+			if results, pivotCols, err = applyPivot(results, pivot); err != nil {
+				writeAuditRow(rowCount, err)
+				resp.write(errorOutput("pivot error", err))
+				return
+			}
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["pivot_columns"] = pivotCols
+			rowKeys = append([]string{pivot.RowKey}, pivotCols...)
+		}
+		switch {
+		case stream != nil:
+			// the rows are written; resp.write adds the rest
+		case direct:
+			if arrays == nil {
+				arrays = [][]interface{}{}
+			}
+			out = Response{Result: compactResult{Columns: rowKeys, Rows: arrays}}
+		case rowLayout == "compact":
+			out = Response{Result: compactRows(results, rowKeys)}
+		case columnOrder == "query":
+			out = Response{Result: orderRows(results, rowKeys)}
+		default:
+			out = Response{Result: results}
+		}
+
+	} else if execResult != nil {
+		affected, _ := execResult.RowsAffected()
+		rowCount = affected
+		// LastInsertId is not supported by lib/pq usually, returns 0 error
+		out = Response{Result: map[string]int64{
+			"rows_affected": affected,
+		}}
+	} else if result != nil {
+		out = Response{Result: result}
+	} else {
+		out = Response{Result: "OK"}
+	}
+
+	if tx != nil && policyTx {
+		n := rowCount
+		if result != nil {
+			n = affectedRows(result)
+		}
+		if err := pol.checkAffected(n); err != nil {
+			tx.Rollback()
+			writeAuditRow(n, err)
+			resp.write(errorOutput("", err))
+			return
+		}
+	}
+
+	if verify != nil && tx != nil {
+		ok, detail, err := evaluateCheck(tx, verify)
+		if err != nil || !ok {
+			tx.Rollback()
+			ce := &componentError{Code: "verification_failed", Message: "verification failed, transaction rolled back", Details: map[string]interface{}{"verify": detail}}
+			if err != nil {
+				ce.Code = "verification_error"
+				ce.Message = fmt.Sprintf("verification query failed, transaction rolled back: %v", err)
+				ce.Details = nil
+			}
+			logger.Warn("verification failed", "data_type", dataType, "error", ce.Message)
+			writeAuditRow(rowCount, ce)
+			resp.write(errorOutput("", ce))
+			return
+		}
+		if meta == nil {
+			meta = map[string]interface{}{}
+		}
+		meta["verify"] = detail
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			// a deferred constraint fires here
+			err = explainConstraint(db, err)
+			writeAuditRow(0, err)
+			resp.write(errorOutput("commit error", err))
+			return
+		}
+		if prepareAs != "" {
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["prepared"] = prepareAs
+		}
+	}
+
+	// Outside the load transaction, which has committed by now
+	if n, ok := loadedRows(result); ok && analyzeOpts.After && (dataType == "insert" || dataType == "import" || dataType == "copy_between") {
+		if analyzeDB == nil {
+			analyzeDB = db
+		}
+		info, err := analyzeTable(analyzeDB, objectName, n, analyzeOpts)
+		if err != nil {
+			logger.Warn("analyze after load failed", "error", err.Error())
+			resp.warn("the load was committed but ANALYZE failed: %v", err)
+		} else {
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["analyze"] = info
+		}
+	}
+
+	elapsed := time.Since(start)
+	var fpHash string
+	if stmtSQL != "" {
+		fp := fingerprintResult(stmtSQL)
+		fpHash = fp["fingerprint_hash"].(string)
+		if meta == nil {
+			meta = map[string]interface{}{}
+		}
+		meta["fingerprint"] = fp["fingerprint"]
+		meta["fingerprint_hash"] = fpHash
+		if echoSQL {
+			meta["sql"] = stmtSQL
+		}
+	}
+	logger.Info("request finished", "data_type", dataType, "duration_ms", elapsed.Milliseconds(), "rows", rowCount, "fingerprint_hash", fpHash)
+
+	if err := writeAuditRow(rowCount, nil); err != nil {
+		resp.write(errorOutput("", err))
+		return
+	}
+
+	if slowMS > 0 && elapsed >= time.Duration(slowMS)*time.Millisecond {
+		meta = reportSlow(dbtx, resp, meta, elapsed, rowCount, stmtSQL, stmtArgs, explainOnSlow)
+	}
+
+	// The schema the statement actually ran against
+	if tenant != "" {
+		if meta == nil {
+			meta = map[string]interface{}{}
+		}
+		meta["tenant"] = tenant
+	}
+
+	if signing != nil {
+		info, err := signing.signOutput(dataType, out.Result)
+		if err != nil {
+			resp.write(errorOutput("sign error", err))
+			return
+		}
+		if meta == nil {
+			meta = map[string]interface{}{}
+		}
+		meta["signature"] = info
+	}
+
+	if showPoolStats {
+		if meta == nil {
+			meta = map[string]interface{}{}
+		}
+		meta["pool_stats"] = poolStats(db)
+	}
+
+	out.Meta = meta
+	if cache != nil {
+		if err := cache.store(out); err != nil {
+			logger.Warn("cache write failed", "error", err.Error())
+			resp.warn("result could not be cached: %v", err)
+		}
+		if out.Meta == nil {
+			out.Meta = map[string]interface{}{}
+		}
+		out.Meta["cached"] = false
+	}
+	resp.write(out)
+}
+
+func parseArgs(paramStr string) ([]interface{}, error) {
+	if paramStr == "" {
+		return []interface{}{}, nil
+	}
+	args := []interface{}{}
+	dec := json.NewDecoder(strings.NewReader(paramStr))
+	err := decodeArray(dec, limits.Parameters, "parameters", "MAX_PARAMETERS", func(dec *json.Decoder) error {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+		args = append(args, hstoreArg(v))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func isTrue(val string) bool {
+	switch strings.ToLower(val) {
+	case "true", "1", "yes", "y", "on":
+		return true
+	}
+	return false
+}
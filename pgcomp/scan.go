@@ -0,0 +1,44 @@
+package pgcomp
+
+import "database/sql"
+
+// rowScanner reads every row of a result into one set of scan targets:
+// database/sql copies what it assigns to an interface{}, so nothing a row
+// keeps points into them. convert turns the scanned value of column i
+// into its result value.
+type rowScanner struct {
+	keys    []string
+	values  []interface{}
+	dest    []interface{}
+	convert func(i int, val interface{}) interface{}
+}
+
+func newRowScanner(keys []string, convert func(i int, val interface{}) interface{}) *rowScanner {
+	s := &rowScanner{keys: keys, values: make([]interface{}, len(keys)), dest: make([]interface{}, len(keys)), convert: convert}
+	for i := range s.values {
+		s.dest[i] = &s.values[i]
+	}
+	return s
+}
+
+// scan reads the current row of rows.
+func (s *rowScanner) scan(rows *sql.Rows) error {
+	return rows.Scan(s.dest...)
+}
+
+// array stores the converted row in row, which holds one value per key.
+func (s *rowScanner) array(row []interface{}) {
+	for i, v := range s.values {
+		row[i] = s.convert(i, v)
+	}
+}
+
+// object returns the converted row as a map with room for size keys. The
+// keys are shared by every row, so the map holds no copies of them.
+func (s *rowScanner) object(size int) map[string]interface{} {
+	m := make(map[string]interface{}, size)
+	for i, key := range s.keys {
+		m[key] = s.convert(i, s.values[i])
+	}
+	return m
+}
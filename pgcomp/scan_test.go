@@ -0,0 +1,176 @@
+package pgcomp
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// wideDriver serves one result of rows rows and cols columns, valued the
+// way lib/pq hands them over: int8, text and numeric as bytes,
+// timestamptz and bool. Every row is written into the same buffer, as a
+// driver reading the wire does.
+type wideDriver struct{ rows, cols int }
+
+type wideConn struct{ d wideDriver }
+
+type wideResult struct {
+	d   wideDriver
+	n   int
+	buf []byte
+}
+
+func (d wideDriver) Open(string) (driver.Conn, error)             { return wideConn{d}, nil }
+func (d wideDriver) Connect(context.Context) (driver.Conn, error) { return wideConn{d}, nil }
+func (d wideDriver) Driver() driver.Driver                        { return d }
+
+func (c wideConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c wideConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (c wideConn) Close() error                        { return nil }
+
+func (c wideConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &wideResult{d: c.d, buf: make([]byte, 0, 64)}, nil
+}
+
+// wideTypes are the column types of wideDriver, by column.
+func wideTypes(cols int) []string {
+	kinds := []string{"INT8", "TEXT", "NUMERIC", "TIMESTAMPTZ", "BOOL"}
+	types := make([]string, cols)
+	for j := range types {
+		types[j] = kinds[j%len(kinds)]
+	}
+	return types
+}
+
+func (r *wideResult) Columns() []string {
+	cols := make([]string, r.d.cols)
+	for j := range cols {
+		cols[j] = fmt.Sprintf("column_%02d", j)
+	}
+	return cols
+}
+
+func (r *wideResult) Close() error { return nil }
+
+var wideCreated = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (r *wideResult) Next(dest []driver.Value) error {
+	if r.n == r.d.rows {
+		return io.EOF
+	}
+	r.buf = r.buf[:0]
+	for j := range dest {
+		switch j % 5 {
+		case 0:
+			dest[j] = int64(r.n)
+		case 1:
+			start := len(r.buf)
+			r.buf = strconv.AppendInt(append(r.buf, "customer "...), int64(r.n), 10)
+			dest[j] = r.buf[start:len(r.buf):len(r.buf)]
+		case 2:
+			start := len(r.buf)
+			r.buf = append(r.buf, "1234.56"...)
+			dest[j] = r.buf[start:len(r.buf):len(r.buf)]
+		case 3:
+			dest[j] = wideCreated
+		default:
+			dest[j] = r.n%2 == 0
+		}
+	}
+	r.n++
+	return nil
+}
+
+// queryWide runs the wideDriver query, returning the rows and a scanner
+// that normalizes the values as the select path does.
+func queryWide(tb testing.TB, rowCount, cols int) (*sql.Rows, *rowScanner) {
+	db := sql.OpenDB(wideDriver{rowCount, cols})
+	tb.Cleanup(func() { db.Close() })
+	rows, err := db.Query("SELECT")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keys, _ := dedupeColumns(columns)
+	types := wideTypes(cols)
+	return rows, newRowScanner(keys, func(i int, val interface{}) interface{} {
+		return normalizeValue(val, types[i])
+	})
+}
+
+// A row keeps its own values although every row is scanned into the same
+// targets from the same driver buffer.
+func TestRowScanner(t *testing.T) {
+	rows, s := queryWide(t, 3, 5)
+	defer rows.Close()
+	var arrays [][]interface{}
+	var objects []map[string]interface{}
+	for rows.Next() {
+		if err := s.scan(rows); err != nil {
+			t.Fatal(err)
+		}
+		row := make([]interface{}, len(s.keys))
+		s.array(row)
+		arrays = append(arrays, row)
+		objects = append(objects, s.object(len(s.keys)))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range arrays {
+		want := []interface{}{int64(i), fmt.Sprintf("customer %d", i), "1234.56", wideCreated, i%2 == 0}
+		if !reflect.DeepEqual(arrays[i], want) {
+			t.Errorf("array row %d = %v, want %v", i, arrays[i], want)
+		}
+		for j, k := range s.keys {
+			if !reflect.DeepEqual(objects[i][k], want[j]) {
+				t.Errorf("object row %d: %s = %v, want %v", i, k, objects[i][k], want[j])
+			}
+		}
+	}
+}
+
+// benchmarkScan reads and normalizes 100k rows of 50 columns into the
+// result layout build keeps them in.
+func benchmarkScan(b *testing.B, build func(s *rowScanner) interface{}) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rows, s := queryWide(b, 100000, 50)
+		var results []interface{}
+		for rows.Next() {
+			if err := s.scan(rows); err != nil {
+				b.Fatal(err)
+			}
+			results = append(results, build(s))
+		}
+		if err := rows.Err(); err != nil {
+			b.Fatal(err)
+		}
+		rows.Close()
+	}
+}
+
+// BenchmarkScanCompact is a compact result: each row straight into its
+// array.
+func BenchmarkScanCompact(b *testing.B) {
+	benchmarkScan(b, func(s *rowScanner) interface{} {
+		row := make([]interface{}, len(s.keys))
+		s.array(row)
+		return row
+	})
+}
+
+// BenchmarkScanObjects is the default result: a map per row.
+func BenchmarkScanObjects(b *testing.B) {
+	benchmarkScan(b, func(s *rowScanner) interface{} { return s.object(len(s.keys)) })
+}
@@ -0,0 +1,384 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// schemaObjectTypes are the object kinds schema_diff compares, in the order
+// suggested statements have to run: types and sequences before the
+// columns using them, columns before the constraints and indexes on them.
+var schemaObjectTypes = []string{"enum", "sequence", "table", "column", "constraint", "index", "function"}
+
+// schemaObject is one introspected object. Table is the owning table of
+// columns, constraints and indexes; Def is what is compared.
+type schemaObject struct {
+	Table string
+	Def   map[string]interface{}
+}
+
+// schemaSnapshot holds the objects of one schema by type and name.
+type schemaSnapshot map[string]map[string]schemaObject
+
+func (s schemaSnapshot) add(typ, name, table string, def map[string]interface{}) {
+	if s[typ] == nil {
+		s[typ] = map[string]schemaObject{}
+	}
+	s[typ][name] = schemaObject{Table: table, Def: def}
+}
+
+// schemaDiff answers the schema_diff data_type: it compares schema on the
+// request connection (the source) with the same schema on the second
+// connection (the target). Missing objects exist only on the source,
+// extra ones only on the target. Function bodies are compared by the
+// md5 of their definition. With suggest, ALTER statements that would
+// bring the target in line for the simple cases are returned too; they
+// only add or change objects and never drop what exists only on the
+// target.
+func schemaDiff(source, target querier, schema string, suggest bool) (interface{}, error) {
+	if schema == "" {
+		schema = "public"
+	}
+	src, err := introspectSchema(source, schema)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	dst, err := introspectSchema(target, schema)
+	if err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+
+	missing := make([]map[string]interface{}, 0)
+	extra := make([]map[string]interface{}, 0)
+	changed := make([]map[string]interface{}, 0)
+	alters := make([]string, 0)
+	for _, typ := range schemaObjectTypes {
+		for _, name := range unionKeys(src[typ], dst[typ]) {
+			a, inSource := src[typ][name]
+			b, inTarget := dst[typ][name]
+			switch {
+			case inSource && !inTarget:
+				// The objects of a missing table come with it
+				if a.Table != "" && dst["table"][a.Table].Def == nil {
+					continue
+				}
+				missing = append(missing, map[string]interface{}{"type": typ, "name": name, "definition": a.Def})
+			case !inSource && inTarget:
+				if b.Table != "" && src["table"][b.Table].Def == nil {
+					continue
+				}
+				extra = append(extra, map[string]interface{}{"type": typ, "name": name, "definition": b.Def})
+				continue
+			case sameDefinition(a.Def, b.Def):
+				continue
+			default:
+				changed = append(changed, map[string]interface{}{"type": typ, "name": name, "source": a.Def, "target": b.Def})
+			}
+			if suggest {
+				alters = append(alters, suggestAlter(schema, typ, name, a, b, inTarget)...)
+			}
+		}
+	}
+
+	res := map[string]interface{}{
+		"schema":    schema,
+		"identical": len(missing)+len(extra)+len(changed) == 0,
+		"missing":   missing,
+		"extra":     extra,
+		"changed":   changed,
+	}
+	if suggest {
+		res["alter"] = alters
+	}
+	return res, nil
+}
+
+// introspectSchema reads the objects of schema that schema_diff compares.
+// Objects owned by extensions are left out, they follow the extension
+// version instead.
+func introspectSchema(db querier, schema string) (schemaSnapshot, error) {
+	snap := schemaSnapshot{}
+	notExtension := func(classid, oid string) string {
+		return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = '%s'::regclass AND d.objid = %s AND d.deptype = 'e')", classid, oid)
+	}
+
+	err := scanRows(db, `SELECT c.relname::text, c.relkind::text FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind IN ('r', 'p', 'f') AND NOT c.relispartition AND `+notExtension("pg_class", "c.oid"),
+		[]interface{}{schema}, func(scan func(...interface{}) error) error {
+			var name, kind string
+			if err := scan(&name, &kind); err != nil {
+				return err
+			}
+			snap.add("table", name, "", map[string]interface{}{"kind": relKinds[kind]})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(db, `SELECT c.relname::text, a.attname::text, format_type(a.atttypid, a.atttypmod),
+			a.attnotnull, COALESCE(pg_get_expr(ad.adbin, ad.adrelid), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+		WHERE n.nspname = $1 AND c.relkind IN ('r', 'p', 'f') AND NOT c.relispartition
+			AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY c.relname, a.attnum`, []interface{}{schema}, func(scan func(...interface{}) error) error {
+		var table, column, typ, def string
+		var notNull bool
+		if err := scan(&table, &column, &typ, &notNull, &def); err != nil {
+			return err
+		}
+		snap.add("column", table+"."+column, table, map[string]interface{}{"type": typ, "not_null": notNull, "default": nullIfEmpty(def)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// NOT NULL constraints (contype n, PostgreSQL 18) are compared as columns
+	err = scanRows(db, `SELECT c.relname::text, con.conname::text, con.contype::text, pg_get_constraintdef(con.oid)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND con.contype IN ('p', 'u', 'f', 'c', 'x') AND NOT c.relispartition`,
+		[]interface{}{schema}, func(scan func(...interface{}) error) error {
+			var table, name, typ, def string
+			if err := scan(&table, &name, &typ, &def); err != nil {
+				return err
+			}
+			snap.add("constraint", table+"."+name, table, map[string]interface{}{"type": constraintTypes[typ], "definition": def})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Indexes backing a constraint are compared as the constraint
+	err = scanRows(db, `SELECT t.relname::text, c.relname::text, pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = $1 AND t.relkind IN ('r', 'p') AND NOT t.relispartition
+			AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid AND con.contype IN ('p', 'u', 'x'))`,
+		[]interface{}{schema}, func(scan func(...interface{}) error) error {
+			var table, name, def string
+			if err := scan(&table, &name, &def); err != nil {
+				return err
+			}
+			snap.add("index", name, table, map[string]interface{}{"table": table, "definition": def})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(db, `SELECT s.sequencename::text, format_type(s.data_type, NULL), s.start_value, s.increment_by,
+			s.min_value, s.max_value, s.cache_size, s.cycle
+		FROM pg_sequences s WHERE s.schemaname = $1`, []interface{}{schema}, func(scan func(...interface{}) error) error {
+		var name, typ string
+		var start, inc, lo, hi, cache int64
+		var cycle bool
+		if err := scan(&name, &typ, &start, &inc, &lo, &hi, &cache, &cycle); err != nil {
+			return err
+		}
+		snap.add("sequence", name, "", map[string]interface{}{
+			"type": typ, "start": start, "increment": inc, "min": lo, "max": hi, "cache": cache, "cycle": cycle,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanRows(db, `SELECT t.typname::text, array_to_json(array_agg(e.enumlabel::text ORDER BY e.enumsortorder))::text
+		FROM pg_type t
+		JOIN pg_enum e ON e.enumtypid = t.oid
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE n.nspname = $1 AND `+notExtension("pg_type", "t.oid")+`
+		GROUP BY t.typname`, []interface{}{schema}, func(scan func(...interface{}) error) error {
+		var name, labelsJSON string
+		if err := scan(&name, &labelsJSON); err != nil {
+			return err
+		}
+		var labels []string
+		if err := json.Unmarshal([]byte(labelsJSON), &labels); err != nil {
+			return err
+		}
+		snap.add("enum", name, "", map[string]interface{}{"labels": labels})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// pg_get_functiondef rejects aggregates
+	err = scanRows(db, `SELECT p.proname::text || '(' || pg_get_function_identity_arguments(p.oid) || ')',
+			pg_get_function_result(p.oid), md5(pg_get_functiondef(p.oid))
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE n.nspname = $1 AND NOT EXISTS (SELECT 1 FROM pg_aggregate ag WHERE ag.aggfnoid = p.oid)
+			AND `+notExtension("pg_proc", "p.oid"), []interface{}{schema}, func(scan func(...interface{}) error) error {
+		var name, hash string
+		var result sql.NullString
+		if err := scan(&name, &result, &hash); err != nil {
+			return err
+		}
+		snap.add("function", name, "", map[string]interface{}{"returns": nullString(result), "hash": hash})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// scanRows runs q and calls fn for every row with the row's Scan.
+func scanRows(db querier, q string, args []interface{}, fn func(scan func(...interface{}) error) error) error {
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// suggestAlter returns the statements that turn the target object b (when
+// exists) into the source object a, or none when that is not a simple
+// case, e.g. a missing table or a changed function.
+func suggestAlter(schema, typ, name string, a, b schemaObject, exists bool) []string {
+	qualify := func(n string) string { return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(n) }
+	switch typ {
+	case "column":
+		table := qualify(a.Table)
+		col := pq.QuoteIdentifier(strings.TrimPrefix(name, a.Table+"."))
+		if !exists {
+			stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col, a.Def["type"])
+			if def, ok := a.Def["default"].(string); ok {
+				stmt += " DEFAULT " + def
+			}
+			if a.Def["not_null"] == true {
+				stmt += " NOT NULL"
+			}
+			return []string{stmt}
+		}
+		var out []string
+		if a.Def["type"] != b.Def["type"] {
+			out = append(out, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, col, a.Def["type"]))
+		}
+		if a.Def["default"] != b.Def["default"] {
+			if def, ok := a.Def["default"].(string); ok {
+				out = append(out, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s", table, col, def))
+			} else {
+				out = append(out, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT", table, col))
+			}
+		}
+		if a.Def["not_null"] != b.Def["not_null"] {
+			action := "DROP NOT NULL"
+			if a.Def["not_null"] == true {
+				action = "SET NOT NULL"
+			}
+			out = append(out, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s %s", table, col, action))
+		}
+		return out
+	case "constraint":
+		table := qualify(a.Table)
+		con := pq.QuoteIdentifier(strings.TrimPrefix(name, a.Table+"."))
+		add := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", table, con, a.Def["definition"])
+		if !exists {
+			return []string{add}
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", table, con), add}
+	case "index":
+		create := a.Def["definition"].(string)
+		if !exists {
+			return []string{create}
+		}
+		return []string{"DROP INDEX " + qualify(name), create}
+	case "sequence":
+		d := a.Def
+		stmt := "CREATE SEQUENCE"
+		if exists {
+			stmt = "ALTER SEQUENCE"
+		}
+		cycle := "NO CYCLE"
+		if d["cycle"] == true {
+			cycle = "CYCLE"
+		}
+		return []string{fmt.Sprintf("%s %s AS %s INCREMENT BY %d MINVALUE %d MAXVALUE %d START WITH %d CACHE %d %s",
+			stmt, qualify(name), d["type"], d["increment"], d["min"], d["max"], d["start"], d["cache"], cycle)}
+	case "enum":
+		labels := a.Def["labels"].([]string)
+		if !exists {
+			quoted := make([]string, len(labels))
+			for i, l := range labels {
+				quoted[i] = pq.QuoteLiteral(l)
+			}
+			return []string{fmt.Sprintf("CREATE TYPE %s AS ENUM (%s)", qualify(name), strings.Join(quoted, ", "))}
+		}
+		return enumAdditions(qualify(name), labels, b.Def["labels"].([]string))
+	}
+	return nil
+}
+
+// enumAdditions returns the ADD VALUE statements that turn the target
+// labels into the source ones, or none when that needs more than adding:
+// labels cannot be removed or reordered.
+func enumAdditions(typ string, source, target []string) []string {
+	var out []string
+	i := 0
+	for j, l := range source {
+		if i < len(target) && target[i] == l {
+			i++
+			continue
+		}
+		if containsString(target, l) {
+			return nil
+		}
+		switch {
+		case j > 0:
+			out = append(out, fmt.Sprintf("ALTER TYPE %s ADD VALUE %s AFTER %s", typ, pq.QuoteLiteral(l), pq.QuoteLiteral(source[j-1])))
+		case len(target) > 0:
+			out = append(out, fmt.Sprintf("ALTER TYPE %s ADD VALUE %s BEFORE %s", typ, pq.QuoteLiteral(l), pq.QuoteLiteral(target[0])))
+		default:
+			out = append(out, fmt.Sprintf("ALTER TYPE %s ADD VALUE %s", typ, pq.QuoteLiteral(l)))
+		}
+	}
+	if i < len(target) {
+		return nil
+	}
+	return out
+}
+
+func sameDefinition(a, b map[string]interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+func unionKeys(a, b map[string]schemaObject) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// searchSpec is the "search" input of table mode. Mode fts matches with
+// to_tsvector/plainto_tsquery and adds a "rank" column; mode trgm matches
+// with ILIKE and pg_trgm's % operator and adds a "similarity" column. Rows
+// are ordered best match first.
+type searchSpec struct {
+	Columns  []string `json:"columns"`
+	Query    string   `json:"query"`
+	Mode     string   `json:"mode"`     // fts (default) or trgm
+	Language string   `json:"language"` // fts text search configuration, server default when empty
+}
+
+func parseSearch(val string) (*searchSpec, error) {
+	var s searchSpec
+	if err := json.Unmarshal([]byte(val), &s); err != nil {
+		return nil, fmt.Errorf("invalid search: %v", err)
+	}
+	s.Mode = strings.ToLower(s.Mode)
+	if s.Mode == "" {
+		s.Mode = "fts"
+	}
+	if s.Mode != "fts" && s.Mode != "trgm" {
+		return nil, fmt.Errorf("search mode must be fts or trgm")
+	}
+	if len(s.Columns) == 0 {
+		return nil, fmt.Errorf("search needs at least one column")
+	}
+	if strings.TrimSpace(s.Query) == "" {
+		return nil, fmt.Errorf("search needs a query")
+	}
+	if s.Language != "" && s.Mode != "fts" {
+		return nil, fmt.Errorf("search language only applies to mode fts")
+	}
+	return &s, nil
+}
+
+// checkTrgm reports a clear error up front instead of the "function
+// similarity does not exist" the server would raise without pg_trgm.
+func checkTrgm(db querier) error {
+	var installed bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')").Scan(&installed); err != nil {
+		return err
+	}
+	if !installed {
+		return newError("extension_missing", "search mode trgm requires the pg_trgm extension; install it with CREATE EXTENSION pg_trgm (data_type extensions, operation create)")
+	}
+	return nil
+}
+
+// render returns the score expression (aliased) for the select list, the
+// WHERE predicate and the ORDER BY clause.
+func (s *searchSpec) render(column func(string) (string, error), bind func(interface{}) string) (score, where, order string, err error) {
+	cols := make([]string, len(s.Columns))
+	for i, c := range s.Columns {
+		if cols[i], err = column(c); err != nil {
+			return "", "", "", err
+		}
+	}
+
+	if s.Mode == "fts" {
+		parts := make([]string, len(cols))
+		for i, c := range cols {
+			parts[i] = fmt.Sprintf("coalesce(%s::text, '')", c)
+		}
+		doc := strings.Join(parts, " || ' ' || ")
+		var vec, tsq string
+		if s.Language != "" {
+			lang := bind(s.Language)
+			vec = fmt.Sprintf("to_tsvector(%s::regconfig, %s)", lang, doc)
+			tsq = fmt.Sprintf("plainto_tsquery(%s::regconfig, %s)", lang, bind(s.Query))
+		} else {
+			vec = fmt.Sprintf("to_tsvector(%s)", doc)
+			tsq = fmt.Sprintf("plainto_tsquery(%s)", bind(s.Query))
+		}
+		return fmt.Sprintf("ts_rank(%s, %s) AS rank", vec, tsq), vec + " @@ " + tsq, "rank DESC", nil
+	}
+
+	q := bind(s.Query)
+	pattern := bind("%" + escapeLike(s.Query) + "%")
+	var sims, preds []string
+	for _, c := range cols {
+		sims = append(sims, fmt.Sprintf("similarity(%s::text, %s)", c, q))
+		preds = append(preds, fmt.Sprintf("%s::text ILIKE %s", c, pattern), fmt.Sprintf("%s::text %% %s", c, q))
+	}
+	sim := sims[0]
+	if len(sims) > 1 {
+		sim = "GREATEST(" + strings.Join(sims, ", ") + ")"
+	}
+	return sim + " AS similarity", "(" + strings.Join(preds, " OR ") + ")", "similarity DESC", nil
+}
+
+// escapeLike escapes the LIKE wildcards in s using the default '\' escape.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
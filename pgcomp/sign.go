@@ -0,0 +1,276 @@
+package pgcomp
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// signSuffix names the sidecar written next to every signed file.
+const signSuffix = ".sig"
+
+// signSpec is the "sign" input. The key is read from key_file or from the
+// environment variable key_env, never from the params, so it cannot leak
+// through an audit row or a saved request. Neither the key nor anything
+// derived from it but the signature is ever logged or returned.
+type signSpec struct {
+	Algorithm string          `json:"algorithm"` // hmac-sha256 or ed25519
+	KeyFile   string          `json:"key_file"`
+	KeyEnv    string          `json:"key_env"`
+	Inline    json.RawMessage `json:"key"` // only to refuse it
+
+	hmacKey []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// signature is the sidecar file contents and meta.signature.
+type signature struct {
+	Algorithm string `json:"algorithm"`
+	Signature string `json:"signature"`        // base64
+	SHA256    string `json:"sha256,omitempty"` // of the signed bytes
+	Size      int64  `json:"size"`
+}
+
+func parseSignSpec(val string) (*signSpec, error) {
+	var spec signSpec
+	if err := json.Unmarshal([]byte(val), &spec); err != nil {
+		return nil, fmt.Errorf("invalid sign: %v", err)
+	}
+	if len(spec.Inline) > 0 {
+		return nil, fmt.Errorf("sign does not take the key itself; give key_file or key_env")
+	}
+	switch spec.Algorithm {
+	case "hmac-sha256", "ed25519":
+	default:
+		return nil, fmt.Errorf("sign algorithm must be one of: hmac-sha256, ed25519")
+	}
+	if (spec.KeyFile == "") == (spec.KeyEnv == "") {
+		return nil, fmt.Errorf("sign requires exactly one of key_file and key_env")
+	}
+	return &spec, nil
+}
+
+// loadKey reads the key: the HMAC secret, or for ed25519 the private key
+// (PKCS #8 PEM, or a base64 seed or private key) to sign and the public
+// key (PKIX PEM, or base64) to verify. A private key also verifies.
+func (s *signSpec) loadKey(verify bool) error {
+	var raw []byte
+	if s.KeyFile != "" {
+		var err error
+		if raw, err = os.ReadFile(s.KeyFile); err != nil {
+			return newError("sign_config", "failed to read sign key_file: %v", err)
+		}
+	} else {
+		raw = []byte(os.Getenv(s.KeyEnv))
+	}
+	text := strings.TrimSpace(string(raw))
+	if text == "" {
+		return newError("sign_config", "the sign key is empty")
+	}
+
+	if s.Algorithm == "hmac-sha256" {
+		s.hmacKey = []byte(text)
+		return nil
+	}
+	if strings.HasPrefix(text, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(text))
+		if block == nil {
+			return newError("sign_config", "the ed25519 key is not valid PEM")
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if priv, ok := k.(ed25519.PrivateKey); err == nil && ok {
+				s.private, s.public = priv, priv.Public().(ed25519.PublicKey)
+				return nil
+			}
+		case "PUBLIC KEY":
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if pub, ok := k.(ed25519.PublicKey); err == nil && ok && verify {
+				s.public = pub
+				return nil
+			}
+		}
+		if verify {
+			return newError("sign_config", "the key is not an ed25519 PUBLIC KEY or PRIVATE KEY")
+		}
+		return newError("sign_config", "signing needs an ed25519 PRIVATE KEY")
+	}
+	b, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return newError("sign_config", "the ed25519 key is neither PEM nor base64")
+	}
+	switch {
+	case len(b) == ed25519.PrivateKeySize:
+		s.private = ed25519.PrivateKey(b)
+		s.public = s.private.Public().(ed25519.PublicKey)
+	case len(b) == ed25519.PublicKeySize && verify:
+		s.public = ed25519.PublicKey(b)
+	case len(b) == ed25519.SeedSize:
+		s.private = ed25519.NewKeyFromSeed(b)
+		s.public = s.private.Public().(ed25519.PublicKey)
+	default:
+		return newError("sign_config", "the ed25519 key has %d bytes", len(b))
+	}
+	return nil
+}
+
+// sign signs data, the exact bytes of a file or of the result.
+func (s *signSpec) sign(data []byte) signature {
+	sum := sha256.Sum256(data)
+	sig := signature{Algorithm: s.Algorithm, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	if s.Algorithm == "hmac-sha256" {
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(data)
+		sig.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		sig.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.private, data))
+	}
+	return sig
+}
+
+// signFile writes file+".sig". Ed25519 signs the file as one message, so
+// the whole file is read; HMAC files are hashed as a stream.
+func (s *signSpec) signFile(file string) (string, error) {
+	var sig signature
+	if s.Algorithm == "ed25519" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s for signing: %v", file, err)
+		}
+		sig = s.sign(data)
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s for signing: %v", file, err)
+		}
+		defer f.Close()
+		mac, sum := hmac.New(sha256.New, s.hmacKey), sha256.New()
+		n, err := io.Copy(io.MultiWriter(mac, sum), f)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s for signing: %v", file, err)
+		}
+		sig = signature{
+			Algorithm: s.Algorithm,
+			Signature: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+			SHA256:    hex.EncodeToString(sum.Sum(nil)),
+			Size:      n,
+		}
+	}
+	raw, err := json.Marshal(sig)
+	if err != nil {
+		return "", err
+	}
+	path := file + signSuffix
+	if err := writeFileAtomic(path, append(raw, '\n')); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// signedFiles lists the files a request wrote, which are signed instead
+// of the result: the output_file of a large object read or export_schema,
+// and the parts of an export or parallel_export.
+func signedFiles(dataType string, result interface{}) []string {
+	res, _ := result.(map[string]interface{})
+	switch dataType {
+	case "largeobject", "export_schema":
+		if f, ok := res["output_file"].(string); ok {
+			return []string{f}
+		}
+	case "export":
+		parts, _ := res["parts"].([]string)
+		return parts
+	case "parallel_export":
+		parts, _ := res["parts"].([]map[string]interface{})
+		files := make([]string, len(parts))
+		for i, p := range parts {
+			files[i] = p["file"].(string)
+		}
+		return files
+	}
+	return nil
+}
+
+// signOutput signs the files the request wrote, each with a sidecar, or
+// otherwise the result as encoded in the response: the signature covers
+// exactly the bytes of the "result" value.
+func (s *signSpec) signOutput(dataType string, result interface{}) (map[string]interface{}, error) {
+	if files := signedFiles(dataType, result); len(files) > 0 {
+		sidecars := make([]string, len(files))
+		for i, f := range files {
+			var err error
+			if sidecars[i], err = s.signFile(f); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{"algorithm": s.Algorithm, "files": files, "signature_files": sidecars}, nil
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	sig := s.sign(raw)
+	return map[string]interface{}{"algorithm": sig.Algorithm, "signature": sig.Signature, "sha256": sig.SHA256, "covers": "result"}, nil
+}
+
+// verifySignature answers the verify_signature data_type: whether file
+// matches the sidecar signature (default file+".sig") under spec's key.
+// A mismatch is a result, valid false, not an error.
+func verifySignature(s *signSpec, file, sigFile string) (interface{}, error) {
+	if file == "" {
+		return nil, fmt.Errorf("input_file is required for verify_signature")
+	}
+	if sigFile == "" {
+		sigFile = file + signSuffix
+	}
+	raw, err := os.ReadFile(sigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature_file: %v", err)
+	}
+	var want signature
+	if err := json.Unmarshal(raw, &want); err != nil {
+		return nil, fmt.Errorf("signature_file %s is not a signature: %v", sigFile, err)
+	}
+	if want.Algorithm != s.Algorithm {
+		return nil, newError("sign_config", "signature_file was made with %s, not %s", want.Algorithm, s.Algorithm)
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(want.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("signature_file %s has an invalid signature: %v", sigFile, err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input_file: %v", err)
+	}
+
+	var valid bool
+	if s.Algorithm == "hmac-sha256" {
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(data)
+		valid = hmac.Equal(mac.Sum(nil), sigBytes)
+	} else {
+		valid = ed25519.Verify(s.public, data, sigBytes)
+	}
+	sum := sha256.Sum256(data)
+	return map[string]interface{}{
+		"valid":          valid,
+		"algorithm":      s.Algorithm,
+		"file":           file,
+		"signature_file": sigFile,
+		"size":           len(data),
+		"sha256":         hex.EncodeToString(sum[:]),
+		// a changed digest tells a modified file from a wrong key
+		"sha256_matches": want.SHA256 == "" || want.SHA256 == hex.EncodeToString(sum[:]),
+	}, nil
+}
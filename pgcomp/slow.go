@@ -0,0 +1,40 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// explainable lists the leading keywords EXPLAIN accepts.
+var explainable = map[string]bool{"SELECT": true, "WITH": true, "VALUES": true, "TABLE": true, "INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true}
+
+// reportSlow records that a request exceeded slow_ms as a warning, a log line
+// and, when explain is set, the statement's current plan in meta under
+// slow_query. The statement is only re-planned, never re-executed.
+func reportSlow(db querier, resp *responder, meta map[string]interface{}, elapsed time.Duration, rows int64, stmt string, args []interface{}, explain bool) map[string]interface{} {
+	resp.warn("slow query: took %d ms, %d rows", elapsed.Milliseconds(), rows)
+
+	slow := map[string]interface{}{
+		"duration_ms": elapsed.Milliseconds(),
+		"rows":        rows,
+	}
+	if explain && stmt != "" {
+		if !explainable[classifyStatement(stmt).Keyword] {
+			slow["plan_error"] = "statement type cannot be explained"
+		} else {
+			var plan []byte
+			if err := db.QueryRow("EXPLAIN (FORMAT JSON) "+stmt, args...).Scan(&plan); err != nil {
+				slow["plan_error"] = err.Error()
+			} else {
+				slow["plan"] = json.RawMessage(plan)
+			}
+		}
+	}
+	logger.Warn("slow query", "duration_ms", elapsed.Milliseconds(), "rows", rows, "sql", stmt, "plan", slow["plan"])
+
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	meta["slow_query"] = slow
+	return meta
+}
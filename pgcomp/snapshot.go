@@ -0,0 +1,137 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxSnapshotHold caps hold_seconds, the time a finished batch keeps its
+// transaction open for other invocations to join the exported snapshot.
+const maxSnapshotHold = 3600
+
+// snapshotSpec is the "snapshot" input of the transaction data_type: the
+// statements run in one read-only REPEATABLE READ or SERIALIZABLE
+// transaction and so all see the same data. "true" takes the defaults.
+type snapshotSpec struct {
+	Isolation  string `json:"isolation"` // repeatable_read (default) or serializable
+	Deferrable bool   `json:"deferrable"`
+	// Export publishes the snapshot with pg_export_snapshot; it can only be
+	// joined while this transaction is open, see ExportFile and HoldSeconds
+	Export bool `json:"export"`
+	// ExportFile receives the snapshot id as soon as it exists, before the
+	// statements run, for workers started alongside this invocation
+	ExportFile  string `json:"export_file"`
+	HoldSeconds int    `json:"hold_seconds"`
+	// SnapshotID joins a snapshot another invocation exported
+	SnapshotID string `json:"snapshot_id"`
+}
+
+func parseSnapshot(val string) (*snapshotSpec, error) {
+	spec := &snapshotSpec{}
+	if !strings.HasPrefix(val, "{") {
+		if !isTrue(val) {
+			return nil, nil
+		}
+	} else if err := json.Unmarshal([]byte(val), spec); err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	switch spec.Isolation = strings.ToLower(spec.Isolation); spec.Isolation {
+	case "":
+		spec.Isolation = "repeatable_read"
+	case "repeatable_read", "serializable":
+	default:
+		return nil, fmt.Errorf("snapshot isolation must be one of: repeatable_read, serializable")
+	}
+	if spec.ExportFile != "" {
+		spec.Export = true
+	}
+	switch {
+	case spec.Deferrable && spec.Isolation != "serializable":
+		return nil, fmt.Errorf("snapshot deferrable needs isolation serializable")
+	case spec.Deferrable && spec.SnapshotID != "":
+		// PostgreSQL refuses to import into a READ ONLY DEFERRABLE transaction
+		return nil, fmt.Errorf("snapshot deferrable cannot be combined with snapshot_id")
+	case spec.HoldSeconds < 0 || spec.HoldSeconds > maxSnapshotHold:
+		return nil, fmt.Errorf("snapshot hold_seconds must be between 0 and %d", maxSnapshotHold)
+	case spec.HoldSeconds > 0 && !spec.Export:
+		return nil, fmt.Errorf("snapshot hold_seconds only makes sense with export")
+	}
+	return spec, nil
+}
+
+// beginSnapshot opens the read-only transaction of spec, joining or
+// exporting its snapshot, and returns the details for meta.snapshot. The
+// SET TRANSACTION statements come before any query, as PostgreSQL
+// requires; the first query fixes the snapshot.
+func beginSnapshot(db *sql.DB, spec *snapshotSpec) (*sql.Tx, map[string]interface{}, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	q := "SET TRANSACTION ISOLATION LEVEL " + strings.ToUpper(strings.Replace(spec.Isolation, "_", " ", 1)) + " READ ONLY"
+	if spec.Deferrable {
+		q += " DEFERRABLE"
+	}
+	logSQL(q, nil)
+	if _, err := tx.Exec(q); err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	if spec.SnapshotID != "" {
+		// SET TRANSACTION SNAPSHOT takes no parameters
+		q = "SET TRANSACTION SNAPSHOT " + pq.QuoteLiteral(spec.SnapshotID)
+		logSQL(q, nil)
+		if _, err := tx.Exec(q); err != nil {
+			tx.Rollback()
+			return nil, nil, fmt.Errorf("failed to join snapshot %s (the exporting transaction must still be open): %w", spec.SnapshotID, err)
+		}
+	}
+
+	var started time.Time
+	if err := tx.QueryRow("SELECT transaction_timestamp()").Scan(&started); err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	info := map[string]interface{}{
+		"isolation":  spec.Isolation,
+		"read_only":  true,
+		"deferrable": spec.Deferrable,
+		"started_at": started.UTC().Format(time.RFC3339Nano),
+		"joined":     spec.SnapshotID != "",
+		"exported":   spec.Export,
+	}
+	if spec.SnapshotID != "" {
+		info["snapshot_id"] = spec.SnapshotID
+	}
+	if spec.Export {
+		var id string
+		if err := tx.QueryRow("SELECT pg_export_snapshot()").Scan(&id); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		info["snapshot_id"] = id
+		if spec.ExportFile != "" {
+			if err := writeFileAtomic(spec.ExportFile, []byte(id+"\n")); err != nil {
+				tx.Rollback()
+				return nil, nil, fmt.Errorf("failed to write snapshot export_file: %v", err)
+			}
+			info["export_file"] = spec.ExportFile
+		}
+	}
+	return tx, info, nil
+}
+
+// hold keeps the finished transaction, and with it the exported snapshot,
+// open for hold_seconds.
+func (s *snapshotSpec) hold(info map[string]interface{}) {
+	if s == nil || s.HoldSeconds == 0 {
+		return
+	}
+	time.Sleep(time.Duration(s.HoldSeconds) * time.Second)
+	info["held_seconds"] = s.HoldSeconds
+}
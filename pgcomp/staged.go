@@ -0,0 +1,229 @@
+package pgcomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// stageTable is the temporary table staged_load loads into; validation
+// queries select from it by this name.
+const stageTable = "staged"
+
+// maxValidationSamples caps the failing rows returned per validation.
+const maxValidationSamples = 10
+
+// stagedValidation is one entry of the validations input: a query over
+// the staged table that must return no rows.
+type stagedValidation struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// stagedOptions are the inputs of the staged_load data_type. The rows come
+// from input_file (with mapping, as for import) or from rows.
+type stagedOptions struct {
+	Validations []stagedValidation
+	Strategy    string // insert (default), upsert or insert_missing
+}
+
+var stagedStrategies = []string{"insert", "upsert", "insert_missing"}
+
+func parseStagedValidations(val string) ([]stagedValidation, error) {
+	var v []stagedValidation
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		return nil, fmt.Errorf("validations must be a JSON array of {name, query}: %v", err)
+	}
+	for i, c := range v {
+		if c.Query == "" {
+			return nil, fmt.Errorf("validation %d has no query", i)
+		}
+		if !classifyStatement(c.Query).ReadOnly {
+			return nil, fmt.Errorf("validation %q must be a read-only query", c.Name)
+		}
+		if c.Name == "" {
+			v[i].Name = fmt.Sprintf("validation_%d", i+1)
+		}
+	}
+	return v, nil
+}
+
+// stagedLoad answers the staged_load data_type: it creates a temporary
+// table with the loaded columns of target, loads the rows into it, runs
+// every validation against it and only then writes the staged rows into
+// target with one INSERT ... SELECT. It runs in the request transaction,
+// which keeps the temporary table on one connection and drops it at the
+// end; when a validation returns rows the target is never touched.
+func stagedLoad(db querier, target string, opts stagedOptions, imp importOptions, write writeOptions) (interface{}, error) {
+	strategy := opts.Strategy
+	if strategy == "" {
+		strategy = "insert"
+	}
+	if !containsString(stagedStrategies, strategy) {
+		return nil, fmt.Errorf("invalid strategy %q, allowed: %s", strategy, strings.Join(stagedStrategies, ", "))
+	}
+	if strategy == "upsert" && len(write.KeyColumns) == 0 {
+		return nil, fmt.Errorf("key_columns is required for the upsert strategy")
+	}
+	rel, err := resolveRelation(db, target)
+	if err != nil {
+		return nil, err
+	}
+	relCols, err := rel.columns(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make([]string, len(relCols))
+	for i, c := range relCols {
+		known[i] = c.Name
+	}
+
+	var loaded []string
+	switch {
+	case imp.File != "" && len(write.Rows) > 0:
+		return nil, fmt.Errorf("staged_load takes input_file or rows, not both")
+	case imp.File != "":
+		if len(imp.Mapping) == 0 {
+			return nil, fmt.Errorf("mapping is required with input_file")
+		}
+		for _, m := range imp.Mapping {
+			loaded = append(loaded, m.TableColumn)
+		}
+	case len(write.Rows) > 0:
+		seen := map[string]bool{}
+		for _, row := range write.Rows {
+			for c := range row {
+				if !seen[c] {
+					seen[c] = true
+					loaded = append(loaded, c)
+				}
+			}
+		}
+		sort.Strings(loaded)
+	default:
+		return nil, fmt.Errorf("input_file or rows is required for staged_load")
+	}
+	for _, c := range loaded {
+		if !containsString(known, c) {
+			return nil, fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+		}
+	}
+	cols, stripped, overriding := splitReadOnly(loaded, relCols, write.OverrideIdentity)
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("no loaded column can be written to %s", rel.Name)
+	}
+	for _, k := range write.KeyColumns {
+		if !containsString(cols, k) {
+			return nil, fmt.Errorf("key column %q is not loaded", k)
+		}
+	}
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = pq.QuoteIdentifier(c)
+	}
+	colList := strings.Join(quoted, ", ")
+
+	// Only the columns' types: no constraints or defaults, so the
+	// validations see the rows exactly as loaded
+	stmt := fmt.Sprintf("CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA", stageTable, colList, rel.Name)
+	logSQL(stmt, nil)
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+	stage := "pg_temp." + stageTable
+	var stagedRows int64
+	if imp.File != "" {
+		var mapping []importMapping
+		for _, m := range imp.Mapping {
+			if containsString(cols, m.TableColumn) {
+				mapping = append(mapping, m)
+			}
+		}
+		imp.Mapping = mapping
+		res, err := importCSV(db, stage, imp)
+		if err != nil {
+			return nil, err
+		}
+		stagedRows = res.(map[string]interface{})["loaded"].(int64)
+	} else {
+		rows := make([]map[string]interface{}, len(write.Rows))
+		for i, row := range write.Rows {
+			rows[i] = map[string]interface{}{}
+			for _, c := range cols {
+				if v, ok := row[c]; ok {
+					rows[i][c] = v
+				}
+			}
+		}
+		res, err := insertRows(db, stage, writeOptions{Rows: rows, Validate: write.Validate})
+		if err != nil {
+			return nil, err
+		}
+		stagedRows = res.(map[string]interface{})["inserted"].(int64)
+	}
+
+	for _, v := range opts.Validations {
+		q := fmt.Sprintf("SELECT * FROM (%s) AS failing LIMIT %d", v.Query, maxValidationSamples+1)
+		logSQL(q, nil)
+		rows, err := db.Query(q)
+		if err != nil {
+			return nil, fmt.Errorf("validation %q: %w", v.Name, err)
+		}
+		failing, err := collectRows(rows)
+		if err != nil {
+			return nil, fmt.Errorf("validation %q: %w", v.Name, err)
+		}
+		if len(failing) == 0 {
+			continue
+		}
+		more := len(failing) > maxValidationSamples
+		if more {
+			failing = failing[:maxValidationSamples]
+		}
+		ce := newError("validation_failed", "validation %q returned rows; %s was not changed", v.Name, rel.Name)
+		ce.Details = map[string]interface{}{"validation": v.Name, "sample_rows": failing, "more_rows": more, "staged_rows": stagedRows}
+		return nil, ce
+	}
+
+	stmt = fmt.Sprintf("INSERT INTO %s (%s) ", rel.Name, colList)
+	if overriding {
+		stmt += "OVERRIDING SYSTEM VALUE "
+	}
+	stmt += fmt.Sprintf("SELECT %s FROM %s", colList, stage)
+	switch strategy {
+	case "insert_missing":
+		stmt += " ON CONFLICT DO NOTHING"
+	case "upsert":
+		keys := make([]string, len(write.KeyColumns))
+		for i, k := range write.KeyColumns {
+			keys[i] = pq.QuoteIdentifier(k)
+		}
+		var set []string
+		for _, c := range cols {
+			if !containsString(write.KeyColumns, c) {
+				set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", pq.QuoteIdentifier(c), pq.QuoteIdentifier(c)))
+			}
+		}
+		if len(set) == 0 {
+			stmt += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(keys, ", "))
+		} else {
+			stmt += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(set, ", "))
+		}
+	}
+	logSQL(stmt, nil)
+	res, err := db.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+	written, _ := res.RowsAffected()
+	return writeResult(map[string]interface{}{
+		"table":       rel.Name,
+		"strategy":    strategy,
+		"staged":      stagedRows,
+		"written":     written,
+		"validations": len(opts.Validations),
+	}, stripped), nil
+}
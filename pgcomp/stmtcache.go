@@ -0,0 +1,133 @@
+package pgcomp
+
+import (
+	"container/list"
+	"database/sql"
+	"strings"
+	"sync"
+)
+
+// stmtCache is an LRU of prepared statements keyed by SQL text. A
+// *sql.Stmt prepares itself again on whichever pooled connection runs it
+// and forgets connections the pool closes, so entries stay valid when
+// connections are recycled.
+type stmtCache struct {
+	db    *sql.DB
+	size  int
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	byKey map[string]*list.Element
+
+	hits, misses, invalidations int64
+}
+
+// stmtCacheTotals adds up the counters of every statement cache this
+// process used, for pool_stats.
+var stmtCacheTotals struct{ hits, misses, invalidations int64 }
+
+type stmtEntry struct {
+	query string
+	stmt  *sql.Stmt
+}
+
+func newStmtCache(db *sql.DB, size int) *stmtCache {
+	return &stmtCache{db: db, size: size, order: list.New(), byKey: map[string]*list.Element{}}
+}
+
+func (c *stmtCache) get(query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.byKey[query]; ok {
+		c.hits++
+		stmtCacheTotals.hits++
+		c.order.MoveToFront(el)
+		return el.Value.(*stmtEntry).stmt, nil
+	}
+	c.misses++
+	stmtCacheTotals.misses++
+	stmt, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.byKey[query] = c.order.PushFront(&stmtEntry{query: query, stmt: stmt})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	return stmt, nil
+}
+
+func (c *stmtCache) invalidate(query string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.byKey[query]; ok {
+		c.invalidations++
+		stmtCacheTotals.invalidations++
+		c.remove(el)
+	}
+}
+
+func (c *stmtCache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*stmtEntry)
+	delete(c.byKey, e.query)
+	e.stmt.Close()
+}
+
+func (c *stmtCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *stmtCache) stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"size": c.size, "entries": c.order.Len(),
+		"hits": c.hits, "misses": c.misses, "invalidations": c.invalidations,
+	}
+}
+
+// run calls fn with the cached statement for query. When DDL has changed
+// the statement's result type the server refuses the old plan; the entry
+// is then dropped and fn retried once on a fresh statement.
+func (c *stmtCache) run(query string, fn func(*sql.Stmt) error) error {
+	stmt, err := c.get(query)
+	if err != nil {
+		return err
+	}
+	err = fn(stmt)
+	if !planInvalidated(err) {
+		return err
+	}
+	c.invalidate(query)
+	if stmt, err = c.get(query); err != nil {
+		return err
+	}
+	return fn(stmt)
+}
+
+// planInvalidated matches "cached plan must not change result type"
+// (feature_not_supported), raised when a prepared statement outlives a
+// change to the tables it reads.
+func planInvalidated(err error) bool {
+	se := asServerError(err)
+	return se != nil && se.Code == "0A000" && strings.Contains(se.Message, "cached plan")
+}
+
+// preparedQuerier runs a prepared statement through the querier interface;
+// the query text is ignored.
+type preparedQuerier struct{ stmt *sql.Stmt }
+
+func (p preparedQuerier) Exec(_ string, args ...interface{}) (sql.Result, error) {
+	return p.stmt.Exec(args...)
+}
+
+func (p preparedQuerier) Query(_ string, args ...interface{}) (*sql.Rows, error) {
+	return p.stmt.Query(args...)
+}
+
+func (p preparedQuerier) QueryRow(_ string, args ...interface{}) *sql.Row {
+	return p.stmt.QueryRow(args...)
+}
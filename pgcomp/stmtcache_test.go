@@ -0,0 +1,97 @@
+package pgcomp
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// prepDriver prepares every statement and counts the prepares; a
+// statement whose text is in stale fails its first run the way the
+// server refuses a plan that DDL made obsolete.
+type prepDriver struct {
+	prepared int
+	stale    map[string]bool
+}
+
+type prepConn struct{ d *prepDriver }
+
+type prepStmt struct {
+	d     *prepDriver
+	query string
+}
+
+func (d *prepDriver) Open(string) (driver.Conn, error)             { return prepConn{d}, nil }
+func (d *prepDriver) Connect(context.Context) (driver.Conn, error) { return prepConn{d}, nil }
+func (d *prepDriver) Driver() driver.Driver                        { return d }
+
+func (c prepConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.prepared++
+	return &prepStmt{d: c.d, query: query}, nil
+}
+func (c prepConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+func (c prepConn) Close() error              { return nil }
+
+func (s *prepStmt) Close() error  { return nil }
+func (s *prepStmt) NumInput() int { return -1 }
+func (s *prepStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *prepStmt) Query([]driver.Value) (driver.Rows, error) {
+	if s.d.stale[s.query] {
+		s.d.stale[s.query] = false
+		return nil, &pq.Error{Code: "0A000", Message: "cached plan must not change result type"}
+	}
+	return emptyRows{}, nil
+}
+
+func TestStmtCache(t *testing.T) {
+	d := &prepDriver{stale: map[string]bool{}}
+	db := sql.OpenDB(d)
+	defer db.Close()
+	c := newStmtCache(db, 2)
+	defer c.Close()
+	before := stmtCacheTotals
+
+	query := func(q string) {
+		t.Helper()
+		err := c.run(q, func(stmt *sql.Stmt) error {
+			rows, err := stmt.Query()
+			if err == nil {
+				rows.Close()
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	query("SELECT 1")
+	query("SELECT 1")
+	query("SELECT 2")
+	query("SELECT 3") // evicts SELECT 1
+	query("SELECT 1")
+	d.stale["SELECT 3"] = true
+	query("SELECT 3") // invalidated and retried once
+
+	want := map[string]interface{}{"size": 2, "entries": 2, "hits": int64(2), "misses": int64(5), "invalidations": int64(1)}
+	got := c.stats()
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("stats %s = %v, want %v", k, got[k], v)
+		}
+	}
+	if d.prepared != 5 {
+		t.Errorf("%d statements prepared, want 5", d.prepared)
+	}
+
+	pool := poolStats(db)["statement_cache"].(map[string]interface{})
+	if pool["hits"] != before.hits+2 || pool["misses"] != before.misses+5 || pool["invalidations"] != before.invalidations+1 {
+		t.Errorf("pool_stats statement_cache = %v, want this cache's counts added", pool)
+	}
+}
@@ -0,0 +1,537 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// syncSourceTable is the temporary table a same-connection sync stages
+// the source rows in, cast to the target's column types.
+const syncSourceTable = "pg_temp._sync_source"
+
+// syncOptions are the inputs of the sync data_type.
+type syncOptions struct {
+	Query            string // the source rows, or
+	SourceTable      string
+	Args             []interface{}
+	KeyColumns       []string // default the target's primary key
+	AllowDelete      bool     // delete target rows missing from the source
+	PlanOnly         bool
+	OverrideIdentity bool
+	Sample           int64 // rows reported per action, default 20
+}
+
+// syncPlan is what a sync has to do, or did: the counts and a sample of
+// the rows of each action.
+type syncPlan struct {
+	Inserted, Updated, Deleted, Kept int64
+
+	samples map[string][]interface{}
+}
+
+// syncTarget makes table on dst look like the source rows on src: it
+// inserts the rows that are missing, updates the rows whose values
+// differ and, with allow_delete, deletes the rows no longer in the
+// source, matching rows by the key columns. The source columns are the
+// ones synced; target columns the source does not have are left alone.
+// With src and dst the same connection the differences are worked out
+// in SQL against a staged copy of the source. Across connections only
+// keys and row hashes are read from the target, and only the differing
+// rows are written to it. Values are compared as text, so the sessions
+// need the same TimeZone and DateStyle.
+func syncTarget(src, dst querier, sameConn bool, table string, opts syncOptions) (interface{}, error) {
+	switch {
+	case opts.Query == "" && opts.SourceTable == "":
+		return nil, fmt.Errorf("query or source_table is required for sync")
+	case opts.Query != "" && opts.SourceTable != "":
+		return nil, fmt.Errorf("sync takes query or source_table, not both")
+	}
+	if opts.Sample <= 0 {
+		opts.Sample = 20
+	}
+	source := "query"
+	query := strings.TrimRight(strings.TrimSpace(opts.Query), ";")
+	if opts.SourceTable != "" {
+		srel, err := resolveRelation(src, opts.SourceTable)
+		if err != nil {
+			return nil, fmt.Errorf("source_table: %w", err)
+		}
+		source = srel.Name
+		query = "SELECT * FROM " + srel.Name
+	}
+
+	rel, err := resolveRelation(dst, table)
+	if err != nil {
+		return nil, err
+	}
+	relCols, err := rel.columns(dst)
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for _, c := range relCols {
+		types[c.Name] = c.TypeSQL
+	}
+	keys := opts.KeyColumns
+	if len(keys) == 0 {
+		if keys, err = primaryKey(dst, rel); err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, newError("no_primary_key", "%s has no primary key; give key_columns", rel.Name)
+		}
+	}
+
+	// The source's own columns, without running it
+	probe := "SELECT * FROM (" + query + ") s LIMIT 0"
+	logSQL(probe, opts.Args)
+	rows, err := src.Query(probe, opts.Args...)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cols {
+		if _, ok := types[c]; !ok {
+			return nil, fmt.Errorf("source column %q does not exist in %s", c, rel.Name)
+		}
+	}
+	for _, k := range keys {
+		if !containsString(cols, k) {
+			return nil, fmt.Errorf("key column %q is missing from the source", k)
+		}
+	}
+	insertCols, stripped, overriding := splitReadOnly(cols, relCols, opts.OverrideIdentity)
+	for _, k := range keys {
+		if !containsString(insertCols, k) {
+			// inserted rows would get new keys and never match
+			return nil, fmt.Errorf("key column %q is generated; sync cannot write it (override_identity for identity columns)", k)
+		}
+	}
+	var nonKey []string
+	for _, c := range cols {
+		if !containsString(keys, c) {
+			nonKey = append(nonKey, c)
+		}
+	}
+	updateCols, _, _ := splitReadOnly(nonKey, relCols, false)
+
+	var plan *syncPlan
+	mode := "server"
+	if sameConn {
+		plan, err = syncServerSide(dst, rel, query, keys, insertCols, updateCols, types, overriding, opts)
+	} else {
+		mode = "client_hash"
+		plan, err = syncClientSide(src, dst, rel, query, keys, insertCols, updateCols, types, overriding, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{
+		"target":      rel.Name,
+		"source":      source,
+		"mode":        mode,
+		"key_columns": keys,
+		"columns":     insertCols,
+		"applied":     !opts.PlanOnly,
+		"inserted":    plan.Inserted,
+		"updated":     plan.Updated,
+		"deleted":     plan.Deleted,
+		"samples":     plan.samples,
+	}
+	if !opts.AllowDelete {
+		// without allow_delete these stay; say how many
+		res["missing_from_source"] = plan.Kept
+	}
+	return writeResult(res, stripped), nil
+}
+
+// syncServerSide stages the source in a temporary table and runs the
+// delete, update and insert (or, for plan_only, the matching SELECTs) as
+// statements over it, in that order so a deleted row cannot clash with
+// an inserted one on another unique key.
+func syncServerSide(db querier, rel *relation, query string, keys, insertCols, updateCols []string, types map[string]string, overriding bool, opts syncOptions) (*syncPlan, error) {
+	qcols := make([]string, len(insertCols))
+	casts := make([]string, len(insertCols))
+	for i, c := range insertCols {
+		qcols[i] = pq.QuoteIdentifier(c)
+		casts[i] = "s." + qcols[i] + "::" + types[c] + " AS " + qcols[i]
+	}
+	list := strings.Join(qcols, ", ")
+	stage := []string{
+		"DROP TABLE IF EXISTS " + syncSourceTable,
+		fmt.Sprintf("CREATE TEMP TABLE _sync_source ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA", list, rel.Name),
+	}
+	for _, q := range stage {
+		logSQL(q, nil)
+		if _, err := db.Exec(q); err != nil {
+			return nil, err
+		}
+	}
+	q := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM (%s) s", syncSourceTable, list, strings.Join(casts, ", "), query)
+	logSQL(q, opts.Args)
+	if _, err := db.Exec(q, opts.Args...); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("ANALYZE " + syncSourceTable); err != nil {
+		return nil, err
+	}
+
+	qkeys := make([]string, len(keys))
+	match := make([]string, len(keys))
+	for i, k := range keys {
+		qkeys[i] = pq.QuoteIdentifier(k)
+		match[i] = "t." + qkeys[i] + " = s." + qkeys[i]
+	}
+	on := strings.Join(match, " AND ")
+	var dupKey sql.NullString
+	q = fmt.Sprintf("SELECT row_to_json(d)::text FROM (SELECT %s FROM %s GROUP BY %s HAVING count(*) > 1 OR bool_or(%s IS NULL) LIMIT 1) d",
+		strings.Join(qkeys, ", "), syncSourceTable, strings.Join(qkeys, ", "), strings.Join(qkeys, " IS NULL OR "))
+	logSQL(q, nil)
+	err := db.QueryRow(q).Scan(&dupKey)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if dupKey.Valid {
+		return nil, newError("sync_source_keys", "the source has a NULL or duplicate key %s; key_columns must identify source rows", dupKey.String)
+	}
+
+	tKeys := "t." + strings.Join(qkeys, ", t.")
+	missing := fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s t WHERE %s)", rel.Name, on)
+	gone := fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s s WHERE %s)", syncSourceTable, on)
+	var changed string
+	if len(updateCols) > 0 {
+		tv := make([]string, len(updateCols))
+		sv := make([]string, len(updateCols))
+		for i, c := range updateCols {
+			qc := pq.QuoteIdentifier(c)
+			// as text, since json, point and xml have no equality
+			tv[i] = "t." + qc + "::text"
+			sv[i] = "s." + qc + "::text"
+		}
+		changed = fmt.Sprintf("(%s) IS DISTINCT FROM (%s)", strings.Join(tv, ", "), strings.Join(sv, ", "))
+		if len(updateCols) == 1 {
+			changed = tv[0] + " IS DISTINCT FROM " + sv[0]
+		}
+	}
+
+	type step struct {
+		name string
+		stmt string
+		n    *int64
+	}
+	plan := &syncPlan{samples: map[string][]interface{}{}}
+	var steps []step
+	deleteSelect := fmt.Sprintf("SELECT %s FROM %s t WHERE %s", tKeys, rel.Name, gone)
+	if opts.PlanOnly || !opts.AllowDelete {
+		name := "deleted"
+		n := &plan.Deleted
+		if !opts.AllowDelete {
+			name, n = "missing_from_source", &plan.Kept
+		}
+		steps = append(steps, step{name, deleteSelect, n})
+	} else {
+		steps = append(steps, step{"deleted", fmt.Sprintf("DELETE FROM %s t WHERE %s RETURNING %s", rel.Name, gone, tKeys), &plan.Deleted})
+	}
+	if changed != "" {
+		if opts.PlanOnly {
+			steps = append(steps, step{"updated", fmt.Sprintf("SELECT s.* FROM %s s JOIN %s t ON %s WHERE %s", syncSourceTable, rel.Name, on, changed), &plan.Updated})
+		} else {
+			set := make([]string, len(updateCols))
+			for i, c := range updateCols {
+				qc := pq.QuoteIdentifier(c)
+				set[i] = qc + " = s." + qc
+			}
+			steps = append(steps, step{"updated", fmt.Sprintf("UPDATE %s t SET %s FROM %s s WHERE %s AND %s RETURNING s.*",
+				rel.Name, strings.Join(set, ", "), syncSourceTable, on, changed), &plan.Updated})
+		}
+	}
+	insertSelect := fmt.Sprintf("SELECT %s FROM %s s WHERE %s", list, syncSourceTable, missing)
+	if opts.PlanOnly {
+		steps = append(steps, step{"inserted", insertSelect, &plan.Inserted})
+	} else {
+		ins := fmt.Sprintf("INSERT INTO %s (%s) ", rel.Name, list)
+		if overriding {
+			ins += "OVERRIDING SYSTEM VALUE "
+		}
+		steps = append(steps, step{"inserted", ins + insertSelect + " RETURNING " + list, &plan.Inserted})
+	}
+
+	for _, st := range steps {
+		// The statement runs once; the count and the sample both read its rows
+		q := fmt.Sprintf("WITH d AS (%s) SELECT (SELECT count(*) FROM d), (SELECT json_agg(x)::text FROM (SELECT * FROM d LIMIT %d) x)", st.stmt, opts.Sample)
+		logSQL(q, nil)
+		var sample sql.NullString
+		if err := db.QueryRow(q).Scan(st.n, &sample); err != nil {
+			return nil, err
+		}
+		rows := []interface{}{}
+		if sample.Valid {
+			if err := json.Unmarshal([]byte(sample.String), &rows); err != nil {
+				return nil, err
+			}
+		}
+		plan.samples[st.name] = rows
+	}
+	return plan, nil
+}
+
+// syncClientSide compares the source rows on src with the target on dst
+// by hash: the target sends its keys and an md5 of each row's text, the
+// source sends its rows with the same md5, and only the rows that differ
+// are written to dst.
+func syncClientSide(src, dst querier, rel *relation, query string, keys, insertCols, updateCols []string, types map[string]string, overriding bool, opts syncOptions) (*syncPlan, error) {
+	hashOf := func(alias string) string {
+		if len(updateCols) == 0 {
+			return "''"
+		}
+		parts := make([]string, len(updateCols))
+		for i, c := range updateCols {
+			parts[i] = alias + "." + pq.QuoteIdentifier(c) + "::text"
+		}
+		return "md5(ROW(" + strings.Join(parts, ", ") + ")::text)"
+	}
+	textCols := func(alias string, names []string) string {
+		parts := make([]string, len(names))
+		for i, c := range names {
+			parts[i] = alias + "." + pq.QuoteIdentifier(c) + "::text"
+		}
+		return strings.Join(parts, ", ")
+	}
+	keyOf := func(vals []sql.NullString) string {
+		k := make([]interface{}, len(vals))
+		for i, v := range vals {
+			if v.Valid {
+				k[i] = v.String
+			}
+		}
+		raw, _ := json.Marshal(k)
+		return string(raw)
+	}
+	keyMap := func(vals []sql.NullString) map[string]interface{} {
+		m := make(map[string]interface{}, len(keys))
+		for i, k := range keys {
+			m[k] = nullString(vals[i])
+		}
+		return m
+	}
+
+	// target keys and hashes
+	target := map[string]string{}
+	targetKeys := map[string][]sql.NullString{}
+	q := fmt.Sprintf("SELECT %s, %s FROM %s t", textCols("t", keys), hashOf("t"), rel.Name)
+	logSQL(q, nil)
+	err := scanRows(dst, q, nil, func(scan func(...interface{}) error) error {
+		vals := make([]sql.NullString, len(keys))
+		dest := make([]interface{}, len(keys)+1)
+		for i := range vals {
+			dest[i] = &vals[i]
+		}
+		var h string
+		dest[len(keys)] = &h
+		if err := scan(dest...); err != nil {
+			return err
+		}
+		k := keyOf(vals)
+		target[k] = h
+		targetKeys[k] = vals
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// source rows, kept only when they differ
+	var inserts, updates [][]sql.NullString
+	seen := map[string]bool{}
+	q = fmt.Sprintf("SELECT %s, %s FROM (%s) s", textCols("s", insertCols), hashOf("s"), query)
+	logSQL(q, opts.Args)
+	keyIdx := make([]int, len(keys))
+	for i, k := range keys {
+		for j, c := range insertCols {
+			if c == k {
+				keyIdx[i] = j
+			}
+		}
+	}
+	err = scanRows(src, q, opts.Args, func(scan func(...interface{}) error) error {
+		vals := make([]sql.NullString, len(insertCols))
+		dest := make([]interface{}, len(insertCols)+1)
+		for i := range vals {
+			dest[i] = &vals[i]
+		}
+		var h string
+		dest[len(insertCols)] = &h
+		if err := scan(dest...); err != nil {
+			return err
+		}
+		kv := make([]sql.NullString, len(keys))
+		for i, j := range keyIdx {
+			if !vals[j].Valid {
+				return newError("sync_source_keys", "the source has a NULL in key column %q", keys[i])
+			}
+			kv[i] = vals[j]
+		}
+		k := keyOf(kv)
+		if seen[k] {
+			return newError("sync_source_keys", "the source has the duplicate key %s; key_columns must identify source rows", k)
+		}
+		seen[k] = true
+		th, ok := target[k]
+		switch {
+		case !ok:
+			inserts = append(inserts, vals)
+		case th != h:
+			updates = append(updates, vals)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var gone []string
+	for k := range targetKeys {
+		if !seen[k] {
+			gone = append(gone, k)
+		}
+	}
+	sort.Strings(gone)
+	deletes := make([][]sql.NullString, len(gone))
+	for i, k := range gone {
+		deletes[i] = targetKeys[k]
+	}
+
+	plan := &syncPlan{
+		Inserted: int64(len(inserts)),
+		Updated:  int64(len(updates)),
+		samples:  map[string][]interface{}{},
+	}
+	rowMap := func(vals []sql.NullString) map[string]interface{} {
+		m := make(map[string]interface{}, len(insertCols))
+		for i, c := range insertCols {
+			m[c] = nullString(vals[i])
+		}
+		return m
+	}
+	sample := func(name string, set [][]sql.NullString, f func([]sql.NullString) map[string]interface{}) {
+		rows := []interface{}{}
+		for i := 0; i < len(set) && int64(i) < opts.Sample; i++ {
+			rows = append(rows, f(set[i]))
+		}
+		plan.samples[name] = rows
+	}
+	if opts.AllowDelete {
+		plan.Deleted = int64(len(deletes))
+		sample("deleted", deletes, keyMap)
+	} else {
+		plan.Kept = int64(len(deletes))
+		sample("missing_from_source", deletes, keyMap)
+		deletes = nil
+	}
+	sample("updated", updates, rowMap)
+	sample("inserted", inserts, rowMap)
+	if opts.PlanOnly {
+		return plan, nil
+	}
+
+	where := make([]string, len(keys))
+	for i, k := range keys {
+		where[i] = fmt.Sprintf("%s = $%d::%s", pq.QuoteIdentifier(k), i+1, types[k])
+	}
+	del := fmt.Sprintf("DELETE FROM %s WHERE %s", rel.Name, strings.Join(where, " AND "))
+	for _, vals := range deletes {
+		args := make([]interface{}, len(vals))
+		for i, v := range vals {
+			args[i] = nullArg(v)
+		}
+		logSQL(del, args)
+		if _, err := dst.Exec(del, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(updates) > 0 {
+		set := make([]string, len(updateCols))
+		for i, c := range updateCols {
+			set[i] = fmt.Sprintf("%s = $%d::%s", pq.QuoteIdentifier(c), i+1, types[c])
+		}
+		where := make([]string, len(keys))
+		for i, k := range keys {
+			where[i] = fmt.Sprintf("%s = $%d::%s", pq.QuoteIdentifier(k), len(updateCols)+i+1, types[k])
+		}
+		upd := fmt.Sprintf("UPDATE %s SET %s WHERE %s", rel.Name, strings.Join(set, ", "), strings.Join(where, " AND "))
+		for _, vals := range updates {
+			args := make([]interface{}, 0, len(updateCols)+len(keys))
+			for _, c := range updateCols {
+				args = append(args, nullArg(vals[indexOf(insertCols, c)]))
+			}
+			for _, j := range keyIdx {
+				args = append(args, nullArg(vals[j]))
+			}
+			logSQL(upd, args)
+			if _, err := dst.Exec(upd, args...); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	quoted := make([]string, len(insertCols))
+	for i, c := range insertCols {
+		quoted[i] = pq.QuoteIdentifier(c)
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) ", rel.Name, strings.Join(quoted, ", "))
+	if overriding {
+		prefix += "OVERRIDING SYSTEM VALUE "
+	}
+	perBatch := maxBindParams / len(insertCols)
+	if perBatch > importBatchRows {
+		perBatch = importBatchRows
+	}
+	for start := 0; start < len(inserts); start += perBatch {
+		end := start + perBatch
+		if end > len(inserts) {
+			end = len(inserts)
+		}
+		var args []interface{}
+		values := make([]string, 0, end-start)
+		for _, vals := range inserts[start:end] {
+			ph := make([]string, len(vals))
+			for i, v := range vals {
+				args = append(args, nullArg(v))
+				ph[i] = "$" + strconv.Itoa(len(args)) + "::" + types[insertCols[i]]
+			}
+			values = append(values, "("+strings.Join(ph, ", ")+")")
+		}
+		logSQL(prefix+"VALUES ...", nil)
+		if _, err := dst.Exec(prefix+"VALUES "+strings.Join(values, ", "), args...); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// nullArg binds a scanned text value, NULL as nil.
+func nullArg(v sql.NullString) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return v.String
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,385 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// tableQuery is the structured SELECT table mode builds from its inputs.
+// Identifiers are always quoted and values always bound.
+type tableQuery struct {
+	Columns   []string
+	Limit     int64
+	Sample    *sampleSpec
+	Distinct  bool
+	Aggregate []aggregateSpec
+	GroupBy   []string
+	Filter    []filterSpec
+	Search    *searchSpec
+	// IncludeXmin adds the row version (xmin) as column "xmin", to be
+	// sent back as expected_version of an update
+	IncludeXmin bool
+	Lock        *lockSpec
+	// Decrypt selects its columns through pgp_sym_decrypt
+	Decrypt *columnCrypto
+
+	// GeometryFormat is how geometry and geography columns are selected
+	// (geojson, wkt or ewkb). queryTable records the columns it found in
+	// geometry, with their SRIDs, so the caller can finish the conversion.
+	GeometryFormat string
+	geometry       map[string]interface{}
+
+	// keyset pages through the relation in key order for export; nil for
+	// a plain table query.
+	keyset *keysetPage
+	// keyRange restricts the rows to one range of parallel_export.
+	keyRange *keyRange
+
+	// columnOIDs maps the relation's columns to their type OIDs, for
+	// drivers that do not report them with the result.
+	columnOIDs map[string]uint32
+}
+
+// aggregateSpec is one entry of the "aggregate" input.
+type aggregateSpec struct {
+	Fn     string `json:"fn"`
+	Column string `json:"column"`
+	As     string `json:"as"`
+}
+
+var aggregateFns = []string{"count", "count_distinct", "sum", "avg", "min", "max"}
+
+// sampleSpec is the "sample" input, translated into TABLESAMPLE.
+type sampleSpec struct {
+	Method  string   `json:"method"` // bernoulli or system
+	Percent float64  `json:"percent"`
+	Seed    *float64 `json:"seed"` // REPEATABLE(seed) when given
+}
+
+// parseColumns accepts a JSON array or a comma-separated list of names.
+func parseColumns(val string) ([]string, error) {
+	var cols []string
+	if strings.HasPrefix(val, "[") {
+		if err := json.Unmarshal([]byte(val), &cols); err != nil {
+			return nil, fmt.Errorf("columns must be a JSON array of strings: %v", err)
+		}
+	} else {
+		cols = strings.Split(val, ",")
+	}
+	out := make([]string, 0, len(cols))
+	for _, c := range cols {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func parseSample(val string) (*sampleSpec, error) {
+	var s sampleSpec
+	if err := json.Unmarshal([]byte(val), &s); err != nil {
+		return nil, fmt.Errorf("invalid sample: %v", err)
+	}
+	s.Method = strings.ToLower(s.Method)
+	if s.Method == "" {
+		s.Method = "bernoulli"
+	}
+	if s.Method != "bernoulli" && s.Method != "system" {
+		return nil, fmt.Errorf("sample method must be bernoulli or system")
+	}
+	if s.Percent <= 0 || s.Percent > 100 {
+		return nil, fmt.Errorf("sample percent must be greater than 0 and at most 100")
+	}
+	return &s, nil
+}
+
+func parseAggregate(val string) ([]aggregateSpec, error) {
+	var aggs []aggregateSpec
+	if err := json.Unmarshal([]byte(val), &aggs); err != nil {
+		return nil, fmt.Errorf("aggregate must be a JSON array of {fn, column, as}: %v", err)
+	}
+	for i := range aggs {
+		aggs[i].Fn = strings.ToLower(aggs[i].Fn)
+		if !containsString(aggregateFns, aggs[i].Fn) {
+			return nil, fmt.Errorf("invalid aggregate fn %q, allowed: %s", aggs[i].Fn, strings.Join(aggregateFns, ", "))
+		}
+		if aggs[i].Column == "" {
+			return nil, fmt.Errorf("aggregate %s needs a column", aggs[i].Fn)
+		}
+		if aggs[i].Column == "*" && aggs[i].Fn != "count" {
+			return nil, fmt.Errorf("only count accepts column \"*\"")
+		}
+	}
+	return aggs, nil
+}
+
+// rewritesGeometry reports whether geometry columns are converted in SQL,
+// which needs an explicit select list instead of *.
+func (t *tableQuery) rewritesGeometry() bool {
+	return len(t.geometry) > 0 && t.GeometryFormat != "ewkb"
+}
+
+// queryTable resolves name and runs the SELECT built from t against it,
+// returning the rows together with the statement and its arguments.
+func queryTable(db querier, name string, t *tableQuery) (*sql.Rows, string, []interface{}, error) {
+	rel, err := resolveRelation(db, name)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	cols, err := rel.columns(db)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	known := make([]string, len(cols))
+	t.columnOIDs = make(map[string]uint32, len(cols))
+	for i, c := range cols {
+		known[i] = c.Name
+		t.columnOIDs[c.Name] = c.TypeOID
+	}
+	t.geometry = geometryColumns(cols)
+	if err := t.Decrypt.check(db, "decrypt_columns", rel.Name, cols); err != nil {
+		return nil, "", nil, err
+	}
+	if t.Search != nil && t.Search.Mode == "trgm" {
+		if err := checkTrgm(db); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	q, args, err := t.build(rel, known)
+	if err == nil {
+		err = checkSQLLength(q)
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	logSQL(q, args)
+	rows, err := db.Query(q, args...)
+	return rows, q, args, err
+}
+
+// build renders the SELECT for rel. known is the relation's column list.
+func (t *tableQuery) build(rel *relation, known []string) (string, []interface{}, error) {
+	var args []interface{}
+	bind := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	column := func(c string) (string, error) {
+		if !containsString(known, c) {
+			return "", fmt.Errorf("column %q does not exist in %s", c, rel.Name)
+		}
+		return pq.QuoteIdentifier(c), nil
+	}
+	columnList := func(names []string) ([]string, error) {
+		out := make([]string, len(names))
+		for i, c := range names {
+			var err error
+			if out[i], err = column(c); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	// outputList is columnList for the select list, where geometry columns
+	// are converted to the requested format and encrypted ones decrypted
+	var keyParam string
+	outputList := func(names []string) ([]string, error) {
+		out, err := columnList(names)
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range names {
+			if _, ok := t.geometry[c]; ok {
+				out[i] = geometrySelect(out[i], t.GeometryFormat)
+			}
+			if t.Decrypt.covers(c) {
+				if keyParam == "" {
+					keyParam = bind(t.Decrypt.key)
+				}
+				out[i] = t.Decrypt.decrypt(out[i], keyParam)
+			}
+		}
+		return out, nil
+	}
+
+	var selectList []string
+	groupBy, err := columnList(t.GroupBy)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(t.Aggregate) > 0 {
+		if len(t.Columns) > 0 {
+			return "", nil, fmt.Errorf("columns cannot be combined with aggregate; list grouping columns in group_by")
+		}
+		if selectList, err = outputList(t.GroupBy); err != nil {
+			return "", nil, err
+		}
+		for _, a := range t.Aggregate {
+			expr, err := a.render(column)
+			if err != nil {
+				return "", nil, err
+			}
+			selectList = append(selectList, expr)
+		}
+	} else {
+		if len(groupBy) > 0 {
+			return "", nil, fmt.Errorf("group_by requires aggregate")
+		}
+		names := t.Columns
+		if len(names) == 0 && (t.rewritesGeometry() || t.Decrypt != nil) {
+			names = known
+		}
+		if selectList, err = outputList(names); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if t.IncludeXmin {
+		if len(t.Aggregate) > 0 || t.Distinct {
+			return "", nil, fmt.Errorf("include_xmin cannot be combined with aggregate or distinct")
+		}
+		switch rel.Kind {
+		case "table", "partitioned_table", "materialized_view":
+		default:
+			return "", nil, fmt.Errorf("include_xmin is not supported on %s %s: only tables have row versions", strings.ReplaceAll(rel.Kind, "_", " "), rel.Name)
+		}
+		if len(selectList) == 0 {
+			selectList = append(selectList, "*")
+		}
+		// xmin is a system column name, so it cannot clash with a user column
+		selectList = append(selectList, "xmin::text AS xmin")
+	}
+
+	var searchWhere, keysetWhere, rangeWhere, orderBy string
+	if t.keyRange != nil {
+		if t.Search != nil || len(t.Aggregate) > 0 || t.Distinct || t.Sample != nil {
+			return "", nil, fmt.Errorf("parallel_export cannot be combined with search, aggregate, distinct or sample")
+		}
+		if rangeWhere, err = t.keyRange.render(column, bind); err != nil {
+			return "", nil, err
+		}
+	}
+	if t.keyset != nil {
+		if t.Search != nil || len(t.Aggregate) > 0 || t.Distinct || t.Sample != nil {
+			return "", nil, fmt.Errorf("export cannot be combined with search, aggregate, distinct or sample")
+		}
+		keys, err := columnList(t.keyset.Columns)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(selectList) == 0 {
+			selectList = append(selectList, "*")
+		}
+		for i, k := range keys {
+			selectList = append(selectList, fmt.Sprintf("%s::text AS %s", k, pq.QuoteIdentifier(keysetAlias(i))))
+		}
+		if t.keyset.After != nil {
+			binds := make([]string, len(t.keyset.After))
+			for i, v := range t.keyset.After {
+				binds[i] = bind(v) + "::" + t.keyset.Types[i]
+			}
+			keysetWhere = "(" + strings.Join(keys, ", ") + ") > (" + strings.Join(binds, ", ") + ")"
+		}
+		orderBy = strings.Join(keys, ", ")
+	}
+	if t.Search != nil {
+		if len(t.Aggregate) > 0 {
+			return "", nil, fmt.Errorf("search cannot be combined with aggregate")
+		}
+		var score string
+		if score, searchWhere, orderBy, err = t.Search.render(column, bind); err != nil {
+			return "", nil, err
+		}
+		if len(selectList) == 0 {
+			selectList = append(selectList, "*")
+		}
+		selectList = append(selectList, score)
+	}
+
+	cols := "*"
+	if len(selectList) > 0 {
+		cols = strings.Join(selectList, ", ")
+	}
+	q := "SELECT "
+	if t.Distinct {
+		if len(selectList) == 0 {
+			return "", nil, fmt.Errorf("distinct requires columns")
+		}
+		q += "DISTINCT "
+	}
+	q += cols + " FROM " + rel.Name
+
+	if t.Sample != nil {
+		switch rel.Kind {
+		case "table", "materialized_view", "partitioned_table":
+		default:
+			return "", nil, fmt.Errorf("sample is not supported on %s %s: TABLESAMPLE only works on tables and materialized views", strings.ReplaceAll(rel.Kind, "_", " "), rel.Name)
+		}
+		q += fmt.Sprintf(" TABLESAMPLE %s (%s)", strings.ToUpper(t.Sample.Method), bind(t.Sample.Percent))
+		if t.Sample.Seed != nil {
+			q += fmt.Sprintf(" REPEATABLE (%s)", bind(*t.Sample.Seed))
+		}
+	}
+
+	var conds []string
+	for _, f := range t.Filter {
+		cond, err := f.render(column, bind)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, cond)
+	}
+	for _, c := range []string{searchWhere, keysetWhere, rangeWhere} {
+		if c != "" {
+			conds = append(conds, c)
+		}
+	}
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if len(groupBy) > 0 {
+		q += " GROUP BY " + strings.Join(groupBy, ", ")
+	}
+	if orderBy != "" {
+		q += " ORDER BY " + orderBy
+	}
+	if t.Limit > 0 {
+		q += " LIMIT " + bind(t.Limit)
+	}
+	if t.Lock != nil {
+		if len(t.Aggregate) > 0 || t.Distinct {
+			return "", nil, fmt.Errorf("lock cannot be combined with aggregate or distinct")
+		}
+		q += " " + t.Lock.clause()
+	}
+	return q, args, nil
+}
+
+// render returns the select-list expression for the aggregate, aliased to
+// As or to fn_column.
+func (a aggregateSpec) render(column func(string) (string, error)) (string, error) {
+	arg := "*"
+	if a.Column != "*" {
+		var err error
+		if arg, err = column(a.Column); err != nil {
+			return "", err
+		}
+	}
+	alias := a.As
+	if alias == "" {
+		alias = a.Fn
+		if a.Column != "*" {
+			alias += "_" + a.Column
+		}
+	}
+	fn := strings.ToUpper(a.Fn)
+	if a.Fn == "count_distinct" {
+		fn, arg = "COUNT", "DISTINCT "+arg
+	}
+	return fmt.Sprintf("%s(%s) AS %s", fn, arg, pq.QuoteIdentifier(alias)), nil
+}
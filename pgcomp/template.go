@@ -0,0 +1,198 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// templatePlaceholder is {{name}} in the SQL of the template data_type.
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+var templateNumber = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// templateValue is one entry of the "values" input. A bare JSON value is
+// shorthand for a literal.
+type templateValue struct {
+	Kind  string      `json:"kind"` // literal (default), identifier or number
+	Value interface{} `json:"value"`
+}
+
+var templateKinds = []string{"literal", "identifier", "number"}
+
+func parseTemplateValues(val string) (map[string]templateValue, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(val), &raw); err != nil {
+		return nil, fmt.Errorf("values must be a JSON object: %v", err)
+	}
+	out := make(map[string]templateValue, len(raw))
+	for name, r := range raw {
+		dec := json.NewDecoder(bytes.NewReader(r))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("values.%s: %v", name, err)
+		}
+		tv := templateValue{Kind: "literal", Value: v}
+		if obj, ok := v.(map[string]interface{}); ok {
+			if _, hasKind := obj["kind"]; hasKind {
+				kind, _ := obj["kind"].(string)
+				tv = templateValue{Kind: strings.ToLower(kind), Value: obj["value"]}
+			}
+		}
+		if !containsString(templateKinds, tv.Kind) {
+			return nil, fmt.Errorf("values.%s: invalid kind %q, allowed: %s", name, tv.Kind, strings.Join(templateKinds, ", "))
+		}
+		out[name] = tv
+	}
+	return out, nil
+}
+
+// renderTemplate replaces every {{name}} in sql with values[name], quoted
+// for its kind, for statements that cannot take bind parameters. Values
+// are never spliced in raw: literals go through pq.QuoteLiteral,
+// identifiers through pq.QuoteIdentifier and numbers must parse as one. A
+// placeholder without a value, or a value without a placeholder, is an
+// error. So is a placeholder inside a string literal, quoted identifier,
+// dollar-quoted body or comment: the quoted value would close the
+// surrounding quotes and the rest of it would run as SQL.
+func renderTemplate(sql string, values map[string]templateValue) (string, error) {
+	if err := checkPlaceholderContext(sql); err != nil {
+		return "", err
+	}
+	used := map[string]bool{}
+	var missing []string
+	var renderErr error
+	out := templatePlaceholder.ReplaceAllStringFunc(sql, func(m string) string {
+		name := templatePlaceholder.FindStringSubmatch(m)[1]
+		v, ok := values[name]
+		if !ok {
+			if !containsString(missing, name) {
+				missing = append(missing, name)
+			}
+			return m
+		}
+		used[name] = true
+		s, err := v.render()
+		if err != nil && renderErr == nil {
+			renderErr = fmt.Errorf("values.%s: %v", name, err)
+		}
+		return s
+	})
+	if len(missing) > 0 {
+		return "", newError("template_error", "no value for placeholder(s): %s", strings.Join(missing, ", "))
+	}
+	var extra []string
+	for name := range values {
+		if !used[name] {
+			extra = append(extra, name)
+		}
+	}
+	if len(extra) > 0 {
+		sort.Strings(extra)
+		return "", newError("template_error", "value(s) without a placeholder: %s", strings.Join(extra, ", "))
+	}
+	if renderErr != nil {
+		return "", &componentError{Code: "template_error", Message: renderErr.Error()}
+	}
+	return out, nil
+}
+
+// checkPlaceholderContext refuses a template whose placeholders are not all
+// in bare SQL, finding the quoted parts the way sqlWords does.
+func checkPlaceholderContext(sql string) error {
+	r := []rune(sql)
+	// offset maps a rune index of r to the byte index of sql
+	offset := make([]int, len(r)+1)
+	for i, n := 0, 0; i < len(r); i++ {
+		offset[i] = n
+		n += utf8.RuneLen(r[i])
+	}
+	offset[len(r)] = len(sql)
+	matches := templatePlaceholder.FindAllStringSubmatchIndex(sql, -1)
+	var err error
+	scanSQL(r, func(string) {}, func(kind string, from, to int) {
+		for _, m := range matches {
+			if err == nil && m[0] < offset[to] && m[1] > offset[from] {
+				err = newError("template_error", "placeholder {{%s}} is inside a %s; put it in bare SQL, the value is quoted for its kind", sql[m[2]:m[3]], kind)
+			}
+		}
+	})
+	return err
+}
+
+// render returns v as SQL text. An array renders as a comma separated
+// list of its elements, e.g. for IN (...) or a column list.
+func (v templateValue) render() (string, error) {
+	if list, ok := v.Value.([]interface{}); ok {
+		if len(list) == 0 {
+			return "", fmt.Errorf("empty list")
+		}
+		parts := make([]string, len(list))
+		for i, e := range list {
+			s, err := templateValue{Kind: v.Kind, Value: e}.render()
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ", "), nil
+	}
+
+	switch v.Kind {
+	case "identifier":
+		s, ok := v.Value.(string)
+		if !ok || s == "" {
+			return "", fmt.Errorf("identifier must be a non-empty string")
+		}
+		// schema.name is written as two identifiers
+		parts := strings.Split(s, ".")
+		for i, p := range parts {
+			if p == "" {
+				return "", fmt.Errorf("invalid identifier %q", s)
+			}
+			parts[i] = pq.QuoteIdentifier(p)
+		}
+		return strings.Join(parts, "."), nil
+	case "number":
+		var s string
+		switch n := v.Value.(type) {
+		case json.Number:
+			s = n.String()
+		case string:
+			s = n
+		default:
+			return "", fmt.Errorf("number must be a JSON number or numeric string")
+		}
+		if !templateNumber.MatchString(s) {
+			return "", fmt.Errorf("%q is not a number", s)
+		}
+		if strings.HasPrefix(s, "-") {
+			// Parenthesized so that "x-{{n}}" cannot become a -- comment
+			return "(" + s + ")", nil
+		}
+		return s, nil
+	}
+
+	switch t := v.Value.(type) {
+	case nil:
+		return "NULL", nil
+	case bool:
+		if t {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case json.Number:
+		return pq.QuoteLiteral(t.String()), nil
+	case string:
+		return pq.QuoteLiteral(t), nil
+	}
+	b, _ := json.Marshal(v.Value)
+	return pq.QuoteLiteral(string(b)), nil
+}
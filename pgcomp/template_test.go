@@ -0,0 +1,49 @@
+package pgcomp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	inject := map[string]templateValue{"c": {Kind: "literal", Value: "; DROP TABLE t; --"}}
+	cases := []struct {
+		name   string
+		sql    string
+		values map[string]templateValue
+		want   string // rendered SQL, or the start of the error when err is set
+		err    bool
+	}{
+		{"literal in bare SQL", `COMMENT ON TABLE t IS {{c}}`, inject, `COMMENT ON TABLE t IS '; DROP TABLE t; --'`, false},
+		{"identifier and number", `CREATE INDEX ON {{tbl}} (id) WHERE qty > {{n}}`, map[string]templateValue{
+			"tbl": {Kind: "identifier", Value: "sales.orders"},
+			"n":   {Kind: "number", Value: "-5"},
+		}, `CREATE INDEX ON "sales"."orders" (id) WHERE qty > (-5)`, false},
+		{"after a closed literal", `SELECT 'a' || {{c}}`, inject, `SELECT 'a' || '; DROP TABLE t; --'`, false},
+
+		{"string literal", `COMMENT ON TABLE t IS '{{c}}'`, inject, "placeholder {{c}} is inside a string literal", true},
+		{"escape string", `COMMENT ON TABLE t IS E'x\'{{c}}'`, inject, "placeholder {{c}} is inside a string literal", true},
+		{"unterminated literal", `COMMENT ON TABLE t IS '{{c}}`, inject, "placeholder {{c}} is inside a string literal", true},
+		{"quoted identifier", `CREATE TABLE "{{c}}" (id int)`, inject, "placeholder {{c}} is inside a quoted identifier", true},
+		{"dollar-quoted body", `DO $$BEGIN RAISE NOTICE {{c}}; END$$`, inject, "placeholder {{c}} is inside a dollar-quoted body", true},
+		{"tagged dollar body", `DO $fn$BEGIN PERFORM {{c}}; END$fn$`, inject, "placeholder {{c}} is inside a dollar-quoted body", true},
+		{"line comment", "SELECT 1 -- {{c}}\n", inject, "placeholder {{c}} is inside a comment", true},
+		{"block comment", `SELECT /* {{c}} */ 1`, inject, "placeholder {{c}} is inside a comment", true},
+		{"nested block comment", `SELECT /* a /* b */ {{c}} */ 1`, inject, "placeholder {{c}} is inside a comment", true},
+
+		{"missing value", `SELECT {{a}}`, nil, "no value for placeholder(s): a", true},
+		{"extra value", `SELECT 1`, inject, "value(s) without a placeholder: c", true},
+	}
+	for _, c := range cases {
+		got, err := renderTemplate(c.sql, c.values)
+		if !c.err {
+			if err != nil || got != c.want {
+				t.Errorf("%s: got %q, %v; want %q", c.name, got, err, c.want)
+			}
+			continue
+		}
+		if errorCode(err) != "template_error" || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("%s: got %q, %v; want template_error %q", c.name, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package pgcomp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// defaultTenantPattern admits lower-case identifiers that need no quoting.
+const defaultTenantPattern = `^[a-z_][a-z0-9_]{0,62}$`
+
+// checkTenant validates the tenant input against tenant_pattern, which
+// should be anchored. The system schemas are never a tenant, whatever
+// the pattern admits.
+func checkTenant(tenant, pattern string) error {
+	if strings.HasPrefix(tenant, "pg_") || tenant == "information_schema" {
+		return fmt.Errorf("tenant %q is a system schema", tenant)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid tenant_pattern: %v", err)
+	}
+	if !re.MatchString(tenant) {
+		return fmt.Errorf("tenant %q does not match the allowed pattern %s", tenant, pattern)
+	}
+	return nil
+}
+
+// applyTenant routes the rest of the transaction tx to the tenant's
+// schema: search_path becomes the schema, then public. The schema must
+// exist, since a search_path entry that does not exist is silently
+// skipped and the statement would reach the public tables instead.
+func applyTenant(tx querier, tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = $1)", tenant).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return newError("tenant_not_found", "tenant schema %q does not exist", tenant)
+	}
+	q := "SET LOCAL search_path = " + pq.QuoteIdentifier(tenant) + ", public"
+	logSQL(q, nil)
+	_, err := tx.Exec(q)
+	return err
+}
+
+// poolDataType reports whether the data_type reads through the pool
+// instead of the request transaction: export and export_schema page
+// through the table on their own, parallel_export opens a connection per
+// worker and benchmark one per client.
+func poolDataType(dataType string) bool {
+	switch dataType {
+	case "export", "export_schema", "parallel_export", "benchmark":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestSessionContextRefused checks that role, rls_settings and tenant are
+// refused, before anything connects, by the data_types they cannot reach.
+func TestSessionContextRefused(t *testing.T) {
+	contexts := map[string]string{
+		"role":         `{"inputname":"role","compvalue":"tenant_reader"}`,
+		"rls_settings": `{"inputname":"rls_settings","compvalue":"{\"app.tenant_id\":\"7\"}"}`,
+		"tenant":       `{"inputname":"tenant","compvalue":"acme"}`,
+	}
+	for _, dataType := range []string{"export", "export_schema", "parallel_export", "benchmark", "database", "commit_prepared"} {
+		for name, param := range contexts {
+			input := `{"params":[` + conn + `,{"inputname":"data_type","compvalue":"` + dataType + `"},` + param + `]}`
+			var out bytes.Buffer
+			Run(strings.NewReader(input), &out, nil)
+			var resp Response
+			if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+				t.Fatalf("%s with %s: %v: %s", dataType, name, err, out.Bytes())
+			}
+			want := "role, rls_settings and tenant cannot be used with data_type " + dataType
+			if resp.Error != want {
+				t.Errorf("%s with %s: got %q, want %q", dataType, name, resp.Error, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+-- Fixture schema for end-to-end runs against docker-compose.yml: one row
+-- of each value shape the component normalizes, plus the edge cases
+-- (NULLs, empty arrays, NaN, the numeric precision limit), a table under
+-- a row-level security policy and an audit table.
+
+CREATE SCHEMA fixtures;
+
+CREATE TYPE fixtures.mood AS ENUM ('sad', 'ok', 'happy');
+
+CREATE TYPE fixtures.address AS (
+    street text,
+    city   text,
+    zip    varchar(10)
+);
+
+CREATE TABLE fixtures.exotic (
+    id          serial PRIMARY KEY,
+    tags        text[],
+    scores      integer[],
+    matrix      numeric[][],
+    doc         jsonb,
+    doc_text    json,
+    payload     bytea,
+    amount      numeric(38),
+    ratio       numeric(38, 10),
+    price       money,
+    measure     double precision,
+    mood        fixtures.mood,
+    moods       fixtures.mood[],
+    home        fixtures.address,
+    created_at  timestamptz,
+    local_at    timestamp,
+    due         date,
+    span        interval,
+    uid         uuid,
+    addr        inet,
+    flag        boolean
+);
+
+INSERT INTO fixtures.exotic (tags, scores, matrix, doc, doc_text, payload, amount, ratio, price,
+        measure, mood, moods, home, created_at, local_at, due, span, uid, addr, flag)
+VALUES
+    (ARRAY['a', 'b,c', 'd"e'], ARRAY[1, 2, 3], ARRAY[[1.5, 2.5], [3.5, 4.5]],
+     '{"n": 1, "nested": {"list": [1, "two", null]}}', '{"kept": "as text"}',
+     '\xdeadbeef', 12345678901234567890123456789012345678, 1234567890.0123456789, 1234.56,
+     3.14159, 'happy', ARRAY['sad', 'ok']::fixtures.mood[], ROW('Main St 1', 'Amsterdam', '1011AB'),
+     '2026-03-29 02:30:00+02', '2026-03-29 02:30:00', '2026-02-28', '1 day 02:03:04',
+     'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', '192.168.0.1/24', true),
+    ('{}', '{}', '{}', 'null', '[]', '', -99999999999999999999999999999999999999, 0, -0.01,
+     'NaN', 'sad', '{}', ROW(NULL, 'Utrecht', NULL), 'infinity', '-infinity', '0001-01-01',
+     '-1 mon', NULL, '::1', false),
+    (NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL,
+     NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL);
+
+CREATE TABLE fixtures.parent (
+    id   integer PRIMARY KEY,
+    code text NOT NULL UNIQUE CHECK (code <> '')
+);
+
+CREATE TABLE fixtures.child (
+    id        integer PRIMARY KEY,
+    parent_id integer NOT NULL REFERENCES fixtures.parent (id)
+);
+
+INSERT INTO fixtures.parent VALUES (1, 'one'), (2, 'two');
+INSERT INTO fixtures.child VALUES (10, 1);
+
+-- Row-level security keyed on app.tenant_id. The compose user is a
+-- superuser and bypasses policies, so requests SET ROLE to
+-- fixtures_tenant to be subject to them. Roles outlive the schema, so the
+-- role is only created once. Once set in a session, app.tenant_id reads
+-- back as '' rather than NULL after its transaction.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'fixtures_tenant') THEN
+        CREATE ROLE fixtures_tenant NOLOGIN;
+    END IF;
+END
+$$;
+
+CREATE TABLE fixtures.ledger (
+    id        integer PRIMARY KEY,
+    tenant_id integer NOT NULL,
+    amount    numeric(12, 2) NOT NULL
+);
+
+ALTER TABLE fixtures.ledger ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY ledger_tenant ON fixtures.ledger
+    USING (tenant_id = NULLIF(current_setting('app.tenant_id', true), '')::integer);
+
+GRANT USAGE ON SCHEMA fixtures TO fixtures_tenant;
+GRANT SELECT ON fixtures.ledger TO fixtures_tenant;
+
+INSERT INTO fixtures.ledger VALUES (1, 1, 10.00), (2, 1, 20.00), (3, 2, 30.00), (4, 3, 40.00);
+
+-- The table the audit input writes to, with the columns auditSpec needs.
+CREATE TABLE fixtures.audit_log (
+    id              bigserial PRIMARY KEY,
+    executed_at     timestamptz NOT NULL,
+    actor           text NOT NULL,
+    context         jsonb,
+    data_type       text,
+    object_name     text,
+    sql_fingerprint text,
+    params_hash     text,
+    rows_affected   bigint,
+    duration_ms     bigint,
+    outcome         text NOT NULL,
+    error           text
+);
@@ -0,0 +1,154 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// topQueriesOptions are the inputs of the top_queries data_type.
+type topQueriesOptions struct {
+	OrderBy string // total_time (default), mean_time, calls or rows
+	Limit   int64
+	Reset   bool // call pg_stat_statements_reset() after reading
+}
+
+var topQueryOrders = []string{"total_time", "mean_time", "calls", "rows"}
+
+// statStatementsColumns maps the reported names to the pg_stat_statements
+// columns that hold them, newest name first: PostgreSQL 13 split
+// total_time into planning and execution time, and 17 renamed the block
+// timing columns.
+var statStatementsColumns = []struct {
+	Name    string
+	Sources []string
+}{
+	{"total_time_ms", []string{"total_exec_time", "total_time"}},
+	{"mean_time_ms", []string{"mean_exec_time", "mean_time"}},
+	{"min_time_ms", []string{"min_exec_time", "min_time"}},
+	{"max_time_ms", []string{"max_exec_time", "max_time"}},
+	{"stddev_time_ms", []string{"stddev_exec_time", "stddev_time"}},
+	{"total_plan_time_ms", []string{"total_plan_time"}},
+	{"blk_read_time_ms", []string{"shared_blk_read_time", "blk_read_time"}},
+	{"blk_write_time_ms", []string{"shared_blk_write_time", "blk_write_time"}},
+}
+
+// topQueries reads pg_stat_statements for the current database and
+// returns the top statements under the same column names on every
+// server version. Columns a version lacks are null.
+func topQueries(db querier, opts topQueriesOptions) (interface{}, error) {
+	if opts.OrderBy == "" {
+		opts.OrderBy = "total_time"
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 20
+	}
+
+	var schema, version string
+	err := db.QueryRow(`SELECT n.nspname::text, e.extversion FROM pg_extension e
+		JOIN pg_namespace n ON n.oid = e.extnamespace WHERE e.extname = 'pg_stat_statements'`).Scan(&schema, &version)
+	if err == sql.ErrNoRows {
+		return nil, newError("extension_missing", "pg_stat_statements is not installed in this database: add it to shared_preload_libraries in postgresql.conf, restart the server, then run CREATE EXTENSION pg_stat_statements (data_type extensions, operation create)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	view := pq.QuoteIdentifier(schema) + ".pg_stat_statements"
+
+	rows, err := db.Query("SELECT attname::text FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped", view)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	selectList := []string{"s.queryid::text", "s.userid::regrole::text", "s.query", "s.calls", "s.rows", "s.shared_blks_hit", "s.shared_blks_read"}
+	exprs := map[string]string{}
+	for _, c := range statStatementsColumns {
+		expr := "NULL::float8"
+		for _, src := range c.Sources {
+			if have[src] {
+				expr = "s." + src + "::float8"
+				break
+			}
+		}
+		exprs[c.Name] = expr
+		selectList = append(selectList, expr)
+	}
+	order := map[string]string{
+		"total_time": exprs["total_time_ms"],
+		"mean_time":  exprs["mean_time_ms"],
+		"calls":      "s.calls",
+		"rows":       "s.rows",
+	}[opts.OrderBy]
+
+	q := fmt.Sprintf(`SELECT %s FROM %s s
+		WHERE s.dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+		ORDER BY %s DESC NULLS LAST LIMIT $1`, strings.Join(selectList, ", "), view, order)
+	logSQL(q, nil)
+	rows, err = db.Query(q, opts.Limit)
+	if err != nil {
+		if se := asServerError(err); se != nil && se.Code == "55000" {
+			return nil, newError("extension_not_loaded", "pg_stat_statements is installed but not loaded: add it to shared_preload_libraries in postgresql.conf and restart the server")
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var queryID, user sql.NullString
+		var query string
+		var calls, nrows, hit, read int64
+		times := make([]sql.NullFloat64, len(statStatementsColumns))
+		dest := []interface{}{&queryID, &user, &query, &calls, &nrows, &hit, &read}
+		for i := range times {
+			dest = append(dest, &times[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		r := map[string]interface{}{
+			"queryid":          nullString(queryID),
+			"user":             nullString(user),
+			"query":            query,
+			"calls":            calls,
+			"rows":             nrows,
+			"shared_blks_hit":  hit,
+			"shared_blks_read": read,
+		}
+		for i, c := range statStatementsColumns {
+			r[c.Name] = nil
+			if times[i].Valid {
+				r[c.Name] = times[i].Float64
+			}
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	res := map[string]interface{}{"extension_version": version, "order_by": opts.OrderBy, "statements": out, "reset": false}
+	if opts.Reset {
+		if _, err := db.Exec("SELECT " + pq.QuoteIdentifier(schema) + ".pg_stat_statements_reset()"); err != nil {
+			return nil, fmt.Errorf("statements were read but could not be reset: %w", err)
+		}
+		res["reset"] = true
+	}
+	return res, nil
+}
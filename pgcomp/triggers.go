@@ -0,0 +1,154 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var triggerEnabled = map[string]string{"O": "enabled", "D": "disabled", "R": "replica", "A": "always"}
+
+// manageTriggers implements the list_triggers data_type: listing the user
+// triggers of a table, or enabling and disabling one of them. name may
+// also be ALL or USER, as in ALTER TABLE ... DISABLE TRIGGER.
+func manageTriggers(db querier, table, operation, name, confirm string) (interface{}, error) {
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	switch operation {
+	case "", "list":
+		return listTriggers(db, rel)
+	case "enable", "disable":
+	default:
+		return nil, fmt.Errorf("unknown list_triggers operation %q (allowed: list, enable, disable)", operation)
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("name is required for trigger %s", operation)
+	}
+	if confirm != name {
+		return nil, fmt.Errorf("trigger %s needs confirm set to the trigger name (%s)", operation, name)
+	}
+	target := pq.QuoteIdentifier(name)
+	if up := strings.ToUpper(name); up == "ALL" || up == "USER" {
+		target = up
+	} else {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = $1 AND tgname = $2 AND NOT tgisinternal)", rel.OID, name).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("trigger %q does not exist on %s", name, rel.Name)
+		}
+	}
+
+	stmt := fmt.Sprintf("ALTER TABLE %s %s TRIGGER %s", rel.Name, strings.ToUpper(operation), target)
+	logSQL(stmt, nil)
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"table": rel.Name, "trigger": name, operation + "d": true, "sql": stmt}, nil
+}
+
+func listTriggers(db querier, rel *relation) (interface{}, error) {
+	rows, err := db.Query(`SELECT t.tgname, t.tgtype, t.tgenabled::text, t.tgfoid::regproc::text, pg_get_triggerdef(t.oid)
+		FROM pg_trigger t
+		WHERE t.tgrelid = $1 AND NOT t.tgisinternal
+		ORDER BY t.tgname`, rel.OID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	triggers := []map[string]interface{}{}
+	for rows.Next() {
+		var name, enabled, function, def string
+		var tgtype int
+		if err := rows.Scan(&name, &tgtype, &enabled, &function, &def); err != nil {
+			return nil, err
+		}
+		// tgtype bits from the server's pg_trigger.h
+		timing := "AFTER"
+		switch {
+		case tgtype&2 != 0:
+			timing = "BEFORE"
+		case tgtype&64 != 0:
+			timing = "INSTEAD OF"
+		}
+		level := "STATEMENT"
+		if tgtype&1 != 0 {
+			level = "ROW"
+		}
+		var events []string
+		for _, e := range []struct {
+			bit  int
+			name string
+		}{{4, "INSERT"}, {16, "UPDATE"}, {8, "DELETE"}, {32, "TRUNCATE"}} {
+			if tgtype&e.bit != 0 {
+				events = append(events, e.name)
+			}
+		}
+		triggers = append(triggers, map[string]interface{}{
+			"name":       name,
+			"timing":     timing,
+			"events":     events,
+			"level":      level,
+			"function":   function,
+			"enabled":    triggerEnabled[enabled],
+			"definition": def,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"table": rel.Name, "triggers": triggers}, nil
+}
+
+var constraintTypes = map[string]string{
+	"c": "check", "u": "unique", "x": "exclusion", "p": "primary_key", "f": "foreign_key", "t": "trigger", "n": "not_null",
+}
+
+// listConstraints returns the constraints of a table with their
+// definitions as pg_get_constraintdef renders them.
+func listConstraints(db querier, table string) (interface{}, error) {
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT conname, contype::text, pg_get_constraintdef(oid), condeferrable, convalidated
+		FROM pg_constraint
+		WHERE conrelid = $1
+		ORDER BY contype, conname`, rel.OID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	constraints := []map[string]interface{}{}
+	for rows.Next() {
+		var name, typ string
+		var def sql.NullString
+		var deferrable, validated bool
+		if err := rows.Scan(&name, &typ, &def, &deferrable, &validated); err != nil {
+			return nil, err
+		}
+		kind := constraintTypes[typ]
+		if kind == "" {
+			kind = typ
+		}
+		constraints = append(constraints, map[string]interface{}{
+			"name":       name,
+			"type":       kind,
+			"definition": nullString(def),
+			"deferrable": deferrable,
+			"validated":  validated,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"table": rel.Name, "constraints": constraints}, nil
+}
@@ -0,0 +1,162 @@
+package pgcomp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// requestTx is the transaction a request runs in: a plain *sql.Tx, or a
+// preparedTx when prepare_as asks for two-phase commit.
+type requestTx interface {
+	querier
+	Commit() error
+	Rollback() error
+}
+
+// maxGIDLength is GIDSIZE - 1 from the server's twophase.h.
+const maxGIDLength = 199
+
+// preparedTx runs a transaction on a dedicated connection and ends it with
+// PREPARE TRANSACTION instead of COMMIT. database/sql's Tx cannot be used:
+// the drivers refuse to commit once PREPARE has ended the transaction.
+type preparedTx struct {
+	conn *sql.Conn
+	gid  string
+	done bool
+}
+
+// beginPrepared opens a transaction that Commit will prepare as gid.
+func beginPrepared(db *sql.DB, gid string) (*preparedTx, error) {
+	if err := validateGID(gid); err != nil {
+		return nil, err
+	}
+	var max int
+	if err := db.QueryRow("SELECT current_setting('max_prepared_transactions')::int").Scan(&max); err != nil {
+		return nil, err
+	}
+	if max == 0 {
+		return nil, newError("prepared_transactions_disabled", "prepare_as needs max_prepared_transactions > 0 on the server (it is 0)")
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &preparedTx{conn: conn, gid: gid}, nil
+}
+
+func (t *preparedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (t *preparedTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (t *preparedTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// Commit prepares the transaction; it stays open on the server until
+// commit_prepared or rollback_prepared ends it.
+func (t *preparedTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	defer t.conn.Close()
+	stmt := "PREPARE TRANSACTION " + pq.QuoteLiteral(t.gid)
+	logSQL(stmt, nil)
+	if _, err := t.Exec(stmt); err != nil {
+		t.Exec("ROLLBACK")
+		return err
+	}
+	return nil
+}
+
+func (t *preparedTx) Rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	defer t.conn.Close()
+	_, err := t.Exec("ROLLBACK")
+	return err
+}
+
+func validateGID(gid string) error {
+	if gid == "" {
+		return fmt.Errorf("gid is required")
+	}
+	if len(gid) > maxGIDLength {
+		return fmt.Errorf("gid is longer than %d bytes", maxGIDLength)
+	}
+	for _, r := range gid {
+		if r == 0 {
+			return fmt.Errorf("gid cannot contain NUL")
+		}
+	}
+	return nil
+}
+
+// finishPrepared implements commit_prepared and rollback_prepared. Neither
+// statement can run inside a transaction block, so db must not be one.
+func finishPrepared(db querier, dataType, gid string) (interface{}, error) {
+	if err := validateGID(gid); err != nil {
+		return nil, err
+	}
+	verb, key := "COMMIT PREPARED ", "committed"
+	if dataType == "rollback_prepared" {
+		verb, key = "ROLLBACK PREPARED ", "rolled_back"
+	}
+	stmt := verb + pq.QuoteLiteral(gid)
+	logSQL(stmt, nil)
+	if _, err := db.Exec(stmt); err != nil {
+		if sqlState(err) == "42704" {
+			return nil, newError("prepared_transaction_not_found", "no prepared transaction with gid %q", gid)
+		}
+		return nil, err
+	}
+	return map[string]interface{}{"gid": gid, key: true}, nil
+}
+
+// listPrepared returns the transactions waiting in pg_prepared_xacts.
+func listPrepared(db querier) (interface{}, error) {
+	rows, err := db.Query(`SELECT gid, transaction::text, prepared, owner::text, database::text
+		FROM pg_prepared_xacts ORDER BY prepared`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		var gid, xid, owner, database string
+		var prepared sql.NullTime
+		if err := rows.Scan(&gid, &xid, &prepared, &owner, &database); err != nil {
+			return nil, err
+		}
+		p := map[string]interface{}{"gid": gid, "transaction": xid, "owner": owner, "database": database, "prepared": nil}
+		if prepared.Valid {
+			p["prepared"] = prepared.Time
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// outsideTransaction reports whether the data_type runs statements that
+// cannot be executed inside a transaction block.
+func outsideTransaction(dataType string) bool {
+	switch dataType {
+	case "database", "commit_prepared", "rollback_prepared":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package pgcomp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dataTypes lists every data_type the dispatcher in main understands.
+var dataTypes = []string{
+	"query", "table", "stored_procedure", "stored_function",
+	"estimate_count", "exists", "matview_refresh", "list_views",
+	"extensions", "roles", "database", "replication_status",
+	"benchmark", "largeobject", "list_enum",
+	"merge", "partition", "commit_prepared", "rollback_prepared", "list_prepared",
+	"cdc_peek", "cdc_advance", "list_triggers", "list_constraints",
+	"import", "generate", "connection_info", "export",
+	"fingerprint", "transaction", "insert", "update",
+	"describe", "delete", "dequeue", "ack", "nack",
+	"top_queries", "index_report", "template",
+	"comments", "schema_diff", "copy_between", "fdw",
+	"verify_copy", "staged_load", "duplicates", "orphans",
+	"verify_signature", "parallel_export", "wal", "export_schema", "restore", "sync", "fanout", "capabilities", "check_encoding",
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// parsePort validates the port input; an empty value means the default.
+func parsePort(val string) (int, error) {
+	if val == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(val)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port must be a number between 1 and 65535, got %q", val)
+	}
+	return port, nil
+}
+
+// parseCount reads the non-negative integer input name; "" is 0. A value
+// with anything but digits, such as "10x", is refused rather than read in
+// part.
+func parseCount(name, val string) (int64, error) {
+	if val == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, val)
+	}
+	return n, nil
+}
+
+func parseEnvelopeVersion(val string) (int, error) {
+	if val == "" {
+		return 1, nil
+	}
+	v, err := strconv.Atoi(val)
+	if err != nil || v < 1 || v > currentEnvelopeVersion {
+		return 1, fmt.Errorf("envelope_version must be between 1 and %d, got %q", currentEnvelopeVersion, val)
+	}
+	return v, nil
+}
+
+// strictProblems lists everything strict mode rejects about a request:
+// unknown or repeated input names and enumerated inputs outside their set.
+func strictProblems(unknown, duplicates []string, dataType, sslmode string) []string {
+	var problems []string
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("unknown input %q", name))
+	}
+	for _, name := range duplicates {
+		problems = append(problems, fmt.Sprintf("duplicate input %q", name))
+	}
+	if !containsString(dataTypes, dataType) {
+		problems = append(problems, fmt.Sprintf("invalid data_type %q, allowed: %s", dataType, strings.Join(dataTypes, ", ")))
+	}
+	if !containsString(sslModes, sslmode) {
+		problems = append(problems, fmt.Sprintf("invalid sslmode %q, allowed: %s", sslmode, strings.Join(sslModes, ", ")))
+	}
+	return problems
+}
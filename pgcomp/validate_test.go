@@ -0,0 +1,90 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// runParams runs one request made of params, in order, and decodes the
+// response.
+func runParams(t *testing.T, params ...string) Response {
+	t.Helper()
+	var in Request
+	for i := 0; i+1 < len(params); i += 2 {
+		in.Params = append(in.Params, Param{InputName: params[i], CompValue: params[i+1]})
+	}
+	raw, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	Run(bytes.NewReader(raw), &out, nil)
+	var resp Response
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, out.String())
+	}
+	return resp
+}
+
+func TestParseCount(t *testing.T) {
+	for _, c := range []struct {
+		val  string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"250", 250, true},
+		{"abc", 0, false},
+		{"10x", 0, false},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+	} {
+		n, err := parseCount("limit", c.val)
+		if (err == nil) != c.ok || n != c.want {
+			t.Errorf("parseCount(%q) = %d, %v; want %d, ok %v", c.val, n, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	for _, c := range []struct {
+		val  string
+		want int
+		ok   bool
+	}{
+		{"", 0, true},
+		{"5432", 5432, true},
+		{"0", 0, false},
+		{"65536", 0, false},
+		{"54x32", 0, false},
+	} {
+		n, err := parsePort(c.val)
+		if (err == nil) != c.ok || n != c.want {
+			t.Errorf("parsePort(%q) = %d, %v; want %d, ok %v", c.val, n, err, c.want, c.ok)
+		}
+	}
+}
+
+// Malformed numbers are refused before anything is connected, whichever
+// input carries them.
+func TestNumericInputsRefused(t *testing.T) {
+	for _, name := range []string{"limit", "slow_ms", "iterations", "warmup", "concurrency",
+		"statement_cache", "cache_ttl_seconds", "exact_if_under", "post_limit", "port"} {
+		for _, val := range []string{"abc", "10x"} {
+			out := runParams(t, "data_type", "table", name, val)
+			if !strings.Contains(out.Error, name) || !strings.Contains(out.Error, val) {
+				t.Errorf("%s=%s: error %q does not name the input and value", name, val, out.Error)
+			}
+		}
+	}
+}
+
+func TestStrictRejectsUnknownInputs(t *testing.T) {
+	out := runParams(t, "strict", "true", "data_tpye", "table")
+	if !strings.Contains(out.Error, "data_tpye") {
+		t.Errorf("error %q does not name the unknown input", out.Error)
+	}
+}
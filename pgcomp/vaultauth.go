@@ -0,0 +1,169 @@
+package pgcomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// vaultConfig holds the inputs of auth_method vault: where Vault is, which
+// database secrets engine role to ask, and how to obtain a Vault token.
+type vaultConfig struct {
+	Addr        string // vault_addr, or VAULT_ADDR
+	Mount       string // database secrets engine mount, default "database"
+	Role        string
+	TokenSource string // env (VAULT_TOKEN), file or kubernetes
+	TokenFile   string // default ~/.vault-token
+	AuthRole    string // kubernetes auth role, default Role
+}
+
+const kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// vaultCredentials asks Vault's database secrets engine for a fresh
+// username and password. Each invocation is a single request, so the
+// lease is never renewed; it simply expires after lease_duration.
+func vaultCredentials(cfg vaultConfig) (string, string, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Addr == "" || cfg.Role == "" {
+		return "", "", newError("vault_config", "vault_addr and vault_role are required for auth_method vault")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = "database"
+	}
+	token, err := vaultToken(cfg)
+	if err != nil {
+		return "", "", err
+	}
+
+	var creds struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Data          struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+	path := strings.Trim(cfg.Mount, "/") + "/creds/" + url.PathEscape(cfg.Role)
+	if err := vaultCall(cfg.Addr, http.MethodGet, path, token, nil, &creds); err != nil {
+		return "", "", err
+	}
+	if creds.LeaseDuration <= 0 {
+		return "", "", newError("vault_lease_expired", "vault issued credentials for role %q with an expired lease", cfg.Role)
+	}
+	if creds.Data.Username == "" {
+		return "", "", newError("vault_error", "vault response for role %q has no username", cfg.Role)
+	}
+	logger.Info("vault credentials issued", "role", cfg.Role, "lease_id", creds.LeaseID, "lease_seconds", creds.LeaseDuration)
+	return creds.Data.Username, creds.Data.Password, nil
+}
+
+// vaultToken returns the token used to read credentials. The kubernetes
+// source logs in with the pod's service account token.
+func vaultToken(cfg vaultConfig) (string, error) {
+	switch cfg.TokenSource {
+	case "", "env":
+		if t := os.Getenv("VAULT_TOKEN"); t != "" {
+			return t, nil
+		}
+		return "", newError("vault_auth_failed", "VAULT_TOKEN is not set")
+	case "file":
+		path := cfg.TokenFile
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", newError("vault_auth_failed", "no vault_token_file and no home directory: %v", err)
+			}
+			path = filepath.Join(home, ".vault-token")
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return "", newError("vault_auth_failed", "failed to read vault token file: %v", err)
+		}
+		return strings.TrimSpace(string(raw)), nil
+	case "kubernetes":
+		jwt, err := os.ReadFile(kubernetesTokenPath)
+		if err != nil {
+			return "", newError("vault_auth_failed", "failed to read service account token: %v", err)
+		}
+		role := cfg.AuthRole
+		if role == "" {
+			role = cfg.Role
+		}
+		var login struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		body := map[string]string{"role": role, "jwt": strings.TrimSpace(string(jwt))}
+		if err := vaultCall(cfg.Addr, http.MethodPost, "auth/kubernetes/login", "", body, &login); err != nil {
+			return "", err
+		}
+		if login.Auth.ClientToken == "" {
+			return "", newError("vault_auth_failed", "vault kubernetes login returned no token")
+		}
+		return login.Auth.ClientToken, nil
+	}
+	return "", newError("vault_config", "vault_token_source must be one of: env, file, kubernetes")
+}
+
+// vaultCall performs one Vault API request and decodes the JSON response
+// into out. Transport failures, permission errors and other non-2xx
+// answers get distinct codes.
+func vaultCall(addr, method, path, token string, body, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(addr, "/")+"/v1/"+path, rd)
+	if err != nil {
+		return newError("vault_config", "invalid vault_addr: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return newError("vault_unreachable", "failed to reach vault: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return newError("vault_unreachable", "failed to read vault response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(raw, &verr)
+		msg := strings.Join(verr.Errors, "; ")
+		if msg == "" {
+			msg = resp.Status
+		}
+		code := "vault_error"
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+			code = "vault_auth_failed"
+		}
+		return newError(code, "vault %s %s: %s", method, path, msg)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return newError("vault_error", "failed to parse vault response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package pgcomp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// verifyCopyOptions are the inputs of the verify_copy data_type.
+type verifyCopyOptions struct {
+	Target     string // the second table, on the second connection when given
+	KeyColumns []string
+	Buckets    int   // 0 compares the tables as a whole
+	Report     int64 // how many differing buckets to return, default 20
+}
+
+// tableChecksum is the count and content checksum of a table, or of one
+// bucket of it.
+type tableChecksum struct {
+	Rows int64
+	Sum  string
+}
+
+// verifyCopy answers the verify_copy data_type: it compares the row count
+// and a checksum of the content of table on src with opts.Target on dst.
+// The checksum is the sum of the first 64 bits of the md5 of every row's
+// text, so it does not depend on row order and all the work stays in SQL.
+// When the tables differ and buckets is set, both are split by a hash of
+// the key columns and the buckets that differ are reported with the
+// condition selecting their rows. Values are compared as text, so both
+// sessions need the same TimeZone and DateStyle.
+func verifyCopy(src, dst querier, table string, opts verifyCopyOptions) (interface{}, error) {
+	if opts.Target == "" {
+		return nil, fmt.Errorf("target_table is required for verify_copy")
+	}
+	if opts.Buckets < 0 {
+		return nil, fmt.Errorf("buckets must not be negative")
+	}
+	if opts.Buckets > 0 && len(opts.KeyColumns) == 0 {
+		return nil, fmt.Errorf("key_columns is required to compare by buckets")
+	}
+	if opts.Report <= 0 {
+		opts.Report = 20
+	}
+
+	a, err := resolveRelation(src, table)
+	if err != nil {
+		return nil, err
+	}
+	b, err := resolveRelation(dst, opts.Target)
+	if err != nil {
+		return nil, fmt.Errorf("target_table: %w", err)
+	}
+	colsA, err := a.columns(src)
+	if err != nil {
+		return nil, err
+	}
+	colsB, err := b.columns(dst)
+	if err != nil {
+		return nil, err
+	}
+	have := make([]string, len(colsB))
+	for i, c := range colsB {
+		have[i] = c.Name
+	}
+	var names, missing []string
+	for _, c := range colsA {
+		if containsString(have, c.Name) {
+			names = append(names, c.Name)
+		} else {
+			missing = append(missing, c.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("column(s) of %s missing from %s: %s", a.Name, b.Name, strings.Join(missing, ", "))
+	}
+	for _, k := range opts.KeyColumns {
+		if !containsString(names, k) {
+			return nil, fmt.Errorf("key column %q does not exist in %s", k, a.Name)
+		}
+	}
+
+	row := checksumRow(names)
+	whole := func(db querier, rel *relation) (tableChecksum, error) {
+		var c tableChecksum
+		q := fmt.Sprintf("SELECT count(*), %s FROM %s", checksumExpr(row), rel.Name)
+		logSQL(q, nil)
+		err := db.QueryRow(q).Scan(&c.Rows, &c.Sum)
+		return c, err
+	}
+	sumA, err := whole(src, a)
+	if err != nil {
+		return nil, err
+	}
+	sumB, err := whole(dst, b)
+	if err != nil {
+		return nil, fmt.Errorf("target_table: %w", err)
+	}
+
+	res := map[string]interface{}{
+		"source":            map[string]interface{}{"table": a.Name, "rows": sumA.Rows, "checksum": sumA.Sum},
+		"target":            map[string]interface{}{"table": b.Name, "rows": sumB.Rows, "checksum": sumB.Sum},
+		"columns":           len(names),
+		"counts_equal":      sumA.Rows == sumB.Rows,
+		"equal":             sumA == sumB,
+		"differing_buckets": []map[string]interface{}{},
+	}
+	if sumA == sumB || opts.Buckets == 0 {
+		return res, nil
+	}
+
+	bucket := bucketExpr(opts.KeyColumns, opts.Buckets)
+	byBucket := func(db querier, rel *relation) (map[int64]tableChecksum, error) {
+		q := fmt.Sprintf("SELECT %s AS bucket, count(*), %s FROM %s GROUP BY 1", bucket, checksumExpr(row), rel.Name)
+		logSQL(q, nil)
+		rows, err := db.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		out := map[int64]tableChecksum{}
+		for rows.Next() {
+			var n int64
+			var c tableChecksum
+			if err := rows.Scan(&n, &c.Rows, &c.Sum); err != nil {
+				return nil, err
+			}
+			out[n] = c
+		}
+		return out, rows.Err()
+	}
+	bucketsA, err := byBucket(src, a)
+	if err != nil {
+		return nil, err
+	}
+	bucketsB, err := byBucket(dst, b)
+	if err != nil {
+		return nil, fmt.Errorf("target_table: %w", err)
+	}
+
+	var differing []int64
+	for n := int64(0); n < int64(opts.Buckets); n++ {
+		if bucketsA[n] != bucketsB[n] {
+			differing = append(differing, n)
+		}
+	}
+	report := make([]map[string]interface{}, 0)
+	for _, n := range differing {
+		if int64(len(report)) >= opts.Report {
+			break
+		}
+		report = append(report, map[string]interface{}{
+			"bucket":      n,
+			"source_rows": bucketsA[n].Rows,
+			"target_rows": bucketsB[n].Rows,
+			"where":       fmt.Sprintf("%s = %d", bucket, n),
+		})
+	}
+	res["buckets"] = opts.Buckets
+	res["differing_bucket_count"] = len(differing)
+	res["differing_buckets"] = report
+	return res, nil
+}
+
+// checksumRow is the row constructor over names, in that order on both
+// sides so column order in the tables does not matter.
+func checksumRow(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = pq.QuoteIdentifier(n)
+	}
+	return "ROW(" + strings.Join(quoted, ", ") + ")"
+}
+
+func checksumExpr(row string) string {
+	return fmt.Sprintf("COALESCE(sum(('x' || substr(md5(%s::text), 1, 16))::bit(64)::bigint), 0)::text", row)
+}
+
+// bucketExpr assigns a row to one of n buckets by the md5 of its key, the
+// same on every server version and platform.
+func bucketExpr(keys []string, n int) string {
+	return fmt.Sprintf("(('x' || substr(md5(%s::text), 1, 8))::bit(32)::bigint %% %d)", checksumRow(keys), n)
+}
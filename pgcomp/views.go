@@ -0,0 +1,78 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// refreshMatview runs REFRESH MATERIALIZED VIEW on name and reports how long
+// it took.
+func refreshMatview(db querier, name string, concurrently bool) (interface{}, error) {
+	rel, err := resolveRelation(db, name)
+	if err != nil {
+		return nil, err
+	}
+	if rel.Kind != "materialized_view" {
+		return nil, fmt.Errorf("%s is a %s, not a materialized view", rel.Name, rel.Kind)
+	}
+
+	stmt := "REFRESH MATERIALIZED VIEW "
+	if concurrently {
+		stmt += "CONCURRENTLY "
+	}
+	stmt += rel.Name
+
+	start := time.Now()
+	if _, err := db.Exec(stmt); err != nil {
+		if concurrently && sqlState(err) == "55000" {
+			return nil, fmt.Errorf("%s cannot be refreshed concurrently: it needs a unique index without a WHERE clause covering all rows; create one or refresh without concurrently", rel.Name)
+		}
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"materialized_view": rel.Name,
+		"concurrently":      concurrently,
+		"duration_ms":       time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// listViews returns the views and materialized views visible in the
+// database, optionally restricted to one schema, with their definitions.
+func listViews(db querier, schema string) (interface{}, error) {
+	rows, err := db.Query(`SELECT n.nspname, c.relname,
+			CASE c.relkind WHEN 'm' THEN 'materialized_view' ELSE 'view' END,
+			pg_get_viewdef(c.oid, true),
+			CASE WHEN c.relkind = 'm' THEN c.relispopulated END
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm')
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND ($1 = '' OR n.nspname = $1)
+		ORDER BY n.nspname, c.relname`, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var nsp, name, kind, def string
+		var populated sql.NullBool
+		if err := rows.Scan(&nsp, &name, &kind, &def, &populated); err != nil {
+			return nil, err
+		}
+		v := map[string]interface{}{
+			"schema":     nsp,
+			"name":       name,
+			"kind":       kind,
+			"definition": def,
+		}
+		if populated.Valid {
+			v["populated"] = populated.Bool
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
@@ -0,0 +1,128 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// walFuncs are the WAL function names of one server version. PostgreSQL
+// 10 renamed xlog to wal and location to lsn throughout.
+type walFuncs struct {
+	Current, Replay, Receive, Diff, Switch, FileName string
+}
+
+func walFunctions(version int) walFuncs {
+	if version < 100000 {
+		return walFuncs{
+			Current:  "pg_current_xlog_location",
+			Replay:   "pg_last_xlog_replay_location",
+			Receive:  "pg_last_xlog_receive_location",
+			Diff:     "pg_xlog_location_diff",
+			Switch:   "pg_switch_xlog",
+			FileName: "pg_xlogfile_name",
+		}
+	}
+	return walFuncs{
+		Current:  "pg_current_wal_lsn",
+		Replay:   "pg_last_wal_replay_lsn",
+		Receive:  "pg_last_wal_receive_lsn",
+		Diff:     "pg_wal_lsn_diff",
+		Switch:   "pg_switch_wal",
+		FileName: "pg_walfile_name",
+	}
+}
+
+// manageWAL implements the wal data_type: current (the write position on
+// a primary, the replay position on a standby), diff (the bytes from lsn
+// to upto_lsn, by default the current position) and switch (to a new WAL
+// file, with confirm set to "switch"), calling the functions under the
+// names the connected server knows.
+func manageWAL(db querier, operation, lsn, uptoLSN, confirm string) (interface{}, error) {
+	switch operation {
+	case "", "current", "diff", "switch":
+	default:
+		return nil, fmt.Errorf("unknown wal operation %q (allowed: current, diff, switch)", operation)
+	}
+	version, err := serverVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	fn := walFunctions(version)
+	var inRecovery bool
+	if err := db.QueryRow("SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return nil, err
+	}
+	position := fn.Current + "()"
+	if inRecovery {
+		position = fn.Replay + "()"
+	}
+
+	switch operation {
+	case "diff":
+		if lsn == "" {
+			return nil, fmt.Errorf("lsn is required for wal diff")
+		}
+		to := position
+		args := []interface{}{lsn}
+		if uptoLSN != "" {
+			to = "$2::pg_lsn"
+			args = append(args, uptoLSN)
+		}
+		q := fmt.Sprintf("SELECT %s(%s, $1::pg_lsn)::bigint, (%s)::text", fn.Diff, to, to)
+		logSQL(q, args)
+		var diff sql.NullInt64
+		var upto sql.NullString
+		if err := db.QueryRow(q, args...).Scan(&diff, &upto); err != nil {
+			return nil, err
+		}
+		if !diff.Valid {
+			// a standby that has not replayed anything yet
+			return nil, fmt.Errorf("the server reports no WAL position to diff against; give upto_lsn")
+		}
+		return map[string]interface{}{"lsn": lsn, "upto_lsn": upto.String, "bytes": diff.Int64, "function": fn.Diff}, nil
+
+	case "switch":
+		if inRecovery {
+			return nil, fmt.Errorf("wal switch needs a primary; this server is a standby")
+		}
+		if confirm != "switch" {
+			return nil, fmt.Errorf("wal switch needs confirm set to switch")
+		}
+		q := fmt.Sprintf("SELECT lsn::text, %s(lsn) FROM %s() AS s(lsn)", fn.FileName, fn.Switch)
+		logSQL(q, nil)
+		var end, file string
+		if err := db.QueryRow(q).Scan(&end, &file); err != nil {
+			return nil, err
+		}
+		// end is where the switched-from file ends; it is complete and can
+		// be archived
+		return map[string]interface{}{"switched": true, "end_lsn": end, "wal_file": file, "function": fn.Switch}, nil
+	}
+
+	res := map[string]interface{}{"in_recovery": inRecovery, "server_version": version}
+	if inRecovery {
+		var replay, receive sql.NullString
+		q := fmt.Sprintf("SELECT %s()::text, %s()::text", fn.Replay, fn.Receive)
+		logSQL(q, nil)
+		if err := db.QueryRow(q).Scan(&replay, &receive); err != nil {
+			return nil, err
+		}
+		res["source"] = "replay"
+		res["lsn"] = nullString(replay)
+		res["receive_lsn"] = nullString(receive)
+		res["function"] = fn.Replay
+		return res, nil
+	}
+	var current, file string
+	// the file name functions refuse to run during recovery
+	q := fmt.Sprintf("SELECT lsn::text, %s(lsn) FROM %s() AS c(lsn)", fn.FileName, fn.Current)
+	logSQL(q, nil)
+	if err := db.QueryRow(q).Scan(&current, &file); err != nil {
+		return nil, err
+	}
+	res["source"] = "current"
+	res["lsn"] = current
+	res["wal_file"] = file
+	res["function"] = fn.Current
+	return res, nil
+}
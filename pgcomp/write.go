@@ -0,0 +1,457 @@
+package pgcomp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// writeOptions are the inputs of the insert and update data_types. Rows
+// are JSON objects: a key that is present is written, null included, and a
+// key that is absent is left to the server — the column default on insert,
+// the current value on update. Defaults lists columns written as DEFAULT
+// in every row.
+type writeOptions struct {
+	Rows       []map[string]interface{}
+	KeyColumns []string // update: the columns rows are matched on
+	Defaults   []string
+	Validate   bool // insert: pre-check rows against the table
+	// OverrideIdentity writes GENERATED ALWAYS identity values on insert
+	// with OVERRIDING SYSTEM VALUE instead of dropping them.
+	OverrideIdentity bool
+
+	// ExpectedVersion turns an update into an optimistic one: the row is
+	// only changed while VersionColumn (xmin when empty) still holds this
+	// value. It needs exactly one row.
+	ExpectedVersion string
+	VersionColumn   string
+
+	Progress   *progress     // insert
+	Checkpoint *checkpointer // insert: commit_every, see importOptions
+	Encrypt    *columnCrypto // encrypt_columns
+	// NumberLocale and DateFormats read string values of numeric and
+	// date columns on insert
+	NumberLocale *numberLocale
+	DateFormats  map[string]*dateFormat
+}
+
+// splitReadOnly drops from names the columns a write may not set:
+// generated columns always, and GENERATED ALWAYS identity columns unless
+// override is set. overriding reports that such an identity column was
+// kept, so the INSERT needs OVERRIDING SYSTEM VALUE. UPDATE has no
+// OVERRIDING clause, so it always passes false.
+func splitReadOnly(names []string, relCols []columnInfo, override bool) (keep, stripped []string, overriding bool) {
+	byName := make(map[string]columnInfo, len(relCols))
+	for _, c := range relCols {
+		byName[c.Name] = c
+	}
+	for _, n := range names {
+		switch byName[n].readOnly() {
+		case "generated":
+			stripped = append(stripped, n)
+		case "identity":
+			if !override {
+				stripped = append(stripped, n)
+				continue
+			}
+			overriding = true
+			keep = append(keep, n)
+		default:
+			keep = append(keep, n)
+		}
+	}
+	return keep, stripped, overriding
+}
+
+// writeResult adds the columns dropped by splitReadOnly to res.
+func writeResult(res map[string]interface{}, stripped []string) map[string]interface{} {
+	if len(stripped) > 0 {
+		res["stripped_columns"] = stripped
+	}
+	return res
+}
+
+// writeTarget resolves the table and checks every column named in rows
+// and defaults exists. It returns the relation and its column types.
+func writeTarget(db querier, table string, opts writeOptions) (*relation, []columnInfo, map[string]string, error) {
+	if len(opts.Rows) == 0 {
+		return nil, nil, nil, fmt.Errorf("rows is required")
+	}
+	rel, err := resolveRelation(db, table)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	relCols, err := rel.columns(db)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	types := make(map[string]string, len(relCols))
+	for _, c := range relCols {
+		types[c.Name] = c.TypeSQL
+	}
+	for _, c := range opts.Defaults {
+		if _, ok := types[c]; !ok {
+			return nil, nil, nil, fmt.Errorf("defaults column %q does not exist in %s", c, rel.Name)
+		}
+	}
+	for r, row := range opts.Rows {
+		for c := range row {
+			if _, ok := types[c]; !ok {
+				return nil, nil, nil, fmt.Errorf("row %d: column %q does not exist in %s", r, c, rel.Name)
+			}
+			if containsString(opts.Defaults, c) {
+				return nil, nil, nil, fmt.Errorf("row %d: column %q is also listed in defaults", r, c)
+			}
+		}
+	}
+	return rel, relCols, types, nil
+}
+
+// insertRows inserts opts.Rows into table. The column list is the union
+// of the keys of all rows plus defaults; a row lacking one of them gets
+// DEFAULT in that position, which is the same as leaving it out. Rows are
+// sent in as few statements as the parameter limit allows.
+func insertRows(db querier, table string, opts writeOptions) (interface{}, error) {
+	rel, relCols, types, err := writeTarget(db, table, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Encrypt.check(db, "encrypt_columns", rel.Name, relCols); err != nil {
+		return nil, err
+	}
+	bad := opts.NumberLocale.applyRows(relCols, opts.Rows)
+	bad = append(bad, applyDateFormats(opts.DateFormats, relCols, opts.Rows)...)
+	if len(bad) > 0 {
+		ce := newError("validation_failed", "values do not parse in number_locale or date_formats; nothing was written")
+		ce.Details = map[string]interface{}{"errors": bad}
+		return nil, ce
+	}
+	if err := rejectRows(relCols, opts.Rows, opts.Validate); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var cols []string
+	for _, row := range opts.Rows {
+		for c := range row {
+			if !seen[c] {
+				seen[c] = true
+				cols = append(cols, c)
+			}
+		}
+	}
+	sort.Strings(cols)
+	cols, stripped, overriding := splitReadOnly(cols, relCols, opts.OverrideIdentity)
+	cols = append(cols, opts.Defaults...)
+	if err := opts.Checkpoint.begin(hashInput(rel.Name, opts.Rows, opts.Defaults)); err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		// Every column from its default
+		var inserted int64
+		for i := range opts.Rows {
+			if opts.Checkpoint.skip(int64(i + 1)) {
+				continue
+			}
+			stmt := "INSERT INTO " + rel.Name + " DEFAULT VALUES"
+			logSQL(stmt, nil)
+			if _, err := db.Exec(stmt); err != nil {
+				return nil, err
+			}
+			inserted++
+			if err := opts.Checkpoint.flushed(int64(i+1), 1); err != nil {
+				return nil, err
+			}
+		}
+		res := map[string]interface{}{"inserted": inserted}
+		if err := opts.Checkpoint.finish(res); err != nil {
+			return nil, err
+		}
+		return writeResult(res, stripped), nil
+	}
+
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = pq.QuoteIdentifier(c)
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) ", rel.Name, strings.Join(quoted, ", "))
+	if overriding {
+		prefix += "OVERRIDING SYSTEM VALUE "
+	}
+	prefix += "VALUES "
+
+	var inserted, position int64
+	flush := func(values []string, args []interface{}) error {
+		if len(values) == 0 {
+			return nil
+		}
+		stmt := prefix + strings.Join(values, ", ")
+		if err := checkSQLLength(stmt); err != nil {
+			return err
+		}
+		logSQL(stmt, args)
+		res, err := db.Exec(stmt, args...)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		inserted += n
+		opts.Progress.add(n, 0)
+		return opts.Checkpoint.flushed(position, n)
+	}
+
+	opts.Progress.expect(int64(len(opts.Rows)), 0)
+	var values []string
+	var args []interface{}
+	var keyPos int
+	for i, row := range opts.Rows {
+		if opts.Checkpoint.skip(int64(i + 1)) {
+			continue
+		}
+		if len(values) > 0 && len(args)+len(row)+1 > maxBindParams {
+			if err := flush(values, args); err != nil {
+				return nil, err
+			}
+			values, args, keyPos = nil, nil, 0
+		}
+		ph := make([]string, len(cols))
+		for i, c := range cols {
+			v, ok := row[c]
+			if !ok {
+				ph[i] = "DEFAULT"
+				continue
+			}
+			ph[i] = opts.Encrypt.bindValue(&args, &keyPos, c, types[c], v)
+		}
+		values = append(values, "("+strings.Join(ph, ", ")+")")
+		position = int64(i + 1)
+		if len(values) >= opts.Checkpoint.batchRows(len(opts.Rows)) {
+			if err := flush(values, args); err != nil {
+				return nil, err
+			}
+			values, args, keyPos = nil, nil, 0
+		}
+	}
+	if err := flush(values, args); err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{"inserted": inserted}
+	opts.Progress.finish(res)
+	if err := opts.Checkpoint.finish(res); err != nil {
+		return nil, err
+	}
+	return writeResult(res, stripped), nil
+}
+
+// updateRows updates one row of table per entry of opts.Rows, matched on
+// opts.KeyColumns. Only the keys present in a row are set, so absent
+// columns keep their current value; defaults are set to DEFAULT. Rows that
+// match nothing are reported by index in not_found.
+func updateRows(db querier, table string, opts writeOptions) (interface{}, error) {
+	if len(opts.KeyColumns) == 0 {
+		return nil, fmt.Errorf("key_columns is required for update")
+	}
+	rel, relCols, types, err := writeTarget(db, table, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range opts.KeyColumns {
+		if containsString(opts.Defaults, k) {
+			return nil, fmt.Errorf("key column %q cannot be listed in defaults", k)
+		}
+		// pgp_sym_encrypt is salted, so the same value never encrypts alike
+		if opts.Encrypt.covers(k) {
+			return nil, fmt.Errorf("key column %q cannot be encrypted: rows could not be matched on it", k)
+		}
+	}
+	if err := opts.Encrypt.check(db, "encrypt_columns", rel.Name, relCols); err != nil {
+		return nil, err
+	}
+	if err := rejectRows(relCols, opts.Rows, false); err != nil {
+		return nil, err
+	}
+	if opts.ExpectedVersion != "" {
+		return updateVersioned(db, rel, relCols, types, opts)
+	}
+
+	var updated int64
+	var stripped []string
+	notFound := make([]int, 0)
+	for r, row := range opts.Rows {
+		var args []interface{}
+		var keyPos int
+		bind := func(c string, v interface{}) string {
+			return opts.Encrypt.bindValue(&args, &keyPos, c, types[c], v)
+		}
+
+		var cols []string
+		for c := range row {
+			if !containsString(opts.KeyColumns, c) {
+				cols = append(cols, c)
+			}
+		}
+		sort.Strings(cols)
+		cols, dropped, _ := splitReadOnly(cols, relCols, false)
+		for _, c := range dropped {
+			if !containsString(stripped, c) {
+				stripped = append(stripped, c)
+			}
+		}
+		sets := make([]string, 0, len(cols)+len(opts.Defaults))
+		for _, c := range cols {
+			sets = append(sets, pq.QuoteIdentifier(c)+" = "+bind(c, row[c]))
+		}
+		for _, c := range opts.Defaults {
+			sets = append(sets, pq.QuoteIdentifier(c)+" = DEFAULT")
+		}
+		if len(sets) == 0 {
+			return nil, fmt.Errorf("row %d has no columns to update", r)
+		}
+
+		where := make([]string, len(opts.KeyColumns))
+		for i, k := range opts.KeyColumns {
+			v, ok := row[k]
+			if !ok || v == nil {
+				return nil, fmt.Errorf("row %d: key column %q must be present and not null", r, k)
+			}
+			where[i] = pq.QuoteIdentifier(k) + " = " + bind(k, v)
+		}
+
+		stmt := fmt.Sprintf("UPDATE %s SET %s WHERE %s", rel.Name, strings.Join(sets, ", "), strings.Join(where, " AND "))
+		logSQL(stmt, args)
+		res, err := db.Exec(stmt, args...)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", r, err)
+		}
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			notFound = append(notFound, r)
+		}
+		updated += n
+	}
+	sort.Strings(stripped)
+	return writeResult(map[string]interface{}{"updated": updated, "not_found": notFound}, stripped), nil
+}
+
+// counterTypes are the version column types updateVersioned increments
+// itself when the row does not set the column.
+var counterTypes = []string{"int2", "int4", "int8", "numeric"}
+
+// updateVersioned is the optimistic form of updateRows for a single row:
+// the UPDATE also matches the expected version, and when that matches
+// nothing the row is read back to tell a concurrent change (code conflict,
+// reason row_changed, with the current row and version) from a delete
+// (reason row_deleted). A numeric version column the row does not set is
+// incremented; other version columns are left to the row or a trigger.
+func updateVersioned(db querier, rel *relation, relCols []columnInfo, types map[string]string, opts writeOptions) (interface{}, error) {
+	if len(opts.Rows) != 1 {
+		return nil, fmt.Errorf("expected_version requires exactly one row, got %d", len(opts.Rows))
+	}
+	row := opts.Rows[0]
+
+	version := "xmin::text"
+	var versionCol columnInfo
+	if opts.VersionColumn != "" {
+		found := false
+		for _, c := range relCols {
+			if c.Name == opts.VersionColumn {
+				versionCol, found = c, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("version_column %q does not exist in %s", opts.VersionColumn, rel.Name)
+		}
+		version = pq.QuoteIdentifier(versionCol.Name) + "::text"
+	} else if rel.Kind != "table" && rel.Kind != "partitioned_table" {
+		return nil, fmt.Errorf("xmin versions need a table; %s is a %s, set version_column", rel.Name, strings.ReplaceAll(rel.Kind, "_", " "))
+	}
+
+	var args []interface{}
+	var keyPos int
+	bind := func(c string, v interface{}) string {
+		return opts.Encrypt.bindValue(&args, &keyPos, c, types[c], v)
+	}
+
+	var cols []string
+	for c := range row {
+		if !containsString(opts.KeyColumns, c) {
+			cols = append(cols, c)
+		}
+	}
+	sort.Strings(cols)
+	cols, stripped, _ := splitReadOnly(cols, relCols, false)
+	var sets []string
+	for _, c := range cols {
+		sets = append(sets, pq.QuoteIdentifier(c)+" = "+bind(c, row[c]))
+	}
+	for _, c := range opts.Defaults {
+		sets = append(sets, pq.QuoteIdentifier(c)+" = DEFAULT")
+	}
+	if vc := versionCol.Name; vc != "" && !containsString(cols, vc) && !containsString(opts.Defaults, vc) && containsString(counterTypes, versionCol.TypName) {
+		q := pq.QuoteIdentifier(vc)
+		sets = append(sets, q+" = "+q+" + 1")
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("row 0 has no columns to update")
+	}
+
+	where := make([]string, len(opts.KeyColumns))
+	for i, k := range opts.KeyColumns {
+		v, ok := row[k]
+		if !ok || v == nil {
+			return nil, fmt.Errorf("row 0: key column %q must be present and not null", k)
+		}
+		where[i] = pq.QuoteIdentifier(k) + " = " + bind(k, v)
+	}
+	keyArgs := append([]interface{}{}, args[len(args)-len(opts.KeyColumns):]...)
+	args = append(args, opts.ExpectedVersion)
+	versionWhere := version + " = $" + strconv.Itoa(len(args))
+
+	stmt := fmt.Sprintf("UPDATE %s SET %s WHERE %s AND %s RETURNING %s",
+		rel.Name, strings.Join(sets, ", "), strings.Join(where, " AND "), versionWhere, version)
+	logSQL(stmt, args)
+	var newVersion string
+	err := db.QueryRow(stmt, args...).Scan(&newVersion)
+	if err == nil {
+		return writeResult(map[string]interface{}{"updated": 1, "version": newVersion}, stripped), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Nothing matched: find out whether the row is gone or newer. The key
+	// placeholders are renumbered from $1 for the lookup.
+	keyWhere := make([]string, len(opts.KeyColumns))
+	for i, k := range opts.KeyColumns {
+		keyWhere[i] = pq.QuoteIdentifier(k) + " = $" + strconv.Itoa(i+1) + "::" + types[k]
+	}
+	var current, currentVersion string
+	err = db.QueryRow(fmt.Sprintf("SELECT to_jsonb(t)::text, %s FROM %s AS t WHERE %s", version, rel.Name, strings.Join(keyWhere, " AND ")), keyArgs...).Scan(&current, &currentVersion)
+	if err == sql.ErrNoRows {
+		ce := newError("conflict", "the row was deleted by someone else")
+		ce.Details = map[string]interface{}{"reason": "row_deleted", "expected_version": opts.ExpectedVersion}
+		return nil, ce
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(current))
+	dec.UseNumber()
+	var currentRow map[string]interface{}
+	if err := dec.Decode(&currentRow); err != nil {
+		return nil, err
+	}
+	ce := newError("conflict", "the row was changed by someone else (version %s, expected %s)", currentVersion, opts.ExpectedVersion)
+	ce.Details = map[string]interface{}{
+		"reason":           "row_changed",
+		"expected_version": opts.ExpectedVersion,
+		"current_version":  currentVersion,
+		"current":          currentRow,
+	}
+	return nil, ce
+}